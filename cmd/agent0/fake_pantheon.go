@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/IANTHEREAL/agent0/runtime/fakepantheon"
+)
+
+// runFakePantheon serves an in-process fake Pantheon MCP endpoint so the
+// controller can be run locally without Pantheon access.
+func runFakePantheon(args []string) error {
+	fs := flag.NewFlagSet("fake-pantheon", flag.ContinueOnError)
+	var (
+		listen   string
+		path     string
+		polls    int
+		runFor   time.Duration
+		inherit  bool
+		jsonResp bool
+		pageSize int
+		outcomes string
+		seed     string
+		prompts  []fakepantheon.Prompt
+	)
+	fs.StringVar(&listen, "listen", "127.0.0.1:8000", "Address to listen on")
+	fs.StringVar(&path, "path", "/mcp/sse", "Endpoint path")
+	fs.IntVar(&polls, "polls", 1, "get_branch polls a branch stays running for")
+	fs.DurationVar(&runFor, "run-for", 0, "Minimum time a branch stays running")
+	fs.BoolVar(&inherit, "inherit-parent-status", true, "New branches report the parent's status/snapshot on their first poll, like Pantheon")
+	fs.BoolVar(&jsonResp, "json", false, "Answer with application/json instead of SSE")
+	fs.IntVar(&pageSize, "page-size", 0, "Accept offset/limit on branch_output and branch_read_file, returning at most this many bytes per call (0 = no paging)")
+	fs.StringVar(&outcomes, "outcomes", "", "Comma-separated final statuses for the next branches (e.g. failed,succeed)")
+	fs.StringVar(&seed, "seed-branch", "", "Comma-separated root branch IDs to create up front")
+	fs.Func("prompt", "Serve a prompt template as 'name=file'; {{arg}} placeholders become arguments (repeatable)", func(v string) error {
+		name, file, ok := strings.Cut(v, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("want 'name=file', got %q", v)
+		}
+		data, err := os.ReadFile(strings.TrimSpace(file))
+		if err != nil {
+			return err
+		}
+		prompts = append(prompts, fakepantheon.Prompt{Name: strings.TrimSpace(name), Template: string(data)})
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	srv := fakepantheon.New(fakepantheon.Config{
+		Polls:               polls,
+		RunFor:              runFor,
+		InheritParentStatus: inherit,
+		JSONResponses:       jsonResp,
+		PageSize:            pageSize,
+	})
+	for _, id := range splitList(seed) {
+		srv.SeedBranch(id)
+	}
+	if list := splitList(outcomes); len(list) > 0 {
+		srv.QueueOutcomes(list...)
+	}
+	for _, p := range prompts {
+		srv.AddPrompt(p)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, srv)
+	httpSrv := &http.Server{Addr: listen, Handler: mux}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = httpSrv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "fake-pantheon listening on http://%s%s\n", listen, path)
+	if err := httpSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	pantheon "github.com/IANTHEREAL/agent0/runtime/pantheon_client"
+)
+
+// runStatus prints the controller state and the live Pantheon status of
+// the active episode branches.
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	var (
+		conn    connFlags
+		offline bool
+	)
+	conn.register(fs)
+	fs.BoolVar(&offline, "offline", false, "Do not ask Pantheon for the active branches' status")
+	if done, err := parseNoArgs(fs, args); done || err != nil {
+		return err
+	}
+	state, err := pantheon.LoadControllerState(conn.statePath)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "state:\t%s\n", conn.statePath)
+	fmt.Fprintf(w, "project:\t%s\n", orNone(state.ProjectName))
+	fmt.Fprintf(w, "mcp:\t%s\n", orNone(state.MCPBaseURL))
+	anchor := orNone(state.AnchorBranch)
+	if n := len(state.AnchorHistory); n > 0 {
+		last := state.AnchorHistory[n-1]
+		anchor += fmt.Sprintf(" (%s", last.Reason)
+		if last.Episode > 0 {
+			anchor += fmt.Sprintf(", episode %d", last.Episode)
+		}
+		anchor += ", " + last.At + ")"
+	}
+	fmt.Fprintf(w, "anchor:\t%s\n", anchor)
+	fmt.Fprintf(w, "initialized:\t%t\n", state.Initialized)
+	if state.TaskQueue != "" {
+		fmt.Fprintf(w, "task queue:\t%s\n", state.TaskQueue)
+		for _, t := range state.Tasks {
+			fmt.Fprintf(w, "  task %s:\t%s, %d episode(s)\n", t.ID, t.Status, t.Episodes)
+		}
+	}
+	if state.LastFailure != "" {
+		fmt.Fprintf(w, "last failure:\t%s\n", oneLine(state.LastFailure, 120))
+	}
+	if state.PausedUntil != "" {
+		fmt.Fprintf(w, "paused until:\t%s (%s)\n", state.PausedUntil, state.PauseReason)
+	}
+	active := state.ActiveBranchIDs()
+	if len(active) == 0 {
+		fmt.Fprintf(w, "active:\tnone\n")
+		return w.Flush()
+	}
+	fmt.Fprintf(w, "active since:\t%s\n", orNone(state.ActiveSince))
+	if offline {
+		fmt.Fprintf(w, "active:\t%s\n", strings.Join(active, ", "))
+		return w.Flush()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	client, err := state.NewMCPClient(conn.connection())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	for _, id := range active {
+		branch, err := client.FetchBranch(ctx, id)
+		if err != nil {
+			fmt.Fprintf(w, "active:\t%s\tstatus unknown: %v\n", id, err)
+			continue
+		}
+		fmt.Fprintf(w, "active:\t%s\tstatus=%s\tsnapshot=%s\n", id, orNone(branch.Status), orNone(branch.LatestSnapID))
+	}
+	return w.Flush()
+}
+
+// runHistory prints the anchor history, or with --attempts every episode
+// attempt of the ledger.
+func runHistory(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	var (
+		statePath  string
+		ledgerPath string
+		attempts   bool
+		asJSON     bool
+	)
+	fs.StringVar(&statePath, "state", defaultControllerStatePath(), "Controller state file")
+	fs.StringVar(&ledgerPath, "ledger", "", "Episode ledger (default: ledger.jsonl next to the state file)")
+	fs.BoolVar(&attempts, "attempts", false, "List episode attempts from the ledger instead of anchors")
+	fs.BoolVar(&asJSON, "json", false, "Print JSON instead of a table")
+	if done, err := parseNoArgs(fs, args); done || err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if attempts {
+		if ledgerPath == "" {
+			ledgerPath = pantheon.DefaultLedgerPath(statePath)
+		}
+		records, err := pantheon.ReadLedger(ledgerPath)
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			return printJSON(records)
+		}
+		fmt.Fprintln(w, "EPISODE\tSTARTED\tDURATION\tSTATUS\tPARENT\tWINNER\tBRANCHES\tPOLLS\tFAILURE")
+		for _, r := range records {
+			episode := strconv.Itoa(r.Episode)
+			if r.Bootstrap {
+				episode = "bootstrap"
+			}
+			polls := 0
+			for _, b := range r.Branches {
+				polls += b.Polls
+			}
+			failure := r.FailureKind
+			if r.Error != "" {
+				failure += ": " + oneLine(r.Error, 60)
+			}
+			duration := time.Duration(r.DurationSeconds * float64(time.Second)).Round(time.Second).String()
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", episode, r.StartedAt, duration, r.Status, r.ParentBranch, orNone(r.Winner), len(r.Branches), polls, failure)
+		}
+		return w.Flush()
+	}
+
+	state, err := pantheon.LoadControllerState(statePath)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(state.AnchorHistory)
+	}
+	fmt.Fprintln(w, "#\tAT\tREASON\tEPISODE\tBRANCH\tTASK\tPROMPT\tOUTPUT")
+	for i, r := range state.AnchorHistory {
+		episode := "-"
+		if r.Episode > 0 {
+			episode = strconv.Itoa(r.Episode)
+		}
+		branch := r.BranchID
+		if r.RolledBackFrom != "" {
+			branch += " (from " + r.RolledBackFrom + ")"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i+1, r.At, r.Reason, episode, branch, orNone(r.Task), orNone(r.PromptHash), oneLine(r.OutputExcerpt, 60))
+	}
+	return w.Flush()
+}
+
+// runInspect prints a branch's metadata, its output and files from its
+// snapshot.
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	var (
+		conn     connFlags
+		files    []string
+		noOutput bool
+		asJSON   bool
+	)
+	conn.register(fs)
+	fs.Func("file", "File to print from the branch snapshot (repeatable)", func(v string) error {
+		files = append(files, v)
+		return nil
+	})
+	fs.BoolVar(&noOutput, "no-output", false, "Do not print the branch output")
+	fs.BoolVar(&asJSON, "json", false, "Print the raw get_branch response instead of a summary")
+	positional, err := parseArgs(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: agent0 inspect [flags] <branch id>")
+	}
+	branchID := positional[0]
+	state, err := pantheon.LoadControllerState(conn.statePath)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	client, err := state.NewMCPClient(conn.connection())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	branch, err := client.FetchBranch(ctx, branchID)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		if err := printJSON(branch.Raw); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "branch:\t%s\n", branch.ID)
+		if branch.Name != "" {
+			fmt.Fprintf(w, "name:\t%s\n", branch.Name)
+		}
+		fmt.Fprintf(w, "status:\t%s\n", orNone(branch.Status))
+		fmt.Fprintf(w, "parent:\t%s\n", orNone(branch.ParentID))
+		fmt.Fprintf(w, "snapshot:\t%s\n", orNone(branch.LatestSnapID))
+		if s := branch.Summary(); s != "" {
+			fmt.Fprintf(w, "summary:\t%s\n", oneLine(s, 200))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if !noOutput {
+		fmt.Println("--- output ---")
+		r, err := client.BranchOutputReader(ctx, branchID)
+		if err != nil {
+			return fmt.Errorf("branch_output: %w", err)
+		}
+		_, err = io.Copy(os.Stdout, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Println()
+	}
+	for _, path := range files {
+		fmt.Printf("--- file: %s ---\n", path)
+		if _, err := client.BranchReadFileTo(ctx, branchID, path, os.Stdout); err != nil {
+			if pantheon.IsNotFound(err) {
+				fmt.Println("(not found)")
+				continue
+			}
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// parseArgs parses flags that may come after positional arguments, as in
+// "agent0 inspect <branch> --file x", and returns the positional ones.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// parseNoArgs parses a command without positional arguments; done is true
+// after --help.
+func parseNoArgs(fs *flag.FlagSet, args []string) (done bool, err error) {
+	positional, err := parseArgs(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(positional) > 0 {
+		return false, fmt.Errorf("unexpected arguments: %s", strings.Join(positional, " "))
+	}
+	return false, nil
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func orNone(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "-"
+	}
+	return s
+}
+
+// oneLine flattens s to one line of at most n bytes for a table cell,
+// cutting between characters.
+func oneLine(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > n {
+		cut := n - 3
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		s = s[:cut] + "..."
+	}
+	return orNone(s)
+}
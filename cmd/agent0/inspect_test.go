@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/IANTHEREAL/agent0/runtime/fakepantheon"
+	pantheon "github.com/IANTHEREAL/agent0/runtime/pantheon_client"
+)
+
+// captureStdout runs fn with os.Stdout redirected and returns what it
+// printed.
+func captureStdout(t *testing.T, fn func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	printed := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		printed <- string(data)
+	}()
+	err = fn()
+	os.Stdout = stdout
+	w.Close()
+	return <-printed, err
+}
+
+// writeState saves a controller state file pointing at mcpBaseURL.
+func writeState(t *testing.T, mcpBaseURL string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "state.json")
+	data, _ := json.Marshal(map[string]any{"mcp_base_url": mcpBaseURL, "project_name": "proj"})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseArgs(t *testing.T) {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var files []string
+	fs.Func("file", "", func(v string) error { files = append(files, v); return nil })
+	asJSON := fs.Bool("json", false, "")
+
+	positional, err := parseArgs(fs, []string{"branch-1", "--file", "a.md", "--json", "branch-2", "--file=b.md"})
+	if err != nil {
+		t.Fatalf("parseArgs: %v", err)
+	}
+	if strings.Join(positional, ",") != "branch-1,branch-2" || strings.Join(files, ",") != "a.md,b.md" || !*asJSON {
+		t.Fatalf("unexpected parse: positional %q, files %q, json %t", positional, files, *asJSON)
+	}
+	if _, err := parseArgs(fs, []string{"--bogus"}); err == nil {
+		t.Fatalf("expected an unknown flag to fail")
+	}
+}
+
+func TestParseNoArgs(t *testing.T) {
+	newFlags := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("status", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.Bool("offline", false, "")
+		return fs
+	}
+	if done, err := parseNoArgs(newFlags(), []string{"--offline"}); done || err != nil {
+		t.Fatalf("expected flags alone to parse, got done=%t err=%v", done, err)
+	}
+	if done, err := parseNoArgs(newFlags(), []string{"--help"}); !done || err != nil {
+		t.Fatalf("expected --help to finish without error, got done=%t err=%v", done, err)
+	}
+	if _, err := parseNoArgs(newFlags(), []string{"extra", "--offline"}); err == nil || !strings.Contains(err.Error(), "extra") {
+		t.Fatalf("expected a positional argument to be rejected, got %v", err)
+	}
+}
+
+func TestHistoryAttempts(t *testing.T) {
+	statePath := writeState(t, "")
+	ledger := pantheon.NewLedger(pantheon.DefaultLedgerPath(statePath), t.TempDir())
+	records := []pantheon.LedgerRecord{
+		{Bootstrap: true, StartedAt: "2026-01-02T03:04:05Z", DurationSeconds: 61, Status: pantheon.LedgerPromoted, ParentBranch: "parent-0", Winner: "branch-1",
+			Branches: []pantheon.LedgerBranch{{BranchID: "branch-1", Status: "succeed", Polls: 3}}},
+		{Episode: 1, StartedAt: "2026-01-02T04:00:00Z", DurationSeconds: 30, Status: pantheon.LedgerNoWinner, ParentBranch: "branch-1", FailureKind: "failed",
+			Error:    "branch   failed\nwith a very long explanation that goes on and on past the sixty byte cell limit",
+			Branches: []pantheon.LedgerBranch{{BranchID: "branch-2", Status: "failed", Polls: 2}, {BranchID: "branch-3", Status: "failed", Polls: 4}}},
+	}
+	for _, r := range records {
+		if err := ledger.Append(r); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	out, err := captureStdout(t, func() error { return runHistory([]string{"--state", statePath, "--attempts"}) })
+	if err != nil {
+		t.Fatalf("history --attempts: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "EPISODE") {
+		t.Fatalf("expected a header and 2 attempts, got:\n%s", out)
+	}
+	for _, want := range []string{"bootstrap", "1m1s", "promoted", "branch-1", "3"} {
+		if !strings.Contains(lines[1], want) {
+			t.Errorf("bootstrap row lacks %q: %s", want, lines[1])
+		}
+	}
+	for _, want := range []string{"no_winner", "branch-1", "6", "failed: branch failed with a very long", "..."} {
+		if !strings.Contains(lines[2], want) {
+			t.Errorf("failed row lacks %q: %s", want, lines[2])
+		}
+	}
+
+	out, err = captureStdout(t, func() error {
+		return runHistory([]string{"--state", statePath, "--attempts", "--json"})
+	})
+	var decoded []pantheon.LedgerRecord
+	if err != nil || json.Unmarshal([]byte(out), &decoded) != nil || len(decoded) != 2 || decoded[1].Branches[1].Polls != 4 {
+		t.Fatalf("history --attempts --json: %v\n%s", err, out)
+	}
+}
+
+func TestInspectFileNotFound(t *testing.T) {
+	fake := fakepantheon.New(fakepantheon.Config{OnExplore: func(b *fakepantheon.Branch) {
+		b.Output = "the report"
+		b.Files["notes.md"] = "# Notes"
+	}})
+	fake.SeedBranch("base")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	explore, err := pantheon.NewMCPClient(srv.URL).Explore(context.Background(), "proj", "base", []string{"go"}, "", 1)
+	if err != nil {
+		t.Fatalf("Explore: %v", err)
+	}
+	id := explore.BranchID()
+	statePath := writeState(t, srv.URL)
+
+	out, err := captureStdout(t, func() error {
+		return runInspect([]string{id, "--state", statePath, "--file", "missing.md", "--file", "notes.md"})
+	})
+	if err != nil {
+		t.Fatalf("inspect: %v", err)
+	}
+	if first, _, _ := strings.Cut(out, "\n"); strings.Join(strings.Fields(first), " ") != "branch: "+id {
+		t.Errorf("expected the branch id first, got %q", first)
+	}
+	for _, want := range []string{"--- output ---\nthe report\n", "--- file: missing.md ---\n(not found)\n", "--- file: notes.md ---\n# Notes\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("inspect output lacks %q:\n%s", want, out)
+		}
+	}
+
+	_, err = captureStdout(t, func() error { return runInspect([]string{"nope", "--state", statePath}) })
+	if !pantheon.IsNotFound(err) {
+		t.Fatalf("expected a not-found error for an unknown branch, got %v", err)
+	}
+	if err := runInspect([]string{"--state", statePath}); err == nil || errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("expected a usage error without a branch id, got %v", err)
+	}
+}
+
+func TestOneLine(t *testing.T) {
+	if got := oneLine("  a\n\tb  ", 10); got != "a b" {
+		t.Fatalf("expected whitespace flattened, got %q", got)
+	}
+	if got := oneLine("", 10); got != "-" {
+		t.Fatalf("expected - for an empty cell, got %q", got)
+	}
+	got := oneLine(strings.Repeat("é", 10), 8)
+	if !utf8.ValidString(got) || len(got) > 8 || got != "éé..." {
+		t.Fatalf("expected the cut between characters, got %q", got)
+	}
+}
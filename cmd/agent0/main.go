@@ -2,18 +2,50 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	pantheon "github.com/IANTHEREAL/agent0/runtime/pantheon_client"
 )
 
+// subcommands run instead of the controller when named as the first
+// argument.
+var subcommands = map[string]func(args []string) error{
+	"fake-pantheon": runFakePantheon,
+	"rollback":      runRollback,
+	"enqueue":       runEnqueue,
+	"dequeue":       runDequeue,
+	"status":        runStatus,
+	"history":       runHistory,
+	"inspect":       runInspect,
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		// "agent0 run [flags]" is the controller itself.
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "agent0 %s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	defaultStatePath := defaultControllerStatePath()
 
 	var (
@@ -22,21 +54,88 @@ func main() {
 		parentBranchID            string
 		mcpAgent                  string
 		task                      string
+		taskTemplate              bool
+		taskPrompt                string
+		taskQueue                 string
+		taskQueueWait             bool
+		taskPromptArgs            = promptArgFlag{}
+		promptVars                = promptArgFlag{}
 		maxEpisodes               int
+		branches                  int
+		selector                  string
+		gates                     []string
+		failurePolicy             []string
 		agentsMDURL               string
 		skillsURL                 string
 		projectCollaborationMDURL string
 		minibookAccount           string
 		rebootstrap               bool
+		mcpHeaders                = headerFlag{}
+		mcpTokenEnv               string
+		mcpTokenFile              string
+		mcpTransport              pantheon.TransportConfig
+		mcpRecord                 string
+		mcpRateLimit              string
+		mcpToolRateLimits         = toolRateLimitFlag{}
+		mcpTrace                  bool
+		pollInterval              time.Duration
+		ledgerPath                string
+		listen                    string
 	)
 
-	flag.StringVar(&mcpBaseURL, "mcp-base-url", envOr("MCP_BASE_URL", ""), "Pantheon MCP base URL (e.g. http://host:8000/mcp/sse)")
+	flag.StringVar(&mcpBaseURL, "mcp-base-url", envOr("MCP_BASE_URL", ""), "Pantheon MCP URL: http(s)://host:8000/mcp/sse, ws(s)://host/mcp, or stdio:<command> [args...] for a local server")
 	flag.StringVar(&projectName, "pantheon-project-name", envFirstNonEmpty("PANTHEON_PROJECT_NAME", "MCP_PROJECT_NAME", "PROJECT_NAME"), "Pantheon project name")
 	flag.StringVar(&parentBranchID, "pantheon-parent-branch-id", envFirstNonEmpty("PANTHEON_PARENT_BRANCH_ID", "MCP_PARENT_BRANCH_ID"), "Parent branch id used only for first run (when no anchor exists yet)")
+	flag.Var(mcpHeaders, "mcp-header", "Extra header sent with every MCP request, as 'Name: value' (repeatable)")
+	flag.StringVar(&mcpTokenEnv, "mcp-token-env", "MCP_BEARER_TOKEN", "Environment variable holding the MCP bearer token (used when set and non-empty)")
+	flag.StringVar(&mcpTokenFile, "mcp-token-file", envOr("MCP_TOKEN_FILE", ""), "File holding the MCP bearer token; re-read when the server answers 401")
+	flag.StringVar(&mcpTransport.CAFile, "mcp-ca-file", envOr("MCP_CA_FILE", ""), "PEM CA bundle trusted for the MCP endpoint (in addition to system roots)")
+	flag.StringVar(&mcpTransport.CertFile, "mcp-client-cert", envOr("MCP_CLIENT_CERT", ""), "PEM client certificate for mTLS")
+	flag.StringVar(&mcpTransport.KeyFile, "mcp-client-key", envOr("MCP_CLIENT_KEY", ""), "PEM client key for mTLS")
+	flag.StringVar(&mcpTransport.ServerName, "mcp-tls-server-name", "", "Override the server name verified against the MCP certificate")
+	flag.BoolVar(&mcpTransport.InsecureSkipVerify, "mcp-insecure-skip-verify", false, "Do not verify the MCP server certificate (testing only)")
+	flag.StringVar(&mcpTransport.ProxyURL, "mcp-proxy", envOr("MCP_PROXY", ""), "HTTP(S) proxy for MCP requests ('direct' disables HTTP(S)_PROXY)")
+	flag.IntVar(&mcpTransport.MaxIdleConns, "mcp-max-idle-conns", 0, "Max idle MCP connections (0 = default)")
+	flag.IntVar(&mcpTransport.MaxIdleConnsPerHost, "mcp-max-idle-conns-per-host", 0, "Max idle MCP connections per host (0 = default)")
+	flag.IntVar(&mcpTransport.MaxConnsPerHost, "mcp-max-conns-per-host", 0, "Max MCP connections per host (0 = unlimited)")
+	flag.DurationVar(&mcpTransport.IdleConnTimeout, "mcp-idle-conn-timeout", 0, "Close idle MCP connections after this long (0 = default)")
+	flag.StringVar(&mcpRateLimit, "mcp-rate-limit", envOr("MCP_RATE_LIMIT", ""), "Client-wide MCP request limit, e.g. 'rate=5,burst=10,inflight=4' (default: that)")
+	flag.Var(mcpToolRateLimits, "mcp-tool-rate-limit", "Per-tool MCP limit as 'tool:rate=0.1,burst=2,inflight=1' (repeatable; parallel_explore defaults to that)")
+	flag.BoolVar(&mcpTrace, "mcp-trace", false, "Trace MCP calls: send W3C traceparent headers and log spans at debug level (joins $TRACEPARENT if set)")
+	flag.StringVar(&mcpRecord, "mcp-record", envOr("MCP_RECORD", ""), "Record all MCP traffic to this cassette file (replay it with --mcp-base-url replay:<file>)")
 	flag.StringVar(&mcpAgent, "pantheon-agent", envFirstNonEmpty("PANTHEON_AGENT", "MCP_AGENT"), "Pantheon agent name (default: codex)")
 
 	flag.StringVar(&task, "task", "", "Episode prompt text (reused every episode)")
+	flag.BoolVar(&taskTemplate, "task-template", false, "Execute the task as a Go text/template with the episode context before every episode, see README (saved in the state file)")
+	flag.StringVar(&taskPrompt, "task-prompt", "", "Name of a prompt template on the MCP server to render as the episode prompt (--task is appended)")
+	flag.Var(taskPromptArgs, "task-prompt-arg", "Argument for --task-prompt as 'name=value' (repeatable)")
+	flag.Var(promptVars, "prompt-var", "Variable for the task template ({{.Vars.name}}) as 'name=value' (repeatable; saved in the state file)")
+	flag.StringVar(&taskQueue, "task-queue", envOr("TASK_QUEUE", ""), "Work through a task queue (JSONL file or directory of task files) instead of repeating --task (saved in the state file)")
+	flag.BoolVar(&taskQueueWait, "task-queue-wait", false, "Wait for new tasks when the task queue is drained instead of exiting")
 	flag.IntVar(&maxEpisodes, "max-episodes", 0, "Max episodes to run (0 = infinite)")
+	flag.IntVar(&branches, "branches", 0, "Branches each episode explores from the anchor (default 1; saved in the state file)")
+	flag.Func("gate", "Check before promoting an episode branch: file:<path>, output:<regexp>, no-output:<regexp>, verifier[:agent] or command:<cmd> (repeatable; saved in the state file; 'none' clears)", func(v string) error {
+		if strings.TrimSpace(v) != "none" {
+			if _, err := pantheon.ParseGate(v); err != nil {
+				return err
+			}
+		}
+		gates = append(gates, v)
+		return nil
+	})
+	flag.Func("failure-policy", "What to do after an episode without a winner, as '[failed|timeout|empty_output:]max=3,backoff=1m/5m/20m,action=retry|rollback|exit,exhausted=exit|pause,pause=1h' (repeatable; saved in the state file; 'default' clears)", func(v string) error {
+		if strings.TrimSpace(v) != "default" {
+			if _, err := pantheon.ParseFailurePolicy([]string{v}); err != nil {
+				return err
+			}
+		}
+		failurePolicy = append(failurePolicy, v)
+		return nil
+	})
+	flag.StringVar(&selector, "selector", "", "How to pick the new anchor among succeeded branches: first-success (default), longest-output, judge[:agent] or script:<command>")
+	flag.StringVar(&ledgerPath, "ledger", envOr("AGENT0_LEDGER", ""), "Episode ledger (JSONL); branch outputs are copied to outputs/ beside it (default: ledger.jsonl next to the state file; 'none' disables)")
+	flag.StringVar(&listen, "listen", envOr("AGENT0_LISTEN", ""), "Serve the control API (status, pause, resume, stop, skip, task) on this address, e.g. 127.0.0.1:8700; requests must send $AGENT0_CONTROL_TOKEN as a bearer token, or the token agent0 writes to control_token beside the state file when that is unset")
+	flag.DurationVar(&pollInterval, "poll-interval", 0, "Initial branch status polling interval (default 1m)")
 	flag.StringVar(&agentsMDURL, "agents-md-url", envOr("AGENTS_MD_URL", ""), "Optional: hint URL to initialize AGENTS.md inside the workspace")
 	flag.StringVar(&skillsURL, "skills-url", envOr("SKILLS_URL", ""), "Optional: hint URL to initialize skills inside the workspace")
 	flag.StringVar(&projectCollaborationMDURL, "project-collaboration-md-url", envOr("PROJECT_COLLABORATION_MD_URL", ""), "Optional: hint URL to initialize agents/PROJECT_COLLABORATION.md inside the workspace")
@@ -48,19 +147,88 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	tokens := tokenSource(mcpTokenEnv, mcpTokenFile)
+
+	var tracer pantheon.Tracer
+	if mcpTrace {
+		tracer = &pantheon.W3CTracer{}
+		if tp := os.Getenv("TRACEPARENT"); tp != "" {
+			ctx = pantheon.ContextWithTraceParent(ctx, tp)
+		}
+	}
+
+	rateLimit, err := pantheon.ParseRateLimit(mcpRateLimit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "agent0: --mcp-rate-limit: %v\n", err)
+		os.Exit(2)
+	}
+
+	if _, err := pantheon.ParseSelector(selector); err != nil {
+		fmt.Fprintf(os.Stderr, "agent0: --selector: %v\n", err)
+		os.Exit(2)
+	}
+
 	cfg := pantheon.ControllerConfig{
 		MCPBaseURL:                mcpBaseURL,
+		MCPHeaders:                mcpHeaders,
+		MCPTokenSource:            tokens,
+		MCPTransport:              mcpTransport,
+		MCPRateLimit:              rateLimit,
+		MCPToolRateLimits:         mcpToolRateLimits,
+		MCPTracer:                 tracer,
+		MCPRecordPath:             mcpRecord,
 		ProjectName:               projectName,
 		ParentBranchID:            parentBranchID,
 		Agent:                     mcpAgent,
 		Rebootstrap:               rebootstrap,
 		Task:                      task,
+		TaskTemplate:              taskTemplate,
+		TaskPrompt:                taskPrompt,
+		TaskPromptArgs:            taskPromptArgs,
+		PromptVars:                promptVars,
+		TaskQueue:                 taskQueue,
+		TaskQueueWait:             taskQueueWait,
 		AgentsMDURL:               agentsMDURL,
 		SkillsURL:                 skillsURL,
 		ProjectCollaborationMDURL: projectCollaborationMDURL,
 		MinibookAccount:           minibookAccount,
 		StatePath:                 defaultStatePath,
 		MaxEpisodes:               maxEpisodes,
+		Branches:                  branches,
+		Selector:                  selector,
+		Gates:                     gates,
+		FailurePolicy:             failurePolicy,
+		PollInterval:              pollInterval,
+		LedgerPath:                ledgerPath,
+	}
+
+	if listen != "" {
+		cfg.Control = pantheon.NewControl()
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "agent0: --listen: %v\n", err)
+			os.Exit(2)
+		}
+		token, tokenFile, err := controlToken(defaultStatePath)
+		if err != nil {
+			ln.Close()
+			fmt.Fprintf(os.Stderr, "agent0: --listen: %v\n", err)
+			os.Exit(2)
+		}
+		if tokenFile != "" {
+			fmt.Fprintf(os.Stderr, "agent0: control API token written to %s\n", tokenFile)
+		}
+		srv := &http.Server{
+			Handler:           cfg.Control.Handler(token, controlHosts(listen)...),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fmt.Fprintf(os.Stderr, "agent0: control API: %v\n", err)
+			}
+		}()
+		defer srv.Close()
+		fmt.Fprintf(os.Stderr, "agent0: control API listening on http://%s\n", ln.Addr())
 	}
 
 	if err := pantheon.RunController(ctx, cfg); err != nil {
@@ -69,6 +237,153 @@ func main() {
 	}
 }
 
+// controlToken returns $AGENT0_CONTROL_TOKEN or, when that is unset, a new
+// random token written to a 0600 file beside the state file. file is that
+// file, or "".
+func controlToken(statePath string) (token, file string, err error) {
+	if token := strings.TrimSpace(os.Getenv("AGENT0_CONTROL_TOKEN")); token != "" {
+		return token, "", nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	file = filepath.Join(filepath.Dir(statePath), "control_token")
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return "", "", err
+	}
+	// A fresh file, so a token file left with looser permissions (or a
+	// symlink planted there) is replaced rather than written through.
+	tmp := file + ".tmp"
+	_ = os.Remove(tmp)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := f.WriteString(token + "\n"); err != nil {
+		f.Close()
+		return "", "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", "", err
+	}
+	return token, file, os.Rename(tmp, file)
+}
+
+// controlHosts are the host names the control API accepts in the Host
+// header besides IP addresses and localhost: the --listen host and this
+// machine's name.
+func controlHosts(listen string) []string {
+	var hosts []string
+	if host, _, err := net.SplitHostPort(listen); err == nil && host != "" {
+		hosts = append(hosts, host)
+	}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	return hosts
+}
+
+// connFlags are the flags of subcommands that talk to the Pantheon of a
+// state file.
+type connFlags struct {
+	statePath string
+	baseURL   string
+	headers   headerFlag
+	tokenEnv  string
+	tokenFile string
+}
+
+func (c *connFlags) register(fs *flag.FlagSet) {
+	c.headers = headerFlag{}
+	fs.StringVar(&c.statePath, "state", defaultControllerStatePath(), "Controller state file")
+	fs.StringVar(&c.baseURL, "mcp-base-url", envOr("MCP_BASE_URL", ""), "Pantheon MCP URL (default: the one in the state file)")
+	fs.Var(c.headers, "mcp-header", "Extra header sent with every MCP request, as 'Name: value' (repeatable)")
+	fs.StringVar(&c.tokenEnv, "mcp-token-env", "MCP_BEARER_TOKEN", "Environment variable holding the MCP bearer token (used when set and non-empty)")
+	fs.StringVar(&c.tokenFile, "mcp-token-file", envOr("MCP_TOKEN_FILE", ""), "File holding the MCP bearer token")
+}
+
+func (c *connFlags) connection() pantheon.MCPConnection {
+	return pantheon.MCPConnection{BaseURL: c.baseURL, Headers: c.headers, TokenSource: tokenSource(c.tokenEnv, c.tokenFile)}
+}
+
+func tokenSource(tokenEnv, tokenFile string) pantheon.TokenSource {
+	switch {
+	case strings.TrimSpace(tokenFile) != "":
+		return pantheon.NewFileTokenSource(strings.TrimSpace(tokenFile))
+	case strings.TrimSpace(tokenEnv) != "" && strings.TrimSpace(os.Getenv(tokenEnv)) != "":
+		return pantheon.EnvTokenSource(strings.TrimSpace(tokenEnv))
+	}
+	return nil
+}
+
+// headerFlag collects repeated --mcp-header "Name: value" flags.
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (h headerFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("want 'Name: value', got %q", v)
+	}
+	h[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	return nil
+}
+
+// promptArgFlag collects repeated "name=value" flags such as
+// --task-prompt-arg and --prompt-var.
+type promptArgFlag map[string]string
+
+func (f promptArgFlag) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (f promptArgFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("want 'name=value', got %q", v)
+	}
+	f[strings.TrimSpace(name)] = value
+	return nil
+}
+
+// toolRateLimitFlag collects repeated --mcp-tool-rate-limit "tool:limits"
+// flags.
+type toolRateLimitFlag map[string]pantheon.RateLimit
+
+func (f toolRateLimitFlag) String() string {
+	parts := make([]string, 0, len(f))
+	for name, l := range f {
+		parts = append(parts, name+":"+l.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f toolRateLimitFlag) Set(v string) error {
+	name, spec, ok := strings.Cut(v, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("want 'tool:rate=R,burst=B,inflight=N', got %q", v)
+	}
+	l, err := pantheon.ParseRateLimit(spec)
+	if err != nil {
+		return err
+	}
+	f[strings.TrimSpace(name)] = l
+	return nil
+}
+
 func defaultControllerStatePath() string {
 	return filepath.Join(".", ".agent0", "controller_state.json")
 }
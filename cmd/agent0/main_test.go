@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestControlToken(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), ".agent0", "controller_state.json")
+
+	t.Setenv("AGENT0_CONTROL_TOKEN", "from-env")
+	if token, file, err := controlToken(statePath); err != nil || token != "from-env" || file != "" {
+		t.Fatalf("controlToken with $AGENT0_CONTROL_TOKEN = %q, %q, %v", token, file, err)
+	}
+
+	t.Setenv("AGENT0_CONTROL_TOKEN", "")
+	token, file, err := controlToken(statePath)
+	if err != nil {
+		t.Fatalf("controlToken: %v", err)
+	}
+	if len(token) != 64 || file != filepath.Join(filepath.Dir(statePath), "control_token") {
+		t.Fatalf("unexpected token %q in %q", token, file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil || strings.TrimSpace(string(data)) != token {
+		t.Fatalf("token file holds %q (%v), want %q", data, err, token)
+	}
+	if info, _ := os.Stat(file); info.Mode().Perm() != 0o600 {
+		t.Fatalf("token file mode %v, want 0600", info.Mode().Perm())
+	}
+	again, _, err := controlToken(statePath)
+	if err != nil || again == token {
+		t.Fatalf("expected a new token per run, got %q (%v)", again, err)
+	}
+}
+
+func TestControlHosts(t *testing.T) {
+	hosts := controlHosts("box.internal:8700")
+	if len(hosts) == 0 || hosts[0] != "box.internal" {
+		t.Fatalf("expected the --listen host first, got %v", hosts)
+	}
+	for _, h := range controlHosts(":8700") {
+		if h == "" {
+			t.Fatalf("empty host in %v", controlHosts(":8700"))
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	pantheon "github.com/IANTHEREAL/agent0/runtime/pantheon_client"
+)
+
+// runRollback moves the controller's anchor back to an earlier branch of
+// the anchor history recorded in the state file.
+func runRollback(args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	var (
+		to    string
+		steps int
+		conn  connFlags
+	)
+	fs.StringVar(&to, "to", "", "Branch to make the anchor again (must be in the anchor history)")
+	fs.IntVar(&steps, "steps", 1, "Anchors to go back when --to is not set")
+	conn.register(fs)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if steps < 1 {
+		return fmt.Errorf("--steps must be at least 1")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rec, err := pantheon.RollbackAnchor(ctx, pantheon.RollbackConfig{
+		StatePath: conn.statePath,
+		To:        to,
+		Steps:     steps,
+		MCP:       conn.connection(),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("anchor rolled back from %s to %s\n", rec.RolledBackFrom, rec.BranchID)
+	return nil
+}
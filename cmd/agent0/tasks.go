@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	pantheon "github.com/IANTHEREAL/agent0/runtime/pantheon_client"
+)
+
+// runEnqueue adds a task to the end of a task queue; a running controller
+// picks it up before its next task.
+func runEnqueue(args []string) error {
+	fs := flag.NewFlagSet("enqueue", flag.ContinueOnError)
+	var (
+		queue       string
+		task        pantheon.QueuedTask
+		promptFile  string
+		maxEpisodes int
+	)
+	fs.StringVar(&queue, "queue", "", "Task queue: a JSONL file or a directory of task files; the task is added last either way")
+	fs.StringVar(&task.ID, "id", "", "Task id (default: a hash of the prompt)")
+	fs.StringVar(&promptFile, "prompt-file", "", "Read the prompt from this file instead of the arguments")
+	fs.IntVar(&maxEpisodes, "max-episodes", 0, "Episodes to spend on the task (0 = one, or unlimited with --done-when)")
+	fs.Func("done-when", "Gate spec that marks the task complete, e.g. file:DONE.md (repeatable)", func(v string) error {
+		if _, err := pantheon.ParseGate(v); err != nil {
+			return err
+		}
+		task.DoneWhen = append(task.DoneWhen, v)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if strings.TrimSpace(queue) == "" {
+		return fmt.Errorf("--queue is required")
+	}
+	task.MaxEpisodes = maxEpisodes
+	task.Prompt = strings.Join(fs.Args(), " ")
+	if promptFile != "" {
+		data, err := os.ReadFile(promptFile)
+		if err != nil {
+			return err
+		}
+		task.Prompt = string(data)
+	}
+	queued, err := pantheon.EnqueueTask(queue, task)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("queued task %s\n", queued.ID)
+	return nil
+}
+
+// runDequeue removes tasks from a task queue. A running controller working
+// on one of them stops after the current episode.
+func runDequeue(args []string) error {
+	fs := flag.NewFlagSet("dequeue", flag.ContinueOnError)
+	var queue string
+	fs.StringVar(&queue, "queue", "", "Task queue: a JSONL file or a directory of task files")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if strings.TrimSpace(queue) == "" || fs.NArg() == 0 {
+		return fmt.Errorf("usage: agent0 dequeue --queue <path> <task id>...")
+	}
+	for _, id := range fs.Args() {
+		if err := pantheon.DequeueTask(queue, id); err != nil {
+			return err
+		}
+		fmt.Printf("dequeued task %s\n", id)
+	}
+	return nil
+}
@@ -0,0 +1,670 @@
+// Package fakepantheon is an in-process stand-in for the Pantheon MCP
+// server. It speaks streamable HTTP (JSON or SSE responses), implements the
+// tools agent0 calls and runs every branch through a scripted lifecycle, so
+// the controller can be exercised end to end without Pantheon.
+package fakepantheon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Branch statuses, as Pantheon reports them.
+const (
+	StatusRunning = "running"
+	StatusSucceed = "succeed"
+	StatusFailed  = "failed"
+)
+
+// Branch is a fake Pantheon branch.
+type Branch struct {
+	ID           string
+	ParentID     string
+	Project      string
+	Agent        string
+	Prompts      []string
+	Status       string
+	LatestSnapID string
+	Output       string
+	Summary      string
+	Files        map[string]string
+
+	created time.Time
+	polls   int
+	final   string
+	done    bool
+}
+
+// Config scripts the fake. The zero value finishes every branch
+// successfully on its first get_branch.
+type Config struct {
+	// Polls is how many get_branch calls report a branch as running before
+	// it reaches its outcome.
+	Polls int
+	// RunFor additionally keeps a branch running for this long.
+	RunFor time.Duration
+	// InheritParentStatus makes a new branch report its parent's status and
+	// snapshot until its first poll completes, as real Pantheon does.
+	InheritParentStatus bool
+	// JSONResponses answers with application/json instead of SSE.
+	JSONResponses bool
+	// PageSize, if > 0, makes branch_output and branch_read_file accept
+	// offset and limit arguments and return at most PageSize bytes per call,
+	// with next_offset and has_more. Offsets count bytes of the UTF-8 text;
+	// pages end on rune boundaries, so a page may be a few bytes short.
+	PageSize int
+	// OnExplore, if set, is called for each new branch (under the server
+	// lock) and may set Output, Summary, Files or the outcome via SetOutcome.
+	OnExplore func(b *Branch)
+}
+
+// runningPolls counts the inherited-status poll, which is not "running".
+func (c Config) runningPolls() int {
+	if c.InheritParentStatus {
+		return c.Polls + 1
+	}
+	return c.Polls
+}
+
+// Fault makes the next Count calls of Tool ("" for any tool) fail, either
+// with an HTTP status or with a tool-level error message.
+type Fault struct {
+	Tool       string
+	Count      int
+	HTTPStatus int
+	RetryAfter time.Duration
+	Message    string
+}
+
+// Server is the fake. It is an http.Handler; mount it at any path.
+type Server struct {
+	cfg Config
+
+	mu        sync.Mutex
+	branches  map[string]*Branch
+	nextID    int
+	sessions  map[string]bool
+	issued    int
+	faults    []*Fault
+	outcomes  []string
+	toolCalls map[string]int
+	prompts   map[string]Prompt
+}
+
+// Prompt is a server-defined prompt template served by prompts/get. Every
+// "{{name}}" in Template is replaced by the argument of that name; all
+// Arguments are required. AddPrompt derives nil Arguments from Template.
+type Prompt struct {
+	Name        string
+	Description string
+	Arguments   []string
+	Template    string
+}
+
+// New returns a fake server.
+func New(cfg Config) *Server {
+	return &Server{
+		cfg:       cfg,
+		branches:  map[string]*Branch{},
+		sessions:  map[string]bool{},
+		toolCalls: map[string]int{},
+		prompts:   map[string]Prompt{},
+	}
+}
+
+var promptPlaceholder = regexp.MustCompile(`\{\{(\w+)\}\}`)
+
+// AddPrompt adds (or replaces) a prompt template.
+func (s *Server) AddPrompt(p Prompt) {
+	if p.Arguments == nil {
+		seen := map[string]bool{}
+		for _, m := range promptPlaceholder.FindAllStringSubmatch(p.Template, -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				p.Arguments = append(p.Arguments, m[1])
+			}
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prompts[p.Name] = p
+}
+
+// SeedBranch adds a finished root branch, e.g. the baseline parent.
+func (s *Server) SeedBranch(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seedLocked(id)
+}
+
+func (s *Server) seedLocked(id string) *Branch {
+	if b, ok := s.branches[id]; ok {
+		return b
+	}
+	b := &Branch{ID: id, Status: StatusSucceed, LatestSnapID: "snap-" + id, Files: map[string]string{}, final: StatusSucceed, done: true}
+	s.branches[id] = b
+	return b
+}
+
+// QueueOutcomes sets the final status of the next branches created, in
+// order. Branches beyond the queue succeed.
+func (s *Server) QueueOutcomes(statuses ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outcomes = append(s.outcomes, statuses...)
+}
+
+// Inject adds a fault. Faults are consumed in the order they were added.
+func (s *Server) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.Count <= 0 {
+		f.Count = 1
+	}
+	s.faults = append(s.faults, &f)
+}
+
+// ExpireSessions forgets every session, so clients must re-initialize.
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = map[string]bool{}
+}
+
+// Branch returns a copy of the branch, if it exists.
+func (s *Server) Branch(id string) (Branch, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.branches[id]
+	if !ok {
+		return Branch{}, false
+	}
+	return *b, true
+}
+
+// Branches returns the IDs of all branches, sorted.
+func (s *Server) Branches() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.branches))
+	for id := range s.branches {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ToolCalls returns how many times tool was called (including faults).
+func (s *Server) ToolCalls(tool string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.toolCalls[tool]
+}
+
+// SetOutcome sets the status b ends in once its lifecycle completes.
+func (b *Branch) SetOutcome(status string) { b.final = status }
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodDelete:
+		s.mu.Lock()
+		delete(s.sessions, r.Header.Get("Mcp-Session-Id"))
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		// No standalone notification stream.
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var msg map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "invalid JSON-RPC message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	method, _ := msg["method"].(string)
+	id, hasID := msg["id"]
+	params, _ := msg["params"].(map[string]any)
+
+	if method == "initialize" {
+		s.mu.Lock()
+		s.issued++
+		sid := fmt.Sprintf("fake-session-%d", s.issued)
+		s.sessions[sid] = true
+		s.mu.Unlock()
+		w.Header().Set("Mcp-Session-Id", sid)
+		s.reply(w, id, map[string]any{
+			"protocolVersion": "2025-03-26",
+			"capabilities": map[string]any{
+				"tools":     map[string]any{},
+				"resources": map[string]any{"subscribe": true},
+				"prompts":   map[string]any{},
+			},
+			"serverInfo": map[string]any{"name": "fake-pantheon", "version": "0.1.0"},
+		})
+		return
+	}
+
+	s.mu.Lock()
+	known := s.sessions[r.Header.Get("Mcp-Session-Id")]
+	s.mu.Unlock()
+	if !known {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	if !hasID {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	switch method {
+	case "ping":
+		s.reply(w, id, map[string]any{})
+	case "tools/list":
+		s.reply(w, id, map[string]any{"tools": toolDefinitions(s.cfg.PageSize > 0)})
+	case "tools/call":
+		name, _ := params["name"].(string)
+		args, _ := params["arguments"].(map[string]any)
+		s.callTool(w, id, name, args)
+	case "resources/list":
+		s.reply(w, id, map[string]any{"resources": s.resources()})
+	case "resources/templates/list":
+		s.reply(w, id, map[string]any{"resourceTemplates": []any{
+			map[string]any{"uriTemplate": resourcePrefix + "{branch_id}/output", "name": "branch output", "mimeType": "text/plain"},
+			map[string]any{"uriTemplate": resourcePrefix + "{branch_id}/files/{path}", "name": "branch file"},
+		}})
+	case "resources/read":
+		uri := str(params, "uri")
+		text, ok := s.readResource(uri)
+		if !ok {
+			s.rpcError(w, id, -32002, "resource not found: "+uri)
+			return
+		}
+		s.reply(w, id, map[string]any{"contents": []any{map[string]any{"uri": uri, "mimeType": "text/plain", "text": text}}})
+	case "resources/subscribe", "resources/unsubscribe":
+		// Updates would need a notification stream, which the fake lacks.
+		s.reply(w, id, map[string]any{})
+	case "prompts/list":
+		s.reply(w, id, map[string]any{"prompts": s.promptList()})
+	case "prompts/get":
+		args, _ := params["arguments"].(map[string]any)
+		result, errMsg := s.renderPrompt(str(params, "name"), args)
+		if errMsg != "" {
+			s.rpcError(w, id, -32602, errMsg)
+			return
+		}
+		s.reply(w, id, result)
+	default:
+		s.rpcError(w, id, -32601, "method not found: "+method)
+	}
+}
+
+// resourcePrefix is the URI prefix of branch resources:
+// pantheon://branches/<id>/output and pantheon://branches/<id>/files/<path>.
+const resourcePrefix = "pantheon://branches/"
+
+func (s *Server) resources() []any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.branches))
+	for id := range s.branches {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	out := []any{}
+	for _, id := range ids {
+		b := s.branches[id]
+		out = append(out, map[string]any{"uri": resourcePrefix + id + "/output", "name": id + " output", "mimeType": "text/plain"})
+		paths := make([]string, 0, len(b.Files))
+		for path := range b.Files {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			out = append(out, map[string]any{"uri": resourcePrefix + id + "/files/" + path, "name": id + ":" + path})
+		}
+	}
+	return out
+}
+
+func (s *Server) readResource(uri string) (string, bool) {
+	rest, ok := strings.CutPrefix(uri, resourcePrefix)
+	if !ok {
+		return "", false
+	}
+	id, kind, _ := strings.Cut(rest, "/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.branches[id]
+	if !ok {
+		return "", false
+	}
+	if kind == "output" {
+		return b.Output, true
+	}
+	path, ok := strings.CutPrefix(kind, "files/")
+	if !ok || !hasFile(b, path) {
+		return "", false
+	}
+	return b.Files[path], true
+}
+
+func (s *Server) promptList() []any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.prompts))
+	for name := range s.prompts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := []any{}
+	for _, name := range names {
+		p := s.prompts[name]
+		args := []any{}
+		for _, a := range p.Arguments {
+			args = append(args, map[string]any{"name": a, "required": true})
+		}
+		out = append(out, map[string]any{"name": p.Name, "description": p.Description, "arguments": args})
+	}
+	return out
+}
+
+func (s *Server) renderPrompt(name string, args map[string]any) (map[string]any, string) {
+	s.mu.Lock()
+	p, ok := s.prompts[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, "prompt not found: " + name
+	}
+	text := p.Template
+	for _, a := range p.Arguments {
+		v, ok := args[a].(string)
+		if !ok {
+			return nil, fmt.Sprintf("prompt %s: missing required argument %q", name, a)
+		}
+		text = strings.ReplaceAll(text, "{{"+a+"}}", v)
+	}
+	return map[string]any{
+		"description": p.Description,
+		"messages": []any{map[string]any{
+			"role":    "user",
+			"content": map[string]any{"type": "text", "text": text},
+		}},
+	}, ""
+}
+
+func (s *Server) callTool(w http.ResponseWriter, id any, name string, args map[string]any) {
+	s.mu.Lock()
+	s.toolCalls[name]++
+	if f := s.takeFaultLocked(name); f != nil {
+		s.mu.Unlock()
+		if f.HTTPStatus != 0 {
+			if f.RetryAfter > 0 {
+				w.Header().Set("Retry-After", fmt.Sprint(int(f.RetryAfter.Seconds())))
+			}
+			http.Error(w, "injected fault", f.HTTPStatus)
+			return
+		}
+		s.toolError(w, id, f.Message)
+		return
+	}
+
+	var (
+		result map[string]any
+		errMsg string
+	)
+	switch name {
+	case "parallel_explore":
+		result, errMsg = s.exploreLocked(args)
+	case "get_branch":
+		result, errMsg = s.getBranchLocked(str(args, "branch_id"))
+	case "branch_output":
+		if b, ok := s.branches[str(args, "branch_id")]; ok {
+			result = s.page(map[string]any{"branch_id": b.ID}, "output", b.Output, args)
+		} else {
+			errMsg = "404: branch not found: " + str(args, "branch_id")
+		}
+	case "branch_read_file":
+		b, ok := s.branches[str(args, "branch_id")]
+		path := str(args, "file_path")
+		switch {
+		case !ok:
+			errMsg = "404: branch not found: " + str(args, "branch_id")
+		case !hasFile(b, path):
+			errMsg = "404: file not found: " + path
+		default:
+			result = s.page(map[string]any{"file_path": path}, "content", b.Files[path], args)
+		}
+	default:
+		errMsg = "unknown tool: " + name
+	}
+	s.mu.Unlock()
+
+	if errMsg != "" {
+		s.toolError(w, id, errMsg)
+		return
+	}
+	text, _ := json.Marshal(result)
+	s.reply(w, id, map[string]any{
+		"content":           []any{map[string]any{"type": "text", "text": string(text)}},
+		"structuredContent": result,
+	})
+}
+
+func (s *Server) exploreLocked(args map[string]any) (map[string]any, string) {
+	parentID := str(args, "parent_branch_id")
+	if parentID == "" {
+		return nil, "parent_branch_id is required"
+	}
+	parent := s.seedLocked(parentID)
+	n := 1
+	if v, ok := args["num_branches"].(float64); ok && v > 0 {
+		n = int(v)
+	}
+	var prompts []string
+	if list, ok := args["shared_prompt_sequence"].([]any); ok {
+		for _, p := range list {
+			if ps, ok := p.(string); ok {
+				prompts = append(prompts, ps)
+			}
+		}
+	}
+
+	var branches []any
+	for i := 0; i < n; i++ {
+		s.nextID++
+		b := &Branch{
+			ID:           fmt.Sprintf("branch-%d", s.nextID),
+			ParentID:     parentID,
+			Project:      str(args, "project_name"),
+			Agent:        str(args, "agent"),
+			Prompts:      prompts,
+			Status:       StatusRunning,
+			LatestSnapID: parent.LatestSnapID,
+			Output:       fmt.Sprintf("fake agent finished %d prompt(s)", len(prompts)),
+			Files:        map[string]string{},
+			created:      time.Now(),
+			final:        StatusSucceed,
+		}
+		for path, content := range parent.Files {
+			b.Files[path] = content
+		}
+		if len(s.outcomes) > 0 {
+			b.final = s.outcomes[0]
+			s.outcomes = s.outcomes[1:]
+		}
+		if s.cfg.InheritParentStatus {
+			b.Status = parent.Status
+		}
+		if s.cfg.OnExplore != nil {
+			s.cfg.OnExplore(b)
+		}
+		s.branches[b.ID] = b
+		branches = append(branches, map[string]any{"branch_id": b.ID})
+	}
+	return map[string]any{"parallel_explore": map[string]any{"branches": branches}}, ""
+}
+
+// getBranchLocked advances the branch lifecycle by one poll and reports it.
+func (s *Server) getBranchLocked(id string) (map[string]any, string) {
+	b, ok := s.branches[id]
+	if !ok {
+		return nil, "404: branch not found: " + id
+	}
+	if b.ParentID != "" && !b.done {
+		b.polls++
+		switch {
+		case s.cfg.InheritParentStatus && b.polls == 1:
+			// Report the inherited status and snapshot once.
+		case b.polls > s.cfg.runningPolls() && time.Since(b.created) >= s.cfg.RunFor:
+			b.Status, b.done = b.final, true
+			b.LatestSnapID = "snap-" + b.ID
+		default:
+			b.Status = StatusRunning
+			b.LatestSnapID = "snap-" + b.ID + "-wip"
+		}
+	}
+	out := map[string]any{
+		"id":             b.ID,
+		"name":           b.ID,
+		"status":         b.Status,
+		"latest_snap_id": b.LatestSnapID,
+	}
+	if b.ParentID != "" {
+		out["parent_id"] = b.ParentID
+	}
+	if b.Summary != "" {
+		out["manifest"] = map[string]any{"summary": b.Summary}
+	}
+	return out, ""
+}
+
+func (s *Server) takeFaultLocked(tool string) *Fault {
+	for i, f := range s.faults {
+		if f.Tool != "" && f.Tool != tool {
+			continue
+		}
+		f.Count--
+		if f.Count <= 0 {
+			s.faults = append(s.faults[:i], s.faults[i+1:]...)
+		}
+		return f
+	}
+	return nil
+}
+
+// toolError answers with an isError result. Like Pantheon, not-found
+// errors carry a "404: " prefix.
+func (s *Server) toolError(w http.ResponseWriter, id any, msg string) {
+	s.reply(w, id, map[string]any{
+		"isError": true,
+		"content": []any{map[string]any{"type": "text", "text": msg}},
+	})
+}
+
+func (s *Server) rpcError(w http.ResponseWriter, id any, code int, msg string) {
+	s.writeMessage(w, map[string]any{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"error":   map[string]any{"code": code, "message": msg},
+	})
+}
+
+func (s *Server) reply(w http.ResponseWriter, id any, result map[string]any) {
+	s.writeMessage(w, map[string]any{"jsonrpc": "2.0", "id": id, "result": result})
+}
+
+func (s *Server) writeMessage(w http.ResponseWriter, msg map[string]any) {
+	data, _ := json.Marshal(msg)
+	if s.cfg.JSONResponses {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+}
+
+// page stores text, or the page of it selected by the offset and limit
+// arguments when paging is enabled, under key in result.
+func (s *Server) page(result map[string]any, key, text string, args map[string]any) map[string]any {
+	if s.cfg.PageSize <= 0 {
+		result[key] = text
+		return result
+	}
+	offset, _ := args["offset"].(float64)
+	limit, _ := args["limit"].(float64)
+	start := int(offset)
+	if start < 0 || start > len(text) {
+		start = len(text)
+	}
+	n := s.cfg.PageSize
+	if limit > 0 && int(limit) < n {
+		n = int(limit)
+	}
+	end := start + n
+	if end > len(text) {
+		end = len(text)
+	}
+	// A rune split across pages would not survive JSON encoding.
+	for end > start && end < len(text) && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	if end == start && start < len(text) {
+		_, size := utf8.DecodeRuneInString(text[start:])
+		end = start + size
+	}
+	result[key] = text[start:end]
+	result["next_offset"] = end
+	result["has_more"] = end < len(text)
+	return result
+}
+
+func hasFile(b *Branch, path string) bool {
+	_, ok := b.Files[path]
+	return ok
+}
+
+func str(m map[string]any, key string) string {
+	v, _ := m[key].(string)
+	return strings.TrimSpace(v)
+}
+
+func toolDefinitions(paging bool) []any {
+	str := map[string]any{"type": "string"}
+	paged := func(props map[string]any) map[string]any {
+		if paging {
+			props["offset"] = map[string]any{"type": "integer"}
+			props["limit"] = map[string]any{"type": "integer"}
+		}
+		return props
+	}
+	tool := func(name, desc string, props map[string]any, required ...any) any {
+		return map[string]any{
+			"name":        name,
+			"description": desc,
+			"inputSchema": map[string]any{"type": "object", "properties": props, "required": required},
+		}
+	}
+	return []any{
+		tool("parallel_explore", "Start branches from a parent snapshot.", map[string]any{
+			"project_name":           str,
+			"parent_branch_id":       str,
+			"shared_prompt_sequence": map[string]any{"type": "array", "items": str},
+			"num_branches":           map[string]any{"type": "integer"},
+			"agent":                  str,
+		}, "project_name", "parent_branch_id", "shared_prompt_sequence"),
+		tool("get_branch", "Get branch status.", map[string]any{"branch_id": str}, "branch_id"),
+		tool("branch_read_file", "Read a file from a branch snapshot.", paged(map[string]any{"branch_id": str, "file_path": str}), "branch_id", "file_path"),
+		tool("branch_output", "Get the agent output of a branch.", paged(map[string]any{"branch_id": str, "full_output": map[string]any{"type": "boolean"}}), "branch_id"),
+	}
+}
@@ -0,0 +1,130 @@
+package fakepantheon
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type rpcClient struct {
+	t       *testing.T
+	url     string
+	session string
+	id      int
+}
+
+func newRPCClient(t *testing.T, url string) *rpcClient {
+	c := &rpcClient{t: t, url: url}
+	resp := c.post(map[string]any{"method": "initialize", "params": map[string]any{}})
+	c.session = resp.Header.Get("Mcp-Session-Id")
+	resp.Body.Close()
+	if c.session == "" {
+		t.Fatal("initialize returned no session id")
+	}
+	return c
+}
+
+func (c *rpcClient) post(msg map[string]any) *http.Response {
+	c.id++
+	msg["jsonrpc"] = "2.0"
+	msg["id"] = c.id
+	data, _ := json.Marshal(msg)
+	req, _ := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if c.session != "" {
+		req.Header.Set("Mcp-Session-Id", c.session)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+// call invokes tool and returns the structured result, or the error text
+// when the tool reported isError.
+func (c *rpcClient) call(tool string, args map[string]any) (map[string]any, string) {
+	resp := c.post(map[string]any{"method": "tools/call", "params": map[string]any{"name": tool, "arguments": args}})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("%s: HTTP %d", tool, resp.StatusCode)
+	}
+	var msg struct {
+		Result struct {
+			IsError           bool             `json:"isError"`
+			Content           []map[string]any `json:"content"`
+			StructuredContent map[string]any   `json:"structuredContent"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		c.t.Fatal(err)
+	}
+	if msg.Result.IsError {
+		text, _ := msg.Result.Content[0]["text"].(string)
+		return nil, text
+	}
+	return msg.Result.StructuredContent, ""
+}
+
+func TestBranchLifecycle(t *testing.T) {
+	fake := New(Config{Polls: 1, InheritParentStatus: true, JSONResponses: true})
+	fake.QueueOutcomes(StatusFailed)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	c := newRPCClient(t, srv.URL)
+
+	if _, errMsg := c.call("parallel_explore", map[string]any{"parent_branch_id": "root", "num_branches": 1}); errMsg != "" {
+		t.Fatalf("parallel_explore: %s", errMsg)
+	}
+	want := []struct{ status, snap string }{
+		{StatusSucceed, "snap-root"},
+		{StatusRunning, "snap-branch-1-wip"},
+		{StatusFailed, "snap-branch-1"},
+		{StatusFailed, "snap-branch-1"},
+	}
+	for i, w := range want {
+		got, errMsg := c.call("get_branch", map[string]any{"branch_id": "branch-1"})
+		if errMsg != "" {
+			t.Fatalf("poll %d: %s", i+1, errMsg)
+		}
+		if got["status"] != w.status || got["latest_snap_id"] != w.snap {
+			t.Fatalf("poll %d: got %v/%v, want %s/%s", i+1, got["status"], got["latest_snap_id"], w.status, w.snap)
+		}
+	}
+	if _, errMsg := c.call("branch_read_file", map[string]any{"branch_id": "branch-1", "file_path": "missing"}); errMsg == "" {
+		t.Fatal("expected tool error for a missing file")
+	}
+}
+
+func TestFaultsAndExpiredSessions(t *testing.T) {
+	fake := New(Config{JSONResponses: true})
+	fake.Inject(Fault{Tool: "get_branch", Count: 2, HTTPStatus: http.StatusServiceUnavailable})
+	fake.SeedBranch("root")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	c := newRPCClient(t, srv.URL)
+
+	args := map[string]any{"branch_id": "root"}
+	for i := 0; i < 2; i++ {
+		resp := c.post(map[string]any{"method": "tools/call", "params": map[string]any{"name": "get_branch", "arguments": args}})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("call %d: expected injected 503, got %d", i+1, resp.StatusCode)
+		}
+	}
+	if _, errMsg := c.call("get_branch", args); errMsg != "" {
+		t.Fatalf("get_branch after faults: %s", errMsg)
+	}
+	if n := fake.ToolCalls("get_branch"); n != 3 {
+		t.Fatalf("expected 3 get_branch calls, got %d", n)
+	}
+
+	fake.ExpireSessions()
+	resp := c.post(map[string]any{"method": "ping"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an expired session, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,116 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// TokenSource supplies the bearer token sent as "Authorization: Bearer ...".
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// TokenRefresher is implemented by token sources that can obtain a new token
+// after the server rejects the current one with HTTP 401. The client refreshes
+// and retries a rejected request once.
+type TokenRefresher interface {
+	Refresh(ctx context.Context) (string, error)
+}
+
+// StaticTokenSource always returns the same token.
+type StaticTokenSource string
+
+func (s StaticTokenSource) Token(context.Context) (string, error) { return string(s), nil }
+
+// EnvTokenSource reads the token from an environment variable on every call,
+// so a supervisor that rotates the variable is picked up on refresh.
+type EnvTokenSource string
+
+func (s EnvTokenSource) Token(context.Context) (string, error) {
+	tok := strings.TrimSpace(os.Getenv(string(s)))
+	if tok == "" {
+		return "", fmt.Errorf("bearer token env %s is empty", string(s))
+	}
+	return tok, nil
+}
+
+func (s EnvTokenSource) Refresh(ctx context.Context) (string, error) { return s.Token(ctx) }
+
+// FileTokenSource reads the token from a file (e.g. a mounted secret) and
+// caches it until Refresh re-reads the file.
+type FileTokenSource struct {
+	Path string
+
+	mu    sync.Mutex
+	token string
+}
+
+func NewFileTokenSource(path string) *FileTokenSource {
+	return &FileTokenSource{Path: path}
+}
+
+func (s *FileTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	tok := s.token
+	s.mu.Unlock()
+	if tok != "" {
+		return tok, nil
+	}
+	return s.Refresh(ctx)
+}
+
+func (s *FileTokenSource) Refresh(context.Context) (string, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return "", fmt.Errorf("read bearer token file: %w", err)
+	}
+	tok := strings.TrimSpace(string(data))
+	if tok == "" {
+		return "", fmt.Errorf("bearer token file %s is empty", s.Path)
+	}
+	s.mu.Lock()
+	s.token = tok
+	s.mu.Unlock()
+	return tok, nil
+}
+
+// setAuthHeaders applies the configured static headers and bearer token.
+func (c *MCPClient) setAuthHeaders(ctx context.Context, h http.Header) error {
+	for name, value := range c.headers {
+		h.Set(name, value)
+	}
+	if c.tokens == nil {
+		return nil
+	}
+	tok, err := c.tokens.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("MCP bearer token: %w", err)
+	}
+	if tok != "" {
+		h.Set("Authorization", "Bearer "+tok)
+	}
+	return nil
+}
+
+// refreshToken asks the token source for a new token after a 401. It
+// reports whether the request is worth retrying.
+func (c *MCPClient) refreshToken(ctx context.Context) bool {
+	r, ok := c.tokens.(TokenRefresher)
+	if !ok {
+		return false
+	}
+	if _, err := r.Refresh(ctx); err != nil {
+		return false
+	}
+	return true
+}
+
+func isUnauthorized(err error) bool {
+	var httpErr HTTPStatusError
+	return errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized
+}
@@ -0,0 +1,343 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/IANTHEREAL/agent0/internal/logx"
+)
+
+// CassetteEntry is one line of a cassette: either an exchange started by
+// the client (Request set) or a notification the server sent on its own.
+type CassetteEntry struct {
+	Seq int `json:"seq"`
+	// OffsetMS is the time since recording started.
+	OffsetMS int64 `json:"offset_ms"`
+
+	Request  map[string]any `json:"request,omitempty"`
+	Response map[string]any `json:"response,omitempty"`
+	Error    *CassetteError `json:"error,omitempty"`
+	// DurationMS is how long the exchange took.
+	DurationMS float64 `json:"duration_ms,omitempty"`
+	// HTTPStatus and SSE describe the wire framing when the exchange went
+	// over HTTP. They are informational; replay does not need them.
+	HTTPStatus int             `json:"http_status,omitempty"`
+	SSE        []CassetteEvent `json:"sse,omitempty"`
+
+	Notification map[string]any `json:"notification,omitempty"`
+}
+
+// CassetteEvent is one SSE event as it arrived.
+type CassetteEvent struct {
+	ID    string `json:"id,omitempty"`
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data"`
+}
+
+// CassetteError records a failed exchange precisely enough for replay to
+// classify it (retryable, session expired, HTTP status) the same way.
+type CassetteError struct {
+	Message        string `json:"message"`
+	HTTPStatus     int    `json:"http_status,omitempty"`
+	RetryAfterMS   int64  `json:"retry_after_ms,omitempty"`
+	SessionExpired bool   `json:"session_expired,omitempty"`
+	Retryable      bool   `json:"retryable,omitempty"`
+}
+
+func newCassetteError(err error) *CassetteError {
+	ce := &CassetteError{Message: err.Error(), Retryable: IsRetryableError(err)}
+	var httpErr HTTPStatusError
+	switch {
+	case errors.Is(err, errSessionExpired):
+		ce.SessionExpired = true
+	case errors.As(err, &httpErr):
+		ce.Message = httpErr.Body
+		ce.HTTPStatus = httpErr.StatusCode
+		ce.RetryAfterMS = httpErr.RetryAfter.Milliseconds()
+	}
+	return ce
+}
+
+// Err rebuilds an error that IsRetryableError classifies like the original.
+func (e CassetteError) Err() error {
+	switch {
+	case e.SessionExpired:
+		return errSessionExpired
+	case e.HTTPStatus != 0:
+		return HTTPStatusError{StatusCode: e.HTTPStatus, Body: e.Message, RetryAfter: time.Duration(e.RetryAfterMS) * time.Millisecond}
+	case e.Retryable:
+		return replayedTransientError{replayedError(e.Message)}
+	}
+	return replayedError(e.Message)
+}
+
+type replayedError string
+
+func (e replayedError) Error() string { return string(e) }
+
+// replayedTransientError satisfies net.Error so it is retried like the
+// network failure it stands in for.
+type replayedTransientError struct{ replayedError }
+
+func (replayedTransientError) Timeout() bool   { return false }
+func (replayedTransientError) Temporary() bool { return true }
+
+// exchangeTrace collects wire details of one exchange for the recorder and
+// the metrics. SSE events are only kept when keepEvents is set.
+type exchangeTrace struct {
+	status     int
+	keepEvents bool
+	events     []sseEvent
+	sseFailed  bool
+}
+
+// Recorder writes MCP traffic to a JSONL cassette, one entry per line as it
+// happens, so a cassette from a crashed run is still usable. It never sees
+// HTTP headers, so tokens do not end up in cassettes.
+type Recorder struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+	start  time.Time
+	seq    int
+	failed bool
+}
+
+// NewRecorder returns a recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w), start: time.Now()}
+}
+
+// CreateCassette creates (or truncates) the cassette file at path.
+func CreateCassette(path string) (*Recorder, error) {
+	if dir := filepath.Dir(path); dir != "" && dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRecorder(f)
+	r.closer = f
+	return r, nil
+}
+
+// Close closes the cassette file if the recorder opened it.
+func (r *Recorder) Close() error {
+	if r == nil || r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+func (r *Recorder) recordExchange(req, resp map[string]any, err error, elapsed time.Duration, trace *exchangeTrace) {
+	e := CassetteEntry{
+		Request:    req,
+		Response:   resp,
+		DurationMS: float64(elapsed.Microseconds()) / 1000,
+	}
+	if err != nil {
+		e.Error = newCassetteError(err)
+	}
+	if trace != nil {
+		e.HTTPStatus = trace.status
+		for _, ev := range trace.events {
+			e.SSE = append(e.SSE, CassetteEvent{ID: ev.ID, Event: ev.Event, Data: ev.Data})
+		}
+	}
+	r.write(e)
+}
+
+func (r *Recorder) recordNotification(msg map[string]any) {
+	r.write(CassetteEntry{Notification: msg})
+}
+
+func (r *Recorder) write(e CassetteEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	e.Seq = r.seq
+	e.OffsetMS = time.Since(r.start).Milliseconds()
+	if err := r.enc.Encode(e); err != nil && !r.failed {
+		r.failed = true
+		logx.Errorf("MCP cassette write failed; recording stopped: %v", err)
+	}
+}
+
+// LoadCassette reads a cassette written by a Recorder.
+func LoadCassette(path string) ([]CassetteEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []CassetteEntry
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			var e CassetteEntry
+			if uerr := json.Unmarshal(data, &e); uerr != nil {
+				return nil, fmt.Errorf("cassette %s line %d: %w", path, line, uerr)
+			}
+			entries = append(entries, e)
+		}
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ReplayTransport serves a cassette back in order. Each message the client
+// sends must match the next recorded request (same method and, for
+// tools/call, same tool); recorded server notifications are delivered just
+// before the response they preceded. Timing is not reproduced.
+type ReplayTransport struct {
+	// StrictArguments also requires tools/call arguments to match.
+	StrictArguments bool
+
+	mu      sync.Mutex
+	entries []CassetteEntry
+	pos     int
+	handler func(map[string]any)
+}
+
+// NewReplayTransport replays entries.
+func NewReplayTransport(entries []CassetteEntry) *ReplayTransport {
+	return &ReplayTransport{entries: entries}
+}
+
+// OpenReplayTransport replays the cassette at path.
+func OpenReplayTransport(path string) (*ReplayTransport, error) {
+	entries, err := LoadCassette(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayTransport(entries), nil
+}
+
+// CassetteMismatchError reports a client message that differs from the
+// recording, i.e. the code under test diverged from the recorded run.
+type CassetteMismatchError struct {
+	Seq      int
+	Expected map[string]any
+	Got      map[string]any
+}
+
+func (e CassetteMismatchError) Error() string {
+	if e.Expected == nil {
+		return fmt.Sprintf("cassette exhausted; unexpected %s", describeMessage(e.Got))
+	}
+	return fmt.Sprintf("cassette entry %d: expected %s, got %s", e.Seq, describeMessage(e.Expected), describeMessage(e.Got))
+}
+
+func (t *ReplayTransport) SetMessageHandler(h func(msg map[string]any)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handler = h
+}
+
+// Remaining returns how many entries have not been replayed yet.
+func (t *ReplayTransport) Remaining() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries) - t.pos
+}
+
+func (t *ReplayTransport) RoundTrip(ctx context.Context, msg map[string]any) (map[string]any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	var notes []map[string]any
+	var entry *CassetteEntry
+	for t.pos < len(t.entries) {
+		e := &t.entries[t.pos]
+		if e.Notification != nil {
+			notes = append(notes, e.Notification)
+			t.pos++
+			continue
+		}
+		if !t.matches(e.Request, msg) {
+			t.mu.Unlock()
+			return nil, CassetteMismatchError{Seq: e.Seq, Expected: e.Request, Got: msg}
+		}
+		entry = e
+		t.pos++
+		break
+	}
+	h := t.handler
+	t.mu.Unlock()
+
+	if h != nil {
+		for _, n := range notes {
+			h(n)
+		}
+	}
+	if entry == nil {
+		return nil, CassetteMismatchError{Got: msg}
+	}
+	if entry.Error != nil {
+		return nil, entry.Error.Err()
+	}
+	if entry.Response == nil {
+		return nil, nil
+	}
+	resp := make(map[string]any, len(entry.Response))
+	for k, v := range entry.Response {
+		resp[k] = v
+	}
+	if id, ok := msg["id"]; ok {
+		resp["id"] = id
+	}
+	return resp, nil
+}
+
+func (t *ReplayTransport) Close() error { return nil }
+
+func (t *ReplayTransport) matches(recorded, msg map[string]any) bool {
+	if recorded["method"] != msg["method"] {
+		return false
+	}
+	if msg["method"] != "tools/call" {
+		return true
+	}
+	rp, _ := recorded["params"].(map[string]any)
+	mp, _ := msg["params"].(map[string]any)
+	if rp["name"] != fmt.Sprint(mp["name"]) {
+		return false
+	}
+	if !t.StrictArguments {
+		return true
+	}
+	want, _ := json.Marshal(rp["arguments"])
+	got, _ := json.Marshal(mp["arguments"])
+	return string(want) == string(got)
+}
+
+func describeMessage(m map[string]any) string {
+	method, _ := m["method"].(string)
+	if method == "" {
+		return fmt.Sprintf("reply %v", m["id"])
+	}
+	if method == "tools/call" {
+		if p, ok := m["params"].(map[string]any); ok {
+			return fmt.Sprintf("tools/call %v", p["name"])
+		}
+	}
+	return method
+}
@@ -0,0 +1,462 @@
+package tools
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBranchSkipped is matched (via errors.Is) for episode branches the
+// controller stopped waiting for because Control.Skip was called.
+var ErrBranchSkipped = errors.New("branch skipped")
+
+// ErrControlConflict is matched (via errors.Is) when a Control command does
+// not apply to what the controller is doing, e.g. skipping without an
+// active episode.
+var ErrControlConflict = errors.New("control command does not apply")
+
+// What a controller is doing, as reported in ControlStatus.Phase.
+const (
+	PhaseStarting  = "starting"
+	PhaseRunning   = "running"   // starting an episode, checking or promoting its branches
+	PhaseExploring = "exploring" // waiting for the episode branches to finish
+	PhaseBackoff   = "backoff"   // waiting after an episode without a winner
+	PhasePaused    = "paused"    // paused by Control.Pause, the failure policy or an open circuit
+	PhaseWaiting   = "waiting"   // the task queue is drained; waiting for new tasks
+	PhaseExited    = "exited"
+)
+
+// ControlStatus is a snapshot of a running controller.
+type ControlStatus struct {
+	Phase string `json:"phase"`
+	// Paused and StopAfterEpisode are the pending Control requests.
+	Paused           bool `json:"paused"`
+	StopAfterEpisode bool `json:"stop_after_episode"`
+
+	AnchorBranch   string   `json:"anchor_branch_id"`
+	ActiveBranches []string `json:"active_branch_ids"`
+	ActiveSince    string   `json:"active_since,omitempty"`
+	// Task is the id of the queued task in progress.
+	Task string `json:"task,omitempty"`
+
+	// Episodes counts the episodes promoted by this run and Attempts every
+	// attempt that ended, as written to the ledger.
+	Episodes            int            `json:"episodes"`
+	Attempts            int            `json:"attempts"`
+	ConsecutiveFailures map[string]int `json:"consecutive_failures,omitempty"`
+	LastError           string         `json:"last_error,omitempty"`
+	LastErrorAt         string         `json:"last_error_at,omitempty"`
+
+	// A summary of the state file. Connection settings, prompt variables
+	// and the task text are left out: they can hold credentials.
+	ProjectName  string `json:"project_name,omitempty"`
+	Initialized  bool   `json:"initialized"`
+	TaskQueue    string `json:"task_queue,omitempty"`
+	TaskTemplate bool   `json:"task_template,omitempty"`
+	PausedUntil  string `json:"paused_until,omitempty"`
+
+	StartedAt string `json:"started_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// Control lets another goroutine, such as the HTTP API of `agent0 run
+// --listen`, watch and steer a running controller (ControllerConfig.Control).
+// Commands take effect at the controller's next safe point and are not
+// saved: a restarted controller runs normally.
+type Control struct {
+	mu     sync.Mutex
+	status ControlStatus
+
+	paused bool
+	stop   bool
+	task   *string
+	// skip holds the active branches to stop waiting for.
+	skip map[string]bool
+	// waiting is the branch being polled and cancelWait ends that poll.
+	waiting    string
+	cancelWait context.CancelFunc
+	// wake, if set, is closed to end the controller's current wait early.
+	wake chan struct{}
+}
+
+// NewControl returns a Control for one controller run.
+func NewControl() *Control {
+	now := time.Now().UTC().Format(time.RFC3339)
+	return &Control{
+		status: ControlStatus{Phase: PhaseStarting, StartedAt: now, UpdatedAt: now},
+		skip:   map[string]bool{},
+	}
+}
+
+// Status returns the controller's latest status.
+func (c *Control) Status() ControlStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.status
+	st.Paused = c.paused
+	st.StopAfterEpisode = c.stop
+	return st
+}
+
+// Pause keeps the controller from starting another episode until Resume.
+// Branches already running are still waited for and promoted.
+func (c *Control) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = true
+}
+
+// Resume undoes Pause. It also cuts short a failure-policy backoff or pause,
+// so the next episode starts at once.
+func (c *Control) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = false
+	c.wakeLocked()
+}
+
+// StopAfterEpisode makes the controller exit once the current episode ends,
+// leaving nothing active. Waits between episodes end at once.
+func (c *Control) StopAfterEpisode() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stop = true
+	c.wakeLocked()
+}
+
+// Skip stops waiting for an active episode branch, or for all of them when
+// branchID is "". Pantheon has no way to cancel a branch, so it keeps
+// running there; the controller treats it as not promotable, and starts a
+// new episode from the same anchor once every branch was skipped.
+func (c *Control) Skip(branchID string) error {
+	branchID = strings.TrimSpace(branchID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active := c.status.ActiveBranches
+	if len(active) == 0 {
+		return fmt.Errorf("%w: no episode is active", ErrControlConflict)
+	}
+	targets := active
+	if branchID != "" {
+		if !slices.Contains(active, branchID) {
+			return fmt.Errorf("%w: %s is not an active episode branch (active: %s)", ErrControlConflict, branchID, strings.Join(active, ", "))
+		}
+		targets = []string{branchID}
+	}
+	for _, id := range targets {
+		c.skip[id] = true
+		if id == c.waiting && c.cancelWait != nil {
+			c.cancelWait()
+		}
+	}
+	return nil
+}
+
+// ReplaceTask sets the fixed episode prompt (--task) used from the next
+// episode on, and saves it in the state file. It is refused while the
+// controller works through a task queue; edit the queue instead. With task
+// templates on, the task must parse as a template, and it may not use
+// include: the caller is remote and must not read local files.
+func (c *Control) ReplaceTask(task string) error {
+	if strings.TrimSpace(task) == "" {
+		return fmt.Errorf("task is empty")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status.TaskQueue != "" {
+		return fmt.Errorf("%w: the controller works through the task queue %s; use agent0 enqueue/dequeue", ErrControlConflict, c.status.TaskQueue)
+	}
+	if c.status.TaskTemplate {
+		if err := checkControlTask(task); err != nil {
+			return fmt.Errorf("invalid task template: %w", err)
+		}
+	}
+	c.task = &task
+	return nil
+}
+
+// The methods below are called by the controller and accept a nil
+// *Control.
+
+// publish records the controller's status. st carries the run's counters;
+// the rest is taken from state.
+func (c *Control) publish(st ControlStatus, state ControllerState) {
+	if c == nil {
+		return
+	}
+	active := state.ActiveBranchIDs()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st.AnchorBranch = state.AnchorBranch
+	st.ActiveBranches = active
+	st.ActiveSince = state.ActiveSince
+	st.Task = state.CurrentTask
+	st.ConsecutiveFailures = maps.Clone(st.ConsecutiveFailures)
+	st.StartedAt = c.status.StartedAt
+	st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	st.ProjectName = state.ProjectName
+	st.Initialized = state.Initialized
+	st.TaskQueue = state.TaskQueue
+	st.TaskTemplate = state.TaskTemplate
+	st.PausedUntil = state.PausedUntil
+	c.status = st
+	for id := range c.skip {
+		if !slices.Contains(active, id) {
+			delete(c.skip, id)
+		}
+	}
+}
+
+func (c *Control) stopRequested() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stop
+}
+
+func (c *Control) pauseRequested() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused && !c.stop
+}
+
+// takeTask returns a task set by ReplaceTask since the last call.
+func (c *Control) takeTask() (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.task == nil {
+		return "", false
+	}
+	task := *c.task
+	c.task = nil
+	return task, true
+}
+
+// waitWhilePaused blocks while the controller is paused.
+func (c *Control) waitWhilePaused(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	for {
+		c.mu.Lock()
+		if !c.paused || c.stop {
+			c.mu.Unlock()
+			return
+		}
+		wake := make(chan struct{})
+		c.wake = wake
+		c.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sleep waits for d like sleepContext, but ends early on Resume or
+// StopAfterEpisode.
+func (c *Control) sleep(ctx context.Context, d time.Duration) {
+	if c == nil {
+		_ = sleepContext(ctx, d)
+		return
+	}
+	c.mu.Lock()
+	if c.stop {
+		c.mu.Unlock()
+		return
+	}
+	wake := make(chan struct{})
+	c.wake = wake
+	c.mu.Unlock()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-wake:
+	case <-ctx.Done():
+	}
+	c.mu.Lock()
+	if c.wake == wake {
+		c.wake = nil
+	}
+	c.mu.Unlock()
+}
+
+func (c *Control) wakeLocked() {
+	if c.wake != nil {
+		close(c.wake)
+		c.wake = nil
+	}
+}
+
+// waitContext returns the context to poll branchID with; Skip cancels it.
+// done must be called when the poll ends.
+func (c *Control) waitContext(ctx context.Context, branchID string) (waitCtx context.Context, done func()) {
+	if c == nil {
+		return ctx, func() {}
+	}
+	waitCtx, cancel := context.WithCancel(ctx)
+	c.mu.Lock()
+	c.waiting, c.cancelWait = branchID, cancel
+	if c.skip[branchID] {
+		cancel()
+	}
+	c.mu.Unlock()
+	return waitCtx, func() {
+		c.mu.Lock()
+		c.waiting, c.cancelWait = "", nil
+		c.mu.Unlock()
+		cancel()
+	}
+}
+
+func (c *Control) skipped(branchID string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.skip[branchID]
+}
+
+// allSkipped reports whether Skip abandoned every candidate of an episode.
+func allSkipped(candidates []Candidate) bool {
+	for _, c := range candidates {
+		if !errors.Is(c.Err, ErrBranchSkipped) {
+			return false
+		}
+	}
+	return len(candidates) > 0
+}
+
+// Handler serves the control API:
+//
+//	GET  /status   the ControlStatus
+//	POST /pause    Pause
+//	POST /resume   Resume
+//	POST /stop     StopAfterEpisode
+//	POST /skip     Skip; body {"branch_id": "..."} (optional)
+//	POST /task     ReplaceTask; body {"task": "..."}
+//
+// Commands answer with the new status, and errors with {"error": "..."}.
+//
+// Every request must send "Authorization: Bearer <token>"; with an empty
+// token every request is refused. Commands must be sent as
+// application/json, which a browser cannot do cross-site without CORS, and
+// the Host header must be an IP address, localhost or one of hosts, so a
+// DNS-rebound page cannot reach the API either.
+func (c *Control) Handler(token string, hosts ...string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeControlJSON(w, http.StatusOK, c.Status())
+	})
+	command := func(run func(r *http.Request) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if err := run(r); err != nil {
+				code := http.StatusBadRequest
+				if errors.Is(err, ErrControlConflict) {
+					code = http.StatusConflict
+				}
+				writeControlJSON(w, code, map[string]string{"error": err.Error()})
+				return
+			}
+			writeControlJSON(w, http.StatusOK, c.Status())
+		}
+	}
+	mux.HandleFunc("POST /pause", command(func(*http.Request) error { c.Pause(); return nil }))
+	mux.HandleFunc("POST /resume", command(func(*http.Request) error { c.Resume(); return nil }))
+	mux.HandleFunc("POST /stop", command(func(*http.Request) error { c.StopAfterEpisode(); return nil }))
+	mux.HandleFunc("POST /skip", command(func(r *http.Request) error {
+		var body struct {
+			BranchID string `json:"branch_id"`
+		}
+		if err := decodeControlBody(r, &body); err != nil {
+			return err
+		}
+		return c.Skip(body.BranchID)
+	}))
+	mux.HandleFunc("POST /task", command(func(r *http.Request) error {
+		var body struct {
+			Task string `json:"task"`
+		}
+		if err := decodeControlBody(r, &body); err != nil {
+			return err
+		}
+		return c.ReplaceTask(body.Task)
+	}))
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !controlHostAllowed(r.Host, hosts) {
+			writeControlJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("host %q is not allowed", r.Host)})
+			return
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeControlJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or wrong bearer token"})
+			return
+		}
+		if r.Method == http.MethodPost {
+			if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+				writeControlJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": "commands must be sent as Content-Type: application/json"})
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// controlHostAllowed reports whether a request's Host header names this
+// machine directly: an IP address, localhost or one of hosts.
+func controlHostAllowed(hostport string, hosts []string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if host == "" || strings.EqualFold(host, "localhost") || net.ParseIP(host) != nil {
+		return true
+	}
+	for _, h := range hosts {
+		if strings.EqualFold(host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeControlBody reads an optional JSON request body into v.
+func decodeControlBody(r *http.Request, v any) error {
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid JSON body: %w", err)
+	}
+	return nil
+}
+
+func writeControlJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
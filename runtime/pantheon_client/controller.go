@@ -1,14 +1,17 @@
 package tools
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/IANTHEREAL/agent0/internal/logx"
 )
@@ -18,14 +21,58 @@ const (
 	defaultPollIntervalSeconds    = 60
 	defaultMaxPollIntervalSeconds = 300
 
+	// Pantheon circuit breaker: pause the controller after this many
+	// consecutive transient failures, probing again after the cooldown.
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 5 * time.Minute
+
 	bootstrapMCPServerName = "test"
 	bootstrapMCPServerURL  = "http://35.89.132.179:8000/mcp/sse"
 )
 
+var (
+	// defaultMCPRateLimit caps all requests of one controller; polling needs
+	// well under one request per second.
+	defaultMCPRateLimit = RateLimit{Rate: 5, Burst: 10, MaxInFlight: 4}
+	// defaultMCPToolRateLimits are stricter limits for expensive tools:
+	// every parallel_explore starts agent sandboxes.
+	defaultMCPToolRateLimits = map[string]RateLimit{
+		"parallel_explore": {Rate: 0.1, Burst: 2, MaxInFlight: 1},
+	}
+)
+
 type ControllerConfig struct {
 	// MCPBaseURL is the Pantheon MCP SSE endpoint, e.g. http://host:8000/mcp/sse.
 	MCPBaseURL string
 
+	// MCPHeaders are sent with every MCP request and MCPTokenSource supplies
+	// a bearer token. Credentials are never written to the state file.
+	MCPHeaders     map[string]string
+	MCPTokenSource TokenSource
+
+	// MCPTransport overrides the TLS/proxy/pool settings saved in the state
+	// file, field by field.
+	MCPTransport TransportConfig
+
+	// MCPRateLimit bounds all MCP requests and MCPToolRateLimits bound
+	// tools/call per tool; unset entries use the defaults (5 req/s, 4 in
+	// flight; parallel_explore at most one every 10s).
+	MCPRateLimit      RateLimit
+	MCPToolRateLimits map[string]RateLimit
+
+	// MCPMetrics and MCPTracer, if set, receive the MCP client's metrics and
+	// spans. The controller also logs a per-episode MCP latency summary.
+	MCPMetrics MCPMetrics
+	MCPTracer  Tracer
+
+	// MCPRecordPath, if set, records all MCP traffic of this run to a
+	// cassette that replay:<path> can serve back.
+	MCPRecordPath string
+
+	// OnProgress, if set, receives Pantheon progress notifications in
+	// addition to the controller log.
+	OnProgress func(ProgressEvent)
+
 	ProjectName string
 	Agent       string
 
@@ -36,9 +83,34 @@ type ControllerConfig struct {
 	// ParentBranchID is only used when the state file has no anchor_branch_id yet.
 	ParentBranchID string
 
-	// Task is the fixed episode prompt (reused every episode).
+	// Task is the episode prompt, reused every episode. While a TaskQueue
+	// task is active, that task's prompt is used instead. The control API
+	// can replace Task while the controller runs.
 	Task string
 
+	// TaskTemplate executes the task (Task or a queued prompt) as a
+	// text/template with the PromptContext fields before every episode
+	// (saved in the state file). Without it tasks are sent as written, so
+	// plain text with "{{" in it is left alone.
+	TaskTemplate bool
+
+	// TaskQueue is a LoadTaskQueue path (saved in the state file). When set,
+	// each queued task runs as its own chain of episodes in place of Task,
+	// and the controller exits once the queue is drained, or with
+	// TaskQueueWait waits for more tasks.
+	TaskQueue     string
+	TaskQueueWait bool
+
+	// TaskPrompt names a prompt template on the MCP server (prompts/get)
+	// that is rendered with TaskPromptArgs at the start of every episode.
+	// Task, if also set, is appended to it.
+	TaskPrompt     string
+	TaskPromptArgs map[string]string
+
+	// PromptVars are available to task templates as .Vars (saved in the
+	// state file).
+	PromptVars map[string]string
+
 	// Optional initialization sources. MVP: we just prepend instructions to the prompt.
 	AgentsMDURL               string
 	SkillsURL                 string
@@ -50,6 +122,37 @@ type ControllerConfig struct {
 
 	// MaxEpisodes limits episodes in one run. 0 = infinite.
 	MaxEpisodes int
+
+	// Branches is how many branches each episode explores from the anchor
+	// (default 1). Selector picks the new anchor among those that succeed:
+	// a ParseSelector spec, saved in the state file. CustomSelector, if
+	// set, is used instead (library use; not saved).
+	Branches       int
+	Selector       string
+	CustomSelector Selector
+
+	// Gates are ParseGate specs every episode branch must pass before it
+	// may become the anchor (saved in the state file; the bootstrap episode
+	// is not gated). CustomGates run after them (library use; not saved).
+	Gates       []string
+	CustomGates []Gate
+
+	// FailurePolicy are ParseFailurePolicy specs for episodes without a
+	// winner (saved in the state file; "default" clears them). The default
+	// retries three times, 20 minutes apart, then exits.
+	FailurePolicy []string
+
+	// PollInterval is the initial get_branch polling interval (default 60s).
+	PollInterval time.Duration
+
+	// LedgerPath is the JSONL episode ledger, one LedgerRecord per episode
+	// attempt; branch outputs are copied to an outputs directory beside it.
+	// Default: ledger.jsonl next to the state file; "none" disables it.
+	LedgerPath string
+
+	// Control, if set, receives the controller's status and pauses, stops
+	// or redirects it (see `agent0 run --listen`).
+	Control *Control
 }
 
 type ControllerState struct {
@@ -66,6 +169,53 @@ type ControllerState struct {
 	AnchorBranch              string `json:"anchor_branch_id,omitempty"`
 	ActiveBranch              string `json:"active_episode_branch_id,omitempty"`
 
+	// Branches/Selector configure multi-branch episodes. While one runs,
+	// its branches are in ActiveBranches instead of ActiveBranch.
+	Branches       int      `json:"branches,omitempty"`
+	Selector       string   `json:"selector,omitempty"`
+	ActiveBranches []string `json:"active_episode_branch_ids,omitempty"`
+
+	// Gates are checked before an episode branch is promoted.
+	Gates []string `json:"gates,omitempty"`
+
+	// TaskQueue lists the tasks to work on; Tasks records their progress
+	// and CurrentTask the one in progress.
+	TaskQueue   string         `json:"task_queue,omitempty"`
+	CurrentTask string         `json:"current_task,omitempty"`
+	Tasks       []TaskProgress `json:"tasks,omitempty"`
+
+	// ActiveSince is when the active episode's branches were started.
+	ActiveSince string `json:"active_since,omitempty"`
+
+	// FailurePolicy decides what happens after an episode without a winner.
+	FailurePolicy []string `json:"failure_policy,omitempty"`
+
+	// AnchorHistory lists every anchor in order; it is only appended to.
+	AnchorHistory []AnchorRecord `json:"anchor_history,omitempty"`
+
+	// TaskTemplate and PromptVars turn on task templates and hold their
+	// variables, and LastFailure is why the previous attempt produced no
+	// winner.
+	TaskTemplate bool              `json:"task_template,omitempty"`
+	PromptVars   map[string]string `json:"prompt_vars,omitempty"`
+	LastFailure  string            `json:"last_failure,omitempty"`
+
+	// TaskFromControl marks a Task set through the control API; its
+	// template may not include files.
+	TaskFromControl bool `json:"task_from_control,omitempty"`
+
+	// TaskPrompt/TaskPromptArgs select a server-defined episode prompt.
+	TaskPrompt     string            `json:"task_prompt,omitempty"`
+	TaskPromptArgs map[string]string `json:"task_prompt_args,omitempty"`
+
+	// MCPTransport holds TLS/proxy/pool settings (file paths, no secrets).
+	MCPTransport *TransportConfig `json:"mcp_transport,omitempty"`
+
+	// PausedUntil/PauseReason are set while the controller waits out an
+	// unavailable Pantheon (RFC 3339, UTC).
+	PausedUntil string `json:"paused_until,omitempty"`
+	PauseReason string `json:"pause_reason,omitempty"`
+
 	// Backward compat for older state files. Do not write it back out.
 	RPCURL string `json:"rpc_url,omitempty"`
 }
@@ -73,23 +223,46 @@ type ControllerState struct {
 func RunController(ctx context.Context, cfg ControllerConfig) error {
 	sleepFn := time.Sleep
 	if ctx != nil {
-		sleepFn = func(d time.Duration) {
-			t := time.NewTimer(d)
-			defer t.Stop()
-			select {
-			case <-t.C:
-			case <-ctx.Done():
-			}
+		sleepFn = func(d time.Duration) { _ = sleepContext(ctx, d) }
+		if cfg.Control != nil {
+			// Resume and stop requests end waits early.
+			sleepFn = func(d time.Duration) { cfg.Control.sleep(ctx, d) }
 		}
 	}
 	return runControllerWithClient(ctx, cfg, nil, sleepFn)
 }
 
-func runControllerWithClient(ctx context.Context, cfg ControllerConfig, client agentClient, sleepFn func(time.Duration)) error {
+// toolVerifier is implemented by clients that can check the server's tool
+// schemas up front (MCPClient does; test stubs do not).
+type toolVerifier interface {
+	VerifyTools(ctx context.Context) error
+}
+
+// outputStreamer is implemented by clients that can read a branch's output
+// in pages instead of one response (MCPClient does).
+type outputStreamer interface {
+	BranchOutputReader(ctx context.Context, branchID string) (io.ReadCloser, error)
+}
+
+// promptGetter is implemented by clients that can render server-defined
+// prompt templates (MCPClient does).
+type promptGetter interface {
+	GetPrompt(ctx context.Context, name string, arguments map[string]string) (PromptResult, error)
+}
+
+func runControllerWithClient(ctx context.Context, cfg ControllerConfig, client agentClient, sleepFn func(time.Duration)) (runErr error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	statePath := strings.TrimSpace(cfg.StatePath)
 	if statePath == "" {
 		statePath = defaultControllerStatePath()
 	}
+	lock, err := lockState(statePath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
 
 	state, err := loadControllerState(statePath)
 	if err != nil {
@@ -98,26 +271,73 @@ func runControllerWithClient(ctx context.Context, cfg ControllerConfig, client a
 
 	applyControllerOverrides(&state, cfg)
 	normalizeControllerDefaults(&state)
+	warnUntemplated(state, "The task", state.Task)
 
+	var mcpStats *MemoryMetrics
 	if client == nil {
-		client = NewMCPClient(state.MCPBaseURL)
-	}
-
-	if cfg.Rebootstrap && strings.TrimSpace(state.ActiveBranch) != "" {
-		activeBranch := strings.TrimSpace(state.ActiveBranch)
-		running, status, err := isBranchRunning(client, activeBranch)
+		var recorder *Recorder
+		if path := strings.TrimSpace(cfg.MCPRecordPath); path != "" {
+			if recorder, err = CreateCassette(path); err != nil {
+				return fmt.Errorf("create MCP cassette: %w", err)
+			}
+			defer recorder.Close()
+			logx.Infof("Recording MCP traffic to %s.", path)
+		}
+		limiter, toolLimiters := mcpRateLimiters(cfg)
+		mcpStats = NewMemoryMetrics()
+		var metrics MCPMetrics = mcpStats
+		if cfg.MCPMetrics != nil {
+			metrics = teeMetrics{mcpStats, cfg.MCPMetrics}
+		}
+		mcp, err := NewMCPClientWithConfig(MCPClientConfig{
+			BaseURL:          state.MCPBaseURL,
+			CircuitBreaker:   NewCircuitBreaker(defaultBreakerThreshold, defaultBreakerCooldown),
+			Headers:          cfg.MCPHeaders,
+			TokenSource:      cfg.MCPTokenSource,
+			Transport:        state.transportConfig(),
+			Recorder:         recorder,
+			RateLimiter:      limiter,
+			ToolRateLimiters: toolLimiters,
+			Metrics:          metrics,
+			Tracer:           cfg.MCPTracer,
+		})
 		if err != nil {
-			return fmt.Errorf("check active episode branch %s before rebootstrap: %w", activeBranch, err)
+			return err
 		}
-		if running {
-			msg := fmt.Sprintf("cannot rebootstrap with an active episode branch still running (active_episode_branch_id=%s)", activeBranch)
-			if status != "" {
-				msg = fmt.Sprintf("%s (status=%s)", msg, status)
+		defer mcp.Close()
+		mcp.OnProgress((&progressLogger{interval: time.Minute}).log)
+		mcp.OnProgress(cfg.OnProgress)
+		listenCtx, stopListen := context.WithCancel(ctx)
+		defer stopListen()
+		go func() {
+			if err := mcp.Listen(listenCtx); err != nil && !errors.Is(err, context.Canceled) {
+				logx.Debugf("MCP listen stream stopped: %v", err)
+			}
+		}()
+		client = mcp
+	}
+	if v, ok := client.(toolVerifier); ok {
+		if err := v.VerifyTools(ctx); err != nil {
+			return fmt.Errorf("verify pantheon tools at %s: %w", state.MCPBaseURL, err)
+		}
+	}
+
+	if cfg.Rebootstrap && len(state.ActiveBranchIDs()) > 0 {
+		for _, activeBranch := range state.ActiveBranchIDs() {
+			running, status, err := isBranchRunning(ctx, client, activeBranch)
+			if err != nil {
+				return fmt.Errorf("check active episode branch %s before rebootstrap: %w", activeBranch, err)
 			}
-			return fmt.Errorf("%s", msg)
+			if running {
+				msg := fmt.Sprintf("cannot rebootstrap with an active episode branch still running (active_episode_branch_id=%s)", activeBranch)
+				if status != "" {
+					msg = fmt.Sprintf("%s (status=%s)", msg, status)
+				}
+				return fmt.Errorf("%s", msg)
+			}
+			logx.Infof("Clearing stopped active_episode_branch_id=%s before rebootstrap (status=%s).", activeBranch, status)
 		}
-		logx.Infof("Clearing stopped active_episode_branch_id=%s before rebootstrap (status=%s).", activeBranch, status)
-		state.ActiveBranch = ""
+		state.setActiveBranches(nil)
 	}
 	bootstrapNeeded := cfg.Rebootstrap || !state.Initialized
 
@@ -130,17 +350,105 @@ func runControllerWithClient(ctx context.Context, cfg ControllerConfig, client a
 		}
 		state.AnchorBranch = strings.TrimSpace(cfg.ParentBranchID)
 	}
+	if len(state.AnchorHistory) == 0 {
+		reason := AnchorParent
+		if state.Initialized {
+			reason = AnchorInitial
+		}
+		state.recordAnchor(AnchorRecord{BranchID: state.AnchorBranch, Reason: reason})
+	}
 
 	if err := saveControllerState(statePath, state); err != nil {
 		return err
 	}
 
 	maxEpisodes := cfg.MaxEpisodes
+	pollInterval := cfg.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultPollIntervalSeconds * time.Second
+	}
 	episode := 0
-	consecutiveFailed := 0
+	// Episodes without a winner in a row, per kind of failure.
+	consecutiveFailed := map[string]int{}
 
-	handler := &ToolHandler{client: client}
+	// The run's status, for cfg.Control.
+	control := cfg.Control
+	attempts := 0
+	var lastError, lastErrorAt string
+	setLastError := func(err error) {
+		if err != nil {
+			lastError, lastErrorAt = err.Error(), time.Now().UTC().Format(time.RFC3339)
+		}
+	}
+	publish := func(phase string) {
+		control.publish(ControlStatus{
+			Phase:               phase,
+			Episodes:            episode,
+			Attempts:            attempts,
+			ConsecutiveFailures: consecutiveFailed,
+			LastError:           lastError,
+			LastErrorAt:         lastErrorAt,
+		}, state)
+	}
+	defer func() {
+		setLastError(runErr)
+		publish(PhaseExited)
+	}()
+	// pauseForOpen is pauseForOpenCircuit reporting the pause.
+	pauseForOpen := func(err error) bool {
+		return pauseForOpenCircuit(err, statePath, &state, func(d time.Duration) {
+			setLastError(err)
+			publish(PhasePaused)
+			sleepFn(d)
+		})
+	}
 
+	polls := map[string]int{}
+	handler := &ToolHandler{client: client, onPoll: func(branchID string) { polls[branchID]++ }}
+	ledger := openLedger(cfg.LedgerPath, statePath)
+	selector := cfg.CustomSelector
+	if selector == nil {
+		if selector, err = ParseSelector(state.Selector); err != nil {
+			return err
+		}
+	}
+	var gates []Gate
+	for _, spec := range state.Gates {
+		g, err := ParseGate(spec)
+		if err != nil {
+			return err
+		}
+		gates = append(gates, g)
+	}
+	gates = append(gates, cfg.CustomGates...)
+	policy, err := ParseFailurePolicy(state.FailurePolicy)
+	if err != nil {
+		return err
+	}
+	pollArgs := func(branchID string) map[string]any {
+		return map[string]any{
+			"branch_id":                 branchID,
+			"timeout_seconds":           float64(defaultPollTimeoutSeconds),
+			"poll_interval_seconds":     pollInterval.Seconds(),
+			"max_poll_interval_seconds": float64(defaultMaxPollIntervalSeconds),
+		}
+	}
+	gateInput := func(branchID, output string) GateInput {
+		return GateInput{
+			BranchID: branchID,
+			Output:   output,
+			ReadFile: func(ctx context.Context, path string) (string, error) {
+				return readBranchFile(ctx, client, branchID, path)
+			},
+			RunAgent: func(ctx context.Context, agent, prompt string) (string, error) {
+				return runSideAgent(ctx, client, handler, state, pollArgs, branchID, agent, prompt)
+			},
+		}
+	}
+
+	// goodQueue is the last task queue that could be read.
+	var goodQueue []QueuedTask
+	haveQueue := false
 	for {
 		if bootstrapNeeded {
 			logx.Infof("Bootstrap required (anchor=%s). Running bootstrap episode.", state.AnchorBranch)
@@ -149,123 +457,738 @@ func runControllerWithClient(ctx context.Context, cfg ControllerConfig, client a
 			logx.Infof("Reached max_episodes=%d. Exiting.", maxEpisodes)
 			return nil
 		}
-		if ctx != nil && ctx.Err() != nil {
+		// Control requests apply between episodes, never to running branches.
+		idle := len(state.ActiveBranchIDs()) == 0
+		if idle && control.pauseRequested() {
+			logx.Infof("Paused by the control API.")
+			publish(PhasePaused)
+			control.waitWhilePaused(ctx)
+		}
+		if ctx.Err() != nil {
 			logx.Infof("Stop requested. Exiting after current episode.")
 			return nil
 		}
+		if idle && control.stopRequested() {
+			logx.Infof("Stop requested by the control API. Exiting.")
+			return nil
+		}
+		if task, ok := control.takeTask(); ok {
+			logx.Infof("Task replaced by the control API.")
+			state.Task = task
+			state.TaskFromControl = true
+			if err := saveControllerState(statePath, state); err != nil {
+				return err
+			}
+		}
+		publish(PhaseRunning)
+
+		branchIDs := state.ActiveBranchIDs()
+		var task QueuedTask
+		if state.TaskQueue != "" && !bootstrapNeeded {
+			queue, err := LoadTaskQueue(state.TaskQueue)
+			switch {
+			case err == nil:
+				goodQueue, haveQueue = queue, true
+			case !haveQueue:
+				return err
+			default:
+				// Operators edit the queue while the controller runs; a
+				// half-written line must not stop it.
+				logx.Warningf("Re-read the task queue: %v. Keeping the last readable queue.", err)
+				queue = goodQueue
+			}
+			if len(branchIDs) > 0 {
+				// Finish the running episode even if its task was dequeued.
+				task = findTask(queue, state.CurrentTask)
+			} else {
+				next, ok := nextTask(&state, queue)
+				if !ok {
+					_ = saveControllerState(statePath, state)
+					if !cfg.TaskQueueWait {
+						logx.Infof("Task queue %s is drained. Exiting.", state.TaskQueue)
+						return nil
+					}
+					logx.Infof("Task queue %s is drained; waiting for new tasks.", state.TaskQueue)
+					publish(PhaseWaiting)
+					sleepFn(pollInterval)
+					continue
+				}
+				if state.CurrentTask != next.ID {
+					state.startTask(next)
+					logx.Infof("Starting task %s.", next.ID)
+					warnUntemplated(state, "Task "+next.ID, next.Prompt)
+					if err := saveControllerState(statePath, state); err != nil {
+						return err
+					}
+				}
+				task = next
+			}
+		}
+		// promptState is the state episode prompts are built from: the
+		// current task's prompt replaces the fixed one.
+		promptState := state
+		if task.Prompt != "" {
+			promptState.Task = task.Prompt
+			promptState.TaskFromControl = false
+		}
 
-		branchID := strings.TrimSpace(state.ActiveBranch)
-		if branchID == "" {
-			var prompt string
+		var prompt string
+		if len(branchIDs) == 0 {
 			if bootstrapNeeded {
 				prompt = buildBootstrapPrompt(state)
 			} else {
-				prompt, err = buildEpisodePrompt(state)
+				prompt, err = episodePrompt(ctx, client, promptState)
 				if err != nil {
+					if ctx.Err() != nil {
+						logx.Infof("Stop requested while fetching the episode prompt. Exiting.")
+						return nil
+					}
+					if pauseForOpen(err) {
+						continue
+					}
 					return err
 				}
 			}
 
-			resp, err := client.ParallelExplore(state.ProjectName, state.AnchorBranch, []string{prompt}, state.Agent, 1)
+			// The bootstrap episode only ever needs one branch.
+			numBranches := 1
+			if !bootstrapNeeded && state.Branches > 1 {
+				numBranches = state.Branches
+			}
+			resp, err := client.ParallelExploreContext(ctx, state.ProjectName, state.AnchorBranch, []string{prompt}, state.Agent, numBranches)
 			if err != nil {
+				if ctx.Err() != nil {
+					logx.Infof("Stop requested while starting an episode. Exiting.")
+					return nil
+				}
+				if pauseForOpen(err) {
+					continue
+				}
 				return fmt.Errorf("parallel_explore failed: %w", err)
 			}
-			if isErr, ok := resp["isError"].(bool); ok && isErr {
-				return fmt.Errorf("parallel_explore returned error: %v", resp["error"])
+			explore, err := DecodeExploreResult(resp, DecodeLenient)
+			if err != nil {
+				return fmt.Errorf("parallel_explore returned error: %w", err)
 			}
-			branchID = strings.TrimSpace(ExtractBranchID(resp))
-			if branchID == "" {
+			if explore.BranchID() == "" {
 				return fmt.Errorf("missing branch id in parallel_explore response: %v", resp)
 			}
-			state.ActiveBranch = branchID
+			branchIDs = []string{explore.BranchID()}
+			if numBranches > 1 {
+				branchIDs = explore.BranchIDs
+				if len(branchIDs) > numBranches {
+					branchIDs = branchIDs[:numBranches]
+				}
+				if len(branchIDs) < numBranches {
+					logx.Warningf("parallel_explore started %d of %d branches: %s", len(branchIDs), numBranches, strings.Join(branchIDs, ", "))
+				}
+			}
+			state.setActiveBranches(branchIDs)
 			if err := saveControllerState(statePath, state); err != nil {
 				return err
 			}
 		}
 
-		// Poll to terminal status.
-		_, err := handler.checkStatus(map[string]any{
-			"branch_id":                 branchID,
-			"timeout_seconds":           float64(defaultPollTimeoutSeconds),
-			"poll_interval_seconds":     float64(defaultPollIntervalSeconds),
-			"max_poll_interval_seconds": float64(defaultMaxPollIntervalSeconds),
-		})
-		if err != nil {
-			if isTerminalFailed(err) {
-				// Terminal failure: clear active branch (this episode is done), then retry with backoff.
-				state.ActiveBranch = ""
+		// Poll every branch to terminal status. They run concurrently on
+		// Pantheon, so waiting for them in turn costs no extra time.
+		publish(PhaseExploring)
+		candidates := make([]Candidate, 0, len(branchIDs))
+		var failedErr, waitErr error
+		for _, branchID := range branchIDs {
+			waitCtx, waitDone := control.waitContext(ctx, branchID)
+			branch, err := handler.waitForBranch(waitCtx, pollArgs(branchID))
+			waitDone()
+			if err != nil && ctx.Err() == nil && control.skipped(branchID) {
+				logx.Warningf("Episode branch %s skipped by the control API; it keeps running on Pantheon.", branchID)
+				candidates = append(candidates, Candidate{BranchID: branchID, Status: "skipped", Err: fmt.Errorf("branch %s: %w", branchID, ErrBranchSkipped)})
+				continue
+			}
+			if err != nil && isTerminalFailed(err) {
+				logx.Errorf("Episode branch %s failed.", branchID)
+				candidates = append(candidates, Candidate{BranchID: branchID, Status: "failed", Err: err})
+				failedErr = err
+				continue
+			}
+			if err != nil && isTerminalTimeout(err) {
+				logx.Errorf("Episode branch %s timed out.", branchID)
+				candidates = append(candidates, Candidate{BranchID: branchID, Status: "timeout", Err: err})
+				failedErr = err
+				continue
+			}
+			if err != nil {
+				waitErr = err
+				break
+			}
+			candidates = append(candidates, Candidate{BranchID: branchID, Status: branch.Status})
+		}
+		if waitErr != nil {
+			if ctx.Err() != nil {
+				// Shutdown while polling: keep active branches so the next run resumes them.
 				_ = saveControllerState(statePath, state)
-
-				consecutiveFailed++
-				logx.Errorf("Episode branch %s failed (attempt %d/3).", branchID, consecutiveFailed)
-
-				if ctx != nil && ctx.Err() != nil {
-					return nil
-				}
-
-				sleepFn(20 * time.Minute)
-				if consecutiveFailed >= 3 {
-					return err
-				}
+				logx.Infof("Stop requested while waiting for branches %s. They stay active for resume.", strings.Join(branchIDs, ", "))
+				return nil
+			}
+			if pauseForOpen(waitErr) {
 				continue
 			}
-
-			// Unknown/non-terminal error: keep active branch for resume.
+			// Unknown/non-terminal error: keep active branches for resume.
 			_ = saveControllerState(statePath, state)
-			return err
+			return waitErr
 		}
+		publish(PhaseRunning)
 
-		// Fetch output; MVP success = we can read branch_output(full=true).
-		outResp, outErr := client.BranchOutput(branchID, true)
+		// Fetch outputs; MVP success = we can read branch_output(full=true).
+		// Full outputs go to the ledger; candidates keep their tails.
+		var outErr error
+		outputs := map[string]fetchedOutput{}
+		for i := range candidates {
+			c := &candidates[i]
+			if !c.Succeeded() {
+				continue
+			}
+			output, err := fetchBranchOutput(ctx, client, ledger, c.BranchID)
+			if err != nil {
+				outErr = err
+				break
+			}
+			if output.blank {
+				logx.Errorf("Episode branch %s finished without output.", c.BranchID)
+				c.Status = "empty_output"
+				c.Err = fmt.Errorf("branch_output for %s: %w", c.BranchID, ErrEmptyOutput)
+				failedErr = c.Err
+				continue
+			}
+			c.Output = output.tail
+			outputs[c.BranchID] = output.fetchedOutput
+		}
 		if outErr != nil {
-			// Do not clear active branch; allow resume to retry branch_output later.
+			// Do not clear active branches; allow resume to retry branch_output later.
 			_ = saveControllerState(statePath, state)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if pauseForOpen(outErr) {
+				continue
+			}
 			return outErr
 		}
+		// Gate the branches that finished; one that fails a gate cannot
+		// become the anchor.
+		var gateErr error
+		for i := range candidates {
+			c := &candidates[i]
+			if !c.Succeeded() || bootstrapNeeded {
+				continue
+			}
+			err := checkGates(ctx, gates, gateInput(c.BranchID, c.Output))
+			var gateFailed *GateError
+			if errors.As(err, &gateFailed) {
+				logx.Warningf("Episode branch %s is not promoted: %v", c.BranchID, err)
+				c.Status = "gate_failed"
+				c.Err = err
+				failedErr = err
+				continue
+			}
+			if err != nil {
+				gateErr = err
+				break
+			}
+		}
+		if gateErr != nil {
+			// Keep active branches; the gates are checked again on resume.
+			_ = saveControllerState(statePath, state)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if pauseForOpen(gateErr) {
+				continue
+			}
+			return fmt.Errorf("check gates: %w", gateErr)
+		}
 
-		outputText := ""
-		if out, ok := outResp["output"].(string); ok {
-			outputText = strings.TrimSpace(out)
+		if prompt == "" {
+			// A resumed episode has not built its prompt; selectors and the
+			// anchor history want it.
+			if bootstrapNeeded {
+				prompt = buildBootstrapPrompt(state)
+			} else {
+				if prompt, err = episodePrompt(ctx, client, promptState); err != nil {
+					logx.Warningf("Rebuild the prompt of the resumed episode: %v", err)
+				}
+			}
 		}
-		if outputText == "" {
+		// entry records the attempt in the ledger once it ends.
+		entry := LedgerRecord{
+			Bootstrap:    bootstrapNeeded,
+			Task:         state.CurrentTask,
+			ParentBranch: state.AnchorBranch,
+			PromptHash:   promptHash(prompt),
+		}
+		if !bootstrapNeeded {
+			entry.Episode = state.nextEpisode()
+		}
+		startedAt, err := time.Parse(time.RFC3339, state.ActiveSince)
+		if err != nil {
+			startedAt = time.Now()
+		}
+		writeLedger := func(status string) {
+			attempts++
+			entry.Status = status
+			entry.Branches = ledgerBranches(candidates, polls, outputs)
+			entry.finish(startedAt)
+			if err := ledger.Append(entry); err != nil {
+				logx.Warningf("Write episode ledger: %v", err)
+			}
+		}
+
+		winner, selErr := selectWinner(ctx, selector, candidates, Selection{
+			Anchor: state.AnchorBranch,
+			Prompt: prompt,
+			RunAgent: func(ctx context.Context, agent, prompt string) (string, error) {
+				return runSideAgent(ctx, client, handler, state, pollArgs, state.AnchorBranch, agent, prompt)
+			},
+		})
+		if selErr != nil && !errors.Is(selErr, ErrNoWinner) {
 			_ = saveControllerState(statePath, state)
-			return fmt.Errorf("branch_output empty for %s", branchID)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if pauseForOpen(selErr) {
+				continue
+			}
+			return fmt.Errorf("select winner among %s: %w", strings.Join(branchIDs, ", "), selErr)
 		}
+		if winner == "" && allSkipped(candidates) {
+			writeLedger(LedgerSkipped)
+			state.setActiveBranches(nil)
+			if err := saveControllerState(statePath, state); err != nil {
+				return err
+			}
+			logx.Warningf("Episode branches %s were skipped; starting a new episode from %s.", strings.Join(branchIDs, ", "), state.AnchorBranch)
+			continue
+		}
+		if winner == "" {
+			if failedErr == nil {
+				failedErr = selErr
+			}
+			setLastError(failedErr)
+			kind := episodeFailureKind(candidates)
+			rule := policy.Rule(kind)
+			entry.FailureKind = kind
+			if failedErr != nil {
+				entry.Error = failedErr.Error()
+			}
+			if rule.Action == FailureExit {
+				writeLedger(LedgerStopped)
+				// Keep active branches; the next run checks them again.
+				if rule.ClearOnExit {
+					state.setActiveBranches(timedOutBranches(candidates))
+				}
+				if failedErr != nil {
+					state.LastFailure = failedErr.Error()
+				}
+				_ = saveControllerState(statePath, state)
+				logx.Errorf("Episode branches %s produced no winner (%s). Exiting.", strings.Join(branchIDs, ", "), kind)
+				return failedErr
+			}
+
+			// Terminal failure: clear active branches (this episode is done), then retry with backoff.
+			writeLedger(LedgerNoWinner)
+			state.setActiveBranches(nil)
+			if failedErr != nil {
+				state.LastFailure = failedErr.Error()
+			}
+			consecutiveFailed[kind]++
+			attempt := consecutiveFailed[kind]
+			logx.Errorf("Episode branches %s produced no winner (%s, attempt %d/%d).", strings.Join(branchIDs, ", "), kind, attempt, rule.MaxConsecutive)
+			if rule.Action == FailureRollback && !bootstrapNeeded {
+				rollbackAfterFailure(&state)
+				bootstrapNeeded = !state.Initialized
+			}
+			_ = saveControllerState(statePath, state)
 
-		// Promote anchor (no extra success gate in MVP).
-		state.AnchorBranch = branchID
-		state.ActiveBranch = ""
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			exhausted := attempt >= rule.MaxConsecutive
+			if !exhausted || !rule.SkipFinalBackoff {
+				publish(PhaseBackoff)
+				sleepFn(rule.backoff(attempt))
+			}
+			if exhausted {
+				if rule.OnExhausted != ExhaustedPause {
+					return failedErr
+				}
+				pauseAfterFailures(statePath, &state, kind, rule, func(d time.Duration) {
+					publish(PhasePaused)
+					sleepFn(d)
+				})
+				consecutiveFailed[kind] = 0
+			}
+			continue
+		}
+		if len(branchIDs) > 1 {
+			logx.Infof("Selected branch %s of %s.", winner, strings.Join(branchIDs, ", "))
+		}
+
+		// Promote anchor.
+		entry.Winner = winner
+		writeLedger(LedgerPromoted)
+		rec := AnchorRecord{BranchID: winner, Reason: AnchorEpisode, PromptHash: promptHash(prompt), Task: state.CurrentTask}
+		var winnerOutput string
+		for _, c := range candidates {
+			if c.BranchID == winner {
+				winnerOutput = c.Output
+				rec.OutputExcerpt = outputExcerpt(c.Output)
+			}
+		}
+		if bootstrapNeeded {
+			rec.Reason = AnchorBootstrap
+		} else {
+			rec.Episode = state.nextEpisode()
+		}
+		state.recordAnchor(rec)
+		state.AnchorBranch = winner
+		state.setActiveBranches(nil)
+		state.LastFailure = ""
 		if bootstrapNeeded {
 			state.Initialized = true
-			state.BootstrapBranch = branchID
+			state.BootstrapBranch = winner
+		} else if progress := state.taskProgress(state.CurrentTask); progress != nil {
+			progress.Episodes++
+			progress.LastAnchor = winner
+			status := TaskRemoved // dequeued while the episode ran
+			if task.ID != "" {
+				status = taskStatusAfterEpisode(ctx, task, *progress, gateInput(winner, winnerOutput))
+			}
+			if status != TaskRunning {
+				logx.Infof("Task %s finished after %d episode(s): %s.", state.CurrentTask, progress.Episodes, status)
+				state.finishTask(status)
+			}
 		}
 		if err := saveControllerState(statePath, state); err != nil {
 			return err
 		}
 
-		consecutiveFailed = 0
+		clear(consecutiveFailed)
 		if bootstrapNeeded {
 			bootstrapNeeded = false
 			logx.Infof("Bootstrap completed. anchor_branch_id=%s", state.AnchorBranch)
+			logMCPStats("Bootstrap", mcpStats)
 			continue
 		}
 
 		episode++
 		logx.Infof("Episode %d completed. anchor_branch_id=%s", episode, state.AnchorBranch)
+		logMCPStats(fmt.Sprintf("Episode %d", episode), mcpStats)
 	}
 }
 
-func buildEpisodePrompt(state ControllerState) (string, error) {
-	task := strings.TrimSpace(state.Task)
-	if task == "" {
-		return "", fmt.Errorf("task is required (pass --task, or keep it in the state file)")
+// selectWinner returns the branch to promote, or "" with ErrNoWinner when
+// none succeeded. The selector is only consulted when there is a choice.
+func selectWinner(ctx context.Context, selector Selector, candidates []Candidate, sel Selection) (string, error) {
+	var succeeded []Candidate
+	for _, c := range candidates {
+		if c.Succeeded() {
+			succeeded = append(succeeded, c)
+		}
+	}
+	switch len(succeeded) {
+	case 0:
+		return "", ErrNoWinner
+	case 1:
+		return succeeded[0].BranchID, nil
 	}
+	sel.Candidates = candidates
+	winner, err := selector.Select(ctx, sel)
+	if err != nil {
+		return "", err
+	}
+	return winner, nil
+}
 
-	var prefix []string
-	if len(prefix) == 0 {
-		return task, nil
+// runSideAgent runs an agent that is not part of the episode (a judge or a
+// verifier) on a new branch from parent, waits for it and returns its
+// output.
+func runSideAgent(ctx context.Context, client agentClient, handler *ToolHandler, state ControllerState, pollArgs func(string) map[string]any, parent, agent, prompt string) (string, error) {
+	if strings.TrimSpace(agent) == "" {
+		agent = state.Agent
 	}
-	return strings.Join(prefix, "\n") + "\n\n" + task, nil
+	resp, err := client.ParallelExploreContext(ctx, state.ProjectName, parent, []string{prompt}, agent, 1)
+	if err != nil {
+		return "", fmt.Errorf("parallel_explore failed: %w", err)
+	}
+	explore, err := DecodeExploreResult(resp, DecodeStrict)
+	if err != nil {
+		return "", err
+	}
+	branchID := explore.BranchID()
+	logx.Infof("Running %s on branch %s (from %s).", agent, branchID, parent)
+	if _, err := handler.waitForBranch(ctx, pollArgs(branchID)); err != nil {
+		return "", err
+	}
+	out, err := fetchBranchOutput(ctx, client, nil, branchID)
+	if err != nil {
+		return "", err
+	}
+	return out.tail, nil
+}
+
+// maxHeldOutput is how much of a branch's output, counted from the end, the
+// controller keeps in memory for gates, selectors and the anchor excerpt.
+// The full output is streamed to the ledger instead.
+const maxHeldOutput = 1 << 20
+
+// fetchedOutput records where a branch's full output was saved and its size.
+type fetchedOutput struct {
+	Path  string
+	Bytes int64
+}
+
+// heldOutput is a fetched branch output as the controller keeps it.
+type heldOutput struct {
+	fetchedOutput
+	// tail is the last maxHeldOutput bytes, cut on a rune boundary.
+	tail string
+	// blank is true if the output is empty or only whitespace.
+	blank bool
+}
+
+// fetchBranchOutput reads a branch's full output, page by page when the
+// client can, copying it to the ledger's output file as it arrives. A
+// failure to save is logged; a failure to fetch is returned.
+func fetchBranchOutput(ctx context.Context, client agentClient, ledger *Ledger, branchID string) (heldOutput, error) {
+	src, err := openBranchOutput(ctx, client, branchID)
+	if err != nil {
+		return heldOutput{}, err
+	}
+	defer src.Close()
+	in := &outputSource{r: src}
+	tail := &tailWriter{max: maxHeldOutput}
+	r := io.TeeReader(in, tail)
+	path, saveErr := ledger.SaveOutput(branchID, r)
+	if in.err == nil {
+		// Without a ledger, or after a failed save, read the rest here.
+		_, _ = io.Copy(io.Discard, r)
+	}
+	if in.err != nil {
+		return heldOutput{}, in.err
+	}
+	if saveErr != nil {
+		logx.Warningf("Save output of %s: %v", branchID, saveErr)
+	}
+	out := heldOutput{fetchedOutput: fetchedOutput{Path: path, Bytes: in.n}, tail: tail.String(), blank: !tail.nonSpace}
+	if out.blank && path != "" {
+		_ = os.Remove(path)
+		out.Path = ""
+	}
+	return out, nil
+}
+
+func openBranchOutput(ctx context.Context, client agentClient, branchID string) (io.ReadCloser, error) {
+	if s, ok := client.(outputStreamer); ok {
+		return s.BranchOutputReader(ctx, branchID)
+	}
+	resp, err := client.BranchOutputContext(ctx, branchID, true)
+	if err != nil {
+		return nil, err
+	}
+	out, err := DecodeBranchOutput(resp, DecodeLenient)
+	if err != nil {
+		return nil, fmt.Errorf("branch_output for %s: %w", branchID, err)
+	}
+	return io.NopCloser(strings.NewReader(out.Output)), nil
+}
+
+// outputSource counts the bytes read through it and keeps the first read
+// error other than EOF, telling a failed fetch from a failed save.
+type outputSource struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (s *outputSource) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	if err != nil && err != io.EOF && s.err == nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// tailWriter keeps the last max bytes written to it.
+type tailWriter struct {
+	max      int
+	buf      []byte
+	cut      bool // bytes before buf were dropped
+	nonSpace bool
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	if !w.nonSpace && len(bytes.TrimSpace(p)) > 0 {
+		w.nonSpace = true
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > 2*w.max {
+		w.buf = append(w.buf[:0], w.buf[len(w.buf)-w.max:]...)
+		w.cut = true
+	}
+	return len(p), nil
+}
+
+// String returns the tail, dropping a rune cut in half at its start.
+func (w *tailWriter) String() string {
+	b, cut := w.buf, w.cut
+	if len(b) > w.max {
+		b, cut = b[len(b)-w.max:], true
+	}
+	for i := 0; cut && i < utf8.UTFMax && len(b) > 0 && !utf8.RuneStart(b[0]); i++ {
+		b = b[1:]
+	}
+	return string(b)
+}
+
+// readBranchFile returns the content of a file in a branch snapshot.
+func readBranchFile(ctx context.Context, client agentClient, branchID, path string) (string, error) {
+	resp, err := client.BranchReadFileContext(ctx, branchID, path)
+	if err != nil {
+		return "", err
+	}
+	file, err := DecodeFileContent(resp, DecodeLenient)
+	if err != nil {
+		return "", err
+	}
+	return file.Content, nil
+}
+
+// logMCPStats logs the MCP traffic since the last call, so a slow episode
+// can be told apart from slow Pantheon calls. stats is nil when the caller
+// supplied its own client.
+func logMCPStats(label string, stats *MemoryMetrics) {
+	if stats == nil {
+		return
+	}
+	logx.Infof("%s MCP traffic: %s", label, stats.Snapshot().Summary())
+	stats.Reset()
+}
+
+// pauseForOpenCircuit handles errors caused by an open Pantheon circuit
+// breaker: it records the pause in the state file, sleeps until the breaker
+// allows a probe, and reports true so the caller retries the step. The active
+// branch is left untouched, so a paused episode resumes where it was.
+func pauseForOpenCircuit(err error, statePath string, state *ControllerState, sleepFn func(time.Duration)) bool {
+	var open CircuitOpenError
+	if !errors.As(err, &open) {
+		return false
+	}
+	wait := time.Until(open.Until)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	state.PausedUntil = open.Until.UTC().Format(time.RFC3339)
+	state.PauseReason = "pantheon unavailable (circuit breaker open)"
+	_ = saveControllerState(statePath, *state)
+	logx.Warningf("Pantheon unavailable; pausing until %s (active episode branches: %s).", state.PausedUntil, strings.Join(state.ActiveBranchIDs(), ", "))
+
+	sleepFn(wait)
+
+	state.PausedUntil = ""
+	state.PauseReason = ""
+	_ = saveControllerState(statePath, *state)
+	return true
+}
+
+// openLedger returns the episode ledger for path ("" = next to the state
+// file), or nil when it is disabled.
+func openLedger(path, statePath string) *Ledger {
+	path = strings.TrimSpace(path)
+	switch path {
+	case "none":
+		return nil
+	case "":
+		path = DefaultLedgerPath(statePath)
+	}
+	return NewLedger(path, filepath.Join(filepath.Dir(path), "outputs"))
+}
+
+// rollbackAfterFailure moves the anchor back one entry of the anchor
+// history, if there is an earlier anchor.
+func rollbackAfterFailure(state *ControllerState) {
+	target, err := rollbackTarget(*state, "", 1)
+	if err != nil {
+		logx.Warningf("Not rolling back after the failed episode: %v. Retrying from anchor %s.", err, state.AnchorBranch)
+		return
+	}
+	logx.Warningf("Rolling anchor back from %s to %s after the failed episode.", state.AnchorBranch, target.BranchID)
+	applyRollback(state, target)
+}
+
+// pauseAfterFailures waits out an exhausted failure rule, recording the
+// pause in the state file like pauseForOpenCircuit.
+func pauseAfterFailures(statePath string, state *ControllerState, kind string, rule FailureRule, sleepFn func(time.Duration)) {
+	state.PausedUntil = time.Now().Add(rule.PauseFor).UTC().Format(time.RFC3339)
+	state.PauseReason = fmt.Sprintf("%d episodes in a row without a winner (%s)", rule.MaxConsecutive, kind)
+	_ = saveControllerState(statePath, *state)
+	logx.Warningf("Failure policy exhausted; pausing until %s.", state.PausedUntil)
+
+	sleepFn(rule.PauseFor)
+
+	state.PausedUntil = ""
+	state.PauseReason = ""
+	_ = saveControllerState(statePath, *state)
+}
+
+// episodePrompt builds the episode prompt: the task, executed as a
+// template (see PromptContext) when task templates are on, after the
+// server-defined task_prompt when one is configured.
+func episodePrompt(ctx context.Context, client agentClient, state ControllerState) (string, error) {
+	task := state.Task
+	if state.TaskTemplate {
+		pc := newPromptContext(ctx, client, state)
+		pc.noInclude = state.TaskFromControl
+		var err error
+		if task, err = renderPrompt(task, pc); err != nil {
+			return "", fmt.Errorf("render task template: %w", err)
+		}
+	}
+	name := strings.TrimSpace(state.TaskPrompt)
+	if name == "" {
+		return buildEpisodePrompt(task)
+	}
+	getter, ok := client.(promptGetter)
+	if !ok {
+		return "", fmt.Errorf("task_prompt %q needs an MCP client that supports prompts", name)
+	}
+	p, err := getter.GetPrompt(ctx, name, state.TaskPromptArgs)
+	if err != nil {
+		return "", fmt.Errorf("fetch task prompt %q: %w", name, err)
+	}
+	text := p.Text()
+	if text == "" {
+		return "", fmt.Errorf("task prompt %q rendered no user text", name)
+	}
+	if task := strings.TrimSpace(task); task != "" {
+		text += "\n\n" + task
+	}
+	return buildEpisodePrompt(text)
+}
+
+// warnUntemplated warns when a task looks like a template but task
+// templates are off, e.g. one saved before templates became opt-in.
+func warnUntemplated(state ControllerState, what, task string) {
+	if !state.TaskTemplate && strings.Contains(task, "{{") {
+		logx.Warningf("%s contains \"{{\" but is sent as written; pass --task-template to execute it as a template.", what)
+	}
+}
+
+func buildEpisodePrompt(task string) (string, error) {
+	task = strings.TrimSpace(task)
+	if task == "" {
+		return "", fmt.Errorf("task is required (pass --task or --task-prompt, or keep it in the state file)")
+	}
+	return task, nil
 }
 
 func buildBootstrapPrompt(state ControllerState) string {
@@ -305,6 +1228,10 @@ func applyControllerOverrides(state *ControllerState, cfg ControllerConfig) {
 	if strings.TrimSpace(cfg.MCPBaseURL) != "" {
 		state.MCPBaseURL = strings.TrimSpace(cfg.MCPBaseURL)
 	}
+	if !cfg.MCPTransport.IsZero() {
+		merged := state.transportConfig().Merge(cfg.MCPTransport)
+		state.MCPTransport = &merged
+	}
 	if strings.TrimSpace(cfg.ProjectName) != "" {
 		state.ProjectName = strings.TrimSpace(cfg.ProjectName)
 	}
@@ -313,6 +1240,44 @@ func applyControllerOverrides(state *ControllerState, cfg ControllerConfig) {
 	}
 	if strings.TrimSpace(cfg.Task) != "" {
 		state.Task = cfg.Task
+		state.TaskFromControl = false
+	}
+	if strings.TrimSpace(cfg.TaskPrompt) != "" {
+		state.TaskPrompt = strings.TrimSpace(cfg.TaskPrompt)
+		state.TaskPromptArgs = cfg.TaskPromptArgs
+	}
+	if cfg.TaskTemplate {
+		state.TaskTemplate = true
+	}
+	if len(cfg.PromptVars) > 0 {
+		state.PromptVars = cfg.PromptVars
+	}
+	if cfg.Branches > 0 {
+		state.Branches = cfg.Branches
+	}
+	if strings.TrimSpace(cfg.Selector) != "" {
+		state.Selector = strings.TrimSpace(cfg.Selector)
+	}
+	if len(cfg.Gates) > 0 {
+		// "none" clears the saved gates.
+		state.Gates = nil
+		for _, spec := range cfg.Gates {
+			if spec = strings.TrimSpace(spec); spec != "" && spec != "none" {
+				state.Gates = append(state.Gates, spec)
+			}
+		}
+	}
+	if strings.TrimSpace(cfg.TaskQueue) != "" {
+		state.TaskQueue = strings.TrimSpace(cfg.TaskQueue)
+	}
+	if len(cfg.FailurePolicy) > 0 {
+		// "default" clears the saved policy.
+		state.FailurePolicy = nil
+		for _, spec := range cfg.FailurePolicy {
+			if spec = strings.TrimSpace(spec); spec != "" && spec != "default" {
+				state.FailurePolicy = append(state.FailurePolicy, spec)
+			}
+		}
 	}
 	if strings.TrimSpace(cfg.AgentsMDURL) != "" {
 		state.AgentsMDURL = strings.TrimSpace(cfg.AgentsMDURL)
@@ -328,6 +1293,42 @@ func applyControllerOverrides(state *ControllerState, cfg ControllerConfig) {
 	}
 }
 
+// ActiveBranchIDs returns the branches of the running episode, if any.
+func (s ControllerState) ActiveBranchIDs() []string {
+	if len(s.ActiveBranches) > 0 {
+		return s.ActiveBranches
+	}
+	if s.ActiveBranch != "" {
+		return []string{s.ActiveBranch}
+	}
+	return nil
+}
+
+// setActiveBranches records the running episode's branches. A single
+// branch is kept in active_episode_branch_id, as before multi-branch
+// episodes existed.
+func (s *ControllerState) setActiveBranches(ids []string) {
+	s.ActiveBranch, s.ActiveBranches = "", nil
+	switch len(ids) {
+	case 0:
+		s.ActiveSince = ""
+	case 1:
+		s.ActiveBranch = ids[0]
+	default:
+		s.ActiveBranches = append([]string(nil), ids...)
+	}
+	if len(ids) > 0 && s.ActiveSince == "" {
+		s.ActiveSince = time.Now().UTC().Format(time.RFC3339)
+	}
+}
+
+func (s ControllerState) transportConfig() TransportConfig {
+	if s.MCPTransport == nil {
+		return TransportConfig{}
+	}
+	return *s.MCPTransport
+}
+
 func normalizeControllerDefaults(state *ControllerState) {
 	if state.MCPBaseURL == "" && strings.TrimSpace(state.RPCURL) != "" {
 		state.MCPBaseURL = strings.TrimSpace(state.RPCURL)
@@ -349,12 +1350,58 @@ func normalizeControllerDefaults(state *ControllerState) {
 	state.BootstrapBranch = strings.TrimSpace(state.BootstrapBranch)
 	state.AnchorBranch = strings.TrimSpace(state.AnchorBranch)
 	state.ActiveBranch = strings.TrimSpace(state.ActiveBranch)
+	state.Selector = strings.TrimSpace(state.Selector)
+	// A pause only lasts for the process that recorded it.
+	state.PausedUntil = ""
+	state.PauseReason = ""
 }
 
 func defaultControllerStatePath() string {
 	return filepath.Join(".", ".agent0", "controller_state.json")
 }
 
+// LoadControllerState reads the state file at path ("" = the default
+// ./.agent0/controller_state.json). A missing file is an empty state.
+func LoadControllerState(path string) (ControllerState, error) {
+	if strings.TrimSpace(path) == "" {
+		path = defaultControllerStatePath()
+	}
+	return loadControllerState(path)
+}
+
+// DefaultLedgerPath is the episode ledger of the state file at statePath
+// when ControllerConfig.LedgerPath is not set.
+func DefaultLedgerPath(statePath string) string {
+	if strings.TrimSpace(statePath) == "" {
+		statePath = defaultControllerStatePath()
+	}
+	return filepath.Join(filepath.Dir(statePath), "ledger.jsonl")
+}
+
+// MCPConnection overrides how a command connects to the Pantheon recorded
+// in a state file. Credentials are never part of the state.
+type MCPConnection struct {
+	BaseURL     string
+	Headers     map[string]string
+	TokenSource TokenSource
+}
+
+// NewMCPClient connects to the state's Pantheon with its saved transport
+// settings.
+func (s ControllerState) NewMCPClient(conn MCPConnection) (*MCPClient, error) {
+	normalizeControllerDefaults(&s)
+	baseURL := s.MCPBaseURL
+	if strings.TrimSpace(conn.BaseURL) != "" {
+		baseURL = strings.TrimSpace(conn.BaseURL)
+	}
+	return NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL:     baseURL,
+		Headers:     conn.Headers,
+		TokenSource: conn.TokenSource,
+		Transport:   s.transportConfig(),
+	})
+}
+
 func loadControllerState(path string) (ControllerState, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -407,41 +1454,49 @@ func isTerminalFailed(err error) bool {
 	return false
 }
 
-func isBranchRunning(client agentClient, branchID string) (bool, string, error) {
-	resp, err := client.GetBranch(branchID)
+// isTerminalTimeout reports whether err is waitForBranch giving up on a
+// branch that did not finish within the poll timeout.
+func isTerminalTimeout(err error) bool {
+	var te ToolExecutionError
+	if !errors.As(err, &te) || te.Instruction != instructionFinishedWithErr {
+		return false
+	}
+	status, _ := te.Details["status"].(string)
+	return status == "timeout"
+}
+
+func isBranchRunning(ctx context.Context, client agentClient, branchID string) (bool, string, error) {
+	resp, err := client.GetBranchContext(ctx, branchID)
+	if IsNotFound(err) {
+		return false, "not_found", nil
+	}
 	if err != nil {
 		return false, "", err
 	}
-	if errMsg, ok := resp["error"]; ok && errMsg != nil {
-		msg := strings.ToLower(fmt.Sprintf("%v", errMsg))
-		if strings.Contains(msg, "404") || strings.Contains(msg, "not found") {
+	branch, err := DecodeBranch(resp, DecodeLenient)
+	if err != nil {
+		if IsNotFound(err) {
 			return false, "not_found", nil
 		}
-		return false, "", fmt.Errorf("GetBranch returned error: %v", errMsg)
+		return false, "", fmt.Errorf("GetBranch returned error: %w", err)
 	}
 
-	status := stringsLower(resp["status"])
-	latestSnapID := stringsLower(resp["latest_snap_id"])
-	parentID := stringsLower(resp["parent_id"])
 	hasNewSnapshot := true
-	if parentID != "" {
-		parentResp, err := client.GetBranch(parentID)
+	if branch.ParentID != "" {
+		parentResp, err := client.GetBranchContext(ctx, branch.ParentID)
 		if err != nil {
 			hasNewSnapshot = false
-		} else if errMsg, ok := parentResp["error"]; ok && errMsg != nil {
+		} else if parent, err := DecodeBranch(parentResp, DecodeLenient); err != nil {
+			hasNewSnapshot = false
+		} else if parent.LatestSnapID != "" && strings.EqualFold(parent.LatestSnapID, branch.LatestSnapID) {
 			hasNewSnapshot = false
-		} else {
-			parentLatestSnapID := stringsLower(parentResp["latest_snap_id"])
-			if parentLatestSnapID != "" && parentLatestSnapID == latestSnapID {
-				hasNewSnapshot = false
-			}
 		}
 	}
 
-	if hasNewSnapshot && isTerminalBranchStatus(status) {
-		return false, status, nil
+	if hasNewSnapshot && branch.IsTerminal() {
+		return false, branch.Status, nil
 	}
-	return true, status, nil
+	return true, branch.Status, nil
 }
 
 func isTerminalBranchStatus(status string) bool {
@@ -452,3 +1507,26 @@ func isTerminalBranchStatus(status string) bool {
 		return false
 	}
 }
+
+// mcpRateLimiters builds the client-wide and per-tool limiters from the
+// configured limits and the defaults.
+func mcpRateLimiters(cfg ControllerConfig) (*Limiter, map[string]*Limiter) {
+	limit := cfg.MCPRateLimit
+	if limit.IsZero() {
+		limit = defaultMCPRateLimit
+	}
+	perTool := map[string]RateLimit{}
+	for name, l := range defaultMCPToolRateLimits {
+		perTool[name] = l
+	}
+	for name, l := range cfg.MCPToolRateLimits {
+		perTool[name] = l
+	}
+	limiters := map[string]*Limiter{}
+	for name, l := range perTool {
+		if lim := NewLimiter(l); lim != nil {
+			limiters[name] = lim
+		}
+	}
+	return NewLimiter(limit), limiters
+}
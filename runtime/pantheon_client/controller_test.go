@@ -3,24 +3,33 @@ package tools
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
+
+	"github.com/IANTHEREAL/agent0/runtime/fakepantheon"
 )
 
 type stubControllerClient struct {
 	parallelExploreCalls int
 	parentBranchIDs      []string
+	prompts              []string
 	branches             []string
 	getBranch            func(branchID string) (map[string]any, error)
 	branchOutput         func(branchID string, fullOutput bool) (map[string]any, error)
 }
 
-func (s *stubControllerClient) ParallelExplore(projectName, parentBranchID string, prompts []string, agent string, numBranches int) (map[string]any, error) {
+func (s *stubControllerClient) ParallelExploreContext(ctx context.Context, projectName, parentBranchID string, prompts []string, agent string, numBranches int) (map[string]any, error) {
 	s.parallelExploreCalls++
 	s.parentBranchIDs = append(s.parentBranchIDs, parentBranchID)
+	s.prompts = append(s.prompts, prompts...)
 	id := ""
 	if len(s.branches) > 0 {
 		id = s.branches[0]
@@ -31,18 +40,18 @@ func (s *stubControllerClient) ParallelExplore(projectName, parentBranchID strin
 	return map[string]any{"branch_id": id}, nil
 }
 
-func (s *stubControllerClient) GetBranch(branchID string) (map[string]any, error) {
+func (s *stubControllerClient) GetBranchContext(ctx context.Context, branchID string) (map[string]any, error) {
 	if s.getBranch != nil {
 		return s.getBranch(branchID)
 	}
 	return map[string]any{"id": branchID, "status": "succeed"}, nil
 }
 
-func (s *stubControllerClient) BranchReadFile(branchID, filePath string) (map[string]any, error) {
+func (s *stubControllerClient) BranchReadFileContext(ctx context.Context, branchID, filePath string) (map[string]any, error) {
 	return map[string]any{"content": ""}, nil
 }
 
-func (s *stubControllerClient) BranchOutput(branchID string, fullOutput bool) (map[string]any, error) {
+func (s *stubControllerClient) BranchOutputContext(ctx context.Context, branchID string, fullOutput bool) (map[string]any, error) {
 	if s.branchOutput != nil {
 		return s.branchOutput(branchID, fullOutput)
 	}
@@ -431,3 +440,1371 @@ func TestControllerRebootstrapClearsStoppedActiveBranch(t *testing.T) {
 		t.Fatalf("expected active cleared, got %q", st.ActiveBranch)
 	}
 }
+
+func TestControllerKeepsActiveBranchWhenStoppedWhilePolling(t *testing.T) {
+	tmp := t.TempDir()
+	statePath := filepath.Join(tmp, "state.json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &stubControllerClient{
+		branches: []string{"branch-1"},
+		getBranch: func(branchID string) (map[string]any, error) {
+			cancel()
+			return map[string]any{"id": branchID, "status": "running"}, nil
+		},
+	}
+
+	cfg := ControllerConfig{
+		ProjectName:    "proj",
+		ParentBranchID: "parent-0",
+		Task:           "do it",
+		StatePath:      statePath,
+	}
+
+	if err := runControllerWithClient(ctx, cfg, client, func(time.Duration) {}); err != nil {
+		t.Fatalf("expected nil error on stop, got %v", err)
+	}
+
+	st, err := loadControllerState(statePath)
+	if err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if st.ActiveBranch != "branch-1" {
+		t.Fatalf("expected active branch kept for resume, got %q", st.ActiveBranch)
+	}
+	if st.AnchorBranch != "parent-0" {
+		t.Fatalf("expected anchor unchanged, got %q", st.AnchorBranch)
+	}
+}
+
+func TestControllerPausesWhileCircuitOpen(t *testing.T) {
+	tmp := t.TempDir()
+	statePath := filepath.Join(tmp, "state.json")
+
+	initial := ControllerState{
+		ProjectName:  "proj",
+		Task:         "do it",
+		Initialized:  true,
+		AnchorBranch: "parent-0",
+		ActiveBranch: "branch-77",
+	}
+	if err := saveControllerState(statePath, initial); err != nil {
+		t.Fatalf("save initial state: %v", err)
+	}
+
+	polls := 0
+	client := &stubControllerClient{
+		getBranch: func(branchID string) (map[string]any, error) {
+			polls++
+			if polls == 1 {
+				return nil, CircuitOpenError{Until: time.Now().Add(time.Hour)}
+			}
+			return map[string]any{"id": branchID, "status": "succeed"}, nil
+		},
+	}
+
+	var sleeps []time.Duration
+	var pausedState ControllerState
+	sleepFn := func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		pausedState, _ = loadControllerState(statePath)
+	}
+
+	cfg := ControllerConfig{StatePath: statePath, MaxEpisodes: 1}
+	if err := runControllerWithClient(context.Background(), cfg, client, sleepFn); err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if len(sleeps) != 1 || sleeps[0] < 59*time.Minute {
+		t.Fatalf("expected one pause of ~1h, got %v", sleeps)
+	}
+	if pausedState.PausedUntil == "" || pausedState.ActiveBranch != "branch-77" {
+		t.Fatalf("expected paused state with active branch kept, got %#v", pausedState)
+	}
+
+	st, err := loadControllerState(statePath)
+	if err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if st.AnchorBranch != "branch-77" || st.PausedUntil != "" {
+		t.Fatalf("expected episode to finish after pause, got %#v", st)
+	}
+}
+
+func TestApplyControllerOverridesMergesTransportConfig(t *testing.T) {
+	state := ControllerState{MCPTransport: &TransportConfig{CAFile: "/etc/pantheon/ca.pem", ProxyURL: "http://proxy:3128"}}
+	applyControllerOverrides(&state, ControllerConfig{MCPTransport: TransportConfig{ProxyURL: "http://other:3128", MaxConnsPerHost: 4}})
+
+	got := state.transportConfig()
+	want := TransportConfig{CAFile: "/etc/pantheon/ca.pem", ProxyURL: "http://other:3128", MaxConnsPerHost: 4}
+	if got != want {
+		t.Fatalf("transport config = %+v, want %+v", got, want)
+	}
+
+	applyControllerOverrides(&state, ControllerConfig{})
+	if state.transportConfig() != want {
+		t.Fatalf("empty override changed saved transport config: %+v", state.transportConfig())
+	}
+}
+
+func TestControllerReplaysRecordedCassette(t *testing.T) {
+	pantheon := newSessionServer()
+	explored := 0
+	pantheon.onTool = func(name string, args map[string]any) map[string]any {
+		switch name {
+		case "parallel_explore":
+			explored++
+			return map[string]any{"branch_id": fmt.Sprintf("branch-%d", explored)}
+		case "get_branch":
+			return map[string]any{"id": args["branch_id"], "status": "succeed"}
+		default:
+			return map[string]any{"output": "done"}
+		}
+	}
+	srv := httptest.NewServer(pantheon)
+	tmp := t.TempDir()
+	cassette := filepath.Join(tmp, "run.jsonl")
+	cfg := func(statePath string) ControllerConfig {
+		return ControllerConfig{ProjectName: "proj", ParentBranchID: "parent-0", Task: "do it", StatePath: statePath, MaxEpisodes: 1}
+	}
+
+	rec, err := CreateCassette(cassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, _ := NewMCPClientWithConfig(MCPClientConfig{BaseURL: srv.URL, Recorder: rec})
+	if err := runControllerWithClient(context.Background(), cfg(filepath.Join(tmp, "live.json")), live, func(time.Duration) {}); err != nil {
+		t.Fatalf("live run: %v", err)
+	}
+	rec.Close()
+	srv.Close()
+
+	replay, err := OpenReplayTransport(cassette)
+	if err != nil {
+		t.Fatalf("OpenReplayTransport: %v", err)
+	}
+	replayed, _ := NewMCPClientWithConfig(MCPClientConfig{BaseURL: srv.URL, RPCTransport: replay})
+	if err := runControllerWithClient(context.Background(), cfg(filepath.Join(tmp, "replay.json")), replayed, func(time.Duration) {}); err != nil {
+		t.Fatalf("replayed run: %v", err)
+	}
+
+	liveState, _ := loadControllerState(filepath.Join(tmp, "live.json"))
+	replayState, _ := loadControllerState(filepath.Join(tmp, "replay.json"))
+	if liveState.AnchorBranch != "branch-2" || replayState.AnchorBranch != liveState.AnchorBranch {
+		t.Fatalf("anchor live=%q replay=%q, want branch-2 for both", liveState.AnchorBranch, replayState.AnchorBranch)
+	}
+	if replay.Remaining() != 0 {
+		t.Fatalf("replay left %d cassette entries unused", replay.Remaining())
+	}
+}
+
+func TestControllerRunsAgainstFakePantheon(t *testing.T) {
+	fake := fakepantheon.New(fakepantheon.Config{Polls: 1, InheritParentStatus: true})
+	fake.QueueOutcomes(fakepantheon.StatusSucceed, fakepantheon.StatusFailed)
+	fake.Inject(fakepantheon.Fault{Tool: "get_branch", HTTPStatus: http.StatusServiceUnavailable})
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	fast := ExponentialRetryPolicy{Attempts: 3, BaseDelay: time.Millisecond}
+	client, err := NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL:           srv.URL,
+		RetryPolicy:       fast,
+		ToolRetryPolicies: map[string]RetryPolicy{"get_branch": fast},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	cfg := ControllerConfig{
+		ProjectName:    "proj",
+		ParentBranchID: "baseline",
+		Task:           "do it",
+		StatePath:      statePath,
+		MaxEpisodes:    1,
+		PollInterval:   time.Millisecond,
+	}
+	if err := runControllerWithClient(context.Background(), cfg, client, func(time.Duration) {}); err != nil {
+		t.Fatalf("runControllerWithClient: %v", err)
+	}
+
+	st, _ := loadControllerState(statePath)
+	// bootstrap (branch-1) succeeds, the episode fails once (branch-2) and
+	// is retried from the same anchor (branch-3).
+	if st.AnchorBranch != "branch-3" {
+		t.Fatalf("expected anchor branch-3, got %q", st.AnchorBranch)
+	}
+	if b, _ := fake.Branch("branch-3"); b.ParentID != "branch-1" {
+		t.Fatalf("expected retry to start from branch-1, got parent %q", b.ParentID)
+	}
+	if fake.ToolCalls("parallel_explore") != 3 {
+		t.Fatalf("expected 3 parallel_explore calls, got %d", fake.ToolCalls("parallel_explore"))
+	}
+}
+
+func TestControllerRendersServerTaskPrompt(t *testing.T) {
+	fake := fakepantheon.New(fakepantheon.Config{})
+	fake.AddPrompt(fakepantheon.Prompt{Name: "episode", Template: "Improve {{area}}."})
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	cfg := ControllerConfig{
+		ProjectName:    "proj",
+		ParentBranchID: "baseline",
+		Task:           "Be brief.",
+		TaskPrompt:     "episode",
+		TaskPromptArgs: map[string]string{"area": "docs"},
+		StatePath:      filepath.Join(t.TempDir(), "state.json"),
+		MaxEpisodes:    1,
+		PollInterval:   time.Millisecond,
+	}
+	if err := runControllerWithClient(context.Background(), cfg, NewMCPClient(srv.URL), func(time.Duration) {}); err != nil {
+		t.Fatalf("runControllerWithClient: %v", err)
+	}
+	// branch-1 is the bootstrap episode.
+	b, ok := fake.Branch("branch-2")
+	if !ok || len(b.Prompts) != 1 || b.Prompts[0] != "Improve docs.\n\nBe brief." {
+		t.Fatalf("unexpected episode prompts %q", b.Prompts)
+	}
+	st, _ := loadControllerState(cfg.StatePath)
+	if st.TaskPrompt != "episode" || st.TaskPromptArgs["area"] != "docs" {
+		t.Fatalf("task prompt not saved in state: %+v", st)
+	}
+}
+
+func TestControllerSelectsWinnerAmongBranches(t *testing.T) {
+	outputs := map[string]string{"branch-3": "short report", "branch-4": "a much longer report"}
+	fake := fakepantheon.New(fakepantheon.Config{Polls: 1, InheritParentStatus: true, OnExplore: func(b *fakepantheon.Branch) {
+		if out, ok := outputs[b.ID]; ok {
+			b.Output = out
+		}
+	}})
+	// bootstrap (branch-1), then an episode of three branches, one failing.
+	fake.QueueOutcomes(fakepantheon.StatusSucceed, fakepantheon.StatusFailed)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	cfg := ControllerConfig{
+		ProjectName:    "proj",
+		ParentBranchID: "baseline",
+		Task:           "do it",
+		StatePath:      filepath.Join(t.TempDir(), "state.json"),
+		MaxEpisodes:    1,
+		PollInterval:   time.Millisecond,
+		Branches:       3,
+		Selector:       "longest-output",
+	}
+	if err := runControllerWithClient(context.Background(), cfg, NewMCPClient(srv.URL), func(time.Duration) {}); err != nil {
+		t.Fatalf("runControllerWithClient: %v", err)
+	}
+	st, _ := loadControllerState(cfg.StatePath)
+	if st.AnchorBranch != "branch-4" {
+		t.Fatalf("expected the longest output (branch-4) to win, got %q", st.AnchorBranch)
+	}
+	if st.ActiveBranch != "" || len(st.ActiveBranches) != 0 {
+		t.Fatalf("expected no active branches after the episode, got %q %v", st.ActiveBranch, st.ActiveBranches)
+	}
+	if st.Branches != 3 || st.Selector != "longest-output" {
+		t.Fatalf("multi-branch settings not saved: %+v", st)
+	}
+	if n := fake.ToolCalls("parallel_explore"); n != 2 {
+		t.Fatalf("expected 2 parallel_explore calls, got %d", n)
+	}
+	if b, _ := fake.Branch("branch-4"); b.ParentID != "branch-1" {
+		t.Fatalf("expected episode branches to start from branch-1, got parent %q", b.ParentID)
+	}
+}
+
+func TestControllerResumesActiveBranches(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	initial := ControllerState{
+		ProjectName:    "proj",
+		Task:           "do it",
+		Initialized:    true,
+		AnchorBranch:   "anchor",
+		ActiveBranches: []string{"branch-a", "branch-b"},
+	}
+	if err := saveControllerState(statePath, initial); err != nil {
+		t.Fatal(err)
+	}
+	client := &stubControllerClient{}
+	var seen []string
+	cfg := ControllerConfig{
+		StatePath:   statePath,
+		MaxEpisodes: 1,
+		CustomSelector: SelectorFunc(func(ctx context.Context, s Selection) (string, error) {
+			for _, c := range s.Candidates {
+				seen = append(seen, c.BranchID)
+			}
+			return "branch-b", nil
+		}),
+	}
+	if err := runControllerWithClient(context.Background(), cfg, client, func(time.Duration) {}); err != nil {
+		t.Fatalf("runControllerWithClient: %v", err)
+	}
+	if client.parallelExploreCalls != 0 {
+		t.Fatalf("expected resume without parallel_explore, got %d calls", client.parallelExploreCalls)
+	}
+	if strings.Join(seen, ",") != "branch-a,branch-b" {
+		t.Fatalf("selector saw candidates %v", seen)
+	}
+	st, _ := loadControllerState(statePath)
+	if st.AnchorBranch != "branch-b" || len(st.ActiveBranches) != 0 {
+		t.Fatalf("unexpected state after resume: %+v", st)
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	sel := Selection{
+		Anchor: "anchor",
+		Prompt: "do it",
+		Candidates: []Candidate{
+			{BranchID: "branch-a", Status: "failed", Err: fmt.Errorf("boom")},
+			{BranchID: "branch-b", Status: "succeed", Output: "done"},
+			{BranchID: "branch-c", Status: "succeed", Output: "done, with tests"},
+		},
+	}
+	ctx := context.Background()
+	for spec, want := range map[string]string{
+		"":                                     "branch-b",
+		"first-success":                        "branch-b",
+		"longest-output":                       "branch-c",
+		"script:cat >/dev/null; echo branch-c": "branch-c",
+	} {
+		s, err := ParseSelector(spec)
+		if err != nil {
+			t.Fatalf("ParseSelector(%q): %v", spec, err)
+		}
+		if got, err := s.Select(ctx, sel); err != nil || got != want {
+			t.Fatalf("%q selected %q (%v), want %q", spec, got, err, want)
+		}
+	}
+	if _, err := ParseSelector("coin-flip"); err == nil {
+		t.Fatal("expected an error for an unknown selector")
+	}
+	if _, err := (ScriptSelector{Command: "echo none"}).Select(ctx, sel); !errors.Is(err, ErrNoWinner) {
+		t.Fatalf("expected ErrNoWinner from a script answering none, got %v", err)
+	}
+
+	var judgePrompt, judgeAgent string
+	verdict := "Both work; c also adds tests.\nWINNER: branch-c"
+	sel.RunAgent = func(ctx context.Context, agent, prompt string) (string, error) {
+		judgeAgent, judgePrompt = agent, prompt
+		return verdict, nil
+	}
+	if got, err := (JudgeSelector{Agent: "claude_code"}).Select(ctx, sel); err != nil || got != "branch-c" {
+		t.Fatalf("judge selected %q (%v)", got, err)
+	}
+	if judgeAgent != "claude_code" || !strings.Contains(judgePrompt, "branch-b") || strings.Contains(judgePrompt, "branch-a") {
+		t.Fatalf("unexpected judge call (agent %q): %s", judgeAgent, judgePrompt)
+	}
+	verdict = "WINNER: NONE"
+	if _, err := (JudgeSelector{}).Select(ctx, sel); !errors.Is(err, ErrNoWinner) {
+		t.Fatalf("expected ErrNoWinner when the judge rejects all, got %v", err)
+	}
+	verdict = "WINNER: branch-a"
+	if _, err := (JudgeSelector{}).Select(ctx, sel); err == nil || errors.Is(err, ErrNoWinner) {
+		t.Fatalf("expected an error when the judge picks a failed branch, got %v", err)
+	}
+}
+
+func TestControllerGatesBranchesBeforePromotion(t *testing.T) {
+	fake := fakepantheon.New(fakepantheon.Config{OnExplore: func(b *fakepantheon.Branch) {
+		switch b.ID {
+		case "branch-2":
+			b.Output = "done, NO_P0_P1"
+		case "branch-3":
+			b.Output = "done, NO_P0_P1"
+			b.Files["report.md"] = "# Report"
+		}
+	}})
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	cfg := ControllerConfig{
+		ProjectName:    "proj",
+		ParentBranchID: "baseline",
+		Task:           "do it",
+		StatePath:      filepath.Join(t.TempDir(), "state.json"),
+		MaxEpisodes:    1,
+		PollInterval:   time.Millisecond,
+		Branches:       2,
+		Gates:          []string{"output:NO_P0_P1", "file:report.md"},
+	}
+	if err := runControllerWithClient(context.Background(), cfg, NewMCPClient(srv.URL), func(time.Duration) {}); err != nil {
+		t.Fatalf("runControllerWithClient: %v", err)
+	}
+	st, _ := loadControllerState(cfg.StatePath)
+	// branch-1 is the ungated bootstrap; branch-2 lacks the report.
+	if st.AnchorBranch != "branch-3" {
+		t.Fatalf("expected the gated winner branch-3, got %q", st.AnchorBranch)
+	}
+	if len(st.Gates) != 2 {
+		t.Fatalf("gates not saved in state: %v", st.Gates)
+	}
+}
+
+func TestGates(t *testing.T) {
+	ctx := context.Background()
+	files := map[string]string{"report.md": "ok", "empty.md": " "}
+	in := GateInput{
+		BranchID: "branch-1",
+		Output:   "review: found 1 P1 issue",
+		ReadFile: func(ctx context.Context, path string) (string, error) {
+			if path == "broken.md" {
+				return "", fmt.Errorf("connection reset")
+			}
+			content, ok := files[path]
+			if !ok {
+				return "", HTTPStatusError{StatusCode: http.StatusNotFound}
+			}
+			return content, nil
+		},
+	}
+	verdict := ""
+	in.RunAgent = func(ctx context.Context, agent, prompt string) (string, error) { return verdict, nil }
+
+	cases := []struct {
+		spec   string
+		verd   string
+		failed bool
+	}{
+		{"file:report.md", "", false},
+		{"file:empty.md", "", true},
+		{"file:missing.md", "", true},
+		{"output:P[01] issue", "", false},
+		{"no-output:P[01]", "", true},
+		{"command:grep -q P1", "", false},
+		{"command:echo broken >&2; exit 3", "", true},
+		{"command:test \"$AGENT0_BRANCH_ID\" = branch-1", "", false},
+		{"verifier", "Tests pass.\nVERDICT: PASS", false},
+		{"verifier:claude_code", "VERDICT: FAIL go test ./... fails", true},
+		{"verifier", "looks fine", true},
+	}
+	for _, c := range cases {
+		g, err := ParseGate(c.spec)
+		if err != nil {
+			t.Fatalf("ParseGate(%q): %v", c.spec, err)
+		}
+		verdict = c.verd
+		err = g.Check(ctx, in)
+		var gateErr *GateError
+		if got := errors.As(err, &gateErr); got != c.failed || (!c.failed && err != nil) {
+			t.Fatalf("%q: got %v, want failed=%v", c.spec, err, c.failed)
+		}
+	}
+	if err := (FileGate{Path: "broken.md"}).Check(ctx, in); err == nil || errors.As(err, new(*GateError)) {
+		t.Fatalf("expected a plain error when the file cannot be read, got %v", err)
+	}
+	for _, spec := range []string{"file:", "output:(", "smoke"} {
+		if _, err := ParseGate(spec); err == nil {
+			t.Fatalf("expected ParseGate(%q) to fail", spec)
+		}
+	}
+}
+
+func TestControllerRecordsAnchorHistory(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	client := &stubControllerClient{
+		branchOutput: func(branchID string, fullOutput bool) (map[string]any, error) {
+			return map[string]any{"output": "report of " + branchID}, nil
+		},
+	}
+	cfg := ControllerConfig{
+		MCPBaseURL:     "http://localhost:8000/mcp/sse",
+		ProjectName:    "proj",
+		ParentBranchID: "parent-0",
+		Task:           "do it",
+		StatePath:      statePath,
+		MaxEpisodes:    2,
+	}
+	if err := runControllerWithClient(context.Background(), cfg, client, func(time.Duration) {}); err != nil {
+		t.Fatalf("runControllerWithClient: %v", err)
+	}
+	st, err := loadControllerState(statePath)
+	if err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	want := []struct {
+		branch, reason string
+		episode        int
+	}{
+		{"parent-0", AnchorParent, 0},
+		{"branch-1", AnchorBootstrap, 0},
+		{"branch-2", AnchorEpisode, 1},
+		{"branch-3", AnchorEpisode, 2},
+	}
+	if len(st.AnchorHistory) != len(want) {
+		t.Fatalf("expected %d history entries, got %+v", len(want), st.AnchorHistory)
+	}
+	for i, w := range want {
+		rec := st.AnchorHistory[i]
+		if rec.BranchID != w.branch || rec.Reason != w.reason || rec.Episode != w.episode {
+			t.Fatalf("entry %d: got %+v, want %+v", i, rec, w)
+		}
+		if rec.At == "" {
+			t.Fatalf("entry %d has no timestamp", i)
+		}
+	}
+	if got := st.AnchorHistory[2]; got.PromptHash == "" || got.OutputExcerpt != "report of branch-2" {
+		t.Fatalf("episode entry missing prompt hash or excerpt: %+v", got)
+	}
+}
+
+func TestRollbackAnchor(t *testing.T) {
+	ctx := context.Background()
+	history := []AnchorRecord{
+		{BranchID: "parent-0", Reason: AnchorParent},
+		{BranchID: "branch-1", Reason: AnchorBootstrap},
+		{BranchID: "branch-2", Reason: AnchorEpisode, Episode: 1},
+		{BranchID: "branch-3", Reason: AnchorEpisode, Episode: 2},
+	}
+	newState := func(t *testing.T) (string, ControllerState) {
+		path := filepath.Join(t.TempDir(), "state.json")
+		st := ControllerState{
+			ProjectName:     "proj",
+			Initialized:     true,
+			BootstrapBranch: "branch-1",
+			AnchorBranch:    "branch-3",
+			AnchorHistory:   append([]AnchorRecord(nil), history...),
+		}
+		return path, st
+	}
+
+	t.Run("steps", func(t *testing.T) {
+		path, st := newState(t)
+		rec, err := rollbackWithClient(ctx, path, st, nil, "", 2)
+		if err != nil {
+			t.Fatalf("rollback: %v", err)
+		}
+		if rec.BranchID != "branch-1" || rec.RolledBackFrom != "branch-3" || rec.Reason != AnchorRollback {
+			t.Fatalf("unexpected record %+v", rec)
+		}
+		saved, _ := loadControllerState(path)
+		if saved.AnchorBranch != "branch-1" || !saved.Initialized || len(saved.AnchorHistory) != 5 {
+			t.Fatalf("unexpected state after rollback: %+v", saved)
+		}
+		// Stepping back again continues from the rolled-back lineage.
+		rec, err = rollbackWithClient(ctx, path, saved, nil, "", 1)
+		if err != nil {
+			t.Fatalf("second rollback: %v", err)
+		}
+		if rec.BranchID != "parent-0" {
+			t.Fatalf("expected parent-0, got %q", rec.BranchID)
+		}
+		saved, _ = loadControllerState(path)
+		if saved.Initialized || saved.BootstrapBranch != "" {
+			t.Fatalf("rolling back to the parent should require a new bootstrap: %+v", saved)
+		}
+		if _, err := rollbackWithClient(ctx, path, saved, nil, "", 1); err == nil {
+			t.Fatalf("expected an error rolling back past the parent")
+		}
+	})
+
+	t.Run("to", func(t *testing.T) {
+		path, st := newState(t)
+		rec, err := rollbackWithClient(ctx, path, st, nil, "branch-2", 0)
+		if err != nil {
+			t.Fatalf("rollback: %v", err)
+		}
+		if rec.Episode != 1 {
+			t.Fatalf("expected the record to carry episode 1, got %+v", rec)
+		}
+		if _, err := rollbackWithClient(ctx, path, st, nil, "branch-9", 0); err == nil || !strings.Contains(err.Error(), "not in the anchor history") {
+			t.Fatalf("expected unknown branch error, got %v", err)
+		}
+		if _, err := rollbackWithClient(ctx, path, st, nil, "branch-3", 0); err == nil {
+			t.Fatalf("expected an error rolling back to the current anchor")
+		}
+	})
+
+	t.Run("refuses while active branch runs", func(t *testing.T) {
+		path, st := newState(t)
+		st.ActiveBranch = "branch-4"
+		running := true
+		client := &stubControllerClient{getBranch: func(branchID string) (map[string]any, error) {
+			status := "succeed"
+			if running {
+				status = "running"
+			}
+			return map[string]any{"id": branchID, "status": status}, nil
+		}}
+		if _, err := rollbackWithClient(ctx, path, st, client, "", 1); err == nil || !strings.Contains(err.Error(), "branch-4 is still running") {
+			t.Fatalf("expected running branch error, got %v", err)
+		}
+		running = false
+		if _, err := rollbackWithClient(ctx, path, st, client, "", 1); err != nil {
+			t.Fatalf("rollback after branch stopped: %v", err)
+		}
+		saved, _ := loadControllerState(path)
+		if saved.ActiveBranch != "" || saved.AnchorBranch != "branch-2" {
+			t.Fatalf("unexpected state after rollback: %+v", saved)
+		}
+	})
+
+	t.Run("refuses while a controller holds the state", func(t *testing.T) {
+		path, st := newState(t)
+		if err := saveControllerState(path, st); err != nil {
+			t.Fatalf("save state: %v", err)
+		}
+		lock, err := lockState(path)
+		if err != nil {
+			t.Fatalf("lockState: %v", err)
+		}
+		if _, err := RollbackAnchor(ctx, RollbackConfig{StatePath: path}); !errors.Is(err, ErrStateLocked) {
+			lock.Unlock()
+			t.Fatalf("expected ErrStateLocked, got %v", err)
+		}
+		err = runControllerWithClient(ctx, ControllerConfig{StatePath: path}, &stubControllerClient{}, func(time.Duration) {})
+		lock.Unlock()
+		if !errors.Is(err, ErrStateLocked) {
+			t.Fatalf("expected a second controller to be refused, got %v", err)
+		}
+		if _, err := RollbackAnchor(ctx, RollbackConfig{StatePath: path}); err != nil {
+			t.Fatalf("rollback after the controller exited: %v", err)
+		}
+	})
+}
+
+func TestControllerFailurePolicyRollsBack(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	initial := ControllerState{
+		MCPBaseURL:      "http://localhost:8000/mcp/sse",
+		ProjectName:     "proj",
+		Task:            "do it",
+		Initialized:     true,
+		BootstrapBranch: "branch-1",
+		AnchorBranch:    "branch-2",
+		AnchorHistory: []AnchorRecord{
+			{BranchID: "parent-0", Reason: AnchorParent},
+			{BranchID: "branch-1", Reason: AnchorBootstrap},
+			{BranchID: "branch-2", Reason: AnchorEpisode, Episode: 1},
+		},
+	}
+	if err := saveControllerState(statePath, initial); err != nil {
+		t.Fatalf("save initial state: %v", err)
+	}
+	client := &stubControllerClient{
+		branches: []string{"branch-3", "branch-4"},
+		getBranch: func(branchID string) (map[string]any, error) {
+			return map[string]any{"id": branchID, "status": "failed"}, nil
+		},
+	}
+	var sleeps []time.Duration
+	cfg := ControllerConfig{
+		StatePath:     statePath,
+		FailurePolicy: []string{"failed:action=rollback,max=2,backoff=1s/2s"},
+	}
+	err := runControllerWithClient(context.Background(), cfg, client, func(d time.Duration) { sleeps = append(sleeps, d) })
+	if err == nil {
+		t.Fatalf("expected the exhausted policy to exit with an error")
+	}
+	if got := strings.Join(client.parentBranchIDs, ","); got != "branch-2,branch-1" {
+		t.Fatalf("expected episodes from branch-2 then the rolled-back branch-1, got %s", got)
+	}
+	if len(sleeps) != 2 || sleeps[0] != time.Second || sleeps[1] != 2*time.Second {
+		t.Fatalf("unexpected backoff %v", sleeps)
+	}
+	st, _ := loadControllerState(statePath)
+	if st.AnchorBranch != "parent-0" || st.Initialized {
+		t.Fatalf("expected the anchor rolled back to the uninitialized parent, got %+v", st)
+	}
+	if len(st.FailurePolicy) != 1 {
+		t.Fatalf("failure policy not saved in state: %v", st.FailurePolicy)
+	}
+}
+
+func TestControllerFailurePolicyEmptyOutput(t *testing.T) {
+	newConfig := func(t *testing.T) ControllerConfig {
+		return ControllerConfig{
+			MCPBaseURL:     "http://localhost:8000/mcp/sse",
+			ProjectName:    "proj",
+			ParentBranchID: "parent-0",
+			Task:           "do it",
+			StatePath:      filepath.Join(t.TempDir(), "state.json"),
+		}
+	}
+	emptyOutput := func(branchID string, fullOutput bool) (map[string]any, error) {
+		return map[string]any{"output": ""}, nil
+	}
+
+	t.Run("default exits and keeps the branch", func(t *testing.T) {
+		cfg := newConfig(t)
+		client := &stubControllerClient{branchOutput: emptyOutput}
+		err := runControllerWithClient(context.Background(), cfg, client, func(time.Duration) {})
+		if !errors.Is(err, ErrEmptyOutput) {
+			t.Fatalf("expected ErrEmptyOutput, got %v", err)
+		}
+		st, _ := loadControllerState(cfg.StatePath)
+		if st.ActiveBranch != "branch-1" {
+			t.Fatalf("expected branch-1 to stay active for resume, got %q", st.ActiveBranch)
+		}
+	})
+
+	t.Run("clear exits and clears the branch", func(t *testing.T) {
+		cfg := newConfig(t)
+		cfg.FailurePolicy = []string{"clear=true"}
+		client := &stubControllerClient{branchOutput: emptyOutput}
+		err := runControllerWithClient(context.Background(), cfg, client, func(time.Duration) {})
+		if !errors.Is(err, ErrEmptyOutput) {
+			t.Fatalf("expected ErrEmptyOutput, got %v", err)
+		}
+		st, _ := loadControllerState(cfg.StatePath)
+		if st.ActiveBranch != "" || !strings.Contains(st.LastFailure, "empty") {
+			t.Fatalf("expected the judged branch cleared and the failure recorded, got %+v", st)
+		}
+		// The next run starts a new episode instead of judging branch-1 again.
+		_ = runControllerWithClient(context.Background(), cfg, client, func(time.Duration) {})
+		if client.parallelExploreCalls != 2 {
+			t.Fatalf("expected a new episode on the next run, got %d parallel_explore calls", client.parallelExploreCalls)
+		}
+	})
+
+	t.Run("skipfinal exits without the last backoff", func(t *testing.T) {
+		cfg := newConfig(t)
+		cfg.FailurePolicy = []string{"empty_output:action=retry,max=2,backoff=1m,skipfinal=true"}
+		client := &stubControllerClient{branchOutput: emptyOutput}
+		var sleeps []time.Duration
+		err := runControllerWithClient(context.Background(), cfg, client, func(d time.Duration) { sleeps = append(sleeps, d) })
+		if !errors.Is(err, ErrEmptyOutput) {
+			t.Fatalf("expected ErrEmptyOutput, got %v", err)
+		}
+		if client.parallelExploreCalls != 2 || len(sleeps) != 1 {
+			t.Fatalf("expected 2 episodes and one backoff, got %d episodes and sleeps %v", client.parallelExploreCalls, sleeps)
+		}
+	})
+
+	t.Run("retry then pause", func(t *testing.T) {
+		cfg := newConfig(t)
+		cfg.FailurePolicy = []string{"empty_output:action=retry,max=2,backoff=1m,exhausted=pause,pause=30m"}
+		client := &stubControllerClient{branchOutput: emptyOutput}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var sleeps []time.Duration
+		var paused ControllerState
+		sleepFn := func(d time.Duration) {
+			sleeps = append(sleeps, d)
+			if d == 30*time.Minute {
+				paused, _ = loadControllerState(cfg.StatePath)
+				cancel()
+			}
+		}
+		if err := runControllerWithClient(ctx, cfg, client, sleepFn); err != nil {
+			t.Fatalf("expected a clean stop, got %v", err)
+		}
+		if client.parallelExploreCalls != 2 {
+			t.Fatalf("expected 2 episodes before the pause, got %d", client.parallelExploreCalls)
+		}
+		if len(sleeps) != 3 || sleeps[0] != time.Minute || sleeps[1] != time.Minute {
+			t.Fatalf("unexpected sleeps %v", sleeps)
+		}
+		if paused.PausedUntil == "" || !strings.Contains(paused.PauseReason, "empty_output") {
+			t.Fatalf("pause not recorded in state: %+v", paused)
+		}
+	})
+}
+
+func TestParseFailurePolicy(t *testing.T) {
+	p, err := ParseFailurePolicy(nil)
+	if err != nil {
+		t.Fatalf("default policy: %v", err)
+	}
+	if r := p.Rule(FailureFailed); r.MaxConsecutive != 3 || r.Action != FailureRetry || r.backoff(5) != 20*time.Minute {
+		t.Fatalf("unexpected default failed rule %+v", r)
+	}
+	if p.Rule(FailureTimeout).Action != FailureExit || p.Rule(FailureEmptyOutput).Action != FailureExit {
+		t.Fatalf("timeouts and empty output should exit by default: %+v", p)
+	}
+
+	p, err = ParseFailurePolicy([]string{"max=5,backoff=1m/5m", "timeout:action=retry,exhausted=pause,pause=2h"})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if r := p.Rule(FailureEmptyOutput); r.MaxConsecutive != 5 || r.backoff(1) != time.Minute || r.backoff(9) != 5*time.Minute || r.Action != FailureExit {
+		t.Fatalf("unexpected empty_output rule %+v", r)
+	}
+	if r := p.Rule(FailureTimeout); r.Action != FailureRetry || r.OnExhausted != ExhaustedPause || r.PauseFor != 2*time.Hour || r.MaxConsecutive != 5 {
+		t.Fatalf("unexpected timeout rule %+v", r)
+	}
+
+	p, err = ParseFailurePolicy([]string{"clear=true", "failed:skipfinal=true"})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if r := p.Rule(FailureFailed); !r.ClearOnExit || !r.SkipFinalBackoff {
+		t.Fatalf("unexpected failed rule %+v", r)
+	}
+	if r := p.Rule(FailureTimeout); !r.ClearOnExit || r.SkipFinalBackoff {
+		t.Fatalf("unexpected timeout rule %+v", r)
+	}
+
+	for _, spec := range []string{"max=0", "backoff=soon", "action=give-up", "exhausted=retry", "crash:max=1", "max", "clear=sometimes"} {
+		if _, err := ParseFailurePolicy([]string{spec}); err == nil {
+			t.Fatalf("expected an error for %q", spec)
+		}
+	}
+
+	timeout := ToolExecutionError{Instruction: instructionFinishedWithErr, Details: map[string]any{"status": "timeout"}}
+	failed := ToolExecutionError{Instruction: instructionFinishedWithErr, Details: map[string]any{"status": "failed"}}
+	empty := fmt.Errorf("branch_output for b: %w", ErrEmptyOutput)
+	if failureKind(timeout) != FailureTimeout || failureKind(failed) != FailureFailed || failureKind(empty) != FailureEmptyOutput {
+		t.Fatalf("failureKind misclassified an error")
+	}
+	mixed := []Candidate{{BranchID: "a", Err: timeout}, {BranchID: "b", Err: empty}}
+	if k := episodeFailureKind(mixed); k != FailureFailed {
+		t.Fatalf("expected mixed failures to count as failed, got %s", k)
+	}
+	if k := episodeFailureKind(mixed[:1]); k != FailureTimeout {
+		t.Fatalf("expected timeout, got %s", k)
+	}
+	if ids := timedOutBranches(mixed); len(ids) != 1 || ids[0] != "a" {
+		t.Fatalf("expected only the timed-out branch a to stay active, got %v", ids)
+	}
+}
+
+func TestControllerWorksThroughTaskQueue(t *testing.T) {
+	dir := t.TempDir()
+	queuePath := filepath.Join(dir, "tasks.jsonl")
+	queue := `{"id": "a", "prompt": "Fix issue A."}
+# comments and blank lines are skipped
+
+{"id": "b", "prompt": "Fix issue B.", "done_when": ["output:DONE"], "max_episodes": 3}
+{"id": "c", "prompt": "Fix issue C."}
+`
+	if err := os.WriteFile(queuePath, []byte(queue), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outputs := map[string]string{"branch-3": "still working", "branch-4": "DONE"}
+	client := &stubControllerClient{
+		branchOutput: func(branchID string, fullOutput bool) (map[string]any, error) {
+			if branchID == "branch-3" {
+				// An operator drops task c while b is running.
+				if err := DequeueTask(queuePath, "c"); err != nil {
+					t.Errorf("dequeue: %v", err)
+				}
+			}
+			out, ok := outputs[branchID]
+			if !ok {
+				out = "ok"
+			}
+			return map[string]any{"output": out}, nil
+		},
+	}
+	cfg := ControllerConfig{
+		MCPBaseURL:     "http://localhost:8000/mcp/sse",
+		ProjectName:    "proj",
+		ParentBranchID: "parent-0",
+		TaskQueue:      queuePath,
+		StatePath:      filepath.Join(dir, "state.json"),
+	}
+	if err := runControllerWithClient(context.Background(), cfg, client, func(time.Duration) {}); err != nil {
+		t.Fatalf("runControllerWithClient: %v", err)
+	}
+	if len(client.prompts) != 4 || client.prompts[1] != "Fix issue A." || client.prompts[2] != "Fix issue B." || client.prompts[3] != "Fix issue B." {
+		t.Fatalf("unexpected episode prompts %q", client.prompts)
+	}
+	st, _ := loadControllerState(cfg.StatePath)
+	if st.CurrentTask != "" || st.AnchorBranch != "branch-4" {
+		t.Fatalf("expected the queue drained at branch-4, got current=%q anchor=%q", st.CurrentTask, st.AnchorBranch)
+	}
+	if len(st.Tasks) != 2 {
+		t.Fatalf("expected progress for a and b, got %+v", st.Tasks)
+	}
+	if a := st.Tasks[0]; a.ID != "a" || a.Status != TaskDone || a.Episodes != 1 || a.StartAnchor != "branch-1" {
+		t.Fatalf("unexpected progress for a: %+v", a)
+	}
+	if b := st.Tasks[1]; b.ID != "b" || b.Status != TaskDone || b.Episodes != 2 || b.LastAnchor != "branch-4" {
+		t.Fatalf("unexpected progress for b: %+v", b)
+	}
+	if rec := st.AnchorHistory[len(st.AnchorHistory)-1]; rec.Task != "b" {
+		t.Fatalf("anchor history should name the task, got %+v", rec)
+	}
+}
+
+func TestControllerKeepsLastReadableTaskQueue(t *testing.T) {
+	dir := t.TempDir()
+	queuePath := filepath.Join(dir, "tasks.jsonl")
+	queue := `{"id": "a", "prompt": "Fix issue A."}
+{"id": "b", "prompt": "Fix issue B."}
+`
+	if err := os.WriteFile(queuePath, []byte(queue), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := &stubControllerClient{
+		branchOutput: func(branchID string, fullOutput bool) (map[string]any, error) {
+			if branchID == "branch-2" {
+				// An operator is halfway through adding a task.
+				if err := os.WriteFile(queuePath, []byte(queue+`{"id": "c", "pro`), 0o644); err != nil {
+					t.Errorf("write queue: %v", err)
+				}
+			}
+			return map[string]any{"output": "ok"}, nil
+		},
+	}
+	cfg := ControllerConfig{
+		MCPBaseURL:     "http://localhost:8000/mcp/sse",
+		ProjectName:    "proj",
+		ParentBranchID: "parent-0",
+		TaskQueue:      queuePath,
+		StatePath:      filepath.Join(dir, "state.json"),
+	}
+	if err := runControllerWithClient(context.Background(), cfg, client, func(time.Duration) {}); err != nil {
+		t.Fatalf("runControllerWithClient: %v", err)
+	}
+	if len(client.prompts) != 3 || client.prompts[2] != "Fix issue B." {
+		t.Fatalf("expected task b to run from the last readable queue, got prompts %q", client.prompts)
+	}
+}
+
+func TestTaskQueueFiles(t *testing.T) {
+	t.Run("jsonl", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "tasks.jsonl")
+		first, err := EnqueueTask(path, QueuedTask{Prompt: "  Fix A.  "})
+		if err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+		if first.ID != promptHash("Fix A.") {
+			t.Fatalf("expected the id to default to the prompt hash, got %q", first.ID)
+		}
+		if _, err := EnqueueTask(path, QueuedTask{ID: "b", Prompt: "Fix B.", DoneWhen: []string{"file:DONE.md"}}); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+		if _, err := EnqueueTask(path, QueuedTask{ID: "b", Prompt: "again"}); err == nil {
+			t.Fatalf("expected a duplicate id error")
+		}
+		for _, id := range []string{"../escape", "a/b", `a\b`, ".."} {
+			if _, err := EnqueueTask(path, QueuedTask{ID: id, Prompt: "x"}); err == nil {
+				t.Fatalf("expected id %q to be rejected", id)
+			}
+		}
+		if _, err := EnqueueTask(path, QueuedTask{ID: "c", Prompt: "x", DoneWhen: []string{"bogus"}}); err == nil {
+			t.Fatalf("expected an invalid done_when error")
+		}
+		if err := DequeueTask(path, first.ID); err != nil {
+			t.Fatalf("dequeue: %v", err)
+		}
+		tasks, err := LoadTaskQueue(path)
+		if err != nil || len(tasks) != 1 || tasks[0].ID != "b" || len(tasks[0].DoneWhen) != 1 {
+			t.Fatalf("unexpected queue %+v (%v)", tasks, err)
+		}
+		if err := DequeueTask(path, "missing"); err == nil {
+			t.Fatalf("expected an error dequeuing an unknown task")
+		}
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "10-first.md"), []byte("Fix A.\n"), 0o644)
+		os.WriteFile(filepath.Join(dir, "20-second.json"), []byte(`{"id": "second", "prompt": "Fix B.", "max_episodes": 2}`), 0o644)
+		os.WriteFile(filepath.Join(dir, "notes.yaml"), []byte("ignored"), 0o644)
+		if _, err := EnqueueTask(dir, QueuedTask{ID: "30-third", Prompt: "Fix C."}); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+		tasks, err := LoadTaskQueue(dir)
+		if err != nil {
+			t.Fatalf("load: %v", err)
+		}
+		var ids []string
+		for _, task := range tasks {
+			ids = append(ids, task.ID)
+		}
+		if strings.Join(ids, ",") != "10-first,second,30-third" || tasks[0].Prompt != "Fix A." || tasks[1].MaxEpisodes != 2 {
+			t.Fatalf("unexpected queue %+v", tasks)
+		}
+		// An id that sorts before the existing files still goes last.
+		for _, id := range []string{"05-urgent", "01-later"} {
+			if _, err := EnqueueTask(dir, QueuedTask{ID: id, Prompt: "Fix " + id + "."}); err != nil {
+				t.Fatalf("enqueue %s: %v", id, err)
+			}
+		}
+		tasks, _ = LoadTaskQueue(dir)
+		ids = ids[:0]
+		for _, task := range tasks {
+			ids = append(ids, task.ID)
+		}
+		if strings.Join(ids, ",") != "10-first,second,30-third,05-urgent,01-later" {
+			t.Fatalf("expected enqueued tasks at the end, got %v", ids)
+		}
+		if err := DequeueTask(dir, "second"); err != nil {
+			t.Fatalf("dequeue: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "20-second.json")); !os.IsNotExist(err) {
+			t.Fatalf("expected the task file removed, got %v", err)
+		}
+	})
+}
+
+func TestControllerRendersTaskTemplate(t *testing.T) {
+	dir := t.TempDir()
+	rules := filepath.Join(dir, "rules.md")
+	if err := os.WriteFile(rules, []byte("Rules for {{.Vars.repo}}."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := &stubControllerClient{
+		getBranch: func(branchID string) (map[string]any, error) {
+			status := "succeed"
+			if branchID == "branch-2" {
+				status = "failed"
+			}
+			return map[string]any{"id": branchID, "status": status}, nil
+		},
+		branchOutput: func(branchID string, fullOutput bool) (map[string]any, error) {
+			return map[string]any{"output": "report of " + branchID}, nil
+		},
+	}
+	task := `Episode {{.Episode}} from {{.Anchor}}.
+{{- with .LastFailure}} Last attempt failed.{{end}}
+Previous: {{tail 8 .PreviousOutput}}
+{{include "` + rules + `"}}`
+	cfg := ControllerConfig{
+		MCPBaseURL:     "http://localhost:8000/mcp/sse",
+		ProjectName:    "proj",
+		ParentBranchID: "parent-0",
+		Task:           task,
+		TaskTemplate:   true,
+		PromptVars:     map[string]string{"repo": "agent0"},
+		StatePath:      filepath.Join(dir, "state.json"),
+		MaxEpisodes:    2,
+	}
+	if err := runControllerWithClient(context.Background(), cfg, client, func(time.Duration) {}); err != nil {
+		t.Fatalf("runControllerWithClient: %v", err)
+	}
+	want := []string{
+		"Episode 1 from branch-1.\nPrevious: branch-1\nRules for agent0.",
+		"Episode 1 from branch-1. Last attempt failed.\nPrevious: branch-1\nRules for agent0.",
+		"Episode 2 from branch-3.\nPrevious: branch-3\nRules for agent0.",
+	}
+	if len(client.prompts) != 4 {
+		t.Fatalf("expected bootstrap + 3 episode prompts, got %q", client.prompts)
+	}
+	for i, w := range want {
+		if got := client.prompts[i+1]; got != w {
+			t.Fatalf("prompt %d:\ngot  %q\nwant %q", i+1, got, w)
+		}
+	}
+	st, _ := loadControllerState(cfg.StatePath)
+	if st.LastFailure != "" || st.PromptVars["repo"] != "agent0" || !st.TaskTemplate {
+		t.Fatalf("expected last_failure cleared and task_template and prompt_vars saved, got %+v", st)
+	}
+}
+
+func TestControllerSendsTaskAsWrittenWithoutTemplates(t *testing.T) {
+	client := &stubControllerClient{}
+	task := "Fix the {{ in the Jinja example; keep {{.Episode}} literal."
+	cfg := ControllerConfig{
+		MCPBaseURL:     "http://localhost:8000/mcp/sse",
+		ProjectName:    "proj",
+		ParentBranchID: "parent-0",
+		Task:           task,
+		StatePath:      filepath.Join(t.TempDir(), "state.json"),
+		MaxEpisodes:    1,
+	}
+	if err := runControllerWithClient(context.Background(), cfg, client, func(time.Duration) {}); err != nil {
+		t.Fatalf("runControllerWithClient: %v", err)
+	}
+	if len(client.prompts) != 2 || !strings.Contains(client.prompts[1], task) {
+		t.Fatalf("expected the task sent as written, got %q", client.prompts)
+	}
+}
+
+func TestRenderPrompt(t *testing.T) {
+	pc := &PromptContext{Episode: 3, Vars: map[string]string{"a": "x"}, History: []AnchorRecord{{BranchID: "p", Reason: AnchorParent}}, Anchor: "p"}
+	if got, err := renderPrompt(`{{tail 3 "café"}}|{{tail 1 "é"}}`, pc); err != nil || got != "fé|" {
+		t.Fatalf("expected tail to cut on a rune boundary, got %q, %v", got, err)
+	}
+	if got := outputExcerpt(strings.Repeat("é", anchorExcerptLen)); !utf8.ValidString(got) {
+		t.Fatalf("expected a valid UTF-8 excerpt, got %q", got)
+	}
+	remote := *pc
+	remote.noInclude = true
+	if _, err := renderPrompt(`{{include "/etc/hostname"}}`, &remote); err == nil {
+		t.Fatalf("expected include to be unavailable to control API tasks")
+	}
+	if got, err := renderPrompt("plain {text}", pc); err != nil || got != "plain {text}" {
+		t.Fatalf("plain text changed: %q, %v", got, err)
+	}
+	if got, err := renderPrompt("{{.Vars.a}}-{{.Episode}}[{{.PreviousOutput}}]", pc); err != nil || got != "x-3[]" {
+		t.Fatalf("unexpected render %q, %v", got, err)
+	}
+	if _, err := renderPrompt("{{.Vars.missing}}", pc); err == nil {
+		t.Fatalf("expected an error for a missing variable")
+	}
+	loop := filepath.Join(t.TempDir(), "loop.md")
+	os.WriteFile(loop, []byte(`{{include "`+loop+`"}}`), 0o644)
+	if _, err := renderPrompt(`{{include "`+loop+`"}}`, pc); err == nil || !strings.Contains(err.Error(), "nested") {
+		t.Fatalf("expected an include depth error, got %v", err)
+	}
+}
+
+func TestControllerWritesEpisodeLedger(t *testing.T) {
+	dir := t.TempDir()
+	client := &stubControllerClient{
+		getBranch: func(branchID string) (map[string]any, error) {
+			status := "succeed"
+			if branchID == "branch-2" {
+				status = "failed"
+			}
+			return map[string]any{"id": branchID, "status": status}, nil
+		},
+		branchOutput: func(branchID string, fullOutput bool) (map[string]any, error) {
+			return map[string]any{"output": "report of " + branchID}, nil
+		},
+	}
+	cfg := ControllerConfig{
+		MCPBaseURL:     "http://localhost:8000/mcp/sse",
+		ProjectName:    "proj",
+		ParentBranchID: "parent-0",
+		Task:           "do it",
+		StatePath:      filepath.Join(dir, "state.json"),
+		MaxEpisodes:    1,
+	}
+	if err := runControllerWithClient(context.Background(), cfg, client, func(time.Duration) {}); err != nil {
+		t.Fatalf("runControllerWithClient: %v", err)
+	}
+	records, err := ReadLedger(filepath.Join(dir, "ledger.jsonl"))
+	if err != nil {
+		t.Fatalf("read ledger: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 attempts, got %+v", records)
+	}
+	boot, failed, promoted := records[0], records[1], records[2]
+	if !boot.Bootstrap || boot.Status != LedgerPromoted || boot.Winner != "branch-1" || boot.ParentBranch != "parent-0" {
+		t.Fatalf("unexpected bootstrap record %+v", boot)
+	}
+	if failed.Episode != 1 || failed.Status != LedgerNoWinner || failed.FailureKind != FailureFailed || failed.Error == "" {
+		t.Fatalf("unexpected failed record %+v", failed)
+	}
+	if b := failed.Branches[0]; b.BranchID != "branch-2" || b.ErrorClass != FailureFailed || b.Polls != 1 || b.OutputFile != "" {
+		t.Fatalf("unexpected failed branch %+v", b)
+	}
+	if promoted.Episode != 1 || promoted.Winner != "branch-3" || promoted.ParentBranch != "branch-1" || promoted.PromptHash != promptHash("do it") {
+		t.Fatalf("unexpected promoted record %+v", promoted)
+	}
+	b := promoted.Branches[0]
+	if b.OutputBytes != len("report of branch-3") {
+		t.Fatalf("unexpected promoted branch %+v", b)
+	}
+	data, err := os.ReadFile(b.OutputFile)
+	if err != nil || string(data) != "report of branch-3" {
+		t.Fatalf("output copy %s: %q, %v", b.OutputFile, data, err)
+	}
+	if promoted.StartedAt == "" || promoted.EndedAt == "" {
+		t.Fatalf("missing timestamps in %+v", promoted)
+	}
+
+	// A torn last line (a crash mid-write) is skipped.
+	f, _ := os.OpenFile(filepath.Join(dir, "ledger.jsonl"), os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"episode": 2, "sta`)
+	f.Close()
+	if records, err := ReadLedger(filepath.Join(dir, "ledger.jsonl")); err != nil || len(records) != 3 {
+		t.Fatalf("expected the torn line skipped, got %d records, %v", len(records), err)
+	}
+}
+
+func TestFetchBranchOutputSavesAllAndHoldsTail(t *testing.T) {
+	dir := t.TempDir()
+	ledger := NewLedger(filepath.Join(dir, "ledger.jsonl"), filepath.Join(dir, "outputs"))
+	// A two-byte rune straddles the start of the held tail.
+	output := strings.Repeat("é", maxHeldOutput) + "end"
+	client := &stubControllerClient{branchOutput: func(string, bool) (map[string]any, error) {
+		return map[string]any{"output": output}, nil
+	}}
+
+	out, err := fetchBranchOutput(context.Background(), client, ledger, "branch-1")
+	if err != nil {
+		t.Fatalf("fetchBranchOutput: %v", err)
+	}
+	if out.Bytes != int64(len(output)) || out.blank {
+		t.Fatalf("unexpected output record %+v", out.fetchedOutput)
+	}
+	if len(out.tail) > maxHeldOutput || !strings.HasSuffix(output, out.tail) || !utf8.ValidString(out.tail) {
+		t.Fatalf("expected a valid tail of at most %d bytes, got %d", maxHeldOutput, len(out.tail))
+	}
+	if data, err := os.ReadFile(out.Path); err != nil || string(data) != output {
+		t.Fatalf("expected the full output in %s (%v)", out.Path, err)
+	}
+
+	client.branchOutput = func(string, bool) (map[string]any, error) {
+		return map[string]any{"output": " \n "}, nil
+	}
+	if out, err := fetchBranchOutput(context.Background(), client, ledger, "branch-2"); err != nil || !out.blank || out.Path != "" {
+		t.Fatalf("expected a blank output without a saved file, got %+v, %v", out, err)
+	}
+}
+
+func TestControllerControlSkipTaskAndStop(t *testing.T) {
+	dir := t.TempDir()
+	control := NewControl()
+	client := &stubControllerClient{}
+	client.getBranch = func(branchID string) (map[string]any, error) {
+		if branchID != "branch-2" {
+			return map[string]any{"id": branchID, "status": "succeed"}, nil
+		}
+		// branch-2 never finishes until it is skipped.
+		if err := control.ReplaceTask("new task"); err != nil {
+			t.Errorf("ReplaceTask: %v", err)
+		}
+		if err := control.Skip("branch-9"); !errors.Is(err, ErrControlConflict) {
+			t.Errorf("expected skipping an inactive branch to conflict, got %v", err)
+		}
+		if err := control.Skip(""); err != nil {
+			t.Errorf("Skip: %v", err)
+		}
+		return map[string]any{"id": branchID, "status": "running"}, nil
+	}
+	client.branchOutput = func(branchID string, fullOutput bool) (map[string]any, error) {
+		if branchID == "branch-3" {
+			control.StopAfterEpisode()
+		}
+		return map[string]any{"output": "report of " + branchID}, nil
+	}
+	cfg := ControllerConfig{
+		MCPBaseURL:     "http://localhost:8000/mcp/sse",
+		ProjectName:    "proj",
+		ParentBranchID: "parent-0",
+		Task:           "do it",
+		StatePath:      filepath.Join(dir, "state.json"),
+		PollInterval:   10 * time.Millisecond,
+		Control:        control,
+	}
+	if err := runControllerWithClient(context.Background(), cfg, client, func(time.Duration) {}); err != nil {
+		t.Fatalf("runControllerWithClient: %v", err)
+	}
+
+	// The skipped episode is retried from the same anchor with the new task,
+	// and the controller stops once that episode is promoted.
+	if client.parallelExploreCalls != 3 || client.prompts[1] != "do it" || client.prompts[2] != "new task" {
+		t.Fatalf("unexpected explore calls: %d, prompts %q", client.parallelExploreCalls, client.prompts)
+	}
+	if client.parentBranchIDs[1] != "branch-1" || client.parentBranchIDs[2] != "branch-1" {
+		t.Fatalf("expected both episodes from branch-1, got %v", client.parentBranchIDs)
+	}
+	state, err := loadControllerState(cfg.StatePath)
+	if err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if state.AnchorBranch != "branch-3" || state.Task != "new task" || len(state.ActiveBranchIDs()) != 0 {
+		t.Fatalf("unexpected state %+v", state)
+	}
+	records, err := ReadLedger(filepath.Join(dir, "ledger.jsonl"))
+	if err != nil || len(records) != 3 {
+		t.Fatalf("expected 3 ledger records, got %+v, %v", records, err)
+	}
+	if r := records[1]; r.Status != LedgerSkipped || r.Branches[0].ErrorClass != "skipped" {
+		t.Fatalf("unexpected skipped record %+v", r)
+	}
+	st := control.Status()
+	if st.Phase != PhaseExited || !st.StopAfterEpisode || st.Episodes != 1 || st.Attempts != 3 || st.AnchorBranch != "branch-3" || st.LastError != "" {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestControlHandler(t *testing.T) {
+	control := NewControl()
+	srv := httptest.NewServer(control.Handler("secret"))
+	defer srv.Close()
+	call := func(method, path, body, token string) (int, map[string]any) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if method == "POST" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var out map[string]any
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	if code, _ := call("GET", "/status", "", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", code)
+	}
+	if code, out := call("GET", "/status", "", "secret"); code != http.StatusOK || out["phase"] != PhaseStarting {
+		t.Fatalf("unexpected status %d %v", code, out)
+	}
+	// A cross-site form or a DNS-rebound page cannot drive the API.
+	req, _ := http.NewRequest("POST", srv.URL+"/stop", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "text/plain")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415 for a text/plain command, got %v %v", resp, err)
+	}
+	req, _ = http.NewRequest("GET", srv.URL+"/status", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Host = "attacker.example:8700"
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a foreign Host, got %v %v", resp, err)
+	}
+	if control.Status().StopAfterEpisode {
+		t.Fatal("a refused request changed the controller")
+	}
+	open := httptest.NewServer(control.Handler(""))
+	defer open.Close()
+	if resp, err := http.Get(open.URL + "/status"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected an empty token to refuse every request, got %v %v", resp, err)
+	}
+
+	if code, _ := call("GET", "/pause", "", "secret"); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for GET /pause, got %d", code)
+	}
+	if code, out := call("POST", "/pause", "", "secret"); code != http.StatusOK || out["paused"] != true {
+		t.Fatalf("unexpected pause answer %d %v", code, out)
+	}
+	if code, out := call("POST", "/resume", "", "secret"); code != http.StatusOK || out["paused"] != false {
+		t.Fatalf("unexpected resume answer %d %v", code, out)
+	}
+	if code, out := call("POST", "/skip", "", "secret"); code != http.StatusConflict || out["error"] == nil {
+		t.Fatalf("expected skip without an episode to conflict, got %d %v", code, out)
+	}
+
+	control.publish(ControlStatus{Phase: PhaseRunning}, ControllerState{TaskTemplate: true})
+	for body, want := range map[string]int{
+		`{"task": "Episode {{.Episode}}"}`:        http.StatusOK,
+		`{"task": "Episode {{.Episode"}`:          http.StatusBadRequest,
+		`{"task": "{{include \"/etc/passwd\"}}"}`: http.StatusBadRequest,
+	} {
+		if code, out := call("POST", "/task", body, "secret"); code != want {
+			t.Fatalf("POST /task %s: expected %d, got %d %v", body, want, code, out)
+		}
+	}
+
+	control.publish(ControlStatus{Phase: PhaseExploring}, ControllerState{
+		AnchorBranch:    "a",
+		ActiveBranches:  []string{"b1", "b2"},
+		TaskQueue:       "tasks.jsonl",
+		MinibookAccount: "secret-account",
+		PromptVars:      map[string]string{"key": "secret-var"},
+	})
+	code, out := call("GET", "/status", "", "secret")
+	if code != http.StatusOK || out["task_queue"] != "tasks.jsonl" || out["state"] != nil {
+		t.Fatalf("unexpected status %d %v", code, out)
+	}
+	if raw, _ := json.Marshal(out); strings.Contains(string(raw), "secret-") {
+		t.Fatalf("status leaks state file fields: %s", raw)
+	}
+	if code, _ := call("POST", "/skip", `{"branch_id": "b3"}`, "secret"); code != http.StatusConflict {
+		t.Fatalf("expected skipping an unknown branch to conflict, got %d", code)
+	}
+	if code, out := call("POST", "/skip", `{"branch_id": "b2"}`, "secret"); code != http.StatusOK || out["phase"] != PhaseExploring {
+		t.Fatalf("unexpected skip answer %d %v", code, out)
+	}
+	if control.skipped("b1") || !control.skipped("b2") {
+		t.Fatal("expected only b2 skipped")
+	}
+	if code, _ := call("POST", "/skip", `{`, "secret"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad body, got %d", code)
+	}
+	if code, _ := call("POST", "/task", `{"task": "x"}`, "secret"); code != http.StatusConflict {
+		t.Fatalf("expected replacing the task of a task queue to conflict, got %d", code)
+	}
+	if code, out := call("POST", "/stop", "", "secret"); code != http.StatusOK || out["stop_after_episode"] != true {
+		t.Fatalf("unexpected stop answer %d %v", code, out)
+	}
+}
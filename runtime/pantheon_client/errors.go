@@ -0,0 +1,244 @@
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// JSON-RPC and MCP error codes.
+const (
+	CodeParseError       = -32700
+	CodeInvalidRequest   = -32600
+	CodeMethodNotFound   = -32601
+	CodeInvalidParams    = -32602
+	CodeInternalError    = -32603
+	CodeResourceNotFound = -32002
+)
+
+// RPCError is a JSON-RPC error answer ("error" member of a response).
+type RPCError struct {
+	Method  string
+	Code    int
+	Message string
+	Data    any
+	// HTTPStatus is the status of the HTTP response that carried the error,
+	// or 0 for other transports.
+	HTTPStatus int
+}
+
+func (e *RPCError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = "unknown error"
+	}
+	if e.Method == "" {
+		return fmt.Sprintf("MCP error %d: %s", e.Code, msg)
+	}
+	return fmt.Sprintf("MCP %s error %d: %s", e.Method, e.Code, msg)
+}
+
+// ToolError is a tool failure reported in a result (isError, or an "error"
+// member of the payload) rather than as a JSON-RPC error.
+type ToolError struct {
+	Tool    string
+	Message string
+	// Status is an HTTP-style status the server attached, either as a
+	// structured status_code or as Pantheon's "404: ..." message prefix.
+	Status int
+	// Code is a symbolic code such as "not_found", if the server sent one.
+	Code              string
+	Content           []any
+	StructuredContent map[string]any
+}
+
+func (e *ToolError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = "unknown error"
+	}
+	if e.Tool == "" {
+		return msg
+	}
+	return fmt.Sprintf("%s failed: %s", e.Tool, msg)
+}
+
+// IsNotFound reports whether err says the requested branch, file or
+// resource does not exist.
+func IsNotFound(err error) bool {
+	var rpcErr *RPCError
+	var toolErr *ToolError
+	var httpErr HTTPStatusError
+	switch {
+	case errors.As(err, &toolErr):
+		return toolErr.Status == http.StatusNotFound || toolErr.Code == "not_found"
+	case errors.As(err, &rpcErr):
+		return rpcErr.Code == CodeResourceNotFound || rpcErr.HTTPStatus == http.StatusNotFound
+	case errors.As(err, &httpErr):
+		return httpErr.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// IsRateLimited reports whether Pantheon (or a gateway in front of it)
+// rejected the request for exceeding a rate limit.
+func IsRateLimited(err error) bool {
+	var rpcErr *RPCError
+	var toolErr *ToolError
+	var httpErr HTTPStatusError
+	switch {
+	case errors.As(err, &toolErr):
+		return toolErr.Status == http.StatusTooManyRequests || toolErr.Code == "rate_limited"
+	case errors.As(err, &rpcErr):
+		return rpcErr.HTTPStatus == http.StatusTooManyRequests
+	case errors.As(err, &httpErr):
+		return httpErr.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// IsTransient reports whether retrying later may succeed: everything
+// IsRetryableError accepts, plus rate limits and 5xx statuses reported by a
+// tool or an internal JSON-RPC error.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if IsRetryableError(err) || IsRateLimited(err) {
+		return true
+	}
+	var rpcErr *RPCError
+	var toolErr *ToolError
+	switch {
+	case errors.As(err, &toolErr):
+		return toolErr.Status >= 500
+	case errors.As(err, &rpcErr):
+		return rpcErr.Code == CodeInternalError || rpcErr.HTTPStatus >= 500
+	}
+	return false
+}
+
+// statusPrefix matches Pantheon's "404: message" error convention.
+var statusPrefix = regexp.MustCompile(`^([1-5][0-9][0-9]):\s*`)
+
+// resultError returns the error carried by a JSON-RPC response: an
+// *RPCError for an "error" member, a *ToolError for a tools/call result
+// with isError set. status is the HTTP status of the response, if any.
+func resultError(payload, obj map[string]any, status int) error {
+	method, _ := payload["method"].(string)
+	if errVal, ok := obj["error"]; ok && errVal != nil {
+		e := rpcErrorFrom(errVal)
+		e.Method = method
+		e.HTTPStatus = status
+		return e
+	}
+	if method != "tools/call" {
+		return nil
+	}
+	res, _ := obj["result"].(map[string]any)
+	if isErr, _ := res["isError"].(bool); !isErr {
+		return nil
+	}
+	e := &ToolError{Tool: toolName(payload)}
+	e.Content, _ = res["content"].([]any)
+	e.StructuredContent, _ = res["structuredContent"].(map[string]any)
+	var texts []string
+	for _, item := range e.Content {
+		if m, ok := item.(map[string]any); ok && m["type"] == "text" {
+			if t, _ := m["text"].(string); strings.TrimSpace(t) != "" {
+				texts = append(texts, strings.TrimSpace(t))
+			}
+		}
+	}
+	e.Message = strings.Join(texts, "\n")
+	if sc := e.StructuredContent; sc != nil {
+		if inner, ok := sc["error"].(map[string]any); ok {
+			sc = inner
+		}
+		applyToolErrorFields(e, sc)
+	}
+	if e.Status == 0 {
+		e.Status = prefixedStatus(e.Message)
+	}
+	return e
+}
+
+// payloadError turns an "error" member found inside a result payload into
+// a *ToolError (or an *RPCError when it carries a JSON-RPC code).
+func payloadError(val any) error {
+	switch v := val.(type) {
+	case string:
+		msg := strings.TrimSpace(v)
+		if msg == "" {
+			msg = "unknown error"
+		}
+		return &ToolError{Message: msg, Status: prefixedStatus(msg)}
+	case map[string]any:
+		if code, ok := v["code"].(float64); ok && code < 0 {
+			return rpcErrorFrom(v)
+		}
+		e := &ToolError{StructuredContent: v}
+		applyToolErrorFields(e, v)
+		if e.Message == "" {
+			data, _ := json.Marshal(v)
+			e.Message = string(data)
+		}
+		if e.Status == 0 {
+			e.Status = prefixedStatus(e.Message)
+		}
+		return e
+	case nil:
+		return &ToolError{Message: "unknown error"}
+	}
+	return &ToolError{Message: fmt.Sprint(val)}
+}
+
+func rpcErrorFrom(val any) *RPCError {
+	m, ok := val.(map[string]any)
+	if !ok {
+		return &RPCError{Message: strings.TrimSpace(fmt.Sprint(val))}
+	}
+	e := &RPCError{Data: m["data"]}
+	if code, ok := m["code"].(float64); ok {
+		e.Code = int(code)
+	}
+	e.Message, _ = m["message"].(string)
+	e.Message = strings.TrimSpace(e.Message)
+	return e
+}
+
+// applyToolErrorFields reads message, status and code from a structured
+// error object. "code" may be numeric (an HTTP status) or symbolic.
+func applyToolErrorFields(e *ToolError, m map[string]any) {
+	if msg, ok := m["message"].(string); ok && strings.TrimSpace(msg) != "" && e.Message == "" {
+		e.Message = strings.TrimSpace(msg)
+	}
+	for _, key := range []string{"status_code", "status", "code"} {
+		switch v := m[key].(type) {
+		case float64:
+			if v >= 100 && v < 600 && e.Status == 0 {
+				e.Status = int(v)
+			}
+		case string:
+			if n, err := strconv.Atoi(v); err == nil && n >= 100 && n < 600 {
+				if e.Status == 0 {
+					e.Status = n
+				}
+			} else if key == "code" && e.Code == "" {
+				e.Code = strings.ToLower(strings.TrimSpace(v))
+			}
+		}
+	}
+}
+
+func prefixedStatus(msg string) int {
+	if m := statusPrefix.FindStringSubmatch(msg); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,193 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// GateInput is what a Gate checks: a finished branch and ways to look into
+// it.
+type GateInput struct {
+	BranchID string
+	// Output is the branch's output, or its last MiB when longer.
+	Output string
+	// ReadFile reads a file from the branch snapshot.
+	ReadFile func(ctx context.Context, path string) (string, error)
+	// RunAgent runs agent ("" for the episode agent) with prompt on a new
+	// branch from BranchID and returns its output.
+	RunAgent func(ctx context.Context, agent, prompt string) (string, error)
+}
+
+// Gate decides whether a finished branch may become the anchor. Check
+// returns a *GateError when the branch fails the gate; any other error means
+// the gate could not be evaluated (e.g. Pantheon is unreachable) and the
+// episode is resumed later.
+type Gate interface {
+	Check(ctx context.Context, in GateInput) error
+}
+
+// GateError reports a branch that failed a gate.
+type GateError struct {
+	Gate     string
+	BranchID string
+	Reason   string
+}
+
+func (e *GateError) Error() string {
+	return fmt.Sprintf("branch %s failed gate %s: %s", e.BranchID, e.Gate, e.Reason)
+}
+
+// FileGate requires a non-empty file in the branch snapshot, e.g. a report
+// the task asks the agent to write.
+type FileGate struct {
+	Path string
+}
+
+func (g FileGate) Check(ctx context.Context, in GateInput) error {
+	content, err := in.ReadFile(ctx, g.Path)
+	if IsNotFound(err) {
+		return &GateError{Gate: "file:" + g.Path, BranchID: in.BranchID, Reason: "file not found"}
+	}
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(content) == "" {
+		return &GateError{Gate: "file:" + g.Path, BranchID: in.BranchID, Reason: "file is empty"}
+	}
+	return nil
+}
+
+// OutputGate requires the branch output to match Pattern, or with Absent,
+// not to match it.
+type OutputGate struct {
+	Pattern *regexp.Regexp
+	Absent  bool
+}
+
+func (g OutputGate) Check(ctx context.Context, in GateInput) error {
+	matched := g.Pattern.MatchString(in.Output)
+	switch {
+	case !g.Absent && !matched:
+		return &GateError{Gate: "output:" + g.Pattern.String(), BranchID: in.BranchID, Reason: "output does not match"}
+	case g.Absent && matched:
+		return &GateError{Gate: "no-output:" + g.Pattern.String(), BranchID: in.BranchID, Reason: fmt.Sprintf("output contains %q", g.Pattern.FindString(in.Output))}
+	}
+	return nil
+}
+
+// verifierVerdict matches the verifier agent's answer line.
+var verifierVerdict = regexp.MustCompile(`(?im)^\W*VERDICT:\s*(PASS|FAIL)\b[\s:-]*(.*)$`)
+
+const verifierPrompt = `Verify the workspace left by the previous agent before it becomes the baseline for later work. Do not change any files.
+Check that the project builds, its tests pass, and the working tree is not left half-edited (conflict markers, stray temporary files, unfinished changes).
+End your answer with a single line "VERDICT: PASS" or "VERDICT: FAIL <reason>".`
+
+// VerifierGate runs a verifier agent on the candidate branch and requires
+// it to answer "VERDICT: PASS".
+type VerifierGate struct {
+	// Agent runs the verifier; "" uses the episode agent.
+	Agent string
+}
+
+func (g VerifierGate) Check(ctx context.Context, in GateInput) error {
+	if in.RunAgent == nil {
+		return fmt.Errorf("verifier gate needs an agent runner")
+	}
+	output, err := in.RunAgent(ctx, g.Agent, verifierPrompt)
+	if err != nil {
+		if isTerminalFailed(err) {
+			return &GateError{Gate: "verifier", BranchID: in.BranchID, Reason: "verifier agent failed"}
+		}
+		return err
+	}
+	matches := verifierVerdict.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return &GateError{Gate: "verifier", BranchID: in.BranchID, Reason: "verifier gave no VERDICT line"}
+	}
+	last := matches[len(matches)-1]
+	if strings.EqualFold(last[1], "pass") {
+		return nil
+	}
+	reason := strings.TrimSpace(last[2])
+	if reason == "" {
+		reason = "verifier answered FAIL"
+	}
+	return &GateError{Gate: "verifier", BranchID: in.BranchID, Reason: reason}
+}
+
+// CommandGate runs Command with "sh -c", feeding it the branch output on
+// stdin and the branch id in $AGENT0_BRANCH_ID. Exit status 0 passes.
+type CommandGate struct {
+	Command string
+}
+
+func (g CommandGate) Check(ctx context.Context, in GateInput) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", g.Command)
+	cmd.Stdin = strings.NewReader(in.Output)
+	cmd.Env = append(os.Environ(), "AGENT0_BRANCH_ID="+in.BranchID)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		reason := strings.TrimSpace(out.String())
+		if len(reason) > 500 {
+			reason = "..." + reason[len(reason)-500:]
+		}
+		if reason == "" {
+			reason = exitErr.Error()
+		}
+		return &GateError{Gate: "command:" + g.Command, BranchID: in.BranchID, Reason: reason}
+	}
+	if err != nil {
+		return fmt.Errorf("gate command %q: %w", g.Command, err)
+	}
+	return nil
+}
+
+// ParseGate parses a gate spec: "file:<path>", "output:<regexp>",
+// "no-output:<regexp>", "verifier" or "verifier:<agent>", or
+// "command:<shell command>".
+func ParseGate(spec string) (Gate, error) {
+	spec = strings.TrimSpace(spec)
+	name, arg, _ := strings.Cut(spec, ":")
+	arg = strings.TrimSpace(arg)
+	switch strings.TrimSpace(name) {
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("gate %q: file needs a path", spec)
+		}
+		return FileGate{Path: arg}, nil
+	case "output", "no-output":
+		re, err := regexp.Compile(arg)
+		if err != nil || arg == "" {
+			return nil, fmt.Errorf("gate %q: want a regular expression: %v", spec, err)
+		}
+		return OutputGate{Pattern: re, Absent: name == "no-output"}, nil
+	case "verifier":
+		return VerifierGate{Agent: arg}, nil
+	case "command":
+		if arg == "" {
+			return nil, fmt.Errorf("gate %q: command needs a shell command", spec)
+		}
+		return CommandGate{Command: arg}, nil
+	}
+	return nil, fmt.Errorf("unknown gate %q (want file:<path>, output:<regexp>, no-output:<regexp>, verifier[:agent] or command:<cmd>)", spec)
+}
+
+// checkGates runs gates in order and stops at the first failure.
+func checkGates(ctx context.Context, gates []Gate, in GateInput) error {
+	for _, g := range gates {
+		if err := g.Check(ctx, in); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package tools
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"path/filepath"
@@ -16,15 +17,22 @@ type ToolExecutionError struct {
 	Msg         string
 	Instruction string
 	Details     map[string]any
+	// Cause is the underlying client error, if any, for errors.Is/As.
+	Cause error
 }
 
 func (e ToolExecutionError) Error() string { return e.Msg }
 
+func (e ToolExecutionError) Unwrap() error { return e.Cause }
+
+// agentClient is the subset of MCPClient used by the handler and controller.
+// Every call takes the caller's context so shutdown and deadlines propagate
+// into in-flight requests and retry backoff.
 type agentClient interface {
-	ParallelExplore(projectName, parentBranchID string, prompts []string, agent string, numBranches int) (map[string]any, error)
-	GetBranch(branchID string) (map[string]any, error)
-	BranchReadFile(branchID, filePath string) (map[string]any, error)
-	BranchOutput(branchID string, fullOutput bool) (map[string]any, error)
+	ParallelExploreContext(ctx context.Context, projectName, parentBranchID string, prompts []string, agent string, numBranches int) (map[string]any, error)
+	GetBranchContext(ctx context.Context, branchID string) (map[string]any, error)
+	BranchReadFileContext(ctx context.Context, branchID, filePath string) (map[string]any, error)
+	BranchOutputContext(ctx context.Context, branchID string, fullOutput bool) (map[string]any, error)
 }
 
 var _ agentClient = (*MCPClient)(nil)
@@ -70,6 +78,8 @@ type ToolHandler struct {
 	defaultProj   string
 	branchTracker *BranchTracker
 	workspaceDir  string
+	// onPoll, if set, is called for every get_branch poll of waitForBranch.
+	onPoll func(branchID string)
 }
 
 // NewToolHandler creates a handler without config. Uses hardcoded defaults.
@@ -107,7 +117,12 @@ type ToolCall struct {
 	} `json:"function"`
 }
 
+// Handle is HandleContext with context.Background().
 func (h *ToolHandler) Handle(call ToolCall) map[string]any {
+	return h.HandleContext(context.Background(), call)
+}
+
+func (h *ToolHandler) HandleContext(ctx context.Context, call ToolCall) map[string]any {
 	name := call.Function.Name
 	if name == "" {
 		return h.errorPayload(ToolExecutionError{Msg: "Missing tool name in call."})
@@ -125,13 +140,13 @@ func (h *ToolHandler) Handle(call ToolCall) map[string]any {
 	var err error
 	switch name {
 	case "execute_agent":
-		res, err = h.executeAgent(args)
+		res, err = h.executeAgent(ctx, args)
 	case "check_status":
-		res, err = h.checkStatus(args)
+		res, err = h.checkStatus(ctx, args)
 	case "read_artifact":
-		res, err = h.readArtifact(args)
+		res, err = h.readArtifact(ctx, args)
 	case "branch_output":
-		res, err = h.branchOutput(args)
+		res, err = h.branchOutput(ctx, args)
 	default:
 		err = ToolExecutionError{Msg: fmt.Sprintf("Unsupported tool: %s", name)}
 	}
@@ -141,7 +156,7 @@ func (h *ToolHandler) Handle(call ToolCall) map[string]any {
 	return map[string]any{"status": "success", "data": res}
 }
 
-func (h *ToolHandler) executeAgent(arguments map[string]any) (map[string]any, error) {
+func (h *ToolHandler) executeAgent(ctx context.Context, arguments map[string]any) (map[string]any, error) {
 	agent, _ := arguments["agent"].(string)
 	prompt, _ := arguments["prompt"].(string)
 	project := h.defaultProj
@@ -155,35 +170,29 @@ func (h *ToolHandler) executeAgent(arguments map[string]any) (map[string]any, er
 	}
 
 	if agent == reviewCodeAgent {
-		return h.executeReviewAgent(project, parent, prompt)
+		return h.executeReviewAgent(ctx, project, parent, prompt)
 	}
-	result, _, err := h.runAgentOnce(agent, project, parent, prompt)
+	result, _, err := h.runAgentOnce(ctx, agent, project, parent, prompt)
 	return result, err
 }
 
-func (h *ToolHandler) runAgentOnce(agent, project, parent, prompt string) (map[string]any, string, error) {
+func (h *ToolHandler) runAgentOnce(ctx context.Context, agent, project, parent, prompt string) (map[string]any, string, error) {
 	logx.Infof("Executing agent %s on project %s from parent %s", agent, project, parent)
-	resp, err := h.client.ParallelExplore(project, parent, []string{prompt}, agent, 1)
+	resp, err := h.client.ParallelExploreContext(ctx, project, parent, []string{prompt}, agent, 1)
 	if err != nil {
 		return nil, "", ToolExecutionError{
 			Msg:         fmt.Sprintf("ParallelExplore failed: %v - %v", err, resp),
 			Instruction: instructionFinishedWithErr,
 		}
 	}
-	if isErr, ok := resp["isError"].(bool); ok && isErr {
-		errMsg := resp["error"]
-		if errMsg == nil {
-			return nil, "", ToolExecutionError{
-				Msg:         fmt.Sprintf("ParallelExplore returned error (details: %v)", resp),
-				Instruction: instructionFinishedWithErr,
-			}
-		}
+	explore, err := DecodeExploreResult(resp, DecodeLenient)
+	if err != nil {
 		return nil, "", ToolExecutionError{
-			Msg:         fmt.Sprintf("ParallelExplore returned error: %v", errMsg),
+			Msg:         fmt.Sprintf("ParallelExplore returned error: %v", err),
 			Instruction: instructionFinishedWithErr,
 		}
 	}
-	branchID := ExtractBranchID(resp)
+	branchID := explore.BranchID()
 	if branchID == "" {
 		return nil, "", ToolExecutionError{
 			Msg:         fmt.Sprintf("Missing branch id in parallel_explore response: %v", resp),
@@ -195,8 +204,11 @@ func (h *ToolHandler) runAgentOnce(agent, project, parent, prompt string) (map[s
 	result := map[string]any{"parallel_explore": resp, "branch_id": branchID}
 
 	logx.Infof("Waiting for branch %s to complete.", branchID)
-	statusResp, err := h.checkStatus(map[string]any{"branch_id": branchID})
+	branch, err := h.waitForBranch(ctx, map[string]any{"branch_id": branchID})
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, "", err
+		}
 		// checkStatus failed - don't record this branch ID
 		if te, ok := err.(ToolExecutionError); ok {
 			// If checkStatus already set FINISHED_WITH_ERROR, propagate it
@@ -216,28 +228,22 @@ func (h *ToolHandler) runAgentOnce(agent, project, parent, prompt string) (map[s
 	// Only record branch ID after successful status check
 	h.branchTracker.Record(branchID)
 
-	result["branch"] = statusResp
-	if status, ok := statusResp["status"]; ok {
-		result["status"] = status
+	result["branch"] = branch.Raw
+	if branch.Status != "" {
+		result["status"] = branch.Status
 	}
 
-	responseText := ""
-	if out, ok := statusResp["output"].(string); ok && strings.TrimSpace(out) != "" {
-		responseText = strings.TrimSpace(out)
-	} else if manifest, ok := statusResp["manifest"].(map[string]any); ok {
-		if summary, ok := manifest["summary"].(string); ok && strings.TrimSpace(summary) != "" {
-			responseText = strings.TrimSpace(summary)
-		}
+	responseText := branch.Output
+	if responseText == "" {
+		responseText = branch.Summary()
 	}
 
-	branchOutputResponse, err := h.client.BranchOutput(branchID, true)
+	branchOutputResponse, err := h.client.BranchOutputContext(ctx, branchID, true)
 	if err != nil {
 		return nil, "", err
-	} else {
-		branchOutput := branchOutputString(branchOutputResponse)
-		if branchOutput != "" {
-			responseText = branchOutput
-		}
+	}
+	if out, err := DecodeBranchOutput(branchOutputResponse, DecodeLenient); err == nil && out.Output != "" {
+		responseText = out.Output
 	}
 	if strings.TrimSpace(responseText) == "" {
 		return nil, "", ToolExecutionError{Msg: "branch_output returned no textual output"}
@@ -247,24 +253,24 @@ func (h *ToolHandler) runAgentOnce(agent, project, parent, prompt string) (map[s
 	return result, branchID, nil
 }
 
-func (h *ToolHandler) executeReviewAgent(project, parent, prompt string) (map[string]any, error) {
+func (h *ToolHandler) executeReviewAgent(ctx context.Context, project, parent, prompt string) (map[string]any, error) {
 	artifactPath := h.reviewLogPath()
 	if artifactPath == "" {
 		return nil, ToolExecutionError{Msg: "workspace directory not configured for review_code validation"}
 	}
 	var lastBranch string
 	for attempt := 1; attempt <= reviewMaxAttempts; attempt++ {
-		result, branchID, err := h.runAgentOnce(reviewCodeAgent, project, parent, prompt)
+		result, branchID, err := h.runAgentOnce(ctx, reviewCodeAgent, project, parent, prompt)
 		if err != nil {
 			return nil, err
 		}
 		lastBranch = branchID
-		if artifact, err := h.client.BranchReadFile(branchID, artifactPath); err == nil {
-			if content, ok := artifact["content"].(string); ok && strings.TrimSpace(content) != "" {
-				result["review_report"] = content
+		if artifact, err := h.client.BranchReadFileContext(ctx, branchID, artifactPath); err == nil {
+			if file, _ := DecodeFileContent(artifact, DecodeLenient); strings.TrimSpace(file.Content) != "" {
+				result["review_report"] = file.Content
 			}
 			return result, nil
-		} else if !isNotFoundError(err) {
+		} else if !IsNotFound(err) {
 			return nil, err
 		}
 		logx.Warningf("review_code attempt %d/%d did not produce %s (branch=%s)", attempt, reviewMaxAttempts, artifactPath, branchID)
@@ -294,10 +300,20 @@ func (h *ToolHandler) reviewLogPath() string {
 	return filepath.Join(h.workspaceDir, reviewArtifactName)
 }
 
-func (h *ToolHandler) checkStatus(arguments map[string]any) (map[string]any, error) {
+func (h *ToolHandler) checkStatus(ctx context.Context, arguments map[string]any) (map[string]any, error) {
+	branch, err := h.waitForBranch(ctx, arguments)
+	if err != nil {
+		return nil, err
+	}
+	return branch.Raw, nil
+}
+
+// waitForBranch polls get_branch until the branch reaches a terminal status
+// that belongs to the branch itself (see the snapshot check below).
+func (h *ToolHandler) waitForBranch(ctx context.Context, arguments map[string]any) (Branch, error) {
 	branchID, _ := arguments["branch_id"].(string)
 	if branchID == "" {
-		return nil, ToolExecutionError{Msg: "`branch_id` is required"}
+		return Branch{}, ToolExecutionError{Msg: "`branch_id` is required"}
 	}
 	// Defaults for tests or when config is nil
 	timeout := 3600.0 * 6 // 6 hours
@@ -328,59 +344,57 @@ func (h *ToolHandler) checkStatus(arguments map[string]any) (map[string]any, err
 
 	logx.Infof("Checking status for branch %s (timeout=%ds)", branchID, int(timeout))
 	for attempt := 1; ; attempt++ {
-		resp, err := h.client.GetBranch(branchID)
+		if h.onPoll != nil {
+			h.onPoll(branchID)
+		}
+		resp, err := h.client.GetBranchContext(ctx, branchID)
 		if err != nil {
-			return nil, ToolExecutionError{
-				Msg: fmt.Sprintf("GetBranch API call failed for branch %s: %v", branchID, err),
+			if ctx.Err() != nil {
+				return Branch{}, ctx.Err()
+			}
+			return Branch{}, ToolExecutionError{
+				Msg:   fmt.Sprintf("GetBranch API call failed for branch %s: %v", branchID, err),
+				Cause: err,
 			}
 		}
 
-		// Check if the response contains an error (e.g., 404 branch not found)
-		if errMsg, ok := resp["error"]; ok {
-			return nil, ToolExecutionError{
-				Msg: fmt.Sprintf("GetBranch returned error for branch %s: %v", branchID, errMsg),
+		// Errors carried in the payload (e.g., 404 branch not found) surface from the decoder.
+		branch, err := DecodeBranch(resp, DecodeLenient)
+		if err != nil {
+			return Branch{}, ToolExecutionError{
+				Msg: fmt.Sprintf("GetBranch returned error for branch %s: %v", branchID, err),
 			}
 		}
-
-		// Validate branch id in response
-		if id := ExtractBranchID(resp); id != "" {
-			// Don't record here - let the caller decide when to record
-			// h.branchTracker.Record(id)
-		} else {
-			return nil, ToolExecutionError{
+		if branch.ID == "" {
+			return Branch{}, ToolExecutionError{
 				Msg: fmt.Sprintf("Branch status response missing branch identifier. Response: %v", resp),
 			}
 		}
 
-		status := stringsLower(resp["status"])
-		latest_snap_id := stringsLower(resp["latest_snap_id"])
+		status := branch.Status
 		hasNewSnapshot := true
-		parent_branch_id := stringsLower(resp["parent_id"])
-		if parent_branch_id != "" {
-			parent_resp, err := h.client.GetBranch(parent_branch_id)
+		if branch.ParentID != "" {
+			parentResp, err := h.client.GetBranchContext(ctx, branch.ParentID)
 			if err != nil {
-				logx.Errorf("Error getting parent branch %s: %v", parent_branch_id, err)
+				logx.Errorf("Error getting parent branch %s: %v", branch.ParentID, err)
 				hasNewSnapshot = false
 			} else {
-				parent_latest_snap_id := stringsLower(parent_resp["latest_snap_id"])
+				parent, _ := DecodeBranch(parentResp, DecodeLenient)
 				// If child's latest_snap_id matches parent's, the child is still using the inherited snapshot.
 				// The status we see might be inherited from parent, not the child's own status.
 				// We must wait for the child to create its own snapshot before trusting the status.
-				if parent_latest_snap_id != "" && parent_latest_snap_id == latest_snap_id {
+				if parent.LatestSnapID != "" && strings.EqualFold(parent.LatestSnapID, branch.LatestSnapID) {
 					hasNewSnapshot = false
 				}
 			}
 		}
 
 		logx.Infof("Branch %s response (attempt %d): %s", branchID, attempt, toJSON(resp))
-		if hasNewSnapshot && (status == "succeed" || status == "ready_for_manifest" || status == "finished" || status == "failed" || status == "manifesting") {
+		if hasNewSnapshot && branch.IsTerminal() {
 			if status == "failed" {
-				details := map[string]any{"status": status}
-				if branchID := ExtractBranchID(resp); branchID != "" {
-					details["branch_id"] = branchID
-				}
+				details := map[string]any{"status": status, "branch_id": branch.ID}
 				excerpt := ""
-				if outResp, err := h.client.BranchOutput(branchID, true); err == nil {
+				if outResp, err := h.client.BranchOutputContext(ctx, branchID, true); err == nil {
 					excerpt = strings.TrimSpace(branchOutputString(outResp))
 					if len(excerpt) > 400 {
 						excerpt = excerpt[:400] + "..."
@@ -390,38 +404,41 @@ func (h *ToolHandler) checkStatus(arguments map[string]any) (map[string]any, err
 				if excerpt != "" {
 					msg = fmt.Sprintf("Branch %s reported failed status: %s. Inspect manifest %s in Pantheon.", branchID, excerpt, branchID)
 				}
-				return nil, ToolExecutionError{
+				return Branch{}, ToolExecutionError{
 					Msg:         msg,
 					Instruction: instructionFinishedWithErr,
 					Details:     details,
 				}
 			}
-			return resp, nil
+			return branch, nil
 		}
 
 		if time.Now().After(deadline) {
-			return nil, ToolExecutionError{
+			return Branch{}, ToolExecutionError{
 				Msg:         fmt.Sprintf("Timed out waiting for branch %s (last status=%s)", branchID, status),
 				Instruction: instructionFinishedWithErr,
+				Details:     map[string]any{"status": "timeout", "branch_id": branchID, "last_status": status},
 			}
 		}
 		logx.Infof("Branch %s still active (status=%s). Sleeping %.1fs.", branchID, status, sleep.Seconds())
-		time.Sleep(sleep)
+		if err := sleepContext(ctx, sleep); err != nil {
+			return Branch{}, err
+		}
 		sleep = time.Duration(minFloat(float64(sleep/time.Second)*backoffFactor, maxPoll)) * time.Second
 	}
 }
 
-func (h *ToolHandler) readArtifact(arguments map[string]any) (map[string]any, error) {
+func (h *ToolHandler) readArtifact(ctx context.Context, arguments map[string]any) (map[string]any, error) {
 	branchID, _ := arguments["branch_id"].(string)
 	path, _ := arguments["path"].(string)
 	if branchID == "" || path == "" {
 		return nil, ToolExecutionError{Msg: "`branch_id` and `path` are required"}
 	}
 	logx.Infof("Reading artifact %s from branch %s", path, branchID)
-	return h.client.BranchReadFile(branchID, path)
+	return h.client.BranchReadFileContext(ctx, branchID, path)
 }
 
-func (h *ToolHandler) branchOutput(arguments map[string]any) (map[string]any, error) {
+func (h *ToolHandler) branchOutput(ctx context.Context, arguments map[string]any) (map[string]any, error) {
 	rawBranchID, _ := arguments["branch_id"].(string)
 	branchID := strings.TrimSpace(rawBranchID)
 	if branchID == "" {
@@ -436,55 +453,21 @@ func (h *ToolHandler) branchOutput(arguments map[string]any) (map[string]any, er
 		fullOutput = flag
 	}
 	logx.Infof("Retrieving branch_output for %s (full_output=%t)", branchID, fullOutput)
-	return h.client.BranchOutput(branchID, fullOutput)
+	return h.client.BranchOutputContext(ctx, branchID, fullOutput)
 }
 
+// ExtractBranchID returns the first branch ID found in a Pantheon payload.
+// See DecodeExploreResult for the shapes it understands.
 func ExtractBranchID(m map[string]any) string {
-	if m == nil {
-		return ""
-	}
-
-	if pe, ok := m["parallel_explore"].(map[string]any); ok {
-		if branches, ok := pe["branches"].([]any); ok {
-			for _, item := range branches {
-				if nested, _ := item.(map[string]any); nested != nil {
-					if id := ExtractBranchID(nested); id != "" {
-						return id
-					}
-				}
-			}
-		}
-	}
-	if branches, ok := m["branches"].([]any); ok {
-		for _, item := range branches {
-			if nested, _ := item.(map[string]any); nested != nil {
-				if id := ExtractBranchID(nested); id != "" {
-					return id
-				}
-			}
-		}
-	}
-	if b, ok := m["branch"].(map[string]any); ok {
-		if id := ExtractBranchID(b); id != "" {
-			return id
-		}
-	}
-	for _, k := range []string{"branch_id", "id"} {
-		if v, ok := m[k].(string); ok && v != "" {
-			return v
-		}
+	if ids := collectBranchIDs(m); len(ids) > 0 {
+		return ids[0]
 	}
 	return ""
 }
 
 func branchOutputString(payload map[string]any) string {
-	if payload == nil {
-		return ""
-	}
-	if out, ok := payload["output"].(string); ok {
-		return strings.TrimSpace(out)
-	}
-	return ""
+	out, _ := DecodeBranchOutput(payload, DecodeLenient)
+	return out.Output
 }
 
 func (h *ToolHandler) errorPayload(err error) map[string]any {
@@ -510,14 +493,6 @@ func (h *ToolHandler) errorPayload(err error) map[string]any {
 	return map[string]any{"status": "error", "error": err.Error()}
 }
 
-func stringsLower(v any) string {
-	if v == nil {
-		return ""
-	}
-	s, _ := v.(string)
-	return stringsTrimLower(s)
-}
-
 func stringsTrimLower(s string) string {
 	return strings.ToLower(strings.TrimSpace(s))
 }
@@ -529,14 +504,6 @@ func minFloat(a, b float64) float64 {
 	return b
 }
 
-func isNotFoundError(err error) bool {
-	if err == nil {
-		return false
-	}
-	msg := strings.ToLower(err.Error())
-	return strings.Contains(msg, "404")
-}
-
 // Tool schema to feed the LLM
 func GetToolDefinitions() []map[string]any {
 	return []map[string]any{
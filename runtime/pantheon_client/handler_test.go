@@ -1,8 +1,10 @@
 package tools
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"testing"
 )
@@ -29,7 +31,7 @@ func TestExecuteAgentReviewCodeRetriesMissingLog(t *testing.T) {
 		"project_name":     "proj",
 	}
 
-	res, err := handler.executeAgent(args)
+	res, err := handler.executeAgent(context.Background(), args)
 	if err != nil {
 		t.Fatalf("executeAgent returned error: %v", err)
 	}
@@ -75,7 +77,7 @@ func TestExecuteAgentReviewCodeFailsAfterMaxAttempts(t *testing.T) {
 		"project_name":     "proj",
 	}
 
-	_, err := handler.executeAgent(args)
+	_, err := handler.executeAgent(context.Background(), args)
 	if err == nil {
 		t.Fatalf("expected error after max attempts, got nil")
 	}
@@ -211,7 +213,7 @@ type branchOutputInput struct {
 	fullOutput bool
 }
 
-func (f *fakeMCPClient) ParallelExplore(projectName, parentBranchID string, prompts []string, agent string, numBranches int) (map[string]any, error) {
+func (f *fakeMCPClient) ParallelExploreContext(ctx context.Context, projectName, parentBranchID string, prompts []string, agent string, numBranches int) (map[string]any, error) {
 	f.parallelExploreCalls++
 	branchID := fmt.Sprintf("branch-%d", f.parallelExploreCalls)
 	return map[string]any{
@@ -219,14 +221,14 @@ func (f *fakeMCPClient) ParallelExplore(projectName, parentBranchID string, prom
 	}, nil
 }
 
-func (f *fakeMCPClient) GetBranch(branchID string) (map[string]any, error) {
+func (f *fakeMCPClient) GetBranchContext(ctx context.Context, branchID string) (map[string]any, error) {
 	return map[string]any{
 		"id":     branchID,
 		"status": "succeed",
 	}, nil
 }
 
-func (f *fakeMCPClient) BranchReadFile(branchID, filePath string) (map[string]any, error) {
+func (f *fakeMCPClient) BranchReadFileContext(ctx context.Context, branchID, filePath string) (map[string]any, error) {
 	f.branchReadInputs = append(f.branchReadInputs, branchReadInput{branchID: branchID, path: filePath})
 	if len(f.readResults) == 0 {
 		return nil, fmt.Errorf("no stub result for branch %s", branchID)
@@ -238,23 +240,13 @@ func (f *fakeMCPClient) BranchReadFile(branchID, filePath string) (map[string]an
 	}
 	if next.data != nil {
 		if errVal, ok := next.data["error"]; ok && errVal != nil {
-			switch v := errVal.(type) {
-			case string:
-				return nil, fmt.Errorf("%s", strings.TrimSpace(v))
-			case map[string]any:
-				if msg, ok := v["message"].(string); ok && strings.TrimSpace(msg) != "" {
-					return nil, fmt.Errorf("%s", strings.TrimSpace(msg))
-				}
-				return nil, fmt.Errorf("%v", v)
-			default:
-				return nil, fmt.Errorf("%v", v)
-			}
+			return nil, payloadError(errVal)
 		}
 	}
 	return next.data, nil
 }
 
-func (f *fakeMCPClient) BranchOutput(branchID string, fullOutput bool) (map[string]any, error) {
+func (f *fakeMCPClient) BranchOutputContext(ctx context.Context, branchID string, fullOutput bool) (map[string]any, error) {
 	f.branchOutputInputs = append(f.branchOutputInputs, branchOutputInput{branchID: branchID, fullOutput: fullOutput})
 	if f.branchOutputErr != nil {
 		return nil, f.branchOutputErr
@@ -266,5 +258,5 @@ func (f *fakeMCPClient) BranchOutput(branchID string, fullOutput bool) (map[stri
 }
 
 func notFoundErr(attempt int) error {
-	return fmt.Errorf("MCP HTTP 404: attempt %d not found", attempt)
+	return HTTPStatusError{StatusCode: http.StatusNotFound, Body: fmt.Sprintf("attempt %d not found", attempt)}
 }
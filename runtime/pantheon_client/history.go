@@ -0,0 +1,240 @@
+package tools
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/IANTHEREAL/agent0/internal/logx"
+)
+
+// Reasons an anchor was set, as recorded in the anchor history.
+const (
+	AnchorParent = "parent"
+	// AnchorInitial is an anchor found in a state file that predates the
+	// history.
+	AnchorInitial   = "initial"
+	AnchorBootstrap = "bootstrap"
+	AnchorEpisode   = "episode"
+	AnchorRollback  = "rollback"
+)
+
+// anchorExcerptLen bounds the output excerpt kept per history entry.
+const anchorExcerptLen = 300
+
+// AnchorRecord is one entry of the append-only anchor history.
+type AnchorRecord struct {
+	BranchID string `json:"branch_id"`
+	Reason   string `json:"reason"`
+	// Episode counts episodes across runs; 0 for the parent and bootstrap.
+	Episode int `json:"episode,omitempty"`
+	// At is when the anchor was set (RFC 3339, UTC).
+	At string `json:"at"`
+	// PromptHash identifies the episode prompt (sha256, 12 hex digits).
+	PromptHash    string `json:"prompt_hash,omitempty"`
+	OutputExcerpt string `json:"output_excerpt,omitempty"`
+	// Task is the queued task the episode worked on.
+	Task string `json:"task,omitempty"`
+	// RolledBackFrom is the anchor a rollback replaced.
+	RolledBackFrom string `json:"rolled_back_from,omitempty"`
+}
+
+// recordAnchor appends rec to the history, stamping the time.
+func (s *ControllerState) recordAnchor(rec AnchorRecord) {
+	rec.At = time.Now().UTC().Format(time.RFC3339)
+	s.AnchorHistory = append(s.AnchorHistory, rec)
+}
+
+// nextEpisode is the number the next episode gets in the anchor history.
+func (s ControllerState) nextEpisode() int {
+	n := 0
+	for _, rec := range s.AnchorHistory {
+		if rec.Episode > n {
+			n = rec.Episode
+		}
+	}
+	return n + 1
+}
+
+// anchorLineage replays the history into the chain of anchors that led to
+// the current one: a rollback drops the anchors after its target.
+func anchorLineage(history []AnchorRecord) []AnchorRecord {
+	var lineage []AnchorRecord
+	for _, rec := range history {
+		if rec.Reason == AnchorRollback {
+			if i := lastAnchorIndex(lineage, rec.BranchID); i >= 0 {
+				lineage = lineage[:i+1]
+				continue
+			}
+		}
+		lineage = append(lineage, rec)
+	}
+	return lineage
+}
+
+func lastAnchorIndex(records []AnchorRecord, branchID string) int {
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].BranchID == branchID {
+			return i
+		}
+	}
+	return -1
+}
+
+func promptHash(prompt string) string {
+	if prompt == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(prompt))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// outputExcerpt keeps the end of an agent's output, where its report is.
+func outputExcerpt(output string) string {
+	output = strings.TrimSpace(output)
+	if len(output) <= anchorExcerptLen {
+		return output
+	}
+	return "..." + tailBytes(output, anchorExcerptLen)
+}
+
+// RollbackConfig configures RollbackAnchor.
+type RollbackConfig struct {
+	StatePath string
+	// To is the branch to return to; it must appear in the anchor history.
+	// Otherwise the anchor moves Steps (default 1) anchors back.
+	To    string
+	Steps int
+
+	// MCP is used to check that no active episode branch is still running;
+	// the state file supplies the URL and transport by default.
+	MCP MCPConnection
+}
+
+// RollbackAnchor resets the anchor to an earlier branch of the anchor
+// history and records the rollback. It refuses while a controller runs on
+// the state file (ErrStateLocked) or an active episode branch is still
+// running on Pantheon; stopped ones are cleared.
+func RollbackAnchor(ctx context.Context, cfg RollbackConfig) (AnchorRecord, error) {
+	statePath := strings.TrimSpace(cfg.StatePath)
+	if statePath == "" {
+		statePath = defaultControllerStatePath()
+	}
+	lock, err := lockState(statePath)
+	if err != nil {
+		if errors.Is(err, ErrStateLocked) {
+			return AnchorRecord{}, fmt.Errorf("cannot roll back: %w; stop the controller first", err)
+		}
+		return AnchorRecord{}, err
+	}
+	defer lock.Unlock()
+	state, err := loadControllerState(statePath)
+	if err != nil {
+		return AnchorRecord{}, err
+	}
+	var client agentClient
+	if len(state.ActiveBranchIDs()) > 0 {
+		mcp, err := state.NewMCPClient(cfg.MCP)
+		if err != nil {
+			return AnchorRecord{}, err
+		}
+		defer mcp.Close()
+		client = mcp
+	}
+	return rollbackWithClient(ctx, statePath, state, client, cfg.To, cfg.Steps)
+}
+
+func rollbackWithClient(ctx context.Context, statePath string, state ControllerState, client agentClient, to string, steps int) (AnchorRecord, error) {
+	for _, branchID := range state.ActiveBranchIDs() {
+		running, status, err := isBranchRunning(ctx, client, branchID)
+		if err != nil {
+			return AnchorRecord{}, fmt.Errorf("check active episode branch %s before rollback: %w", branchID, err)
+		}
+		if running {
+			return AnchorRecord{}, fmt.Errorf("cannot roll back while active episode branch %s is still running (status=%s); stop the controller and wait for it to finish", branchID, status)
+		}
+		logx.Infof("Clearing stopped active_episode_branch_id=%s before rollback (status=%s).", branchID, status)
+	}
+
+	target, err := rollbackTarget(state, strings.TrimSpace(to), steps)
+	if err != nil {
+		return AnchorRecord{}, err
+	}
+	state.setActiveBranches(nil)
+	applyRollback(&state, target)
+	if err := saveControllerState(statePath, state); err != nil {
+		return AnchorRecord{}, err
+	}
+	return state.AnchorHistory[len(state.AnchorHistory)-1], nil
+}
+
+// applyRollback makes target the anchor again and records the rollback.
+func applyRollback(state *ControllerState, target AnchorRecord) {
+	rec := AnchorRecord{
+		BranchID:       target.BranchID,
+		Reason:         AnchorRollback,
+		Episode:        target.Episode,
+		PromptHash:     target.PromptHash,
+		OutputExcerpt:  target.OutputExcerpt,
+		RolledBackFrom: state.AnchorBranch,
+	}
+	state.AnchorBranch = target.BranchID
+	switch target.Reason {
+	case AnchorParent:
+		// Before the bootstrap: the next run bootstraps again.
+		state.Initialized = false
+		state.BootstrapBranch = ""
+	case AnchorBootstrap:
+		state.Initialized = true
+		state.BootstrapBranch = target.BranchID
+	default:
+		state.Initialized = true
+	}
+	state.recordAnchor(rec)
+}
+
+func rollbackTarget(state ControllerState, to string, steps int) (AnchorRecord, error) {
+	if len(state.AnchorHistory) == 0 {
+		return AnchorRecord{}, fmt.Errorf("state file has no anchor history to roll back to")
+	}
+	var target AnchorRecord
+	if to != "" {
+		i := lastAnchorIndex(state.AnchorHistory, to)
+		if i < 0 {
+			return AnchorRecord{}, fmt.Errorf("branch %s is not in the anchor history", to)
+		}
+		target = state.AnchorHistory[i]
+		if target.Reason == AnchorRollback {
+			// Describe the branch by how it first became the anchor.
+			if j := firstPromotion(state.AnchorHistory, to); j >= 0 {
+				target = state.AnchorHistory[j]
+			}
+		}
+	} else {
+		if steps <= 0 {
+			steps = 1
+		}
+		lineage := anchorLineage(state.AnchorHistory)
+		if steps >= len(lineage) {
+			return AnchorRecord{}, fmt.Errorf("cannot go back %d anchors: the history has %d before the current one", steps, len(lineage)-1)
+		}
+		target = lineage[len(lineage)-1-steps]
+	}
+	if target.BranchID == state.AnchorBranch {
+		return AnchorRecord{}, fmt.Errorf("branch %s is already the anchor", target.BranchID)
+	}
+	return target, nil
+}
+
+func firstPromotion(history []AnchorRecord, branchID string) int {
+	for i, rec := range history {
+		if rec.BranchID == branchID && rec.Reason != AnchorRollback {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,193 @@
+package tools
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Outcomes of an episode attempt, as recorded in the ledger.
+const (
+	LedgerPromoted = "promoted"  // a branch became the anchor
+	LedgerNoWinner = "no_winner" // the failure policy retried, rolled back or exited
+	LedgerStopped  = "stopped"   // the failure policy stopped the controller; branches stay active unless the rule clears them
+	LedgerSkipped  = "skipped"   // every branch was skipped via Control.Skip
+)
+
+// LedgerRecord is one episode attempt in the ledger.
+type LedgerRecord struct {
+	// Episode is the anchor-history episode number the attempt was for; 0
+	// for the bootstrap.
+	Episode   int    `json:"episode"`
+	Bootstrap bool   `json:"bootstrap,omitempty"`
+	Task      string `json:"task,omitempty"`
+	StartedAt string `json:"started_at"`
+	EndedAt   string `json:"ended_at"`
+	// DurationSeconds is EndedAt - StartedAt, for cost accounting.
+	DurationSeconds float64 `json:"duration_seconds"`
+	ParentBranch    string  `json:"parent_branch_id"`
+	PromptHash      string  `json:"prompt_hash,omitempty"`
+	Status          string  `json:"status"`
+	Winner          string  `json:"winner_branch_id,omitempty"`
+	// FailureKind and Error describe an attempt without a winner.
+	FailureKind string         `json:"failure_kind,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	Branches    []LedgerBranch `json:"branches"`
+}
+
+// LedgerBranch is one branch of an episode attempt.
+type LedgerBranch struct {
+	BranchID string `json:"branch_id"`
+	Status   string `json:"status"`
+	// Polls counts get_branch calls made by this process while waiting.
+	Polls       int `json:"polls"`
+	OutputBytes int `json:"output_bytes"`
+	// OutputFile is the local copy of the full branch_output.
+	OutputFile string `json:"output_file,omitempty"`
+	// ErrorClass is failed, timeout, empty_output, gate_failed or skipped.
+	ErrorClass string `json:"error_class,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Ledger appends LedgerRecords to a JSONL file and keeps copies of branch
+// outputs next to it. A nil *Ledger records nothing.
+type Ledger struct {
+	path      string
+	outputDir string
+}
+
+// NewLedger returns a ledger writing to path and saving outputs in
+// outputDir.
+func NewLedger(path, outputDir string) *Ledger {
+	return &Ledger{path: path, outputDir: outputDir}
+}
+
+// Append writes rec as one line and syncs the file.
+func (l *Ledger) Append(rec LedgerRecord) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// SaveOutput copies a branch's full output from r to a file and returns the
+// file's path. It reads nothing without a ledger, and may stop reading r
+// early when the copy fails; no file is left behind then.
+func (l *Ledger) SaveOutput(branchID string, r io.Reader) (string, error) {
+	if l == nil {
+		return "", nil
+	}
+	if err := os.MkdirAll(l.outputDir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(l.outputDir, unsafeFileChars.ReplaceAllString(branchID, "_")+".txt")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// ReadLedger reads every record of a ledger file. A missing file is an empty
+// ledger.
+func ReadLedger(path string) ([]LedgerRecord, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []LedgerRecord
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[0] != '\n' {
+			var rec LedgerRecord
+			if jerr := json.Unmarshal(line, &rec); jerr != nil {
+				// A crash can leave a torn last line.
+				if err != nil {
+					break
+				}
+				return nil, fmt.Errorf("ledger %s:%d: %w", path, n, jerr)
+			}
+			out = append(out, rec)
+		}
+		if err != nil {
+			break
+		}
+	}
+	return out, nil
+}
+
+// ledgerBranches describes the candidates of an attempt.
+func ledgerBranches(candidates []Candidate, polls map[string]int, outputs map[string]fetchedOutput) []LedgerBranch {
+	out := make([]LedgerBranch, 0, len(candidates))
+	for _, c := range candidates {
+		b := LedgerBranch{
+			BranchID:    c.BranchID,
+			Status:      c.Status,
+			Polls:       polls[c.BranchID],
+			OutputBytes: int(outputs[c.BranchID].Bytes),
+			OutputFile:  outputs[c.BranchID].Path,
+		}
+		if c.Err != nil {
+			b.Error = c.Err.Error()
+			b.ErrorClass = failureKind(c.Err)
+			var gateErr *GateError
+			if errors.As(c.Err, &gateErr) {
+				b.ErrorClass = "gate_failed"
+			}
+			if errors.Is(c.Err, ErrBranchSkipped) {
+				b.ErrorClass = "skipped"
+			}
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// finish stamps the end of an attempt that started at startedAt.
+func (rec *LedgerRecord) finish(startedAt time.Time) {
+	end := time.Now().UTC()
+	rec.StartedAt = startedAt.UTC().Format(time.RFC3339)
+	rec.EndedAt = end.Format(time.RFC3339)
+	rec.DurationSeconds = end.Sub(startedAt).Seconds()
+}
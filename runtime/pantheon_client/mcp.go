@@ -1,14 +1,15 @@
 package tools
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -20,51 +21,215 @@ type MCPError struct{ Msg string }
 func (e MCPError) Error() string { return e.Msg }
 
 type MCPClient struct {
-	rpcURL     string
-	timeout    time.Duration
-	maxRetries int
-	sessionID  string
-	client     *http.Client
-	requestID  int64
+	rpcURL       string
+	timeout      time.Duration
+	retry        RetryPolicy
+	toolRetry    map[string]RetryPolicy
+	toolTimeouts map[string]time.Duration
+	breaker      *CircuitBreaker
+	headers      map[string]string
+	tokens       TokenSource
+	client       *http.Client
+	transport    Transport // nil: streamable HTTP via client
+	recorder     *Recorder
+	limiter      *Limiter
+	toolLimiters map[string]*Limiter
+	metrics      MCPMetrics
+	tracer       Tracer
+	pageSize     int
+	requestID    int64
+
+	// initMu serializes the initialize handshake; mu guards session and
+	// the tools/list cache, which is dropped whenever the session changes.
+	initMu  sync.Mutex
+	mu      sync.Mutex
+	session *SessionInfo
+	tools   map[string]Tool
+	// noToolsList is set once the server answered that it has no
+	// tools/list; calls are then sent without validation.
+	noToolsList bool
+
+	handlers notificationHandlers
 }
 
+// MCPClientConfig configures NewMCPClientWithConfig. Zero values select the
+// defaults NewMCPClient uses.
+type MCPClientConfig struct {
+	// BaseURL is the MCP endpoint, e.g. http://host:8000/mcp/sse.
+	BaseURL string
+	// Timeout bounds a single request attempt. Default 30s.
+	Timeout time.Duration
+
+	// RetryPolicy applies to every call without a per-tool policy.
+	// Default DefaultRetryPolicy().
+	RetryPolicy RetryPolicy
+	// ToolRetryPolicies and ToolTimeouts override the defaults per tool name.
+	// get_branch defaults to 5 attempts and a 300s timeout.
+	ToolRetryPolicies map[string]RetryPolicy
+	ToolTimeouts      map[string]time.Duration
+
+	// CircuitBreaker, if set, rejects calls while Pantheon is failing.
+	CircuitBreaker *CircuitBreaker
+
+	// Headers are sent with every request (API keys, tenant headers, ...).
+	Headers map[string]string
+	// TokenSource, if set, supplies a bearer token for every request. If it
+	// also implements TokenRefresher, a 401 triggers one refresh and retry.
+	TokenSource TokenSource
+
+	// Transport configures TLS, proxy and connection pooling for the
+	// default http.Client. Ignored when HTTPClient is set.
+	Transport TransportConfig
+
+	// HTTPClient replaces the default http.Client.
+	HTTPClient *http.Client
+
+	// RPCTransport replaces the transport chosen from BaseURL's scheme
+	// (streamable HTTP for http(s)://, NewStdioTransport for stdio:,
+	// NewWebSocketTransport for ws(s)://).
+	RPCTransport Transport
+
+	// Recorder, if set, writes every exchange to a cassette for replay.
+	Recorder *Recorder
+
+	// RateLimiter bounds every request this client sends, retries and
+	// session handshakes included. ToolRateLimiters additionally bound
+	// tools/call per tool name. Limiters may be shared between clients.
+	RateLimiter      *Limiter
+	ToolRateLimiters map[string]*Limiter
+
+	// Metrics, if set, receives call latencies, retries, HTTP statuses and
+	// SSE parse failures. Tracer, if set, wraps every call in a span whose
+	// trace context is sent in the HTTP headers, or in params._meta over
+	// stdio and WebSocket.
+	Metrics MCPMetrics
+	Tracer  Tracer
+
+	// PageSize is how many bytes BranchOutputReader and BranchReadFileTo
+	// request per page from tools that support paging. Default
+	// DefaultPageSize.
+	PageSize int
+}
+
+// NewMCPClient creates a client for baseURL with default settings. It panics
+// if baseURL cannot be used, e.g. an unsupported scheme or a malformed stdio
+// command; use NewMCPClientWithConfig to get that as an error instead.
 func NewMCPClient(baseURL string) *MCPClient {
-	base := strings.TrimRight(baseURL, "/")
+	c, err := NewMCPClientWithConfig(MCPClientConfig{BaseURL: baseURL})
+	if err != nil {
+		panic(fmt.Sprintf("tools: NewMCPClient(%q): %v", baseURL, err))
+	}
+	return c
+}
+
+// NewMCPClientWithConfig creates a client from cfg. Use this in production.
+func NewMCPClientWithConfig(cfg MCPClientConfig) (*MCPClient, error) {
+	base := strings.TrimRight(strings.TrimSpace(cfg.BaseURL), "/")
 	if base == "" {
 		base = "http://localhost:8000/mcp/sse"
 	}
-	return &MCPClient{
-		rpcURL:     base,
-		timeout:    30 * time.Second,
-		maxRetries: 3,
-		sessionID:  fmt.Sprintf("%d", time.Now().UnixNano()),
-		client:     &http.Client{},
+	c := &MCPClient{
+		rpcURL:       base,
+		timeout:      cfg.Timeout,
+		retry:        cfg.RetryPolicy,
+		toolRetry:    map[string]RetryPolicy{},
+		toolTimeouts: map[string]time.Duration{},
+		breaker:      cfg.CircuitBreaker,
+		headers:      map[string]string{},
+		tokens:       cfg.TokenSource,
+		client:       cfg.HTTPClient,
+		recorder:     cfg.Recorder,
+		limiter:      cfg.RateLimiter,
+		toolLimiters: map[string]*Limiter{},
+		metrics:      cfg.Metrics,
+		tracer:       cfg.Tracer,
+		pageSize:     cfg.PageSize,
+	}
+	for name, value := range cfg.Headers {
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("MCP header with empty name")
+		}
+		c.headers[http.CanonicalHeaderKey(strings.TrimSpace(name))] = value
+	}
+	if c.timeout <= 0 {
+		c.timeout = 30 * time.Second
+	}
+	if c.retry == nil {
+		c.retry = DefaultRetryPolicy()
+	}
+	if c.pageSize <= 0 {
+		c.pageSize = DefaultPageSize
+	}
+	if c.client == nil {
+		client, err := NewHTTPClient(cfg.Transport)
+		if err != nil {
+			return nil, err
+		}
+		c.client = client
+	}
+	c.transport = cfg.RPCTransport
+	if c.transport == nil {
+		t, err := newTransportForURL(base, cfg.Transport, c.setAuthHeaders)
+		if err != nil {
+			return nil, err
+		}
+		c.transport = t
+	}
+	if r, ok := c.transport.(MessageReceiver); ok {
+		r.SetMessageHandler(func(msg map[string]any) {
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			defer cancel()
+			c.handleStreamMessage(ctx, msg, nil)
+		})
 	}
-}
 
-func (c *MCPClient) rpcPost(url string, body map[string]any, timeout time.Duration) (*http.Response, context.CancelFunc, error) {
-	payload, _ := json.Marshal(body)
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
-	if err != nil {
-		return nil, nil, err
+	// get_branch is polled for hours; give it more patience than other tools.
+	getBranchRetry := DefaultRetryPolicy()
+	getBranchRetry.Attempts = 5
+	c.toolRetry["get_branch"] = getBranchRetry
+	c.toolTimeouts["get_branch"] = 300 * time.Second
+	for name, p := range cfg.ToolRetryPolicies {
+		c.toolRetry[name] = p
 	}
-	req.Header.Set("Accept", "application/json, text/event-stream")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Mcp-Session-Id", c.sessionID)
+	for name, d := range cfg.ToolTimeouts {
+		c.toolTimeouts[name] = d
+	}
+	for name, l := range cfg.ToolRateLimiters {
+		if l != nil {
+			c.toolLimiters[name] = l
+		}
+	}
+	return c, nil
+}
 
+func (c *MCPClient) rpcPost(ctx context.Context, url string, body map[string]any, timeout time.Duration) (*http.Response, context.CancelFunc, error) {
+	payload, _ := json.Marshal(body)
 	effectiveTimeout := timeout
 	if effectiveTimeout <= 0 {
 		effectiveTimeout = c.timeout
 	}
 
-	ctx := context.Background()
 	var cancel context.CancelFunc
 	if effectiveTimeout > 0 {
 		ctx, cancel = context.WithTimeout(ctx, effectiveTimeout)
 	} else {
-		cancel = func() {}
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if err := c.setAuthHeaders(ctx, req.Header); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	req.Header.Set("Content-Type", "application/json")
+	c.setSessionHeaders(req.Header)
+	if span := spanFromContext(ctx); span != nil {
+		span.Inject(req.Header)
 	}
-	req = req.WithContext(ctx)
 
 	resp, err := c.client.Do(req)
 	if err != nil {
@@ -74,15 +239,152 @@ func (c *MCPClient) rpcPost(url string, body map[string]any, timeout time.Durati
 	return resp, cancel, nil
 }
 
-func (c *MCPClient) call(method string, params map[string]any, timeout time.Duration) (map[string]any, error) {
-	return c.callWithRetries(method, params, timeout, c.maxRetries)
+// roundTrip sends one JSON-RPC message within the client's rate limits,
+// reports the attempt to the metrics and, if a recorder is attached, writes
+// the exchange to its cassette. JSON-RPC errors and tool results with
+// isError are returned as *RPCError and *ToolError.
+func (c *MCPClient) roundTrip(ctx context.Context, method string, payload map[string]any, timeout time.Duration) (map[string]any, http.Header, error) {
+	release, err := c.acquireLimits(ctx, method, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	trace := &exchangeTrace{keepEvents: c.recorder != nil}
+	start := time.Now()
+	obj, header, err := c.send(ctx, method, payload, timeout, trace)
+	elapsed := time.Since(start)
+	if c.metrics != nil {
+		c.metrics.ObserveAttempt(method, toolName(payload), trace.status, elapsed)
+		if trace.sseFailed {
+			c.metrics.IncSSEParseFailure(method)
+		}
+	}
+	if c.recorder != nil {
+		c.recorder.recordExchange(payload, obj, err, elapsed, trace)
+	}
+	if err == nil && obj != nil {
+		if rerr := resultError(payload, obj, trace.status); rerr != nil {
+			return nil, header, rerr
+		}
+	}
+	return obj, header, err
+}
+
+// send performs a single JSON-RPC POST. For requests it returns the
+// decoded response message; for notifications (no "id") it returns nil.
+// A 404 for a request that carried a session ID is reported as
+// errSessionExpired so the caller can re-initialize. trace, if non-nil,
+// collects the HTTP status and SSE framing.
+func (c *MCPClient) send(ctx context.Context, method string, payload map[string]any, timeout time.Duration, trace *exchangeTrace) (map[string]any, http.Header, error) {
+	if c.transport != nil {
+		if timeout <= 0 {
+			timeout = c.timeout
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if span := spanFromContext(ctx); span != nil {
+			payload = withTraceMeta(payload, span)
+		}
+		obj, err := c.transport.RoundTrip(ctx, payload)
+		return obj, nil, err
+	}
+	sentSession := c.sessionID()
+	resp, cancel, err := c.rpcPost(ctx, c.rpcURL, payload, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if trace != nil {
+		trace.status = resp.StatusCode
+	}
+
+	ct := resp.Header.Get("Content-Type")
+	if resp.StatusCode == http.StatusNotFound && sentSession != "" {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, resp.Header, errSessionExpired
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		logx.Errorf("MCP HTTP error %d for %s (CT=%s): %.500s", resp.StatusCode, method, ct, string(body))
+		return nil, resp.Header, newHTTPStatusError(resp, body)
+	}
+	if _, ok := payload["id"]; !ok {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, resp.Header, nil
+	}
+
+	if strings.Contains(ct, "text/event-stream") {
+		obj, err := c.readSSEResponse(ctx, resp.Body, payload["id"], trace)
+		if err != nil {
+			if trace != nil && ctx.Err() == nil {
+				trace.sseFailed = true
+			}
+			logx.Errorf("Failed to read SSE response for %s. Content-Type: %s, Status: %d (%v)", method, ct, resp.StatusCode, err)
+			return nil, resp.Header, err
+		}
+		return obj, resp.Header, nil
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logx.Errorf("Failed reading MCP response body for %s: %v (bytes=%d)", method, err, len(data))
+		return nil, resp.Header, err
+	}
+	var obj map[string]any
+	if err := json.Unmarshal(data, &obj); err != nil {
+		logx.Errorf("MCP response not JSON (status %d, CT=%s). First 1000 bytes: %q", resp.StatusCode, ct, string(data[:min(1000, len(data))]))
+		return nil, resp.Header, err
+	}
+	return obj, resp.Header, nil
+}
+
+func (c *MCPClient) call(ctx context.Context, method string, params map[string]any, timeout time.Duration) (map[string]any, error) {
+	return c.callWithRetries(ctx, method, params, timeout, c.retry)
 }
 
-func (c *MCPClient) callWithRetries(method string, params map[string]any, timeout time.Duration, maxRetries int) (map[string]any, error) {
+func (c *MCPClient) callWithRetries(ctx context.Context, method string, params map[string]any, timeout time.Duration, policy RetryPolicy) (resp map[string]any, err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	tool, _ := params["name"].(string)
+	if method != "tools/call" {
+		tool = ""
+	}
+	attempts := 0
+	if c.metrics != nil {
+		start := time.Now()
+		defer func() { c.metrics.ObserveCall(method, tool, time.Since(start), err) }()
+	}
+	if c.tracer != nil {
+		var span Span
+		ctx, span = c.tracer.Start(ctx, metricKey(method, tool))
+		span.SetAttribute("rpc.system", "jsonrpc")
+		span.SetAttribute("mcp.method.name", method)
+		if tool != "" {
+			span.SetAttribute("mcp.tool.name", tool)
+		}
+		defer func() {
+			span.SetAttribute("mcp.attempts", attempts)
+			if err != nil {
+				span.RecordError(err)
+			}
+			span.End()
+		}()
+	}
+	maxRetries := policy.MaxAttempts()
 	if maxRetries < 1 {
 		maxRetries = 1
 	}
 	requestID := atomic.AddInt64(&c.requestID, 1)
+	if method == "tools/call" && c.wantsProgress() {
+		withMeta := make(map[string]any, len(params)+1)
+		for k, v := range params {
+			withMeta[k] = v
+		}
+		withMeta["_meta"] = map[string]any{"progressToken": requestID}
+		params = withMeta
+	}
 	payload := map[string]any{
 		"jsonrpc": "2.0",
 		"id":      requestID,
@@ -90,61 +392,64 @@ func (c *MCPClient) callWithRetries(method string, params map[string]any, timeou
 		"params":  params,
 	}
 	var lastErr error
+	renewed, reauthed := false, false
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		logx.Debugf("MCP POST %s attempt %d to %s", method, attempt+1, c.rpcURL)
-		resp, cancel, err := c.rpcPost(c.rpcURL, payload, timeout)
-		if err != nil {
-			lastErr = err
-		} else {
-			ct := resp.Header.Get("Content-Type")
-			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-				body, _ := io.ReadAll(resp.Body)
-				resp.Body.Close()
-				cancel()
-				logx.Errorf("MCP HTTP error %d for %s (CT=%s): %.500s", resp.StatusCode, method, ct, string(body))
-				lastErr = fmt.Errorf("MCP HTTP %d: %s", resp.StatusCode, string(body))
-			} else if strings.Contains(ct, "text/event-stream") {
-				data, preview, err := parseSSEStream(resp.Body)
-				resp.Body.Close()
-				cancel()
-				if preview != "" {
-					logx.Debugf("MCP SSE preview: %q", preview)
-				}
-				if err != nil {
-					logx.Errorf("Failed to parse SSE JSON for %s. Content-Type: %s, Status: %d (%v)", method, ct, resp.StatusCode, err)
-					lastErr = err
-				} else {
-					var obj map[string]any
-					if err := json.Unmarshal(data, &obj); err != nil {
-						logx.Errorf("MCP SSE payload not JSON (status %d, CT=%s). Preview: %.200s", resp.StatusCode, ct, string(data[:min(200, len(data))]))
-						lastErr = err
-					} else {
-						return normalizeRPC(obj), nil
-					}
-				}
-			} else {
-				data, err := io.ReadAll(resp.Body)
-				resp.Body.Close()
-				cancel()
-				if err != nil {
-					logx.Errorf("Failed reading MCP response body for %s: %v (bytes=%d)", method, err, len(data))
-					lastErr = err
-					continue
-				}
-				var obj map[string]any
-				if err := json.Unmarshal(data, &obj); err != nil {
-					logx.Errorf("MCP response not JSON (status %d, CT=%s). First 1000 bytes: %q", resp.StatusCode, ct, string(data[:min(1000, len(data))]))
-					lastErr = err
-				} else {
-					return normalizeRPC(obj), nil
-				}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if c.breaker != nil {
+			if err := c.breaker.Allow(); err != nil {
+				return nil, err
 			}
 		}
+		var obj map[string]any
+		sessionID := ""
+		err := c.ensureSession(ctx)
+		if err == nil {
+			sessionID = c.sessionID()
+			attempts++
+			logx.Debugf("MCP POST %s attempt %d to %s", method, attempt+1, c.rpcURL)
+			obj, _, err = c.roundTrip(ctx, method, payload, timeout)
+		}
+		c.recordOutcome(err)
+		switch {
+		case err == nil:
+			return normalizeRPC(obj), nil
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case errors.Is(err, errSessionExpired) && !renewed:
+			// Re-initialize once per call without consuming a retry.
+			renewed = true
+			logx.Warningf("MCP session %s expired; re-initializing.", sessionID)
+			c.dropSession(sessionID)
+			attempt--
+			continue
+		case isUnauthorized(err) && !reauthed && c.refreshToken(ctx):
+			// Same for a rejected bearer token: refresh it and retry once.
+			reauthed = true
+			logx.Warningf("MCP %s rejected with 401; retrying with a refreshed token.", method)
+			attempt--
+			continue
+		default:
+			lastErr = err
+		}
+		if !policy.Retryable(lastErr) {
+			logx.Warningf("MCP call %s failed with non-retryable error (attempt %d/%d): %v", method, attempt+1, maxRetries, lastErr)
+			return nil, lastErr
+		}
 		if attempt < maxRetries-1 {
-			wait := time.Duration(1<<attempt) * time.Second
-			logx.Warningf("MCP call %s failed (attempt %d/%d): %v. Retrying in %ds...", method, attempt+1, maxRetries, lastErr, int(wait.Seconds()))
-			time.Sleep(wait)
+			wait := policy.Backoff(attempt + 1)
+			if ra := retryAfter(lastErr); ra > wait {
+				wait = ra
+			}
+			logx.Warningf("MCP call %s failed (attempt %d/%d): %v. Retrying in %s...", method, attempt+1, maxRetries, lastErr, wait.Round(time.Millisecond))
+			if c.metrics != nil {
+				c.metrics.IncRetry(method, tool)
+			}
+			if err := sleepContext(ctx, wait); err != nil {
+				return nil, err
+			}
 		}
 	}
 	if lastErr == nil {
@@ -153,11 +458,9 @@ func (c *MCPClient) callWithRetries(method string, params map[string]any, timeou
 	return nil, lastErr
 }
 
+// normalizeRPC unwraps a successful response to its structuredContent, or
+// its result when there is none.
 func normalizeRPC(obj map[string]any) map[string]any {
-	if errVal, ok := obj["error"]; ok {
-		_ = errVal
-		return obj
-	}
 	if res, ok := obj["result"].(map[string]any); ok {
 		if sc, ok := res["structuredContent"].(map[string]any); ok {
 			return sc
@@ -167,12 +470,60 @@ func normalizeRPC(obj map[string]any) map[string]any {
 	return obj
 }
 
+// sleepContext waits for d or until ctx is done, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CallTool is CallToolContext with context.Background().
 func (c *MCPClient) CallTool(name string, arguments map[string]any) (map[string]any, error) {
-	return c.call("tools/call", map[string]any{"name": name, "arguments": arguments}, c.timeout)
+	return c.CallToolContext(context.Background(), name, arguments)
+}
+
+// CallToolContext invokes an MCP tool. Cancelling ctx aborts the in-flight
+// request and any pending retry backoff.
+// Arguments are validated against the tool's advertised input schema first.
+func (c *MCPClient) CallToolContext(ctx context.Context, name string, arguments map[string]any) (map[string]any, error) {
+	if err := c.validateToolCall(ctx, name, arguments); err != nil {
+		return nil, err
+	}
+	timeout := c.timeout
+	if d, ok := c.toolTimeouts[name]; ok && d > 0 {
+		timeout = d
+	}
+	policy := c.retry
+	if p, ok := c.toolRetry[name]; ok && p != nil {
+		policy = p
+	}
+	return c.callWithRetries(ctx, "tools/call", map[string]any{"name": name, "arguments": arguments}, timeout, policy)
+}
+
+// recordOutcome feeds an attempt's result to the circuit breaker. An
+// expired session says nothing about the server's health, but must still
+// free the probe slot for the renewed attempt.
+func (c *MCPClient) recordOutcome(err error) {
+	switch {
+	case c.breaker == nil:
+	case errors.Is(err, errSessionExpired):
+		c.breaker.Release()
+	default:
+		c.breaker.Record(err)
+	}
 }
 
 func (c *MCPClient) ParallelExplore(projectName, parentBranchID string, prompts []string, agent string, numBranches int) (map[string]any, error) {
-	return c.CallTool("parallel_explore", map[string]any{
+	return c.ParallelExploreContext(context.Background(), projectName, parentBranchID, prompts, agent, numBranches)
+}
+
+func (c *MCPClient) ParallelExploreContext(ctx context.Context, projectName, parentBranchID string, prompts []string, agent string, numBranches int) (map[string]any, error) {
+	return c.CallToolContext(ctx, "parallel_explore", map[string]any{
 		"project_name":           projectName,
 		"parent_branch_id":       parentBranchID,
 		"shared_prompt_sequence": prompts,
@@ -182,18 +533,19 @@ func (c *MCPClient) ParallelExplore(projectName, parentBranchID string, prompts
 }
 
 func (c *MCPClient) GetBranch(branchID string) (map[string]any, error) {
-	retries := c.maxRetries
-	if retries < 5 {
-		retries = 5
-	}
-	return c.callWithRetries("tools/call", map[string]any{
-		"name":      "get_branch",
-		"arguments": map[string]any{"branch_id": branchID},
-	}, 300*time.Second, retries)
+	return c.GetBranchContext(context.Background(), branchID)
+}
+
+func (c *MCPClient) GetBranchContext(ctx context.Context, branchID string) (map[string]any, error) {
+	return c.CallToolContext(ctx, "get_branch", map[string]any{"branch_id": branchID})
 }
 
 func (c *MCPClient) BranchReadFile(branchID, filePath string) (map[string]any, error) {
-	resp, err := c.CallTool("branch_read_file", map[string]any{"branch_id": branchID, "file_path": filePath})
+	return c.BranchReadFileContext(context.Background(), branchID, filePath)
+}
+
+func (c *MCPClient) BranchReadFileContext(ctx context.Context, branchID, filePath string) (map[string]any, error) {
+	resp, err := c.CallToolContext(ctx, "branch_read_file", map[string]any{"branch_id": branchID, "file_path": filePath})
 	if err != nil {
 		return nil, err
 	}
@@ -201,109 +553,25 @@ func (c *MCPClient) BranchReadFile(branchID, filePath string) (map[string]any, e
 		return nil, fmt.Errorf("branch_read_file returned empty response")
 	}
 	if errVal, ok := resp["error"]; ok && errVal != nil {
-		return nil, payloadError(errVal)
+		err := payloadError(errVal)
+		if te, ok := err.(*ToolError); ok {
+			te.Tool = "branch_read_file"
+		}
+		return nil, err
 	}
 	return resp, nil
 }
 
 func (c *MCPClient) BranchOutput(branchID string, fullOutput bool) (map[string]any, error) {
+	return c.BranchOutputContext(context.Background(), branchID, fullOutput)
+}
+
+func (c *MCPClient) BranchOutputContext(ctx context.Context, branchID string, fullOutput bool) (map[string]any, error) {
 	args := map[string]any{"branch_id": branchID}
 	if fullOutput {
 		args["full_output"] = true
 	}
-	return c.CallTool("branch_output", args)
-}
-
-func parseSSEStream(r io.Reader) ([]byte, string, error) {
-	scanner := bufio.NewScanner(r)
-	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
-
-	var (
-		current strings.Builder
-		total   strings.Builder
-		preview strings.Builder
-	)
-
-	appendPreview := func(line string) {
-		const maxPreview = 2000
-		if preview.Len() >= maxPreview {
-			return
-		}
-		if preview.Len()+len(line) > maxPreview {
-			line = line[:maxPreview-preview.Len()]
-		}
-		preview.WriteString(line)
-		preview.WriteByte('\n')
-	}
-
-	tryDecode := func(text string) ([]byte, bool) {
-		text = strings.TrimSpace(text)
-		if text == "" || text == "[DONE]" || text == "DONE" {
-			return nil, false
-		}
-		if json.Valid([]byte(text)) {
-			return []byte(text), true
-		}
-		if data, err := extractJSONFromText(text); err == nil {
-			return data, true
-		}
-		return nil, false
-	}
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		appendPreview(line)
-		line = strings.TrimRight(line, "\r")
-		if line == "" {
-			if current.Len() > 0 {
-				if data, ok := tryDecode(current.String()); ok {
-					return data, preview.String(), nil
-				}
-				current.Reset()
-			}
-			if data, ok := tryDecode(total.String()); ok {
-				return data, preview.String(), nil
-			}
-			continue
-		}
-		if strings.HasPrefix(line, ":") {
-			continue
-		}
-		if i := strings.Index(line, ":"); i >= 0 {
-			field := strings.TrimSpace(line[:i])
-			value := strings.TrimSpace(line[i+1:])
-			if strings.EqualFold(field, "data") {
-				current.WriteString(value)
-				current.WriteByte('\n')
-				total.WriteString(value)
-				total.WriteByte('\n')
-				if data, ok := tryDecode(current.String()); ok {
-					return data, preview.String(), nil
-				}
-				if data, ok := tryDecode(total.String()); ok {
-					return data, preview.String(), nil
-				}
-			}
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, preview.String(), err
-	}
-	if current.Len() > 0 {
-		if data, ok := tryDecode(current.String()); ok {
-			return data, preview.String(), nil
-		}
-	}
-	if total.Len() > 0 {
-		if data, ok := tryDecode(total.String()); ok {
-			return data, preview.String(), nil
-		}
-	}
-	if data, err := extractJSONFromText(preview.String()); err == nil {
-		return data, preview.String(), nil
-	}
-	return nil, preview.String(), fmt.Errorf("no JSON data event in SSE response")
+	return c.CallToolContext(ctx, "branch_output", args)
 }
 
 func extractJSONFromText(text string) ([]byte, error) {
@@ -333,26 +601,3 @@ func min(a, b int) int {
 	}
 	return b
 }
-
-func payloadError(val any) error {
-	switch v := val.(type) {
-	case string:
-		msg := strings.TrimSpace(v)
-		if msg == "" {
-			return fmt.Errorf("unknown error")
-		}
-		return fmt.Errorf("%s", msg)
-	case map[string]any:
-		if msg, ok := v["message"].(string); ok && strings.TrimSpace(msg) != "" {
-			return fmt.Errorf("%s", strings.TrimSpace(msg))
-		}
-		if data, err := json.Marshal(v); err == nil {
-			return fmt.Errorf("%s", string(data))
-		}
-	default:
-		if v != nil {
-			return fmt.Errorf("%v", v)
-		}
-	}
-	return fmt.Errorf("unknown error")
-}
@@ -0,0 +1,328 @@
+package tools
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrCapabilityUnsupported is matched (via errors.Is) when the server did not
+// advertise the capability a call needs, e.g. "resources" or "prompts".
+var ErrCapabilityUnsupported = errors.New("MCP capability not supported by server")
+
+const methodResourceUpdated = "notifications/resources/updated"
+
+// Resource is an MCP resource as advertised by resources/list.
+type Resource struct {
+	URI         string
+	Name        string
+	Description string
+	MIMEType    string
+	// Size in bytes, or 0 when the server does not say.
+	Size int64
+}
+
+// ResourceTemplate is a parameterized resource URI (RFC 6570), as advertised
+// by resources/templates/list.
+type ResourceTemplate struct {
+	URITemplate string
+	Name        string
+	Description string
+	MIMEType    string
+}
+
+// ResourceContents is one item returned by resources/read. Exactly one of
+// Text and Blob is set.
+type ResourceContents struct {
+	URI      string
+	MIMEType string
+	Text     string
+	Blob     []byte
+}
+
+// Prompt is a server-defined prompt template, as advertised by prompts/list.
+type Prompt struct {
+	Name        string
+	Description string
+	Arguments   []PromptArgument
+}
+
+// PromptArgument is one argument a prompt template accepts.
+type PromptArgument struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// PromptMessage is one message of a rendered prompt. Text holds the text of
+// "text" content (or the text of an embedded text resource); Content is the
+// raw content object.
+type PromptMessage struct {
+	Role    string
+	Text    string
+	Content map[string]any
+}
+
+// PromptResult is a prompt rendered by prompts/get.
+type PromptResult struct {
+	Description string
+	Messages    []PromptMessage
+}
+
+// Text joins the text of all user messages, which is what agent0 sends to
+// an agent as its prompt.
+func (p PromptResult) Text() string {
+	var parts []string
+	for _, m := range p.Messages {
+		if m.Role != "" && m.Role != "user" {
+			continue
+		}
+		if t := strings.TrimSpace(m.Text); t != "" {
+			parts = append(parts, t)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// requireCapability initializes the session if needed and checks that the
+// server advertised capability.
+func (c *MCPClient) requireCapability(ctx context.Context, capability string) (map[string]any, error) {
+	s, err := c.Initialize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	caps, ok := s.Capabilities[capability].(map[string]any)
+	if !ok {
+		if !s.HasCapability(capability) {
+			return nil, fmt.Errorf("%w: %s (server %s)", ErrCapabilityUnsupported, capability, s.ServerInfo.Name)
+		}
+		caps = map[string]any{}
+	}
+	return caps, nil
+}
+
+// listPaged calls a paginated list method and returns the items under key
+// from every page.
+func (c *MCPClient) listPaged(ctx context.Context, method, key string) ([]map[string]any, error) {
+	var (
+		out    []map[string]any
+		cursor string
+	)
+	for {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		resp, err := c.call(ctx, method, params, c.timeout)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", method, err)
+		}
+		items, _ := resp[key].([]any)
+		for _, item := range items {
+			if m, ok := item.(map[string]any); ok {
+				out = append(out, m)
+			}
+		}
+		cursor, _ = resp["nextCursor"].(string)
+		if cursor == "" {
+			return out, nil
+		}
+	}
+}
+
+// ListResources fetches the server's resources, following pagination.
+func (c *MCPClient) ListResources(ctx context.Context) ([]Resource, error) {
+	if _, err := c.requireCapability(ctx, "resources"); err != nil {
+		return nil, err
+	}
+	items, err := c.listPaged(ctx, "resources/list", "resources")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Resource, 0, len(items))
+	for _, m := range items {
+		r := Resource{}
+		r.URI, _ = m["uri"].(string)
+		r.Name, _ = m["name"].(string)
+		r.Description, _ = m["description"].(string)
+		r.MIMEType, _ = m["mimeType"].(string)
+		if size, ok := m["size"].(float64); ok {
+			r.Size = int64(size)
+		}
+		if strings.TrimSpace(r.URI) == "" {
+			continue
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// ListResourceTemplates fetches the server's resource URI templates.
+func (c *MCPClient) ListResourceTemplates(ctx context.Context) ([]ResourceTemplate, error) {
+	if _, err := c.requireCapability(ctx, "resources"); err != nil {
+		return nil, err
+	}
+	items, err := c.listPaged(ctx, "resources/templates/list", "resourceTemplates")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ResourceTemplate, 0, len(items))
+	for _, m := range items {
+		t := ResourceTemplate{}
+		t.URITemplate, _ = m["uriTemplate"].(string)
+		t.Name, _ = m["name"].(string)
+		t.Description, _ = m["description"].(string)
+		t.MIMEType, _ = m["mimeType"].(string)
+		if strings.TrimSpace(t.URITemplate) == "" {
+			continue
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// ReadResource reads the resource at uri. Binary contents are decoded from
+// base64.
+func (c *MCPClient) ReadResource(ctx context.Context, uri string) ([]ResourceContents, error) {
+	if _, err := c.requireCapability(ctx, "resources"); err != nil {
+		return nil, err
+	}
+	resp, err := c.call(ctx, "resources/read", map[string]any{"uri": uri}, c.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("resources/read %s: %w", uri, err)
+	}
+	items, _ := resp["contents"].([]any)
+	out := make([]ResourceContents, 0, len(items))
+	for _, item := range items {
+		m, _ := item.(map[string]any)
+		if m == nil {
+			continue
+		}
+		rc := ResourceContents{}
+		rc.URI, _ = m["uri"].(string)
+		rc.MIMEType, _ = m["mimeType"].(string)
+		rc.Text, _ = m["text"].(string)
+		if blob, ok := m["blob"].(string); ok {
+			data, err := base64.StdEncoding.DecodeString(blob)
+			if err != nil {
+				return nil, fmt.Errorf("resources/read %s: invalid blob: %w", uri, err)
+			}
+			rc.Blob = data
+		}
+		out = append(out, rc)
+	}
+	return out, nil
+}
+
+// SubscribeResource asks the server to send notifications/resources/updated
+// for uri; register a handler with OnResourceUpdated. Updates arrive on the
+// Listen stream (or the transport, for stdio and WebSocket).
+func (c *MCPClient) SubscribeResource(ctx context.Context, uri string) error {
+	return c.resourceSubscription(ctx, "resources/subscribe", uri)
+}
+
+// UnsubscribeResource cancels a SubscribeResource.
+func (c *MCPClient) UnsubscribeResource(ctx context.Context, uri string) error {
+	return c.resourceSubscription(ctx, "resources/unsubscribe", uri)
+}
+
+func (c *MCPClient) resourceSubscription(ctx context.Context, method, uri string) error {
+	caps, err := c.requireCapability(ctx, "resources")
+	if err != nil {
+		return err
+	}
+	if subscribe, _ := caps["subscribe"].(bool); !subscribe {
+		return fmt.Errorf("%w: resources.subscribe", ErrCapabilityUnsupported)
+	}
+	_, err = c.call(ctx, method, map[string]any{"uri": uri}, c.timeout)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, uri, err)
+	}
+	return nil
+}
+
+// OnResourceUpdated registers h for notifications/resources/updated. h gets
+// the URI of the changed resource; call ReadResource to fetch it.
+func (c *MCPClient) OnResourceUpdated(h func(uri string)) {
+	if h == nil {
+		return
+	}
+	c.OnNotification(methodResourceUpdated, func(n Notification) {
+		if uri, ok := n.Params["uri"].(string); ok {
+			h(uri)
+		}
+	})
+}
+
+// ListPrompts fetches the server's prompt templates, following pagination.
+func (c *MCPClient) ListPrompts(ctx context.Context) ([]Prompt, error) {
+	if _, err := c.requireCapability(ctx, "prompts"); err != nil {
+		return nil, err
+	}
+	items, err := c.listPaged(ctx, "prompts/list", "prompts")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Prompt, 0, len(items))
+	for _, m := range items {
+		p := Prompt{}
+		p.Name, _ = m["name"].(string)
+		p.Description, _ = m["description"].(string)
+		args, _ := m["arguments"].([]any)
+		for _, a := range args {
+			am, _ := a.(map[string]any)
+			if am == nil {
+				continue
+			}
+			arg := PromptArgument{}
+			arg.Name, _ = am["name"].(string)
+			arg.Description, _ = am["description"].(string)
+			arg.Required, _ = am["required"].(bool)
+			p.Arguments = append(p.Arguments, arg)
+		}
+		if strings.TrimSpace(p.Name) == "" {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// GetPrompt renders the named prompt template with arguments.
+func (c *MCPClient) GetPrompt(ctx context.Context, name string, arguments map[string]string) (PromptResult, error) {
+	if _, err := c.requireCapability(ctx, "prompts"); err != nil {
+		return PromptResult{}, err
+	}
+	params := map[string]any{"name": name}
+	if len(arguments) > 0 {
+		params["arguments"] = arguments
+	}
+	resp, err := c.call(ctx, "prompts/get", params, c.timeout)
+	if err != nil {
+		return PromptResult{}, fmt.Errorf("prompts/get %s: %w", name, err)
+	}
+	out := PromptResult{}
+	out.Description, _ = resp["description"].(string)
+	msgs, _ := resp["messages"].([]any)
+	for _, item := range msgs {
+		m, _ := item.(map[string]any)
+		if m == nil {
+			continue
+		}
+		pm := PromptMessage{}
+		pm.Role, _ = m["role"].(string)
+		pm.Content, _ = m["content"].(map[string]any)
+		switch pm.Content["type"] {
+		case "text":
+			pm.Text, _ = pm.Content["text"].(string)
+		case "resource":
+			if res, ok := pm.Content["resource"].(map[string]any); ok {
+				pm.Text, _ = res["text"].(string)
+			}
+		}
+		out.Messages = append(out.Messages, pm)
+	}
+	return out, nil
+}
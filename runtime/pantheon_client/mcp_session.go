@@ -0,0 +1,225 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/IANTHEREAL/agent0/internal/logx"
+)
+
+const (
+	// mcpProtocolVersion is the protocol revision requested in initialize.
+	mcpProtocolVersion = "2025-03-26"
+
+	mcpClientName    = "agent0"
+	mcpClientVersion = "0.1.0"
+
+	headerSessionID       = "Mcp-Session-Id"
+	headerProtocolVersion = "Mcp-Protocol-Version"
+)
+
+// supportedProtocolVersions lists the revisions the server may answer with.
+var supportedProtocolVersions = []string{"2024-11-05", "2025-03-26", "2025-06-18"}
+
+// errSessionExpired is returned by roundTrip when the server no longer
+// recognizes the session ID we sent (HTTP 404).
+var errSessionExpired = errors.New("MCP session expired")
+
+// ServerInfo identifies the MCP server implementation.
+type ServerInfo struct {
+	Name    string
+	Version string
+}
+
+// SessionInfo is what the server told us during the initialize handshake.
+type SessionInfo struct {
+	// ID is the server-issued Mcp-Session-Id; empty for stateless servers.
+	ID              string
+	ProtocolVersion string
+	ServerInfo      ServerInfo
+	Capabilities    map[string]any
+	Instructions    string
+}
+
+// HasCapability reports whether the server advertised the named capability
+// (e.g. "tools", "resources", "prompts").
+func (s SessionInfo) HasCapability(name string) bool {
+	_, ok := s.Capabilities[name]
+	return ok
+}
+
+// Session returns the current session, if the handshake has completed.
+func (c *MCPClient) Session() (SessionInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == nil {
+		return SessionInfo{}, false
+	}
+	return *c.session, true
+}
+
+// Initialize performs the MCP initialize handshake if it has not happened
+// yet and returns the negotiated session. Calls made through the client
+// initialize lazily, so calling this is only needed to fail fast or to
+// inspect server capabilities up front.
+func (c *MCPClient) Initialize(ctx context.Context) (SessionInfo, error) {
+	c.initMu.Lock()
+	defer c.initMu.Unlock()
+	if s, ok := c.Session(); ok {
+		return s, nil
+	}
+
+	payload := map[string]any{
+		"jsonrpc": "2.0",
+		"id":      atomic.AddInt64(&c.requestID, 1),
+		"method":  "initialize",
+		"params": map[string]any{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]any{},
+			"clientInfo": map[string]any{
+				"name":    mcpClientName,
+				"version": mcpClientVersion,
+			},
+		},
+	}
+	obj, header, err := c.roundTrip(ctx, "initialize", payload, c.timeout)
+	if err != nil {
+		return SessionInfo{}, fmt.Errorf("MCP initialize: %w", err)
+	}
+	result, _ := obj["result"].(map[string]any)
+	if result == nil {
+		return SessionInfo{}, fmt.Errorf("MCP initialize returned no result: %v", obj)
+	}
+
+	info := SessionInfo{ID: strings.TrimSpace(header.Get(headerSessionID))}
+	info.ProtocolVersion, _ = result["protocolVersion"].(string)
+	if !isSupportedProtocolVersion(info.ProtocolVersion) {
+		return SessionInfo{}, fmt.Errorf("MCP server answered with unsupported protocol version %q (want one of %s)", info.ProtocolVersion, strings.Join(supportedProtocolVersions, ", "))
+	}
+	info.Capabilities, _ = result["capabilities"].(map[string]any)
+	if info.Capabilities == nil {
+		info.Capabilities = map[string]any{}
+	}
+	if si, ok := result["serverInfo"].(map[string]any); ok {
+		info.ServerInfo.Name, _ = si["name"].(string)
+		info.ServerInfo.Version, _ = si["version"].(string)
+	}
+	info.Instructions, _ = result["instructions"].(string)
+
+	c.setSession(&info)
+	if err := c.notify(ctx, "notifications/initialized", nil); err != nil {
+		c.setSession(nil)
+		return SessionInfo{}, fmt.Errorf("MCP initialized notification: %w", err)
+	}
+	logx.Infof("MCP session initialized (server=%s %s, protocol=%s, session=%s)", info.ServerInfo.Name, info.ServerInfo.Version, info.ProtocolVersion, info.ID)
+	return info, nil
+}
+
+// Close terminates the server-side session, if any. Servers that do not
+// support explicit termination answer 405, which is not an error.
+func (c *MCPClient) Close() error {
+	sessionID := c.sessionID()
+	c.mu.Lock()
+	c.session = nil
+	c.tools = nil
+	c.mu.Unlock()
+	if c.transport != nil {
+		return c.transport.Close()
+	}
+	if sessionID == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.rpcURL, nil)
+	if err != nil {
+		return err
+	}
+	if err := c.setAuthHeaders(ctx, req.Header); err != nil {
+		return err
+	}
+	req.Header.Set(headerSessionID, sessionID)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("MCP session delete: HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// notify sends a JSON-RPC notification; the server answers 202 with no body.
+func (c *MCPClient) notify(ctx context.Context, method string, params map[string]any) error {
+	payload := map[string]any{
+		"jsonrpc": "2.0",
+		"method":  method,
+	}
+	if params != nil {
+		payload["params"] = params
+	}
+	_, _, err := c.roundTrip(ctx, method, payload, c.timeout)
+	return err
+}
+
+func (c *MCPClient) ensureSession(ctx context.Context) error {
+	if _, ok := c.Session(); ok {
+		return nil
+	}
+	_, err := c.Initialize(ctx)
+	return err
+}
+
+func (c *MCPClient) sessionID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == nil {
+		return ""
+	}
+	return c.session.ID
+}
+
+func (c *MCPClient) setSession(s *SessionInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.session = s
+}
+
+// dropSession forgets the session only if it is still the one that expired,
+// so a concurrent re-initialization is not thrown away.
+func (c *MCPClient) dropSession(expiredID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session != nil && c.session.ID == expiredID {
+		c.session = nil
+		c.tools = nil
+	}
+}
+
+func (c *MCPClient) setSessionHeaders(h http.Header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == nil {
+		return
+	}
+	if c.session.ID != "" {
+		h.Set(headerSessionID, c.session.ID)
+	}
+	if c.session.ProtocolVersion != "" {
+		h.Set(headerProtocolVersion, c.session.ProtocolVersion)
+	}
+}
+
+func isSupportedProtocolVersion(v string) bool {
+	for _, s := range supportedProtocolVersions {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// DefaultPageSize is how many bytes BranchOutputReader and BranchReadFileTo
+// request per call from tools that accept offset and limit arguments.
+const DefaultPageSize = 256 * 1024
+
+// pageArguments are the arguments a Pantheon tool advertises when it can
+// return its text in pages. They are only sent to tools whose schema has
+// them, so they are not part of pantheonToolArguments.
+var pageArguments = []string{"offset", "limit"}
+
+// textPage is one page of a tool's text.
+type textPage struct {
+	text string
+	next int64
+	more bool
+}
+
+// pagedReader reads a tool's text page by page, fetching the next page only
+// when the previous one has been consumed.
+type pagedReader struct {
+	ctx    context.Context
+	fetch  func(ctx context.Context, offset int64) (textPage, error)
+	offset int64
+	buf    string
+	done   bool
+	err    error
+}
+
+func (r *pagedReader) Read(p []byte) (int, error) {
+	for r.buf == "" {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		pg, err := r.fetch(r.ctx, r.offset)
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		r.apply(pg)
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *pagedReader) apply(pg textPage) {
+	r.buf = pg.text
+	r.offset = pg.next
+	r.done = !pg.more
+}
+
+// Close stops the reader; no further pages are fetched.
+func (r *pagedReader) Close() error {
+	r.buf = ""
+	r.done = true
+	return nil
+}
+
+// BranchOutputReader streams the full output of a branch. If branch_output
+// accepts offset and limit arguments the output is fetched in pages of
+// PageSize bytes as the reader is consumed; otherwise it is fetched in one
+// call. ctx governs every page fetch. Errors for the first page (e.g. an
+// unknown branch) are returned here rather than from Read.
+func (c *MCPClient) BranchOutputReader(ctx context.Context, branchID string) (io.ReadCloser, error) {
+	return c.openText(ctx, "branch_output", "output", map[string]any{"branch_id": branchID, "full_output": true})
+}
+
+// BranchReadFileTo copies a file from a branch snapshot to w, page by page
+// when branch_read_file supports paging, and returns the number of bytes
+// written.
+func (c *MCPClient) BranchReadFileTo(ctx context.Context, branchID, filePath string, w io.Writer) (int64, error) {
+	r, err := c.openText(ctx, "branch_read_file", "content", map[string]any{"branch_id": branchID, "file_path": filePath})
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(w, r)
+}
+
+// openText returns a reader over the string field key of tool's result,
+// having fetched the first page.
+func (c *MCPClient) openText(ctx context.Context, tool, key string, args map[string]any) (io.ReadCloser, error) {
+	paged := c.supportsPaging(ctx, tool)
+	fetch := func(ctx context.Context, offset int64) (textPage, error) {
+		callArgs := make(map[string]any, len(args)+2)
+		for k, v := range args {
+			callArgs[k] = v
+		}
+		if paged {
+			callArgs["offset"] = offset
+			callArgs["limit"] = c.pageSize
+		}
+		resp, err := c.CallToolContext(ctx, tool, callArgs)
+		if err != nil {
+			return textPage{}, err
+		}
+		if err := payloadErr(resp, tool); err != nil {
+			return textPage{}, err
+		}
+		text, ok := resp[key].(string)
+		if !ok {
+			return textPage{}, fmt.Errorf("%s: missing %s in response: %.200v", tool, key, resp)
+		}
+		if !paged {
+			return textPage{text: text}, nil
+		}
+		return nextPage(resp, text, offset, c.pageSize), nil
+	}
+	pg, err := fetch(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	r := &pagedReader{ctx: ctx, fetch: fetch}
+	r.apply(pg)
+	return r, nil
+}
+
+// nextPage works out where the page after text starts: next_offset and
+// has_more when the server sends them, otherwise a page shorter than limit
+// by more than a cut-off rune ends the text. Offsets count bytes of the
+// UTF-8 text, as fakepantheon does; a server counting characters must send
+// next_offset.
+func nextPage(resp map[string]any, text string, offset int64, limit int) textPage {
+	pg := textPage{text: text, next: offset + int64(len(text)), more: len(text) > limit-utf8.UTFMax}
+	if n, ok := resp["next_offset"].(float64); ok {
+		pg.next = int64(n)
+	}
+	if more, ok := resp["has_more"].(bool); ok {
+		pg.more = more
+	}
+	// Never ask for the same page twice.
+	if text == "" || pg.next <= offset {
+		pg.more = false
+	}
+	return pg
+}
+
+// supportsPaging reports whether tool's advertised input schema accepts the
+// page arguments.
+func (c *MCPClient) supportsPaging(ctx context.Context, tool string) bool {
+	t, err := c.DescribeTool(ctx, tool)
+	if err != nil {
+		return false
+	}
+	props, _ := t.InputSchema["properties"].(map[string]any)
+	for _, name := range pageArguments {
+		if _, ok := props[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,1624 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IANTHEREAL/agent0/runtime/fakepantheon"
+)
+
+func TestGetBranchContextAbortsOnCancel(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	client := NewMCPClient(srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := client.GetBranchContext(ctx, "branch-1")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("GetBranchContext took %s after cancel", elapsed)
+	}
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("expected no retries after cancel, got %d requests", got)
+	}
+}
+
+func TestCallToolContextCancelsRetryBackoff(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	client := NewMCPClient(srv.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.CallToolContext(ctx, "get_branch", map[string]any{"branch_id": "b"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("retry backoff ignored context (took %s)", elapsed)
+	}
+}
+
+// sessionServer is a minimal streamable-HTTP MCP endpoint that issues
+// session IDs and can be told to forget them.
+type sessionServer struct {
+	mu          sync.Mutex
+	tools       []any
+	sessions    map[string]bool
+	issued      int
+	initialized int
+	toolCalls   []string // session ID seen on each tools/call
+	toolLists   int
+	// listError, if set, is the JSON-RPC error code tools/list answers with.
+	listError int
+	// onTool, if set, produces the structuredContent of tools/call results.
+	onTool func(name string, args map[string]any) map[string]any
+}
+
+func newSessionServer() *sessionServer {
+	return &sessionServer{sessions: map[string]bool{}, tools: pantheonTestTools()}
+}
+
+func pantheonTestTools() []any {
+	str := map[string]any{"type": "string"}
+	tool := func(name string, props map[string]any, required ...string) any {
+		req := make([]any, 0, len(required))
+		for _, r := range required {
+			req = append(req, r)
+		}
+		return map[string]any{
+			"name":        name,
+			"inputSchema": map[string]any{"type": "object", "properties": props, "required": req},
+		}
+	}
+	return []any{
+		tool("parallel_explore", map[string]any{
+			"project_name":           str,
+			"parent_branch_id":       str,
+			"shared_prompt_sequence": map[string]any{"type": "array", "items": str},
+			"num_branches":           map[string]any{"type": "integer"},
+			"agent":                  str,
+		}, "project_name", "parent_branch_id", "shared_prompt_sequence"),
+		tool("get_branch", map[string]any{"branch_id": str}, "branch_id"),
+		tool("branch_read_file", map[string]any{"branch_id": str, "file_path": str}, "branch_id", "file_path"),
+		tool("branch_output", map[string]any{"branch_id": str, "full_output": map[string]any{"type": "boolean"}}, "branch_id"),
+	}
+}
+
+func (s *sessionServer) expireAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = map[string]bool{}
+}
+
+func (s *sessionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var msg map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	method, _ := msg["method"].(string)
+	sid := r.Header.Get("Mcp-Session-Id")
+	if method == "initialize" {
+		if sid != "" {
+			http.Error(w, "initialize must not carry a session", http.StatusBadRequest)
+			return
+		}
+		s.issued++
+		sid = fmt.Sprintf("sess-%d", s.issued)
+		s.sessions[sid] = true
+		w.Header().Set("Mcp-Session-Id", sid)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      msg["id"],
+			"result": map[string]any{
+				"protocolVersion": "2025-03-26",
+				"capabilities":    map[string]any{"tools": map[string]any{}},
+				"serverInfo":      map[string]any{"name": "test-pantheon", "version": "1.2.3"},
+			},
+		})
+		return
+	}
+	if !s.sessions[sid] {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	if method == "notifications/initialized" {
+		s.initialized++
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if method == "tools/list" {
+		s.toolLists++
+		w.Header().Set("Content-Type", "application/json")
+		if s.listError != 0 {
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"jsonrpc": "2.0",
+				"id":      msg["id"],
+				"error":   map[string]any{"code": s.listError, "message": "tools/list failed"},
+			})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      msg["id"],
+			"result":  map[string]any{"tools": s.tools},
+		})
+		return
+	}
+	s.toolCalls = append(s.toolCalls, sid)
+	content := map[string]any{"id": "branch-1", "status": "succeed"}
+	if s.onTool != nil {
+		params, _ := msg["params"].(map[string]any)
+		name, _ := params["name"].(string)
+		args, _ := params["arguments"].(map[string]any)
+		content = s.onTool(name, args)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      msg["id"],
+		"result":  map[string]any{"structuredContent": content},
+	})
+}
+
+func TestMCPClientPerformsInitializeHandshake(t *testing.T) {
+	server := newSessionServer()
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	client := NewMCPClient(srv.URL)
+	resp, err := client.GetBranchContext(context.Background(), "branch-1")
+	if err != nil {
+		t.Fatalf("GetBranchContext: %v", err)
+	}
+	if resp["status"] != "succeed" {
+		t.Fatalf("unexpected response %#v", resp)
+	}
+
+	session, ok := client.Session()
+	if !ok {
+		t.Fatalf("expected an initialized session")
+	}
+	if session.ID != "sess-1" || session.ProtocolVersion != "2025-03-26" {
+		t.Fatalf("unexpected session %#v", session)
+	}
+	if session.ServerInfo.Name != "test-pantheon" || !session.HasCapability("tools") {
+		t.Fatalf("unexpected server info/capabilities %#v", session)
+	}
+	if server.initialized != 1 {
+		t.Fatalf("expected 1 initialized notification, got %d", server.initialized)
+	}
+	if len(server.toolCalls) != 1 || server.toolCalls[0] != "sess-1" {
+		t.Fatalf("expected tools/call on sess-1, got %v", server.toolCalls)
+	}
+}
+
+func TestMCPClientReinitializesExpiredSession(t *testing.T) {
+	server := newSessionServer()
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	client := NewMCPClient(srv.URL)
+	if _, err := client.GetBranchContext(context.Background(), "branch-1"); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	server.expireAll()
+	if _, err := client.GetBranchContext(context.Background(), "branch-1"); err != nil {
+		t.Fatalf("call after expiry: %v", err)
+	}
+
+	if server.issued != 2 {
+		t.Fatalf("expected 2 sessions issued, got %d", server.issued)
+	}
+	if got := server.toolCalls; len(got) != 2 || got[1] != "sess-2" {
+		t.Fatalf("expected second call on sess-2, got %v", got)
+	}
+}
+
+func TestCallToolValidatesArgumentsAgainstSchema(t *testing.T) {
+	server := newSessionServer()
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	client := NewMCPClient(srv.URL)
+	_, err := client.CallToolContext(context.Background(), "branch_read_file", map[string]any{"branch_id": "b", "file_path": 7})
+	var argErr ArgumentError
+	if !errors.As(err, &argErr) {
+		t.Fatalf("expected ArgumentError, got %v", err)
+	}
+	if argErr.Tool != "branch_read_file" || len(argErr.Problems) != 1 || !strings.Contains(argErr.Problems[0], "file_path") {
+		t.Fatalf("unexpected problems %#v", argErr)
+	}
+	if len(server.toolCalls) != 0 {
+		t.Fatalf("expected invalid call not to be sent, got %d tools/call", len(server.toolCalls))
+	}
+
+	if _, err := client.CallToolContext(context.Background(), "no_such_tool", nil); err == nil || !strings.Contains(err.Error(), "no_such_tool") {
+		t.Fatalf("expected unknown tool error, got %v", err)
+	}
+}
+
+func TestCallToolSkipsValidationWithoutToolsList(t *testing.T) {
+	for _, code := range []int{CodeMethodNotFound, CodeInternalError} {
+		server := newSessionServer()
+		server.listError = code
+		srv := httptest.NewServer(server)
+
+		client, _ := NewMCPClientWithConfig(MCPClientConfig{BaseURL: srv.URL, RetryPolicy: ExponentialRetryPolicy{Attempts: 1}})
+		for i := 0; i < 2; i++ {
+			if _, err := client.CallToolContext(context.Background(), "get_branch", map[string]any{"branch_id": "b"}); err != nil {
+				t.Fatalf("code %d: call %d: %v", code, i, err)
+			}
+		}
+		if len(server.toolCalls) != 2 {
+			t.Fatalf("code %d: expected both calls sent, got %d", code, len(server.toolCalls))
+		}
+		// An unsupported tools/list is not asked for again; a failed one is.
+		want := 2
+		if code == CodeMethodNotFound {
+			want = 1
+		}
+		if server.toolLists != want {
+			t.Fatalf("code %d: expected %d tools/list, got %d", code, want, server.toolLists)
+		}
+		srv.Close()
+	}
+}
+
+func TestVerifyToolsReportsNewRequiredArgument(t *testing.T) {
+	server := newSessionServer()
+	server.tools = append(server.tools[:1:1], map[string]any{
+		"name": "get_branch",
+		"inputSchema": map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"branch_uuid": map[string]any{"type": "string"}},
+			"required":   []any{"branch_uuid"},
+		},
+	})
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	err := NewMCPClient(srv.URL).VerifyTools(context.Background())
+	if err == nil {
+		t.Fatalf("expected schema mismatch error")
+	}
+	for _, want := range []string{`requires argument "branch_uuid"`, `tool "branch_output"`, `tool "branch_read_file"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected error to mention %s, got %v", want, err)
+		}
+	}
+}
+
+func TestValidateSchemaHandlesOptionalAndRefs(t *testing.T) {
+	schema := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"limit": map[string]any{"anyOf": []any{map[string]any{"type": "integer"}, map[string]any{"type": "null"}}},
+			"mode":  map[string]any{"$ref": "#/$defs/Mode"},
+		},
+		"additionalProperties": false,
+		"$defs": map[string]any{
+			"Mode": map[string]any{"type": "string", "enum": []any{"fast", "full"}},
+		},
+	}
+	if problems := validateSchema(schema, map[string]any{"limit": nil, "mode": "full"}); len(problems) != 0 {
+		t.Fatalf("expected valid, got %v", problems)
+	}
+	problems := validateSchema(schema, map[string]any{"limit": 1.5, "mode": "slow", "extra": true})
+	if len(problems) != 3 {
+		t.Fatalf("expected 3 problems, got %v", problems)
+	}
+}
+
+func TestCallToolDoesNotRetryClientErrors(t *testing.T) {
+	server := newSessionServer()
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Mcp-Session-Id") != "" && atomic.AddInt32(&calls, 1) > 2 {
+			// The initialized notification and tools/list succeed; tools/call answers 400.
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		server.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	client := NewMCPClient(srv.URL)
+	_, err := client.CallToolContext(context.Background(), "branch_output", map[string]any{"branch_id": "b"})
+	var httpErr HTTPStatusError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected HTTP 400 error, got %v", err)
+	}
+	// initialized notification + tools/list + a single tools/call
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Fatalf("expected 4xx not to be retried, got %d session requests", got)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{HTTPStatusError{StatusCode: 429}, true},
+		{HTTPStatusError{StatusCode: 503}, true},
+		{HTTPStatusError{StatusCode: 404}, false},
+		{fmt.Errorf("wrapped: %w", HTTPStatusError{StatusCode: 502}), true},
+		{&json.SyntaxError{}, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, true},
+		{CircuitOpenError{}, false},
+		{ArgumentError{Tool: "x"}, false},
+	}
+	for _, tc := range cases {
+		if got := IsRetryableError(tc.err); got != tc.want {
+			t.Fatalf("IsRetryableError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestCircuitBreakerOpensAndProbes(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var transitions []string
+	b := NewCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+	b.OnStateChange = func(from, to CircuitState) { transitions = append(transitions, from.String()+"->"+to.String()) }
+
+	unavailable := HTTPStatusError{StatusCode: 503}
+	b.Record(HTTPStatusError{StatusCode: 400})
+	b.Record(unavailable)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expected closed breaker after 1 failure, got %v", err)
+	}
+	b.Record(unavailable)
+	err := b.Allow()
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected open breaker, got %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expected probe to be allowed after cooldown, got %v", err)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected concurrent calls rejected while probing, got %v", err)
+	}
+	b.Record(nil)
+	if b.State() != CircuitClosed {
+		t.Fatalf("expected closed after successful probe, got %s", b.State())
+	}
+	want := []string{"closed->open", "open->half-open", "half-open->closed"}
+	if fmt.Sprint(transitions) != fmt.Sprint(want) {
+		t.Fatalf("expected transitions %v, got %v", want, transitions)
+	}
+}
+
+func TestCircuitBreakerProbeSurvivesSessionRenewal(t *testing.T) {
+	server := newSessionServer()
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	now := time.Unix(1000, 0)
+	breaker := NewCircuitBreaker(1, time.Minute)
+	breaker.now = func() time.Time { return now }
+	client, _ := NewMCPClientWithConfig(MCPClientConfig{BaseURL: srv.URL, CircuitBreaker: breaker})
+	if _, err := client.GetBranchContext(context.Background(), "branch-1"); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+
+	// The server restarts: the breaker opens, and the probe after the
+	// cooldown finds the session gone.
+	breaker.Record(HTTPStatusError{StatusCode: 503})
+	now = now.Add(time.Minute)
+	server.expireAll()
+	if _, err := client.GetBranchContext(context.Background(), "branch-1"); err != nil {
+		t.Fatalf("probe with an expired session: %v", err)
+	}
+	if breaker.State() != CircuitClosed {
+		t.Fatalf("expected the renewed probe to close the breaker, got %s", breaker.State())
+	}
+	if _, err := client.GetBranchContext(context.Background(), "branch-1"); err != nil {
+		t.Fatalf("call after the probe: %v", err)
+	}
+}
+
+type rotatingTokenSource struct {
+	tokens    []string
+	refreshes int
+}
+
+func (s *rotatingTokenSource) Token(context.Context) (string, error) { return s.tokens[0], nil }
+
+func (s *rotatingTokenSource) Refresh(context.Context) (string, error) {
+	s.refreshes++
+	s.tokens = s.tokens[1:]
+	return s.tokens[0], nil
+}
+
+func TestMCPClientSendsHeadersAndRefreshesTokenOn401(t *testing.T) {
+	server := newSessionServer()
+	var seenTenant []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenTenant = append(seenTenant, r.Header.Get("X-Tenant"))
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		server.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	tokens := &rotatingTokenSource{tokens: []string{"stale", "fresh"}}
+	client, err := NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL:     srv.URL,
+		Headers:     map[string]string{"x-tenant": "team-a"},
+		TokenSource: tokens,
+	})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	if _, err := client.GetBranchContext(context.Background(), "branch-1"); err != nil {
+		t.Fatalf("GetBranchContext: %v", err)
+	}
+	if tokens.refreshes != 1 {
+		t.Fatalf("expected exactly 1 token refresh, got %d", tokens.refreshes)
+	}
+	for i, tenant := range seenTenant {
+		if tenant != "team-a" {
+			t.Fatalf("request %d missing X-Tenant header", i+1)
+		}
+	}
+}
+
+func TestMCPClientGivesUpAfterOneTokenRefresh(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	tokens := &rotatingTokenSource{tokens: []string{"a", "b", "c"}}
+	client, _ := NewMCPClientWithConfig(MCPClientConfig{BaseURL: srv.URL, TokenSource: tokens})
+	_, err := client.GetBranchContext(context.Background(), "branch-1")
+	if !isUnauthorized(err) {
+		t.Fatalf("expected 401 error, got %v", err)
+	}
+	if tokens.refreshes != 1 {
+		t.Fatalf("expected a single refresh, got %d", tokens.refreshes)
+	}
+}
+
+func TestMCPClientTrustsConfiguredCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(newSessionServer())
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	untrusted, err := NewMCPClientWithConfig(MCPClientConfig{BaseURL: srv.URL, RetryPolicy: ExponentialRetryPolicy{Attempts: 1}})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	if _, err := untrusted.GetBranchContext(context.Background(), "branch-1"); err == nil {
+		t.Fatalf("expected certificate error without CA bundle")
+	}
+
+	client, err := NewMCPClientWithConfig(MCPClientConfig{BaseURL: srv.URL, Transport: TransportConfig{CAFile: caFile}})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	if _, err := client.GetBranchContext(context.Background(), "branch-1"); err != nil {
+		t.Fatalf("GetBranchContext with CA bundle: %v", err)
+	}
+}
+
+func TestMCPClientRoutesThroughProxy(t *testing.T) {
+	upstream := newSessionServer()
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "pantheon.internal:8000" {
+			http.Error(w, "unexpected host "+r.URL.Host, http.StatusBadGateway)
+			return
+		}
+		atomic.AddInt32(&proxied, 1)
+		upstream.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	client, err := NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL:   "http://pantheon.internal:8000/mcp",
+		Transport: TransportConfig{ProxyURL: proxy.URL},
+	})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	if _, err := client.GetBranchContext(context.Background(), "branch-1"); err != nil {
+		t.Fatalf("GetBranchContext via proxy: %v", err)
+	}
+	if atomic.LoadInt32(&proxied) == 0 {
+		t.Fatalf("expected requests to go through the proxy")
+	}
+}
+
+func TestNewHTTPClientRejectsBadTransportConfig(t *testing.T) {
+	cases := map[string]TransportConfig{
+		"missing CA file":    {CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		"cert without key":   {CertFile: "client.pem"},
+		"proxy missing host": {ProxyURL: "proxy.internal"},
+	}
+	for name, cfg := range cases {
+		if _, err := NewHTTPClient(cfg); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// streamingServer answers tools/call over SSE with the given events and
+// delegates everything else to a sessionServer.
+func streamingServer(events func(msg map[string]any) []string) http.Handler {
+	inner := newSessionServer()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var msg map[string]any
+		_ = json.Unmarshal(body, &msg)
+		if msg["method"] != "tools/call" {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			inner.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, ev := range events(msg) {
+			fmt.Fprintf(w, "%s\n\n", ev)
+			w.(http.Flusher).Flush()
+		}
+	})
+}
+
+func TestCallToolDispatchesProgressAndMatchesResponseID(t *testing.T) {
+	var token any
+	srv := httptest.NewServer(streamingServer(func(msg map[string]any) []string {
+		params, _ := msg["params"].(map[string]any)
+		meta, _ := params["_meta"].(map[string]any)
+		token = meta["progressToken"]
+		id, _ := json.Marshal(msg["id"])
+		tok, _ := json.Marshal(token)
+		return []string{
+			": keep-alive",
+			fmt.Sprintf(`data: {"jsonrpc":"2.0","method":"notifications/progress","params":{"progressToken":%s,"progress":1,"total":4,"message":"cloning"}}`, tok),
+			`data: {"jsonrpc":"2.0","method":"notifications/message","params":{"level":"info","data":"hello"}}`,
+			`data: {"jsonrpc":"2.0","id":999,"result":{"structuredContent":{"id":"wrong"}}}`,
+			"event: message\ndata: {\"jsonrpc\":\"2.0\",\"id\":" + string(id) + ",\ndata: \"result\":{\"structuredContent\":{\"id\":\"branch-1\",\"status\":\"running\"}}}",
+		}
+	}))
+	defer srv.Close()
+
+	client := NewMCPClient(srv.URL)
+	var (
+		progress []ProgressEvent
+		logs     []Notification
+	)
+	client.OnProgress(func(ev ProgressEvent) { progress = append(progress, ev) })
+	client.OnNotification("notifications/message", func(n Notification) { logs = append(logs, n) })
+
+	resp, err := client.GetBranchContext(context.Background(), "branch-1")
+	if err != nil {
+		t.Fatalf("GetBranchContext: %v", err)
+	}
+	if resp["id"] != "branch-1" {
+		t.Fatalf("expected response matching request id, got %v", resp)
+	}
+	if token == nil {
+		t.Fatalf("expected a progressToken in tools/call _meta")
+	}
+	if len(progress) != 1 || progress[0].Progress != 1 || progress[0].Total != 4 || progress[0].Message != "cloning" {
+		t.Fatalf("unexpected progress events: %+v", progress)
+	}
+	if len(logs) != 1 {
+		t.Fatalf("expected 1 log notification, got %d", len(logs))
+	}
+}
+
+func TestProgressLoggerForgetsFinishedRequests(t *testing.T) {
+	now := time.Unix(1000, 0)
+	p := &progressLogger{interval: time.Minute, now: func() time.Time { return now }}
+	p.log(ProgressEvent{Token: "a", Progress: 1, Total: 2})
+	p.log(ProgressEvent{Token: "b", Progress: 1})
+	p.log(ProgressEvent{Token: "a", Progress: 2, Total: 2})
+	if _, ok := p.last["a"]; ok || len(p.last) != 1 {
+		t.Fatalf("expected only the unfinished token to be tracked, got %v", p.last)
+	}
+	now = now.Add(time.Minute)
+	p.log(ProgressEvent{Token: "c", Progress: 1})
+	if _, ok := p.last["b"]; ok || len(p.last) != 1 {
+		t.Fatalf("expected the quiet token to be dropped, got %v", p.last)
+	}
+}
+
+func TestSSEReaderSplitsEvents(t *testing.T) {
+	stream := ": comment\r\nid: 7\r\nevent: message\r\ndata: {\"a\":\r\ndata: 1}\r\n\r\n\n\ndata: tail"
+	r := newSSEReader(strings.NewReader(stream))
+
+	ev, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if ev.ID != "7" || ev.Event != "message" || ev.Data != "{\"a\":\n1}" {
+		t.Fatalf("unexpected first event: %+v", ev)
+	}
+	if ev, err = r.Next(); err != nil || ev.Data != "tail" {
+		t.Fatalf("expected unterminated tail event, got %+v (%v)", ev, err)
+	}
+	if _, err = r.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestListenDispatchesServerNotifications(t *testing.T) {
+	inner := newSessionServer()
+	var lastEventIDs []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			inner.ServeHTTP(w, r)
+			return
+		}
+		mu.Lock()
+		lastEventIDs = append(lastEventIDs, r.Header.Get("Last-Event-ID"))
+		n := len(lastEventIDs)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "id: ev-%d\ndata: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\",\"params\":{\"progressToken\":\"branch-1\",\"progress\":%d}}\n\n", n, n)
+	}))
+	defer srv.Close()
+
+	client, _ := NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL:     srv.URL,
+		RetryPolicy: ExponentialRetryPolicy{Attempts: 1, BaseDelay: time.Millisecond},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	got := make(chan ProgressEvent, 10)
+	client.OnProgress(func(ev ProgressEvent) {
+		got <- ev
+		if ev.Progress >= 2 {
+			cancel()
+		}
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- client.Listen(ctx) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Listen returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listen did not deliver notifications")
+	}
+	if len(got) < 2 {
+		t.Fatalf("expected notifications from two connections, got %d", len(got))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if lastEventIDs[1] != "ev-1" {
+		t.Fatalf("expected reconnect with Last-Event-ID ev-1, got %q", lastEventIDs[1])
+	}
+}
+
+func TestListenReportsUnsupportedServer(t *testing.T) {
+	inner := newSessionServer()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			http.Error(w, "no", http.StatusMethodNotAllowed)
+			return
+		}
+		inner.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	if err := NewMCPClient(srv.URL).Listen(context.Background()); !errors.Is(err, ErrListenUnsupported) {
+		t.Fatalf("expected ErrListenUnsupported, got %v", err)
+	}
+}
+
+// answerTestMCP is a transport-independent stand-in MCP server: it returns
+// the messages to send back for msg (a progress notification precedes each
+// tool result).
+func answerTestMCP(msg map[string]any) []map[string]any {
+	method, _ := msg["method"].(string)
+	id, hasID := msg["id"]
+	if !hasID || method == "" {
+		return nil
+	}
+	reply := func(result map[string]any) map[string]any {
+		return map[string]any{"jsonrpc": "2.0", "id": id, "result": result}
+	}
+	switch method {
+	case "initialize":
+		return []map[string]any{reply(map[string]any{
+			"protocolVersion": "2025-03-26",
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "stand-in", "version": "0"},
+		})}
+	case "tools/list":
+		return []map[string]any{reply(map[string]any{"tools": pantheonTestTools()})}
+	case "tools/call":
+		return []map[string]any{
+			{"jsonrpc": "2.0", "method": "notifications/progress", "params": map[string]any{"progressToken": "t", "progress": 1.0}},
+			reply(map[string]any{"structuredContent": map[string]any{"id": "branch-1", "status": "succeed"}}),
+		}
+	}
+	return []map[string]any{{"jsonrpc": "2.0", "id": id, "error": map[string]any{"code": -32601, "message": "unknown method"}}}
+}
+
+func TestStdioHelperProcess(t *testing.T) {
+	if os.Getenv("AGENT0_STDIO_HELPER") != "1" {
+		return
+	}
+	if os.Getenv("AGENT0_STDIO_HELPER_NOISY") == "1" {
+		// More than a pipe buffer of stderr in one line, then more.
+		fmt.Fprintln(os.Stderr, strings.Repeat("x", 256*1024))
+		fmt.Fprintln(os.Stderr, strings.Repeat("y", 256*1024))
+	}
+	in := bufio.NewScanner(os.Stdin)
+	out := json.NewEncoder(os.Stdout)
+	for in.Scan() {
+		var msg map[string]any
+		if err := json.Unmarshal(in.Bytes(), &msg); err != nil {
+			fmt.Fprintln(os.Stderr, "bad message:", err)
+			continue
+		}
+		for _, m := range answerTestMCP(msg) {
+			_ = out.Encode(m)
+		}
+	}
+	os.Exit(0)
+}
+
+func TestStdioTransportTalksToLocalServer(t *testing.T) {
+	t.Setenv("AGENT0_STDIO_HELPER", "1")
+	client, err := NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL: "stdio:" + os.Args[0] + " -test.run=^TestStdioHelperProcess$",
+	})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	defer client.Close()
+	progress := make(chan ProgressEvent, 1)
+	client.OnProgress(func(ev ProgressEvent) { progress <- ev })
+
+	resp, err := client.GetBranchContext(context.Background(), "branch-1")
+	if err != nil {
+		t.Fatalf("GetBranchContext: %v", err)
+	}
+	if resp["id"] != "branch-1" {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	select {
+	case <-progress:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a progress notification over stdio")
+	}
+	if s, _ := client.Session(); s.ServerInfo.Name != "stand-in" {
+		t.Fatalf("unexpected session %+v", s)
+	}
+}
+
+func TestStdioTransportDrainsLongStderrLines(t *testing.T) {
+	t.Setenv("AGENT0_STDIO_HELPER", "1")
+	t.Setenv("AGENT0_STDIO_HELPER_NOISY", "1")
+	client, err := NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL: "stdio:'" + os.Args[0] + "' '-test.run=^TestStdioHelperProcess$'",
+	})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := client.GetBranchContext(ctx, "branch-1"); err != nil {
+		t.Fatalf("GetBranchContext: %v", err)
+	}
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	cases := map[string][]string{
+		"python -m server":                      {"python", "-m", "server"},
+		`  "/opt/my server/bin"  --name 'a b' `: {"/opt/my server/bin", "--name", "a b"},
+		`run --arg="x \"y\" \z" it\'s ''`:       {"run", `--arg=x "y" \z`, "it's", ""},
+		`'don''t'`:                              {"dont"},
+	}
+	for in, want := range cases {
+		got, err := splitCommandLine(in)
+		if err != nil {
+			t.Fatalf("splitCommandLine(%q): %v", in, err)
+		}
+		if strings.Join(got, "|") != strings.Join(want, "|") || len(got) != len(want) {
+			t.Errorf("splitCommandLine(%q) = %q, want %q", in, got, want)
+		}
+	}
+	for _, bad := range []string{`"open`, `it's`, `trailing\`} {
+		if _, err := splitCommandLine(bad); err == nil {
+			t.Errorf("splitCommandLine(%q): expected an error", bad)
+		}
+	}
+}
+
+// newWebSocketTestServer answers MCP over WebSocket, selecting protocol as
+// the subprotocol, and records the handshake's Authorization header.
+func newWebSocketTestServer(protocol string, auth *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth != nil {
+			*auth = r.Header.Get("Authorization")
+		}
+		key := r.Header.Get("Sec-WebSocket-Key")
+		sum := sha1.Sum([]byte(key + websocketGUID))
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+		if protocol != "" {
+			fmt.Fprintf(rw, "Sec-WebSocket-Protocol: %s\r\n", protocol)
+		}
+		fmt.Fprint(rw, "\r\n")
+		rw.Flush()
+		// Reuse the client framing code; the server side just leaves
+		// frames masked, which readers must accept either way.
+		ws := &wsConn{conn: conn, r: rw.Reader}
+		for {
+			data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg map[string]any
+			_ = json.Unmarshal(data, &msg)
+			for _, m := range answerTestMCP(msg) {
+				out, _ := json.Marshal(m)
+				_ = ws.WriteMessage(out)
+			}
+		}
+	}))
+}
+
+func TestWebSocketTransportTalksToServer(t *testing.T) {
+	var auth string
+	srv := newWebSocketTestServer("mcp", &auth)
+	defer srv.Close()
+
+	client, err := NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL:     "ws" + strings.TrimPrefix(srv.URL, "http") + "/mcp",
+		TokenSource: StaticTokenSource("secret"),
+	})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	defer client.Close()
+	resp, err := client.GetBranchContext(context.Background(), "branch-1")
+	if err != nil {
+		t.Fatalf("GetBranchContext: %v", err)
+	}
+	if resp["id"] != "branch-1" {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	if auth != "Bearer secret" {
+		t.Fatalf("expected bearer token on the handshake, got %q", auth)
+	}
+}
+
+func TestWebSocketHandshakeRequiresMCPSubprotocol(t *testing.T) {
+	srv := newWebSocketTestServer("", nil)
+	defer srv.Close()
+
+	client, err := NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL:     "ws" + strings.TrimPrefix(srv.URL, "http") + "/mcp",
+		RetryPolicy: ExponentialRetryPolicy{Attempts: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.GetBranchContext(context.Background(), "branch-1"); err == nil || !strings.Contains(err.Error(), "subprotocol") {
+		t.Fatalf("expected a subprotocol error, got %v", err)
+	}
+}
+
+func TestWebSocketTransportTunnelsThroughProxy(t *testing.T) {
+	srv := newWebSocketTestServer("mcp", nil)
+	defer srv.Close()
+
+	var tunnels atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tunnels.Add(1)
+		fmt.Fprint(rw, "HTTP/1.1 200 Connection established\r\n\r\n")
+		rw.Flush()
+		go io.Copy(upstream, rw)
+		io.Copy(conn, upstream)
+	}))
+	defer proxy.Close()
+
+	client, err := NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL:   "ws" + strings.TrimPrefix(srv.URL, "http") + "/mcp",
+		Transport: TransportConfig{ProxyURL: proxy.URL},
+	})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.GetBranchContext(context.Background(), "branch-1"); err != nil {
+		t.Fatalf("GetBranchContext: %v", err)
+	}
+	if tunnels.Load() != 1 {
+		t.Fatalf("expected one CONNECT tunnel through the proxy, got %d", tunnels.Load())
+	}
+}
+
+func TestWebSocketRejectsOversizedMessages(t *testing.T) {
+	huge := []byte{0x81, 127}
+	huge = binary.BigEndian.AppendUint64(huge, 1<<62)
+	ws := &wsConn{r: bufio.NewReader(bytes.NewReader(huge))}
+	if _, err := ws.ReadMessage(); err == nil || !strings.Contains(err.Error(), "size limit") {
+		t.Fatalf("expected a size limit error for a huge frame, got %v", err)
+	}
+
+	// Two frames that fit alone but not together.
+	fragmented := append([]byte{0x01, 6}, "abcdef"...)
+	fragmented = append(fragmented, append([]byte{0x80, 6}, "ghijkl"...)...)
+	ws = &wsConn{r: bufio.NewReader(bytes.NewReader(fragmented)), max: 10}
+	if _, err := ws.ReadMessage(); err == nil || !strings.Contains(err.Error(), "size limit") {
+		t.Fatalf("expected a size limit error for a reassembled message, got %v", err)
+	}
+}
+
+// funcTransport is an in-process Transport backed by answerTestMCP.
+type funcTransport struct {
+	mu    sync.Mutex
+	calls int
+	fail  int // fail this many requests with a dropped connection first
+	msgs  []map[string]any
+}
+
+func (f *funcTransport) RoundTrip(_ context.Context, msg map[string]any) (map[string]any, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	f.msgs = append(f.msgs, msg)
+	if f.fail > 0 && msg["method"] == "tools/call" {
+		f.fail--
+		return nil, errConnectionLost{cause: io.EOF}
+	}
+	for _, m := range answerTestMCP(msg) {
+		if _, ok := m["method"]; !ok {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *funcTransport) Close() error { return nil }
+
+func TestMCPClientReinitializesAfterConnectionLoss(t *testing.T) {
+	tr := &funcTransport{fail: 1}
+	client, err := NewMCPClientWithConfig(MCPClientConfig{BaseURL: "stdio:unused", RPCTransport: tr})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	if _, err := client.GetBranchContext(context.Background(), "branch-1"); err != nil {
+		t.Fatalf("GetBranchContext: %v", err)
+	}
+	// initialize, initialized, tools/list, failed call, then initialize,
+	// initialized and the call again over the new connection.
+	if tr.calls != 7 {
+		t.Fatalf("expected re-initialization after connection loss, got %d messages", tr.calls)
+	}
+}
+
+func TestNewMCPClientRejectsUnknownScheme(t *testing.T) {
+	if _, err := NewMCPClientWithConfig(MCPClientConfig{BaseURL: "ftp://pantheon"}); err == nil {
+		t.Fatal("expected error for ftp:// URL")
+	}
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "unsupported MCP URL scheme") {
+			t.Fatalf("expected NewMCPClient to panic with the config error, got %v", r)
+		}
+	}()
+	NewMCPClient("ftp://pantheon")
+}
+
+func TestReplayTransportReproducesRecordedSession(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(streamingServer(func(msg map[string]any) []string {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return []string{`data: {"jsonrpc":"2.0","id":` + fmt.Sprint(msg["id"]) + `,"error":{"code":-32000,"message":"busy"}}`}
+		}
+		return []string{
+			`data: {"jsonrpc":"2.0","method":"notifications/progress","params":{"progressToken":"x","progress":3}}`,
+			`data: {"jsonrpc":"2.0","id":` + fmt.Sprint(msg["id"]) + `,"result":{"structuredContent":{"id":"branch-7","status":"running"}}}`,
+		}
+	}))
+	var cassette bytes.Buffer
+	rec, _ := NewMCPClientWithConfig(MCPClientConfig{BaseURL: srv.URL, Recorder: NewRecorder(&cassette)})
+	var rpcErr *RPCError
+	if _, err := rec.GetBranchContext(context.Background(), "branch-7"); !errors.As(err, &rpcErr) || rpcErr.Code != -32000 {
+		t.Fatalf("expected recorded JSON-RPC error, got %v", err)
+	}
+	resp, err := rec.GetBranchContext(context.Background(), "branch-7")
+	if err != nil || resp["status"] != "running" {
+		t.Fatalf("recorded GetBranchContext: %v %v", resp, err)
+	}
+	srv.Close()
+
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	if err := os.WriteFile(path, cassette.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := OpenReplayTransport(path)
+	if err != nil {
+		t.Fatalf("OpenReplayTransport: %v", err)
+	}
+	client, _ := NewMCPClientWithConfig(MCPClientConfig{BaseURL: srv.URL, RPCTransport: replay})
+	var progress []ProgressEvent
+	client.OnProgress(func(ev ProgressEvent) { progress = append(progress, ev) })
+
+	if _, err := client.GetBranchContext(context.Background(), "branch-7"); !errors.As(err, &rpcErr) || rpcErr.Message != "busy" {
+		t.Fatalf("expected replayed JSON-RPC error, got %v", err)
+	}
+	resp, err = client.GetBranchContext(context.Background(), "branch-7")
+	if err != nil || resp["id"] != "branch-7" {
+		t.Fatalf("replayed GetBranchContext: %v %v", resp, err)
+	}
+	if len(progress) != 1 || progress[0].Progress != 3 {
+		t.Fatalf("expected replayed progress notification, got %+v", progress)
+	}
+	if replay.Remaining() != 0 {
+		t.Fatalf("expected cassette fully consumed, %d entries left", replay.Remaining())
+	}
+
+	_, err = client.BranchOutputContext(context.Background(), "branch-7", false)
+	var mismatch CassetteMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected CassetteMismatchError past the end of the cassette, got %v", err)
+	}
+}
+
+func TestCassetteErrorKeepsRetryClassification(t *testing.T) {
+	for _, err := range []error{
+		HTTPStatusError{StatusCode: 503, Body: "down", RetryAfter: 2 * time.Second},
+		HTTPStatusError{StatusCode: 400, Body: "bad"},
+		errSessionExpired,
+		&net.OpError{Op: "dial", Err: errors.New("connection refused")},
+		errors.New("boom"),
+	} {
+		replayed := newCassetteError(err).Err()
+		if IsRetryableError(replayed) != IsRetryableError(err) {
+			t.Errorf("%v: retryable=%v after replay, want %v", err, IsRetryableError(replayed), IsRetryableError(err))
+		}
+		if errors.Is(replayed, errSessionExpired) != errors.Is(err, errSessionExpired) {
+			t.Errorf("%v: session-expired classification lost", err)
+		}
+		if retryAfter(replayed) != retryAfter(err) {
+			t.Errorf("%v: Retry-After lost", err)
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	l, err := ParseRateLimit("rate=0.5, burst=3,inflight=2")
+	if err != nil {
+		t.Fatalf("ParseRateLimit: %v", err)
+	}
+	if l != (RateLimit{Rate: 0.5, Burst: 3, MaxInFlight: 2}) {
+		t.Fatalf("unexpected limit %+v", l)
+	}
+	if l.String() != "rate=0.5,burst=3,inflight=2" {
+		t.Fatalf("unexpected String() %q", l.String())
+	}
+	for _, bad := range []string{"rate", "rate=-1", "speed=3", "inflight=x"} {
+		if _, err := ParseRateLimit(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestLimiterTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewLimiter(RateLimit{Rate: 2, Burst: 2})
+	l.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if wait := l.reserve(); wait != 0 {
+			t.Fatalf("request %d within burst waited %s", i+1, wait)
+		}
+	}
+	if wait := l.reserve(); wait != 500*time.Millisecond {
+		t.Fatalf("expected 500ms wait after the burst, got %s", wait)
+	}
+	now = now.Add(time.Second)
+	if wait := l.reserve(); wait != 0 {
+		t.Fatalf("expected refilled bucket, got wait %s", wait)
+	}
+	if NewLimiter(RateLimit{}) != nil {
+		t.Fatal("expected nil limiter for an unlimited RateLimit")
+	}
+}
+
+// concurrencyTransport answers like funcTransport but holds each tools/call
+// briefly and records the peak number of calls in flight.
+type concurrencyTransport struct {
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (c *concurrencyTransport) RoundTrip(_ context.Context, msg map[string]any) (map[string]any, error) {
+	if msg["method"] == "tools/call" {
+		c.mu.Lock()
+		c.inFlight++
+		c.peak = max(c.peak, c.inFlight)
+		c.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		c.mu.Lock()
+		c.inFlight--
+		c.mu.Unlock()
+	}
+	for _, m := range answerTestMCP(msg) {
+		if _, ok := m["method"]; !ok {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *concurrencyTransport) Close() error { return nil }
+
+func TestToolRateLimiterBoundsConcurrency(t *testing.T) {
+	tr := &concurrencyTransport{}
+	client, err := NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL:          "stdio:unused",
+		RPCTransport:     tr,
+		RateLimiter:      NewLimiter(RateLimit{MaxInFlight: 3}),
+		ToolRateLimiters: map[string]*Limiter{"get_branch": NewLimiter(RateLimit{MaxInFlight: 1})},
+	})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	if _, err := client.Initialize(context.Background()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.GetBranchContext(context.Background(), "branch-1"); err != nil {
+				t.Errorf("GetBranchContext: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if tr.peak != 1 {
+		t.Fatalf("expected get_branch calls to be serialized, peak in flight %d", tr.peak)
+	}
+}
+
+func TestLimiterAcquireHonoursCancellation(t *testing.T) {
+	l := NewLimiter(RateLimit{Rate: 0.001, Burst: 1, MaxInFlight: 1})
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("first Acquire: %v", err)
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error while the only slot is held, got %v", err)
+	}
+}
+
+func TestMCPClientReportsMetricsAndPropagatesTraceContext(t *testing.T) {
+	fake := fakepantheon.New(fakepantheon.Config{})
+	fake.SeedBranch("branch-1")
+	fake.Inject(fakepantheon.Fault{Tool: "get_branch", HTTPStatus: http.StatusServiceUnavailable})
+	var (
+		mu           sync.Mutex
+		traceparents []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		mu.Unlock()
+		fake.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	var spans []SpanRecord
+	metrics := NewMemoryMetrics()
+	fast := ExponentialRetryPolicy{Attempts: 3, BaseDelay: time.Millisecond}
+	client, err := NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL:           srv.URL,
+		ToolRetryPolicies: map[string]RetryPolicy{"get_branch": fast},
+		Metrics:           metrics,
+		Tracer:            &W3CTracer{OnEnd: func(r SpanRecord) { spans = append(spans, r) }},
+	})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	const parentTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	ctx := ContextWithTraceParent(context.Background(), "00-"+parentTrace+"-00f067aa0ba902b7-01")
+	if _, err := client.GetBranchContext(ctx, "branch-1"); err != nil {
+		t.Fatalf("GetBranchContext: %v", err)
+	}
+
+	snap := metrics.Snapshot()
+	h := snap.Calls["tools/call get_branch"]
+	if h.Count != 1 || h.Errors != 0 {
+		t.Fatalf("expected one successful get_branch call, got %+v", h)
+	}
+	if snap.Retries["tools/call get_branch"] != 1 {
+		t.Fatalf("expected one retry, got %v", snap.Retries)
+	}
+	if snap.HTTPStatus[http.StatusServiceUnavailable] != 1 || snap.HTTPStatus[http.StatusOK] == 0 {
+		t.Fatalf("unexpected HTTP status counts %v", snap.HTTPStatus)
+	}
+
+	var call *SpanRecord
+	for i := range spans {
+		if spans[i].Name == "tools/call get_branch" {
+			call = &spans[i]
+		}
+	}
+	if call == nil {
+		t.Fatalf("no span for get_branch among %+v", spans)
+	}
+	if call.TraceID != parentTrace || call.ParentID != "00f067aa0ba902b7" || call.Attributes["mcp.attempts"] != 2 {
+		t.Fatalf("unexpected span %+v", *call)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := traceparents[len(traceparents)-1]; got != call.TraceParent() {
+		t.Fatalf("expected traceparent %q on the tools/call request, got %q", call.TraceParent(), got)
+	}
+}
+
+func TestMCPClientPropagatesTraceContextWithoutHTTP(t *testing.T) {
+	tr := &funcTransport{}
+	var spans []SpanRecord
+	client, err := NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL:      "stdio:unused",
+		RPCTransport: tr,
+		Tracer:       &W3CTracer{OnEnd: func(r SpanRecord) { spans = append(spans, r) }},
+	})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	if _, err := client.GetBranchContext(context.Background(), "branch-1"); err != nil {
+		t.Fatalf("GetBranchContext: %v", err)
+	}
+
+	want := ""
+	for _, s := range spans {
+		if s.Name == "tools/call get_branch" {
+			want = s.TraceParent()
+		}
+	}
+	for _, msg := range tr.msgs {
+		if msg["method"] != "tools/call" {
+			continue
+		}
+		params, _ := msg["params"].(map[string]any)
+		meta, _ := params["_meta"].(map[string]any)
+		if meta["traceparent"] != want || want == "" {
+			t.Fatalf("expected _meta.traceparent %q on the tools/call message, got %#v", want, params["_meta"])
+		}
+		return
+	}
+	t.Fatalf("no tools/call among %d messages", len(tr.msgs))
+}
+
+func TestMCPClientCountsSSEParseFailures(t *testing.T) {
+	srv := httptest.NewServer(streamingServer(func(map[string]any) []string {
+		return []string{"data: <html>gateway error</html>"}
+	}))
+	defer srv.Close()
+	metrics := NewMemoryMetrics()
+	client, err := NewMCPClientWithConfig(MCPClientConfig{
+		BaseURL:     srv.URL,
+		RetryPolicy: ExponentialRetryPolicy{Attempts: 1},
+		Metrics:     metrics,
+	})
+	if err != nil {
+		t.Fatalf("NewMCPClientWithConfig: %v", err)
+	}
+	if _, err := client.BranchOutputContext(context.Background(), "branch-1", false); err == nil {
+		t.Fatal("expected an error for an SSE stream without a response")
+	}
+	if n := metrics.Snapshot().SSEParseFailures; n != 1 {
+		t.Fatalf("expected 1 SSE parse failure, got %d", n)
+	}
+}
+
+func TestMCPClientReadsResourcesAndPrompts(t *testing.T) {
+	fake := fakepantheon.New(fakepantheon.Config{JSONResponses: true})
+	fake.SeedBranch("branch-0")
+	fake.AddPrompt(fakepantheon.Prompt{Name: "episode", Description: "standard episode", Template: "Work on {{area}}."})
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client := NewMCPClient(srv.URL)
+	ctx := context.Background()
+
+	resources, err := client.ListResources(ctx)
+	if err != nil {
+		t.Fatalf("ListResources: %v", err)
+	}
+	if len(resources) != 1 || resources[0].URI != "pantheon://branches/branch-0/output" {
+		t.Fatalf("unexpected resources %+v", resources)
+	}
+	templates, err := client.ListResourceTemplates(ctx)
+	if err != nil || len(templates) != 2 {
+		t.Fatalf("ListResourceTemplates: %v %+v", err, templates)
+	}
+	contents, err := client.ReadResource(ctx, resources[0].URI)
+	if err != nil {
+		t.Fatalf("ReadResource: %v", err)
+	}
+	if len(contents) != 1 || contents[0].URI != resources[0].URI || contents[0].MIMEType != "text/plain" {
+		t.Fatalf("unexpected contents %+v", contents)
+	}
+	if _, err := client.ReadResource(ctx, "pantheon://branches/nope/output"); err == nil {
+		t.Fatal("expected an error for a missing resource")
+	}
+	if err := client.SubscribeResource(ctx, resources[0].URI); err != nil {
+		t.Fatalf("SubscribeResource: %v", err)
+	}
+
+	prompts, err := client.ListPrompts(ctx)
+	if err != nil {
+		t.Fatalf("ListPrompts: %v", err)
+	}
+	if len(prompts) != 1 || prompts[0].Name != "episode" || len(prompts[0].Arguments) != 1 || !prompts[0].Arguments[0].Required {
+		t.Fatalf("unexpected prompts %+v", prompts)
+	}
+	p, err := client.GetPrompt(ctx, "episode", map[string]string{"area": "docs"})
+	if err != nil {
+		t.Fatalf("GetPrompt: %v", err)
+	}
+	if p.Text() != "Work on docs." || p.Description != "standard episode" {
+		t.Fatalf("unexpected prompt %+v", p)
+	}
+	if _, err := client.GetPrompt(ctx, "episode", nil); err == nil {
+		t.Fatal("expected an error for a missing prompt argument")
+	}
+}
+
+func TestMCPClientReportsMissingCapability(t *testing.T) {
+	srv := httptest.NewServer(newSessionServer())
+	defer srv.Close()
+	client := NewMCPClient(srv.URL)
+	if _, err := client.ListPrompts(context.Background()); !errors.Is(err, ErrCapabilityUnsupported) {
+		t.Fatalf("expected ErrCapabilityUnsupported, got %v", err)
+	}
+	if _, err := client.ReadResource(context.Background(), "pantheon://x"); !errors.Is(err, ErrCapabilityUnsupported) {
+		t.Fatalf("expected ErrCapabilityUnsupported, got %v", err)
+	}
+}
+
+func TestOnResourceUpdatedReceivesURI(t *testing.T) {
+	client := NewMCPClient("http://unused")
+	var got []string
+	client.OnResourceUpdated(func(uri string) { got = append(got, uri) })
+	client.handleStreamMessage(context.Background(), map[string]any{
+		"jsonrpc": "2.0",
+		"method":  "notifications/resources/updated",
+		"params":  map[string]any{"uri": "pantheon://branches/b/output"},
+	}, nil)
+	if len(got) != 1 || got[0] != "pantheon://branches/b/output" {
+		t.Fatalf("unexpected updates %v", got)
+	}
+}
+
+func TestMCPClientReturnsStructuredErrors(t *testing.T) {
+	fake := fakepantheon.New(fakepantheon.Config{JSONResponses: true})
+	fake.SeedBranch("branch-0")
+	fake.AddPrompt(fakepantheon.Prompt{Name: "episode", Template: "Work on {{area}}."})
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client := NewMCPClient(srv.URL)
+	ctx := context.Background()
+
+	_, err := client.GetBranchContext(ctx, "nope")
+	var toolErr *ToolError
+	if !errors.As(err, &toolErr) || toolErr.Tool != "get_branch" || toolErr.Status != http.StatusNotFound || !IsNotFound(err) {
+		t.Fatalf("expected a not-found ToolError for get_branch, got %#v", err)
+	}
+	if _, err := client.BranchReadFileContext(ctx, "branch-0", "missing.log"); !IsNotFound(err) || IsTransient(err) {
+		t.Fatalf("expected a permanent not-found error for a missing file, got %v", err)
+	}
+
+	_, err = client.ReadResource(ctx, "pantheon://branches/nope/output")
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != CodeResourceNotFound || rpcErr.HTTPStatus != http.StatusOK || !IsNotFound(err) {
+		t.Fatalf("expected a resource-not-found RPCError, got %#v", err)
+	}
+	_, err = client.GetPrompt(ctx, "episode", nil)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != CodeInvalidParams || IsNotFound(err) || IsTransient(err) {
+		t.Fatalf("expected an invalid-params RPCError, got %#v", err)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	cases := []struct {
+		name                             string
+		err                              error
+		notFound, rateLimited, transient bool
+	}{
+		{"tool 404 prefix", payloadError("404: File or directory not found: /x"), true, false, false},
+		{"tool code", payloadError(map[string]any{"code": "not_found", "message": "gone"}), true, false, false},
+		{"tool 429", payloadError(map[string]any{"status_code": 429.0, "message": "slow down"}), false, true, true},
+		{"tool 503", &ToolError{Message: "upstream", Status: 503}, false, false, true},
+		{"tool mentions not found", &ToolError{Message: "agent output: file not found in patch"}, false, false, false},
+		{"rpc resource", &RPCError{Code: CodeResourceNotFound}, true, false, false},
+		{"rpc internal", &RPCError{Code: CodeInternalError}, false, false, true},
+		{"rpc params", &RPCError{Code: CodeInvalidParams, Message: "branch not found"}, false, false, false},
+		{"http 404", fmt.Errorf("wrapped: %w", HTTPStatusError{StatusCode: 404}), true, false, false},
+		{"http 429", HTTPStatusError{StatusCode: 429}, false, true, true},
+		{"plain", errors.New("404 not found"), false, false, false},
+		{"nil", nil, false, false, false},
+	}
+	for _, c := range cases {
+		if got := IsNotFound(c.err); got != c.notFound {
+			t.Errorf("%s: IsNotFound = %v", c.name, got)
+		}
+		if got := IsRateLimited(c.err); got != c.rateLimited {
+			t.Errorf("%s: IsRateLimited = %v", c.name, got)
+		}
+		if got := IsTransient(c.err); got != c.transient {
+			t.Errorf("%s: IsTransient = %v", c.name, got)
+		}
+	}
+}
+
+func TestBranchOutputReaderReadsLargeSSEResponse(t *testing.T) {
+	big := strings.Repeat("agent log line\n", 200*1024) // ~3 MiB on one SSE data line
+	fake := fakepantheon.New(fakepantheon.Config{OnExplore: func(b *fakepantheon.Branch) { b.Output = big }})
+	fake.SeedBranch("root")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client := NewMCPClient(srv.URL)
+	ctx := context.Background()
+
+	if _, err := client.ParallelExploreContext(ctx, "proj", "root", []string{"go"}, "codex", 1); err != nil {
+		t.Fatalf("ParallelExplore: %v", err)
+	}
+	r, err := client.BranchOutputReader(ctx, "branch-1")
+	if err != nil {
+		t.Fatalf("BranchOutputReader: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != big {
+		t.Fatalf("read %d of %d bytes (%v)", len(got), len(big), err)
+	}
+}
+
+func TestBranchOutputReaderPagesNonASCIIOutput(t *testing.T) {
+	output := strings.Repeat("héllo wörld ✓ 🚀 ", 500)
+	fake := fakepantheon.New(fakepantheon.Config{JSONResponses: true, PageSize: 7, OnExplore: func(b *fakepantheon.Branch) {
+		b.Output = output
+	}})
+	fake.SeedBranch("root")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client, _ := NewMCPClientWithConfig(MCPClientConfig{BaseURL: srv.URL, PageSize: 7})
+	ctx := context.Background()
+
+	if _, err := client.ParallelExploreContext(ctx, "proj", "root", []string{"go"}, "codex", 1); err != nil {
+		t.Fatalf("ParallelExplore: %v", err)
+	}
+	r, err := client.BranchOutputReader(ctx, "branch-1")
+	if err != nil {
+		t.Fatalf("BranchOutputReader: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != output {
+		t.Fatalf("read %d of %d bytes (%v), pages do not line up", len(got), len(output), err)
+	}
+}
+
+func TestBranchOutputReaderAndReadFilePage(t *testing.T) {
+	output := strings.Repeat("x", 1<<20) + "tail"
+	file := strings.Repeat("0123456789", 20*1024)
+	fake := fakepantheon.New(fakepantheon.Config{JSONResponses: true, PageSize: 64 * 1024, OnExplore: func(b *fakepantheon.Branch) {
+		b.Output = output
+		b.Files["report.md"] = file
+	}})
+	fake.SeedBranch("root")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	client, _ := NewMCPClientWithConfig(MCPClientConfig{BaseURL: srv.URL, PageSize: 128 * 1024})
+	ctx := context.Background()
+
+	if _, err := client.ParallelExploreContext(ctx, "proj", "root", []string{"go"}, "codex", 1); err != nil {
+		t.Fatalf("ParallelExplore: %v", err)
+	}
+	r, err := client.BranchOutputReader(ctx, "branch-1")
+	if err != nil {
+		t.Fatalf("BranchOutputReader: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != output {
+		t.Fatalf("read %d of %d bytes (%v)", len(got), len(output), err)
+	}
+	// The server caps pages at 64 KiB: 16 full pages and the tail.
+	if n := fake.ToolCalls("branch_output"); n != 17 {
+		t.Fatalf("expected 17 branch_output pages, got %d", n)
+	}
+
+	var buf bytes.Buffer
+	n, err := client.BranchReadFileTo(ctx, "branch-1", "report.md", &buf)
+	if err != nil || n != int64(len(file)) || buf.String() != file {
+		t.Fatalf("BranchReadFileTo: %d bytes, %v", n, err)
+	}
+	if _, err := client.BranchReadFileTo(ctx, "branch-1", "missing.md", &buf); !IsNotFound(err) {
+		t.Fatalf("expected not-found error for a missing file, got %v", err)
+	}
+	if _, err := client.BranchOutputReader(ctx, "nope"); !IsNotFound(err) {
+		t.Fatalf("expected not-found error for a missing branch, got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/IANTHEREAL/agent0/internal/logx"
+)
+
+// Tool is an MCP tool as advertised by tools/list.
+type Tool struct {
+	Name        string
+	Description string
+	InputSchema map[string]any
+}
+
+// pantheonToolArguments lists, per Pantheon tool, every argument this client
+// may send. VerifyTools checks it against the advertised schemas so a renamed
+// or newly required argument fails at startup instead of mid-episode.
+var pantheonToolArguments = map[string][]string{
+	"parallel_explore": {"project_name", "parent_branch_id", "shared_prompt_sequence", "num_branches", "agent"},
+	"get_branch":       {"branch_id"},
+	"branch_read_file": {"branch_id", "file_path"},
+	"branch_output":    {"branch_id", "full_output"},
+}
+
+// ListTools fetches the server's tool list (following pagination) and
+// refreshes the cached input schemas used to validate calls.
+func (c *MCPClient) ListTools(ctx context.Context) ([]Tool, error) {
+	var (
+		out    []Tool
+		cursor string
+	)
+	for {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		resp, err := c.call(ctx, "tools/list", params, c.timeout)
+		if err != nil {
+			return nil, fmt.Errorf("tools/list: %w", err)
+		}
+		items, _ := resp["tools"].([]any)
+		for _, item := range items {
+			m, _ := item.(map[string]any)
+			if m == nil {
+				continue
+			}
+			t := Tool{}
+			t.Name, _ = m["name"].(string)
+			t.Description, _ = m["description"].(string)
+			t.InputSchema, _ = m["inputSchema"].(map[string]any)
+			if strings.TrimSpace(t.Name) == "" {
+				continue
+			}
+			out = append(out, t)
+		}
+		cursor, _ = resp["nextCursor"].(string)
+		if cursor == "" {
+			break
+		}
+	}
+
+	cache := make(map[string]Tool, len(out))
+	for _, t := range out {
+		cache[t.Name] = t
+	}
+	c.mu.Lock()
+	c.tools = cache
+	c.mu.Unlock()
+	return out, nil
+}
+
+// DescribeTool returns the named tool, listing tools first if the cache is
+// empty.
+func (c *MCPClient) DescribeTool(ctx context.Context, name string) (Tool, error) {
+	c.mu.Lock()
+	cache := c.tools
+	c.mu.Unlock()
+	if cache == nil {
+		if _, err := c.ListTools(ctx); err != nil {
+			return Tool{}, err
+		}
+		c.mu.Lock()
+		cache = c.tools
+		c.mu.Unlock()
+	}
+	t, ok := cache[name]
+	if !ok {
+		return Tool{}, fmt.Errorf("MCP server does not provide tool %q (available: %s)", name, strings.Join(sortedToolNames(cache), ", "))
+	}
+	return t, nil
+}
+
+// VerifyTools checks that the server provides every Pantheon tool this client
+// calls and that their schemas accept the arguments we send.
+func (c *MCPClient) VerifyTools(ctx context.Context) error {
+	if _, err := c.ListTools(ctx); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(pantheonToolArguments))
+	for name := range pantheonToolArguments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		t, err := c.DescribeTool(ctx, name)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		problems = append(problems, checkToolArguments(t, pantheonToolArguments[name])...)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("pantheon tool schema mismatch: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateToolCall validates arguments against the cached schema of the
+// tool. Validation is skipped, with a warning, when the tools cannot be
+// listed: a server without tools/list, or a failed listing, must not fail
+// calls the server itself would accept.
+func (c *MCPClient) validateToolCall(ctx context.Context, name string, arguments map[string]any) error {
+	c.mu.Lock()
+	cache, unsupported := c.tools, c.noToolsList
+	c.mu.Unlock()
+	if unsupported {
+		return nil
+	}
+	if cache == nil {
+		if _, err := c.ListTools(ctx); err != nil {
+			var rpcErr *RPCError
+			if errors.As(err, &rpcErr) && rpcErr.Code == CodeMethodNotFound {
+				c.mu.Lock()
+				c.noToolsList = true
+				c.mu.Unlock()
+				logx.Warningf("MCP server does not support tools/list; tool arguments are not validated.")
+				return nil
+			}
+			if !listingFailed(err) {
+				// Auth, TLS and connection errors would fail the call too.
+				return err
+			}
+			logx.Warningf("Not validating arguments of %s: %v", name, err)
+			return nil
+		}
+	}
+	t, err := c.DescribeTool(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(t.InputSchema) == 0 {
+		return nil
+	}
+	if problems := validateSchema(t.InputSchema, arguments); len(problems) > 0 {
+		return ArgumentError{Tool: name, Problems: problems}
+	}
+	return nil
+}
+
+// listingFailed reports whether err is the server's answer to tools/list,
+// as opposed to an error that would fail any request.
+func listingFailed(err error) bool {
+	var rpcErr *RPCError
+	var httpErr HTTPStatusError
+	switch {
+	case errors.As(err, &rpcErr):
+		return true
+	case errors.As(err, &httpErr):
+		return httpErr.StatusCode != http.StatusUnauthorized && httpErr.StatusCode != http.StatusForbidden
+	}
+	return false
+}
+
+// ArgumentError reports arguments rejected by a tool's input schema before
+// the call was sent.
+type ArgumentError struct {
+	Tool     string
+	Problems []string
+}
+
+func (e ArgumentError) Error() string {
+	return fmt.Sprintf("invalid arguments for tool %s: %s", e.Tool, strings.Join(e.Problems, "; "))
+}
+
+// checkToolArguments compares the argument names we may send with the tool's
+// schema: every required property must be one we know how to send, and every
+// argument we send must be declared unless the schema allows extras.
+func checkToolArguments(t Tool, sent []string) []string {
+	props, _ := t.InputSchema["properties"].(map[string]any)
+	known := map[string]bool{}
+	for _, name := range sent {
+		known[name] = true
+	}
+
+	var problems []string
+	for _, req := range schemaRequired(t.InputSchema) {
+		if !known[req] {
+			problems = append(problems, fmt.Sprintf("tool %s requires argument %q which agent0 does not send", t.Name, req))
+		}
+	}
+	if props != nil {
+		if extra, ok := t.InputSchema["additionalProperties"].(bool); ok && !extra {
+			for _, name := range sent {
+				if _, ok := props[name]; !ok {
+					problems = append(problems, fmt.Sprintf("tool %s no longer accepts argument %q", t.Name, name))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+func sortedToolNames(cache map[string]Tool) []string {
+	names := make([]string, 0, len(cache))
+	for name := range cache {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
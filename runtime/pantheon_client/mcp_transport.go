@@ -0,0 +1,308 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/IANTHEREAL/agent0/internal/logx"
+)
+
+// Transport carries JSON-RPC messages between MCPClient and a server.
+// MCPClient speaks streamable HTTP itself for http(s) URLs; a Transport is
+// used for stdio: and ws(s): URLs, or when set in MCPClientConfig.
+type Transport interface {
+	// RoundTrip sends msg. For a request (a message with both "method" and
+	// "id") it waits for the matching response and returns it; for
+	// notifications and replies it returns (nil, nil) once msg is sent.
+	RoundTrip(ctx context.Context, msg map[string]any) (map[string]any, error)
+	// Close releases the connection (or stops the server process).
+	Close() error
+}
+
+// MessageReceiver is implemented by transports on which the server can send
+// messages of its own (notifications, requests). MCPClient registers its
+// dispatcher when it adopts the transport.
+type MessageReceiver interface {
+	SetMessageHandler(h func(msg map[string]any))
+}
+
+// newTransportForURL picks a transport from the URL scheme. It returns nil
+// for http(s), which MCPClient handles directly. replay:<path> serves a
+// recorded cassette.
+func newTransportForURL(raw string, cfg TransportConfig, headers func(context.Context, http.Header) error) (Transport, error) {
+	scheme, rest, _ := strings.Cut(raw, ":")
+	switch strings.ToLower(scheme) {
+	case "http", "https":
+		return nil, nil
+	case "stdio":
+		fields, err := splitCommandLine(strings.TrimPrefix(rest, "//"))
+		if err != nil {
+			return nil, fmt.Errorf("stdio MCP URL %q: %w", raw, err)
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("stdio MCP URL %q names no command", raw)
+		}
+		return NewStdioTransport(fields[0], fields[1:]...), nil
+	case "replay":
+		return OpenReplayTransport(strings.TrimPrefix(rest, "//"))
+	case "ws", "wss":
+		if _, err := url.Parse(raw); err != nil {
+			return nil, fmt.Errorf("invalid MCP WebSocket URL %q: %w", raw, err)
+		}
+		tlsCfg, err := cfg.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		proxy, err := cfg.proxyFunc()
+		if err != nil {
+			return nil, err
+		}
+		return NewWebSocketTransport(raw, WebSocketOptions{TLSConfig: tlsCfg, Proxy: proxy, HeaderFunc: headers}), nil
+	}
+	return nil, fmt.Errorf("unsupported MCP URL scheme %q (want http, https, stdio, ws, wss or replay)", scheme)
+}
+
+// splitCommandLine splits a stdio: command into words the way a POSIX shell
+// would, without expanding anything: whitespace separates words, single
+// quotes keep their content literally, and a backslash escapes the next
+// character outside single quotes (inside double quotes only before $, `,
+// " or \). No shell is run.
+func splitCommandLine(s string) ([]string, error) {
+	var (
+		words  []string
+		word   strings.Builder
+		inWord bool
+		quote  rune
+		escape bool
+	)
+	for _, r := range s {
+		switch {
+		case escape:
+			if quote == '"' && !strings.ContainsRune("$`\"\\", r) {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escape = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escape, inWord = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	switch {
+	case escape:
+		return nil, fmt.Errorf("trailing backslash")
+	case quote != 0:
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// messageConn is one connection that exchanges whole JSON-RPC messages.
+type messageConn interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage(data []byte) error
+	Close() error
+}
+
+// errConnectionLost wraps the cause when a stream connection drops. It
+// matches errSessionExpired: the server-side session died with the
+// connection, so MCPClient re-initializes over a fresh one.
+type errConnectionLost struct{ cause error }
+
+func (e errConnectionLost) Error() string { return fmt.Sprintf("MCP connection lost: %v", e.cause) }
+func (e errConnectionLost) Unwrap() error { return e.cause }
+func (e errConnectionLost) Is(target error) bool {
+	return target == errSessionExpired
+}
+
+// streamTransport multiplexes requests over a messageConn, correlating
+// responses by id. It dials lazily and redials after the connection drops.
+type streamTransport struct {
+	name string
+	dial func(ctx context.Context) (messageConn, error)
+
+	mu      sync.Mutex
+	conn    messageConn
+	pending map[string]chan map[string]any
+	handler func(map[string]any)
+	closed  bool
+	wmu     sync.Mutex
+}
+
+func (t *streamTransport) SetMessageHandler(h func(msg map[string]any)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handler = h
+}
+
+func (t *streamTransport) RoundTrip(ctx context.Context, msg map[string]any) (map[string]any, error) {
+	conn, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	_, isRequest := msg["method"]
+	id, hasID := msg["id"]
+	isRequest = isRequest && hasID
+	var ch chan map[string]any
+	if isRequest {
+		ch = make(chan map[string]any, 1)
+		t.mu.Lock()
+		if t.conn != conn {
+			t.mu.Unlock()
+			return nil, errConnectionLost{cause: fmt.Errorf("%s connection closed", t.name)}
+		}
+		t.pending[fmt.Sprint(id)] = ch
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			delete(t.pending, fmt.Sprint(id))
+			t.mu.Unlock()
+		}()
+	}
+
+	t.wmu.Lock()
+	err = conn.WriteMessage(data)
+	t.wmu.Unlock()
+	if err != nil {
+		t.drop(conn, err)
+		return nil, errConnectionLost{cause: err}
+	}
+	if !isRequest {
+		return nil, nil
+	}
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, errConnectionLost{cause: fmt.Errorf("%s connection closed before response", t.name)}
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *streamTransport) Close() error {
+	t.mu.Lock()
+	conn := t.conn
+	t.closed = true
+	t.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	t.drop(conn, errors.New("transport closed"))
+	return nil
+}
+
+func (t *streamTransport) connect(ctx context.Context) (messageConn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, fmt.Errorf("%s transport is closed", t.name)
+	}
+	if t.conn != nil {
+		return t.conn, nil
+	}
+	conn, err := t.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect %s MCP transport: %w", t.name, err)
+	}
+	t.conn = conn
+	t.pending = map[string]chan map[string]any{}
+	go t.readLoop(conn)
+	return conn, nil
+}
+
+// drop closes conn if it is still current and fails its pending requests.
+func (t *streamTransport) drop(conn messageConn, cause error) {
+	t.mu.Lock()
+	if t.conn != conn {
+		t.mu.Unlock()
+		return
+	}
+	t.conn = nil
+	pending := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	logx.Debugf("MCP %s connection dropped: %v", t.name, cause)
+	_ = conn.Close()
+	for _, ch := range pending {
+		close(ch)
+	}
+}
+
+func (t *streamTransport) readLoop(conn messageConn) {
+	for {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			t.drop(conn, err)
+			return
+		}
+		for _, msg := range decodeSSEMessages(string(data)) {
+			t.deliver(msg)
+		}
+	}
+}
+
+func (t *streamTransport) deliver(msg map[string]any) {
+	_, hasMethod := msg["method"]
+	if id, ok := msg["id"]; ok && !hasMethod {
+		// Send under the lock so drop cannot close ch concurrently; the
+		// entry is removed first, so the buffered send never blocks.
+		t.mu.Lock()
+		ch := t.pending[fmt.Sprint(id)]
+		if ch != nil {
+			delete(t.pending, fmt.Sprint(id))
+			ch <- msg
+		}
+		t.mu.Unlock()
+		if ch != nil {
+			return
+		}
+		logx.Debugf("MCP %s: dropping response for unknown request %v", t.name, id)
+		return
+	}
+	t.mu.Lock()
+	h := t.handler
+	t.mu.Unlock()
+	if h != nil {
+		h(msg)
+	}
+}
@@ -0,0 +1,322 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DecodeMode selects how strictly Pantheon payloads are decoded.
+type DecodeMode int
+
+const (
+	// DecodeLenient accepts the shape variations Pantheon has produced over
+	// time and ignores fields with unexpected types.
+	DecodeLenient DecodeMode = iota
+	// DecodeStrict rejects payloads with missing identifiers or mistyped
+	// fields. Useful in tools that would rather fail than guess.
+	DecodeStrict
+)
+
+// Branch is the get_branch payload. Status is trimmed and lower-cased, e.g.
+// "running", "succeed", "failed".
+type Branch struct {
+	ID           string
+	Name         string
+	Status       string
+	ParentID     string
+	LatestSnapID string
+	Output       string
+	Manifest     map[string]any
+	Raw          map[string]any
+}
+
+// IsTerminal reports whether Status is one Pantheon never leaves.
+func (b Branch) IsTerminal() bool { return isTerminalBranchStatus(b.Status) }
+
+// Summary returns the manifest summary, if the branch has one.
+func (b Branch) Summary() string {
+	s, _ := b.Manifest["summary"].(string)
+	return strings.TrimSpace(s)
+}
+
+// ExploreResult is the parallel_explore payload.
+type ExploreResult struct {
+	// BranchIDs lists created branches in the order Pantheon reported them.
+	BranchIDs []string
+	Raw       map[string]any
+}
+
+// BranchID returns the first created branch, or "" if there is none.
+func (r ExploreResult) BranchID() string {
+	if len(r.BranchIDs) == 0 {
+		return ""
+	}
+	return r.BranchIDs[0]
+}
+
+// BranchOutput is the branch_output payload. Output is returned as sent.
+type BranchOutput struct {
+	BranchID string
+	Output   string
+	Raw      map[string]any
+}
+
+// FileContent is the branch_read_file payload. Content is the file as
+// sent, indentation and trailing newlines included.
+type FileContent struct {
+	Path    string
+	Content string
+	Raw     map[string]any
+}
+
+// DecodeBranch decodes a get_branch response. The branch may be at the top
+// level or nested under "branch".
+func DecodeBranch(m map[string]any, mode DecodeMode) (Branch, error) {
+	if err := payloadErr(m, "get_branch"); err != nil {
+		return Branch{}, err
+	}
+	src := m
+	if nested, ok := m["branch"].(map[string]any); ok && firstString(m, "id", "branch_id") == "" {
+		src = nested
+	}
+	d := fieldDecoder{mode: mode, what: "branch"}
+	b := Branch{Raw: m}
+	b.ID = d.str(src, "id", "branch_id")
+	b.Name = d.str(src, "name", "branch_name")
+	b.Status = stringsTrimLower(d.str(src, "status"))
+	b.ParentID = d.str(src, "parent_id", "parent_branch_id")
+	b.LatestSnapID = d.str(src, "latest_snap_id")
+	b.Output = d.text(src, "output")
+	b.Manifest = d.obj(src, "manifest")
+	if mode == DecodeStrict {
+		if b.ID == "" {
+			d.fail("missing branch id")
+		}
+		if b.Status == "" {
+			d.fail("missing status")
+		}
+	}
+	return b, d.err()
+}
+
+// DecodeExploreResult decodes a parallel_explore response. It accepts every
+// shape ExtractBranchID does and collects all created branch IDs.
+func DecodeExploreResult(m map[string]any, mode DecodeMode) (ExploreResult, error) {
+	if err := payloadErr(m, "parallel_explore"); err != nil {
+		return ExploreResult{}, err
+	}
+	r := ExploreResult{Raw: m, BranchIDs: collectBranchIDs(m)}
+	if mode == DecodeStrict && len(r.BranchIDs) == 0 {
+		return r, fmt.Errorf("decode parallel_explore: no branch id in response: %v", m)
+	}
+	return r, nil
+}
+
+// DecodeBranchOutput decodes a branch_output response.
+func DecodeBranchOutput(m map[string]any, mode DecodeMode) (BranchOutput, error) {
+	if err := payloadErr(m, "branch_output"); err != nil {
+		return BranchOutput{}, err
+	}
+	d := fieldDecoder{mode: mode, what: "branch_output"}
+	out := BranchOutput{Raw: m}
+	out.BranchID = d.str(m, "branch_id", "id")
+	out.Output = d.text(m, "output")
+	if mode == DecodeStrict {
+		if _, ok := m["output"].(string); !ok {
+			d.fail("missing output")
+		}
+	}
+	return out, d.err()
+}
+
+// DecodeFileContent decodes a branch_read_file response.
+func DecodeFileContent(m map[string]any, mode DecodeMode) (FileContent, error) {
+	if err := payloadErr(m, "branch_read_file"); err != nil {
+		return FileContent{}, err
+	}
+	d := fieldDecoder{mode: mode, what: "branch_read_file"}
+	f := FileContent{Raw: m}
+	f.Path = d.str(m, "file_path", "path")
+	f.Content = d.text(m, "content")
+	if mode == DecodeStrict {
+		if _, ok := m["content"].(string); !ok {
+			d.fail("missing content")
+		}
+	}
+	return f, d.err()
+}
+
+// payloadErr turns an error carried inside a response payload into a
+// *ToolError (or *RPCError).
+func payloadErr(m map[string]any, what string) error {
+	if m == nil {
+		return fmt.Errorf("%s returned empty response", what)
+	}
+	if errVal, ok := m["error"]; ok && errVal != nil {
+		err := payloadError(errVal)
+		if te, ok := err.(*ToolError); ok {
+			te.Tool = what
+		}
+		return err
+	}
+	if isErr, ok := m["isError"].(bool); ok && isErr {
+		return &ToolError{Tool: what, Message: fmt.Sprintf("returned error (details: %v)", m), StructuredContent: m}
+	}
+	return nil
+}
+
+// collectBranchIDs walks the same shapes as ExtractBranchID, in the same
+// priority order, but keeps every ID it finds.
+func collectBranchIDs(m map[string]any) []string {
+	if m == nil {
+		return nil
+	}
+	var ids []string
+	seen := map[string]bool{}
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	fromList := func(list []any) {
+		for _, item := range list {
+			if nested, _ := item.(map[string]any); nested != nil {
+				for _, id := range collectBranchIDs(nested) {
+					add(id)
+				}
+			}
+		}
+	}
+	if pe, ok := m["parallel_explore"].(map[string]any); ok {
+		if branches, ok := pe["branches"].([]any); ok {
+			fromList(branches)
+		}
+	}
+	if branches, ok := m["branches"].([]any); ok {
+		fromList(branches)
+	}
+	if len(ids) == 0 {
+		if b, ok := m["branch"].(map[string]any); ok {
+			for _, id := range collectBranchIDs(b) {
+				add(id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		add(firstString(m, "branch_id", "id"))
+	}
+	return ids
+}
+
+func firstString(m map[string]any, keys ...string) string {
+	for _, k := range keys {
+		if v, ok := m[k].(string); ok && strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// fieldDecoder reads loosely typed fields, recording type mismatches as
+// errors only in strict mode.
+type fieldDecoder struct {
+	mode     DecodeMode
+	what     string
+	problems []string
+}
+
+func (d *fieldDecoder) str(m map[string]any, keys ...string) string {
+	for _, k := range keys {
+		v, ok := m[k]
+		if !ok || v == nil {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			d.fail(fmt.Sprintf("field %q is %T, want string", k, v))
+			continue
+		}
+		if strings.TrimSpace(s) != "" {
+			return strings.TrimSpace(s)
+		}
+	}
+	return ""
+}
+
+// text reads a payload field such as output or file content. Unlike str it
+// keeps surrounding whitespace.
+func (d *fieldDecoder) text(m map[string]any, key string) string {
+	v, ok := m[key]
+	if !ok || v == nil {
+		return ""
+	}
+	s, ok := v.(string)
+	if !ok {
+		d.fail(fmt.Sprintf("field %q is %T, want string", key, v))
+	}
+	return s
+}
+
+func (d *fieldDecoder) obj(m map[string]any, key string) map[string]any {
+	v, ok := m[key]
+	if !ok || v == nil {
+		return nil
+	}
+	o, ok := v.(map[string]any)
+	if !ok {
+		d.fail(fmt.Sprintf("field %q is %T, want object", key, v))
+	}
+	return o
+}
+
+func (d *fieldDecoder) fail(msg string) {
+	if d.mode == DecodeStrict {
+		d.problems = append(d.problems, msg)
+	}
+}
+
+func (d *fieldDecoder) err() error {
+	if len(d.problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("decode %s: %s", d.what, strings.Join(d.problems, "; "))
+}
+
+// FetchBranch is GetBranchContext decoded into a Branch.
+func (c *MCPClient) FetchBranch(ctx context.Context, branchID string) (Branch, error) {
+	resp, err := c.GetBranchContext(ctx, branchID)
+	if err != nil {
+		return Branch{}, err
+	}
+	return DecodeBranch(resp, DecodeLenient)
+}
+
+// Explore is ParallelExploreContext decoded into an ExploreResult.
+func (c *MCPClient) Explore(ctx context.Context, projectName, parentBranchID string, prompts []string, agent string, numBranches int) (ExploreResult, error) {
+	resp, err := c.ParallelExploreContext(ctx, projectName, parentBranchID, prompts, agent, numBranches)
+	if err != nil {
+		return ExploreResult{}, err
+	}
+	return DecodeExploreResult(resp, DecodeLenient)
+}
+
+// FetchOutput is BranchOutputContext (full output) decoded into a
+// BranchOutput. Use BranchOutputReader for outputs too large to hold.
+func (c *MCPClient) FetchOutput(ctx context.Context, branchID string) (BranchOutput, error) {
+	resp, err := c.BranchOutputContext(ctx, branchID, true)
+	if err != nil {
+		return BranchOutput{}, err
+	}
+	return DecodeBranchOutput(resp, DecodeLenient)
+}
+
+// ReadFile is BranchReadFileContext decoded into a FileContent.
+func (c *MCPClient) ReadFile(ctx context.Context, branchID, filePath string) (FileContent, error) {
+	resp, err := c.BranchReadFileContext(ctx, branchID, filePath)
+	if err != nil {
+		return FileContent{}, err
+	}
+	return DecodeFileContent(resp, DecodeLenient)
+}
@@ -0,0 +1,121 @@
+package tools
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/IANTHEREAL/agent0/runtime/fakepantheon"
+)
+
+func TestDecodeExploreResultShapes(t *testing.T) {
+	cases := []struct {
+		name string
+		in   map[string]any
+		want []string
+	}{
+		{"top-level id", map[string]any{"branch_id": "b1"}, []string{"b1"}},
+		{"branches list", map[string]any{"branches": []any{map[string]any{"id": "b1"}, map[string]any{"branch_id": "b2"}}}, []string{"b1", "b2"}},
+		{"nested parallel_explore", map[string]any{"parallel_explore": map[string]any{"branches": []any{map[string]any{"branch": map[string]any{"id": "b3"}}}}}, []string{"b3"}},
+		{"nested branch", map[string]any{"branch": map[string]any{"id": "b4"}}, []string{"b4"}},
+		{"empty", map[string]any{}, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := DecodeExploreResult(tc.in, DecodeLenient)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got.BranchIDs, tc.want) {
+				t.Fatalf("expected %v, got %v", tc.want, got.BranchIDs)
+			}
+			if ExtractBranchID(tc.in) != got.BranchID() {
+				t.Fatalf("ExtractBranchID disagrees with decoder: %q vs %q", ExtractBranchID(tc.in), got.BranchID())
+			}
+		})
+	}
+
+	if _, err := DecodeExploreResult(map[string]any{}, DecodeStrict); err == nil {
+		t.Fatalf("expected strict decode to reject a response without branch ids")
+	}
+	if _, err := DecodeExploreResult(map[string]any{"isError": true, "error": "quota exceeded"}, DecodeLenient); err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Fatalf("expected isError payload to surface as error, got %v", err)
+	}
+}
+
+func TestDecodeBranchModes(t *testing.T) {
+	in := map[string]any{
+		"id":             "b1",
+		"status":         " Succeed ",
+		"parent_id":      "p1",
+		"latest_snap_id": 42,
+		"manifest":       map[string]any{"summary": " done "},
+	}
+	b, err := DecodeBranch(in, DecodeLenient)
+	if err != nil {
+		t.Fatalf("lenient decode: %v", err)
+	}
+	if b.ID != "b1" || b.Status != "succeed" || b.ParentID != "p1" || b.LatestSnapID != "" || !b.IsTerminal() || b.Summary() != "done" {
+		t.Fatalf("unexpected branch %#v", b)
+	}
+
+	_, err = DecodeBranch(in, DecodeStrict)
+	if err == nil || !strings.Contains(err.Error(), "latest_snap_id") {
+		t.Fatalf("expected strict decode to reject mistyped latest_snap_id, got %v", err)
+	}
+
+	if _, err := DecodeBranch(map[string]any{"error": "404: branch not found"}, DecodeLenient); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected error payload to surface, got %v", err)
+	}
+}
+
+func TestDecodeOutputAndFileContent(t *testing.T) {
+	// Payloads are returned as sent; only identifiers are trimmed.
+	out, err := DecodeBranchOutput(map[string]any{"branch_id": " b1 ", "output": "  hello \n"}, DecodeStrict)
+	if err != nil || out.Output != "  hello \n" || out.BranchID != "b1" {
+		t.Fatalf("unexpected output %#v (err=%v)", out, err)
+	}
+	if _, err := DecodeBranchOutput(map[string]any{}, DecodeStrict); err == nil {
+		t.Fatalf("expected strict decode to require output")
+	}
+
+	file, err := DecodeFileContent(map[string]any{"file_path": "/w/a.txt", "content": "\tindented\n\n"}, DecodeStrict)
+	if err != nil || file.Path != "/w/a.txt" || file.Content != "\tindented\n\n" {
+		t.Fatalf("unexpected file %#v (err=%v)", file, err)
+	}
+	if _, err := DecodeFileContent(map[string]any{"content": 3}, DecodeStrict); err == nil {
+		t.Fatalf("expected strict decode to reject non-string content")
+	}
+}
+
+func TestMCPClientTypedCalls(t *testing.T) {
+	fake := fakepantheon.New(fakepantheon.Config{OnExplore: func(b *fakepantheon.Branch) {
+		b.Output = "report\n"
+		b.Files["main.go"] = "\tindented\n"
+	}})
+	fake.SeedBranch("base")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	ctx := context.Background()
+	client := NewMCPClient(srv.URL)
+
+	explore, err := client.Explore(ctx, "proj", "base", []string{"go"}, "", 1)
+	if err != nil || explore.BranchID() == "" {
+		t.Fatalf("Explore: %+v, %v", explore, err)
+	}
+	id := explore.BranchID()
+	branch, err := client.FetchBranch(ctx, id)
+	if err != nil || branch.ID != id || branch.ParentID != "base" {
+		t.Fatalf("FetchBranch: %+v, %v", branch, err)
+	}
+	out, err := client.FetchOutput(ctx, id)
+	if err != nil || out.Output != "report\n" {
+		t.Fatalf("FetchOutput: %q, %v", out.Output, err)
+	}
+	file, err := client.ReadFile(ctx, id, "main.go")
+	if err != nil || file.Content != "\tindented\n" {
+		t.Fatalf("ReadFile: %q, %v", file.Content, err)
+	}
+}
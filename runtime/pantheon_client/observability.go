@@ -0,0 +1,406 @@
+package tools
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IANTHEREAL/agent0/internal/logx"
+)
+
+// MCPMetrics receives measurements from MCPClient. Implementations must be
+// safe for concurrent use; adapters for Prometheus or OpenTelemetry metrics
+// wrap this interface. tool is the tool name for tools/call and "" for other
+// methods.
+type MCPMetrics interface {
+	// ObserveCall records the latency of one logical call, retries and
+	// backoff included.
+	ObserveCall(method, tool string, d time.Duration, err error)
+	// ObserveAttempt records one request on the wire. status is the HTTP
+	// status, or 0 when no HTTP response arrived (or the transport is not
+	// HTTP).
+	ObserveAttempt(method, tool string, status int, d time.Duration)
+	// IncRetry counts an attempt that is retried after backoff.
+	IncRetry(method, tool string)
+	// IncSSEParseFailure counts SSE responses that could not be decoded.
+	IncSSEParseFailure(method string)
+}
+
+// latencyBuckets are the upper bounds of MemoryMetrics histograms.
+var latencyBuckets = []time.Duration{
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+// LatencyHistogram counts observations per bucket of latencyBuckets; the
+// last count is for observations above the largest bound.
+type LatencyHistogram struct {
+	Counts []int
+	Count  int
+	Errors int
+	Sum    time.Duration
+	Max    time.Duration
+}
+
+func (h *LatencyHistogram) observe(d time.Duration, failed bool) {
+	if h.Counts == nil {
+		h.Counts = make([]int, len(latencyBuckets)+1)
+	}
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+	if failed {
+		h.Errors++
+	}
+}
+
+// Quantile estimates the q-quantile (0..1) as the upper bound of the bucket
+// it falls in; observations beyond the last bucket report Max.
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := int(q*float64(h.Count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	seen := 0
+	for i, n := range h.Counts {
+		seen += n
+		if seen >= rank {
+			if i < len(latencyBuckets) && latencyBuckets[i] < h.Max {
+				return latencyBuckets[i]
+			}
+			return h.Max
+		}
+	}
+	return h.Max
+}
+
+// MetricsSnapshot is a copy of what a MemoryMetrics has collected. Map keys
+// are the method, or "tools/call <tool>" for tool calls.
+type MetricsSnapshot struct {
+	Calls            map[string]LatencyHistogram
+	Retries          map[string]int
+	HTTPStatus       map[int]int
+	SSEParseFailures int
+}
+
+// MemoryMetrics is an in-process MCPMetrics. The controller uses one to log
+// per-episode MCP latency; it is also handy in tests.
+type MemoryMetrics struct {
+	mu   sync.Mutex
+	snap MetricsSnapshot
+}
+
+// NewMemoryMetrics returns an empty collector.
+func NewMemoryMetrics() *MemoryMetrics {
+	m := &MemoryMetrics{}
+	m.Reset()
+	return m
+}
+
+func metricKey(method, tool string) string {
+	if tool == "" {
+		return method
+	}
+	return method + " " + tool
+}
+
+func (m *MemoryMetrics) ObserveCall(method, tool string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := metricKey(method, tool)
+	h := m.snap.Calls[key]
+	h.observe(d, err != nil)
+	m.snap.Calls[key] = h
+}
+
+func (m *MemoryMetrics) ObserveAttempt(method, tool string, status int, d time.Duration) {
+	if status == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snap.HTTPStatus[status]++
+}
+
+func (m *MemoryMetrics) IncRetry(method, tool string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snap.Retries[metricKey(method, tool)]++
+}
+
+func (m *MemoryMetrics) IncSSEParseFailure(method string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snap.SSEParseFailures++
+}
+
+// Snapshot returns a copy of the collected metrics.
+func (m *MemoryMetrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := MetricsSnapshot{
+		Calls:            make(map[string]LatencyHistogram, len(m.snap.Calls)),
+		Retries:          make(map[string]int, len(m.snap.Retries)),
+		HTTPStatus:       make(map[int]int, len(m.snap.HTTPStatus)),
+		SSEParseFailures: m.snap.SSEParseFailures,
+	}
+	for k, h := range m.snap.Calls {
+		h.Counts = append([]int(nil), h.Counts...)
+		out.Calls[k] = h
+	}
+	for k, n := range m.snap.Retries {
+		out.Retries[k] = n
+	}
+	for k, n := range m.snap.HTTPStatus {
+		out.HTTPStatus[k] = n
+	}
+	return out
+}
+
+// Reset clears all metrics.
+func (m *MemoryMetrics) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snap = MetricsSnapshot{
+		Calls:      map[string]LatencyHistogram{},
+		Retries:    map[string]int{},
+		HTTPStatus: map[int]int{},
+	}
+}
+
+// Summary renders the snapshot on one line for the controller log, e.g.
+// "get_branch: 12 calls, total 1.2s, p50 100ms, p95 250ms, 1 retries".
+func (s MetricsSnapshot) Summary() string {
+	keys := make([]string, 0, len(s.Calls))
+	for k := range s.Calls {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		h := s.Calls[k]
+		part := fmt.Sprintf("%s: %d calls, total %s, p50 %s, p95 %s",
+			strings.TrimPrefix(k, "tools/call "), h.Count, h.Sum.Round(time.Millisecond),
+			h.Quantile(0.5).Round(time.Millisecond), h.Quantile(0.95).Round(time.Millisecond))
+		if h.Errors > 0 {
+			part += fmt.Sprintf(", %d failed", h.Errors)
+		}
+		if n := s.Retries[k]; n > 0 {
+			part += fmt.Sprintf(", %d retries", n)
+		}
+		parts = append(parts, part)
+	}
+	if s.SSEParseFailures > 0 {
+		parts = append(parts, fmt.Sprintf("%d SSE parse failures", s.SSEParseFailures))
+	}
+	if len(parts) == 0 {
+		return "no MCP calls"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// teeMetrics forwards to several collectors.
+type teeMetrics []MCPMetrics
+
+func (t teeMetrics) ObserveCall(method, tool string, d time.Duration, err error) {
+	for _, m := range t {
+		m.ObserveCall(method, tool, d, err)
+	}
+}
+
+func (t teeMetrics) ObserveAttempt(method, tool string, status int, d time.Duration) {
+	for _, m := range t {
+		m.ObserveAttempt(method, tool, status, d)
+	}
+}
+
+func (t teeMetrics) IncRetry(method, tool string) {
+	for _, m := range t {
+		m.IncRetry(method, tool)
+	}
+}
+
+func (t teeMetrics) IncSSEParseFailure(method string) {
+	for _, m := range t {
+		m.IncSSEParseFailure(method)
+	}
+}
+
+// Tracer starts spans around MCP calls. W3CTracer is the implementation
+// shipped here; agent0 has no OpenTelemetry dependency, so bridging to an
+// OpenTelemetry SDK is left to the caller.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is one traced MCP call.
+type Span interface {
+	SetAttribute(key string, value any)
+	RecordError(err error)
+	End()
+	// Inject writes the span's trace context (traceparent, ...) into the
+	// headers of an outgoing request. Over stdio and WebSocket, which have
+	// no per-message headers, the same fields go into params._meta.
+	Inject(h http.Header)
+}
+
+type spanKey struct{}
+
+func contextWithSpan(ctx context.Context, s Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+func spanFromContext(ctx context.Context) Span {
+	s, _ := ctx.Value(spanKey{}).(Span)
+	return s
+}
+
+// W3CTracer is a dependency-free Tracer that propagates W3C trace context
+// (the traceparent header), so Pantheon-side traces can be joined with
+// agent0's. Finished spans are logged at debug level and passed to OnEnd.
+type W3CTracer struct {
+	// OnEnd, if set, receives every finished span.
+	OnEnd func(SpanRecord)
+}
+
+// SpanRecord is a finished W3CTracer span.
+type SpanRecord struct {
+	Name       string
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Start      time.Time
+	Duration   time.Duration
+	Attributes map[string]any
+	Err        error
+}
+
+// TraceParent formats the record as a traceparent header value.
+func (r SpanRecord) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-01", r.TraceID, r.SpanID)
+}
+
+type w3cSpan struct {
+	tracer *W3CTracer
+	mu     sync.Mutex
+	rec    SpanRecord
+	ended  bool
+}
+
+// ContextWithTraceParent returns ctx carrying a remote parent parsed from a
+// traceparent header value, so spans started under it join that trace.
+// Invalid values are ignored.
+func ContextWithTraceParent(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return ctx
+	}
+	return contextWithSpan(ctx, &w3cSpan{rec: SpanRecord{TraceID: parts[1], SpanID: parts[2]}, ended: true})
+}
+
+func (t *W3CTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	rec := SpanRecord{Name: name, SpanID: randomHex(8), Start: time.Now(), Attributes: map[string]any{}}
+	if parent, ok := spanFromContext(ctx).(*w3cSpan); ok {
+		rec.TraceID = parent.rec.TraceID
+		rec.ParentID = parent.rec.SpanID
+	} else {
+		rec.TraceID = randomHex(16)
+	}
+	s := &w3cSpan{tracer: t, rec: rec}
+	return contextWithSpan(ctx, s), s
+}
+
+func (s *w3cSpan) SetAttribute(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rec.Attributes[key] = value
+}
+
+func (s *w3cSpan) RecordError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rec.Err = err
+}
+
+func (s *w3cSpan) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.rec.Duration = time.Since(s.rec.Start)
+	rec := s.rec
+	s.mu.Unlock()
+	logx.Debugf("trace %s span %s %q took %s (err=%v)", rec.TraceID, rec.SpanID, rec.Name, rec.Duration.Round(time.Millisecond), rec.Err)
+	if s.tracer != nil && s.tracer.OnEnd != nil {
+		s.tracer.OnEnd(rec)
+	}
+}
+
+func (s *w3cSpan) Inject(h http.Header) {
+	h.Set("traceparent", s.rec.TraceParent())
+}
+
+// withTraceMeta returns payload with span's trace context added to
+// params._meta under lower-case header names, for transports without
+// per-message headers. payload itself is left unchanged.
+func withTraceMeta(payload map[string]any, span Span) map[string]any {
+	h := http.Header{}
+	span.Inject(h)
+	if len(h) == 0 {
+		return payload
+	}
+	params, _ := payload["params"].(map[string]any)
+	oldMeta, _ := params["_meta"].(map[string]any)
+	meta := make(map[string]any, len(oldMeta)+len(h))
+	for k, v := range oldMeta {
+		meta[k] = v
+	}
+	for k := range h {
+		meta[strings.ToLower(k)] = h.Get(k)
+	}
+	newParams := make(map[string]any, len(params)+1)
+	for k, v := range params {
+		newParams[k] = v
+	}
+	newParams["_meta"] = meta
+	out := make(map[string]any, len(payload))
+	for k, v := range payload {
+		out[k] = v
+	}
+	out["params"] = newParams
+	return out
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// toolName returns the tool a tools/call payload invokes, or "".
+func toolName(payload map[string]any) string {
+	if payload["method"] != "tools/call" {
+		return ""
+	}
+	params, _ := payload["params"].(map[string]any)
+	name, _ := params["name"].(string)
+	return name
+}
@@ -0,0 +1,277 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrEmptyOutput is matched (via errors.Is) when a branch finished without
+// any branch_output.
+var ErrEmptyOutput = errors.New("branch output is empty")
+
+// Kinds of episode failure a FailurePolicy handles separately.
+const (
+	// FailureFailed: branches ended in status failed, or none passed the
+	// gates and the selector.
+	FailureFailed = "failed"
+	// FailureTimeout: branches did not finish within the poll timeout.
+	FailureTimeout = "timeout"
+	// FailureEmptyOutput: branches finished without output.
+	FailureEmptyOutput = "empty_output"
+)
+
+// What a FailureRule does after a failed episode.
+const (
+	// FailureRetry starts a new episode from the same anchor.
+	FailureRetry = "retry"
+	// FailureRollback moves the anchor back one entry of the anchor history
+	// first (like `agent0 rollback`), so a bad anchor is not retried forever.
+	FailureRollback = "rollback"
+	// FailureExit stops the controller at once. The episode's branches stay
+	// active, so the next run checks them again, unless the rule sets
+	// ClearOnExit.
+	FailureExit = "exit"
+)
+
+// What a FailureRule does once MaxConsecutive failures are reached.
+const (
+	ExhaustedExit  = "exit"
+	ExhaustedPause = "pause"
+)
+
+// FailureRule is how the controller handles one kind of episode failure.
+type FailureRule struct {
+	// MaxConsecutive failures of this kind in a row exhaust the rule.
+	MaxConsecutive int
+	// Backoff is the wait after the 1st, 2nd, ... failure in a row; the last
+	// entry repeats.
+	Backoff []time.Duration
+	// Action is FailureRetry, FailureRollback or FailureExit.
+	Action string
+	// OnExhausted is ExhaustedExit, or ExhaustedPause to wait PauseFor and
+	// then start counting again.
+	OnExhausted string
+	PauseFor    time.Duration
+	// ClearOnExit makes FailureExit clear the branches that reached a
+	// terminal status, so the next run starts a new episode instead of
+	// judging them again. Timed-out branches may still be running on
+	// Pantheon and stay active.
+	ClearOnExit bool
+	// SkipFinalBackoff skips the wait after the failure that exhausts the
+	// rule.
+	SkipFinalBackoff bool
+}
+
+// backoff returns the wait after the n-th failure in a row (n >= 1).
+func (r FailureRule) backoff(n int) time.Duration {
+	if len(r.Backoff) == 0 {
+		return 0
+	}
+	if n > len(r.Backoff) {
+		n = len(r.Backoff)
+	}
+	return r.Backoff[n-1]
+}
+
+// FailurePolicy holds a FailureRule per kind of failure.
+type FailurePolicy struct {
+	Failed      FailureRule
+	Timeout     FailureRule
+	EmptyOutput FailureRule
+}
+
+// DefaultFailurePolicy retries a failed episode from the same anchor three
+// times, 20 minutes apart, then exits. Timeouts and empty output stop the
+// controller at once with the branches still active.
+func DefaultFailurePolicy() FailurePolicy {
+	failed := FailureRule{
+		MaxConsecutive: 3,
+		Backoff:        []time.Duration{20 * time.Minute},
+		Action:         FailureRetry,
+		OnExhausted:    ExhaustedExit,
+		PauseFor:       time.Hour,
+	}
+	other := failed
+	other.Action = FailureExit
+	return FailurePolicy{Failed: failed, Timeout: other, EmptyOutput: other}
+}
+
+// Rule returns the rule for a kind of failure.
+func (p FailurePolicy) Rule(kind string) FailureRule {
+	switch kind {
+	case FailureTimeout:
+		return p.Timeout
+	case FailureEmptyOutput:
+		return p.EmptyOutput
+	}
+	return p.Failed
+}
+
+func (p *FailurePolicy) rules(kind string) ([]*FailureRule, error) {
+	switch kind {
+	case "":
+		return []*FailureRule{&p.Failed, &p.Timeout, &p.EmptyOutput}, nil
+	case FailureFailed:
+		return []*FailureRule{&p.Failed}, nil
+	case FailureTimeout:
+		return []*FailureRule{&p.Timeout}, nil
+	case FailureEmptyOutput:
+		return []*FailureRule{&p.EmptyOutput}, nil
+	}
+	return nil, fmt.Errorf("unknown failure kind %q (want failed, timeout or empty_output)", kind)
+}
+
+// ParseFailurePolicy applies specs in order to DefaultFailurePolicy. A spec
+// is "[kind:]key=value,...": without a kind (failed, timeout or
+// empty_output) it changes every rule. Keys are max (failures in a row),
+// backoff (durations separated by "/", e.g. 1m/5m/20m), action (retry,
+// rollback or exit), exhausted (exit or pause), pause (a duration), clear
+// (ClearOnExit) and skipfinal (SkipFinalBackoff).
+func ParseFailurePolicy(specs []string) (FailurePolicy, error) {
+	p := DefaultFailurePolicy()
+	for _, spec := range specs {
+		if err := p.apply(spec); err != nil {
+			return FailurePolicy{}, err
+		}
+	}
+	return p, nil
+}
+
+func (p *FailurePolicy) apply(spec string) error {
+	settings := strings.TrimSpace(spec)
+	kind := ""
+	if name, rest, ok := strings.Cut(settings, ":"); ok && !strings.Contains(name, "=") {
+		kind, settings = strings.TrimSpace(name), rest
+	}
+	rules, err := p.rules(kind)
+	if err != nil {
+		return fmt.Errorf("failure policy %q: %v", spec, err)
+	}
+	for _, part := range strings.Split(settings, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return fmt.Errorf("failure policy %q: want key=value, got %q", spec, part)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		set, err := failureRuleSetter(key, value)
+		if err != nil {
+			return fmt.Errorf("failure policy %q: %s: %v", spec, key, err)
+		}
+		for _, r := range rules {
+			set(r)
+		}
+	}
+	return nil
+}
+
+func failureRuleSetter(key, value string) (func(*FailureRule), error) {
+	switch key {
+	case "max":
+		n, err := strconv.Atoi(value)
+		if err == nil && n < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func(r *FailureRule) { r.MaxConsecutive = n }, nil
+	case "backoff":
+		var backoff []time.Duration
+		for _, item := range strings.Split(value, "/") {
+			d, err := time.ParseDuration(strings.TrimSpace(item))
+			if err == nil && d < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+			if err != nil {
+				return nil, err
+			}
+			backoff = append(backoff, d)
+		}
+		return func(r *FailureRule) { r.Backoff = backoff }, nil
+	case "action":
+		switch value {
+		case FailureRetry, FailureRollback, FailureExit:
+			return func(r *FailureRule) { r.Action = value }, nil
+		}
+		return nil, fmt.Errorf("want retry, rollback or exit, got %q", value)
+	case "exhausted":
+		switch value {
+		case ExhaustedExit, ExhaustedPause:
+			return func(r *FailureRule) { r.OnExhausted = value }, nil
+		}
+		return nil, fmt.Errorf("want exit or pause, got %q", value)
+	case "pause":
+		d, err := time.ParseDuration(value)
+		if err == nil && d <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func(r *FailureRule) { r.PauseFor = d }, nil
+	case "clear":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *FailureRule) { r.ClearOnExit = b }, nil
+	case "skipfinal":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *FailureRule) { r.SkipFinalBackoff = b }, nil
+	}
+	return nil, fmt.Errorf("unknown key (want max, backoff, action, exhausted, pause, clear or skipfinal)")
+}
+
+// failureKind classifies why a branch did not produce a usable result.
+func failureKind(err error) string {
+	switch {
+	case isTerminalTimeout(err):
+		return FailureTimeout
+	case errors.Is(err, ErrEmptyOutput):
+		return FailureEmptyOutput
+	}
+	return FailureFailed
+}
+
+// timedOutBranches returns the candidates that failed only because the poll
+// deadline passed; they may still be running on Pantheon.
+func timedOutBranches(candidates []Candidate) []string {
+	var ids []string
+	for _, c := range candidates {
+		if isTerminalTimeout(c.Err) {
+			ids = append(ids, c.BranchID)
+		}
+	}
+	return ids
+}
+
+// episodeFailureKind classifies an episode without a winner: the kind its
+// failed branches share, or FailureFailed when they differ. Skipped branches
+// do not count.
+func episodeFailureKind(candidates []Candidate) string {
+	kind := ""
+	for _, c := range candidates {
+		if c.Succeeded() || errors.Is(c.Err, ErrBranchSkipped) {
+			continue
+		}
+		k := failureKind(c.Err)
+		if kind != "" && k != kind {
+			return FailureFailed
+		}
+		kind = k
+	}
+	if kind == "" {
+		return FailureFailed
+	}
+	return kind
+}
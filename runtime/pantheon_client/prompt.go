@@ -0,0 +1,163 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// maxIncludeDepth stops templates that include each other in a cycle.
+const maxIncludeDepth = 8
+
+// PromptContext is what a task prompt template sees, e.g.
+//
+//	Episode {{.Episode}} on {{.Anchor}}.
+//	{{with .LastFailure}}The last attempt failed: {{.}}{{end}}
+//	The last episode reported:
+//	{{tail 4000 .PreviousOutput}}
+//	{{include "prompts/rules.md"}}
+//
+// Templates also have include (another local template file), tail (the last
+// n bytes of a string) and trim.
+type PromptContext struct {
+	// Episode is the number the episode gets in the anchor history.
+	Episode int
+	// Anchor is the branch the episode starts from.
+	Anchor string
+	// Task and TaskEpisode are the queued task's id and the episode number
+	// within it (empty without a task queue).
+	Task        string
+	TaskEpisode int
+	// History is the anchor history, oldest first.
+	History []AnchorRecord
+	// LastFailure is why the previous attempt produced no winner, or "" if
+	// it succeeded.
+	LastFailure string
+	// Vars are the user's prompt variables; a missing one is an error.
+	Vars map[string]string
+
+	ctx    context.Context
+	client agentClient
+	output *string
+	// noInclude leaves include out, for tasks set through the control API.
+	noInclude bool
+}
+
+func newPromptContext(ctx context.Context, client agentClient, state ControllerState) *PromptContext {
+	pc := &PromptContext{
+		Episode:     state.nextEpisode(),
+		Anchor:      state.AnchorBranch,
+		Task:        state.CurrentTask,
+		History:     state.AnchorHistory,
+		LastFailure: state.LastFailure,
+		Vars:        state.PromptVars,
+		ctx:         ctx,
+		client:      client,
+	}
+	if pc.Vars == nil {
+		pc.Vars = map[string]string{}
+	}
+	if p := state.taskProgress(state.CurrentTask); p != nil {
+		pc.TaskEpisode = p.Episodes + 1
+	}
+	return pc
+}
+
+// PreviousOutput is the output of the episode that produced the anchor (its
+// last MiB when longer), fetched from Pantheon the first time a template
+// uses it. It is empty when the anchor is the parent branch.
+func (p *PromptContext) PreviousOutput() (string, error) {
+	if p.output != nil {
+		return *p.output, nil
+	}
+	out := ""
+	if i := lastAnchorIndex(p.History, p.Anchor); i >= 0 && p.client != nil {
+		switch p.History[i].Reason {
+		case AnchorParent, AnchorInitial:
+		default:
+			fetched, err := fetchBranchOutput(p.ctx, p.client, nil, p.Anchor)
+			if err != nil {
+				return "", fmt.Errorf("fetch output of anchor %s: %w", p.Anchor, err)
+			}
+			out = fetched.tail
+		}
+	}
+	p.output = &out
+	return out, nil
+}
+
+// tailBytes returns at most the last n bytes of s, starting at a rune
+// boundary so no character is cut in half.
+func tailBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[len(s)-n:]
+	for i := 0; i < utf8.UTFMax && s != "" && !utf8.RuneStart(s[0]); i++ {
+		s = s[1:]
+	}
+	return s
+}
+
+// renderPrompt executes text as a text/template with pc. Text without
+// actions is returned unchanged.
+func renderPrompt(text string, pc *PromptContext) (string, error) {
+	return renderPromptDepth("task", text, pc, 0)
+}
+
+func renderPromptDepth(name, text string, pc *PromptContext, depth int) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(promptFuncs(pc, depth)).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, pc); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// checkControlTask parses a task sent through the control API as
+// episodePrompt will execute it: without include, so that a remote caller
+// cannot read local files into the prompt.
+func checkControlTask(task string) error {
+	if !strings.Contains(task, "{{") {
+		return nil
+	}
+	_, err := template.New("task").Funcs(promptFuncs(&PromptContext{noInclude: true}, 0)).Parse(task)
+	return err
+}
+
+// promptFuncs are the functions available to task templates.
+func promptFuncs(pc *PromptContext, depth int) template.FuncMap {
+	funcs := template.FuncMap{
+		"include": func(path string) (string, error) {
+			if depth >= maxIncludeDepth {
+				return "", fmt.Errorf("include %s: nested more than %d deep", path, maxIncludeDepth)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			return renderPromptDepth(path, string(data), pc, depth+1)
+		},
+		"tail": func(n int, s string) string {
+			if n < 0 {
+				return s
+			}
+			return tailBytes(s, n)
+		},
+		"trim": strings.TrimSpace,
+	}
+	if pc.noInclude {
+		delete(funcs, "include")
+	}
+	return funcs
+}
@@ -0,0 +1,200 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IANTHEREAL/agent0/internal/logx"
+)
+
+// RateLimit bounds MCP requests. The zero value is unlimited.
+type RateLimit struct {
+	// Rate is the sustained number of requests per second (0 = unlimited).
+	Rate float64
+	// Burst is how many requests may be sent back to back before Rate
+	// applies. Default: Rate rounded up, at least 1.
+	Burst int
+	// MaxInFlight caps concurrent requests (0 = unlimited).
+	MaxInFlight int
+}
+
+// IsZero reports whether l imposes no limit.
+func (l RateLimit) IsZero() bool { return l.Rate <= 0 && l.MaxInFlight <= 0 }
+
+func (l RateLimit) String() string {
+	var parts []string
+	if l.Rate > 0 {
+		parts = append(parts, "rate="+strconv.FormatFloat(l.Rate, 'g', -1, 64))
+		if l.Burst > 0 {
+			parts = append(parts, "burst="+strconv.Itoa(l.Burst))
+		}
+	}
+	if l.MaxInFlight > 0 {
+		parts = append(parts, "inflight="+strconv.Itoa(l.MaxInFlight))
+	}
+	if len(parts) == 0 {
+		return "unlimited"
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseRateLimit parses "rate=5,burst=10,inflight=4"; every key is optional.
+func ParseRateLimit(s string) (RateLimit, error) {
+	var l RateLimit
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return RateLimit{}, fmt.Errorf("rate limit %q: want key=value, got %q", s, part)
+		}
+		var err error
+		switch strings.TrimSpace(key) {
+		case "rate":
+			l.Rate, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err == nil && (l.Rate < 0 || math.IsNaN(l.Rate) || math.IsInf(l.Rate, 0)) {
+				err = fmt.Errorf("must be a non-negative number")
+			}
+		case "burst":
+			l.Burst, err = strconv.Atoi(strings.TrimSpace(value))
+		case "inflight":
+			l.MaxInFlight, err = strconv.Atoi(strings.TrimSpace(value))
+		default:
+			return RateLimit{}, fmt.Errorf("rate limit %q: unknown key %q (want rate, burst or inflight)", s, key)
+		}
+		if err != nil {
+			return RateLimit{}, fmt.Errorf("rate limit %q: %s: %v", s, key, err)
+		}
+	}
+	return l, nil
+}
+
+// Limiter enforces a RateLimit with a token bucket and a semaphore. Like a
+// CircuitBreaker, one Limiter may be shared by several clients so that
+// everything talking to the same Pantheon stays under one budget. A nil
+// *Limiter never blocks.
+type Limiter struct {
+	rate  float64
+	burst float64
+	slots chan struct{}
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewLimiter returns a limiter for l, or nil if l is unlimited.
+func NewLimiter(l RateLimit) *Limiter {
+	if l.IsZero() {
+		return nil
+	}
+	lim := &Limiter{}
+	if l.Rate > 0 {
+		lim.rate = l.Rate
+		lim.burst = float64(l.Burst)
+		if lim.burst < 1 {
+			lim.burst = math.Max(1, math.Ceil(l.Rate))
+		}
+		lim.tokens = lim.burst
+	}
+	if l.MaxInFlight > 0 {
+		lim.slots = make(chan struct{}, l.MaxInFlight)
+	}
+	return lim
+}
+
+// Acquire waits for an in-flight slot and a token. The caller must call
+// release once the request has finished. Cancelling ctx abandons the wait.
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	release = func() {}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+			release = func() { <-l.slots }
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if wait := l.reserve(); wait > 0 {
+		if err := sleepContext(ctx, wait); err != nil {
+			l.unreserve()
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// reserve takes a token, possibly going into debt, and returns how long
+// the caller must wait for the debt to be paid off.
+func (l *Limiter) reserve() time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+func (l *Limiter) unreserve() {
+	if l.rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	l.tokens++
+	l.mu.Unlock()
+}
+
+func (l *Limiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// acquireLimits takes the per-tool limiter (for tools/call) and then the
+// client-wide one, so a strict tool limit does not hold a shared slot while
+// it waits.
+func (c *MCPClient) acquireLimits(ctx context.Context, method string, payload map[string]any) (func(), error) {
+	if c.limiter == nil && len(c.toolLimiters) == 0 {
+		return func() {}, nil
+	}
+	toolLim := c.toolLimiters[toolName(payload)]
+	start := time.Now()
+	releaseTool, err := toolLim.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	releaseAll, err := c.limiter.Acquire(ctx)
+	if err != nil {
+		releaseTool()
+		return nil, err
+	}
+	if waited := time.Since(start); waited >= time.Second {
+		logx.Debugf("MCP %s waited %s for the client rate limit.", describeMessage(payload), waited.Round(time.Millisecond))
+	}
+	return func() {
+		releaseAll()
+		releaseTool()
+	}, nil
+}
@@ -0,0 +1,313 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/IANTHEREAL/agent0/internal/logx"
+)
+
+// RetryPolicy decides whether and when a failed MCP request is retried.
+type RetryPolicy interface {
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts() int
+	// Backoff returns how long to wait after failed attempt n (1-based).
+	Backoff(attempt int) time.Duration
+	// Retryable reports whether err is worth another attempt.
+	Retryable(err error) bool
+}
+
+// ExponentialRetryPolicy retries transient errors with jittered exponential
+// backoff: BaseDelay * 2^(attempt-1), capped at MaxDelay, +/- Jitter.
+type ExponentialRetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Jitter is the fraction (0..1) of the delay to randomize, so a fleet of
+	// controllers does not retry in lockstep.
+	Jitter float64
+	// Classifier overrides IsRetryableError when set.
+	Classifier func(error) bool
+}
+
+// DefaultRetryPolicy is used for every MCP call without a per-tool policy.
+func DefaultRetryPolicy() ExponentialRetryPolicy {
+	return ExponentialRetryPolicy{Attempts: 3, BaseDelay: time.Second, MaxDelay: 30 * time.Second, Jitter: 0.2}
+}
+
+func (p ExponentialRetryPolicy) MaxAttempts() int {
+	if p.Attempts < 1 {
+		return 1
+	}
+	return p.Attempts
+}
+
+func (p ExponentialRetryPolicy) Backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	base := p.BaseDelay
+	if base <= 0 {
+		base = time.Second
+	}
+	d := float64(base) * math.Pow(2, float64(attempt-1))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		j := math.Min(p.Jitter, 1)
+		d += d * j * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+func (p ExponentialRetryPolicy) Retryable(err error) bool {
+	if p.Classifier != nil {
+		return p.Classifier(err)
+	}
+	return IsRetryableError(err)
+}
+
+// HTTPStatusError is a non-2xx answer from the MCP endpoint.
+type HTTPStatusError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is parsed from the Retry-After header, if present.
+	RetryAfter time.Duration
+}
+
+func (e HTTPStatusError) Error() string {
+	return fmt.Sprintf("MCP HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+func newHTTPStatusError(resp *http.Response, body []byte) HTTPStatusError {
+	e := HTTPStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	if ra := strings.TrimSpace(resp.Header.Get("Retry-After")); ra != "" {
+		if secs, err := strconv.Atoi(ra); err == nil && secs > 0 {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(ra); err == nil {
+			e.RetryAfter = time.Until(t)
+		}
+	}
+	return e
+}
+
+// IsRetryableError is the default classifier: network failures, timeouts,
+// HTTP 408/425/429 and 5xx are transient; other 4xx answers, malformed
+// payloads and cancellation are not.
+func IsRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	var httpErr HTTPStatusError
+	if errors.As(err, &httpErr) {
+		switch code := httpErr.StatusCode; {
+		case code == http.StatusRequestTimeout, code == http.StatusTooEarly, code == http.StatusTooManyRequests:
+			return true
+		case code >= 500:
+			return true
+		default:
+			return false
+		}
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var argErr ArgumentError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.As(err, &argErr) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryAfter returns the server-requested delay carried by err, if any.
+func retryAfter(err error) time.Duration {
+	var httpErr HTTPStatusError
+	if errors.As(err, &httpErr) {
+		return httpErr.RetryAfter
+	}
+	return 0
+}
+
+// ErrCircuitOpen is matched (via errors.Is) by the error returned while the
+// circuit breaker rejects calls.
+var ErrCircuitOpen = errors.New("MCP circuit breaker open")
+
+// CircuitOpenError is returned instead of contacting the server while the
+// breaker is open.
+type CircuitOpenError struct {
+	// Until is when the breaker lets a probe request through again.
+	Until time.Time
+}
+
+func (e CircuitOpenError) Error() string {
+	return fmt.Sprintf("%v until %s", ErrCircuitOpen, e.Until.Format(time.RFC3339))
+}
+
+func (e CircuitOpenError) Is(target error) bool { return target == ErrCircuitOpen }
+
+// CircuitState is the breaker state.
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops all calls after Threshold consecutive transient
+// failures, then lets a single probe through once Cooldown has elapsed.
+// One breaker may be shared by several clients talking to the same server.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+	// OnStateChange, if set, is called (outside the lock) on every transition.
+	OnStateChange func(from, to CircuitState)
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+// NewCircuitBreaker returns a closed breaker.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// State returns the current state, moving open to half-open once the
+// cooldown has elapsed.
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen && !b.clock().Before(b.openedAt.Add(b.Cooldown)) {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
+
+// Allow returns a CircuitOpenError if calls are currently rejected.
+func (b *CircuitBreaker) Allow() error {
+	var from, to CircuitState
+	b.mu.Lock()
+	switch b.state {
+	case CircuitOpen:
+		until := b.openedAt.Add(b.Cooldown)
+		if b.clock().Before(until) {
+			b.mu.Unlock()
+			return CircuitOpenError{Until: until}
+		}
+		from, to = b.state, CircuitHalfOpen
+		b.state = CircuitHalfOpen
+		b.probing = true
+	case CircuitHalfOpen:
+		if b.probing {
+			until := b.clock().Add(b.Cooldown)
+			b.mu.Unlock()
+			return CircuitOpenError{Until: until}
+		}
+		b.probing = true
+		b.mu.Unlock()
+		return nil
+	default:
+		b.mu.Unlock()
+		return nil
+	}
+	b.mu.Unlock()
+	b.notify(from, to)
+	return nil
+}
+
+// Record reports the outcome of an attempt. Only transient failures count;
+// a 4xx answer still proves the server is reachable.
+func (b *CircuitBreaker) Record(err error) {
+	if err != nil && errors.Is(err, context.Canceled) {
+		b.Release()
+		return
+	}
+	failed := err != nil && IsRetryableError(err)
+
+	b.mu.Lock()
+	from := b.state
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.state = CircuitClosed
+	} else {
+		b.failures++
+		threshold := b.Threshold
+		if threshold < 1 {
+			threshold = 1
+		}
+		if b.state == CircuitHalfOpen || b.failures >= threshold {
+			b.state = CircuitOpen
+			b.openedAt = b.clock()
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	if from != to {
+		b.notify(from, to)
+	}
+}
+
+// Release ends an attempt that Allow let through without judging the
+// server, e.g. one cancelled or answered with an expired session, so the
+// half-open probe slot is free for the next attempt.
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *CircuitBreaker) notify(from, to CircuitState) {
+	if to == CircuitOpen {
+		logx.Errorf("MCP circuit breaker open after %d consecutive failures; pausing calls for %s.", b.Threshold, b.Cooldown)
+	} else {
+		logx.Infof("MCP circuit breaker %s -> %s.", from, to)
+	}
+	if b.OnStateChange != nil {
+		b.OnStateChange(from, to)
+	}
+}
+
+func (b *CircuitBreaker) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,232 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// validateSchema checks value against the subset of JSON Schema that MCP
+// servers emit for tool inputs: type, required, properties,
+// additionalProperties, enum, items, anyOf/oneOf and local $ref into $defs.
+// It returns one message per violation; nil means the value is valid.
+func validateSchema(schema map[string]any, value any) []string {
+	normalized, err := normalizeJSONValue(value)
+	if err != nil {
+		return []string{fmt.Sprintf("arguments are not JSON-encodable: %v", err)}
+	}
+	v := schemaValidator{root: schema}
+	return v.validate(schema, normalized, "")
+}
+
+type schemaValidator struct {
+	root map[string]any
+}
+
+func (v schemaValidator) validate(schema map[string]any, value any, path string) []string {
+	if schema == nil {
+		return nil
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, err := v.resolveRef(ref)
+		if err != nil {
+			return []string{fmt.Sprintf("%s: %v", displayPath(path), err)}
+		}
+		return v.validate(resolved, value, path)
+	}
+
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if alts, ok := schema[key].([]any); ok && len(alts) > 0 {
+			matched := false
+			for _, alt := range alts {
+				altSchema, _ := alt.(map[string]any)
+				if len(v.validate(altSchema, value, path)) == 0 {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return []string{fmt.Sprintf("%s: value does not match any allowed schema", displayPath(path))}
+			}
+		}
+	}
+
+	if types := schemaTypes(schema["type"]); len(types) > 0 && !matchesAnyType(types, value) {
+		return []string{fmt.Sprintf("%s: expected %s, got %s", displayPath(path), strings.Join(types, " or "), jsonTypeName(value))}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok && len(enum) > 0 {
+		found := false
+		for _, allowed := range enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return []string{fmt.Sprintf("%s: value %v not in enum %v", displayPath(path), value, enum)}
+		}
+	}
+
+	var problems []string
+	switch val := value.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		for _, req := range schemaRequired(schema) {
+			if _, ok := val[req]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing required property %q", displayPath(path), req))
+			}
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			propSchema, declared := props[k].(map[string]any)
+			if declared {
+				problems = append(problems, v.validate(propSchema, val[k], joinPath(path, k))...)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					problems = append(problems, fmt.Sprintf("%s: unexpected property %q", displayPath(path), k))
+				}
+			case map[string]any:
+				problems = append(problems, v.validate(extra, val[k], joinPath(path, k))...)
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range val {
+				problems = append(problems, v.validate(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+	return problems
+}
+
+func (v schemaValidator) resolveRef(ref string) (map[string]any, error) {
+	for _, prefix := range []string{"#/$defs/", "#/definitions/"} {
+		if !strings.HasPrefix(ref, prefix) {
+			continue
+		}
+		defsKey := strings.TrimSuffix(strings.TrimPrefix(prefix, "#/"), "/")
+		defs, _ := v.root[defsKey].(map[string]any)
+		if def, ok := defs[strings.TrimPrefix(ref, prefix)].(map[string]any); ok {
+			return def, nil
+		}
+	}
+	return nil, fmt.Errorf("unresolvable schema reference %q", ref)
+}
+
+func schemaRequired(schema map[string]any) []string {
+	raw, _ := schema["required"].([]any)
+	out := make([]string, 0, len(raw))
+	for _, r := range raw {
+		if s, ok := r.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func schemaTypes(raw any) []string {
+	switch t := raw.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		out := make([]string, 0, len(t))
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func matchesAnyType(types []string, value any) bool {
+	for _, t := range types {
+		if matchesType(t, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesType(t string, value any) bool {
+	switch t {
+	case "null":
+		return value == nil
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	}
+	return true
+}
+
+func jsonTypeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// normalizeJSONValue round-trips value through encoding/json so Go types such
+// as []string or int compare like the JSON the server will receive.
+func normalizeJSONValue(value any) (any, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "arguments"
+	}
+	return path
+}
@@ -0,0 +1,216 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// ErrNoWinner is returned (possibly wrapped) by a Selector that found no
+// acceptable branch. The controller then treats the episode as failed.
+var ErrNoWinner = errors.New("no branch selected")
+
+// Candidate is one branch of a multi-branch episode.
+type Candidate struct {
+	BranchID string
+	Status   string
+	// Output is the branch_output of a branch that finished, or its last
+	// MiB when longer (the ledger keeps the full text); empty for a failed
+	// one.
+	Output string
+	// Err is why the branch failed, or nil.
+	Err error
+}
+
+// Succeeded reports whether the branch finished without failing.
+func (c Candidate) Succeeded() bool { return c.Err == nil }
+
+// Selection is what a Selector chooses from.
+type Selection struct {
+	// Anchor is the branch every candidate was explored from.
+	Anchor string
+	// Prompt is the episode prompt the candidates were given.
+	Prompt     string
+	Candidates []Candidate
+	// RunAgent runs agent ("" for the episode agent) with prompt on a new
+	// branch from Anchor and returns its output. The controller provides it
+	// so selectors can consult a judge.
+	RunAgent func(ctx context.Context, agent, prompt string) (string, error)
+}
+
+// Selector chooses which branch of a multi-branch episode becomes the new
+// anchor. It is only consulted when more than one branch succeeded.
+type Selector interface {
+	Select(ctx context.Context, s Selection) (string, error)
+}
+
+// SelectorFunc adapts a function to Selector.
+type SelectorFunc func(ctx context.Context, s Selection) (string, error)
+
+func (f SelectorFunc) Select(ctx context.Context, s Selection) (string, error) { return f(ctx, s) }
+
+// FirstSuccessSelector picks the first branch Pantheon reported that
+// succeeded.
+type FirstSuccessSelector struct{}
+
+func (FirstSuccessSelector) Select(ctx context.Context, s Selection) (string, error) {
+	for _, c := range s.Candidates {
+		if c.Succeeded() {
+			return c.BranchID, nil
+		}
+	}
+	return "", ErrNoWinner
+}
+
+// LongestOutputSelector picks the succeeded branch with the longest output,
+// on the theory that the agent that got further reported more.
+type LongestOutputSelector struct{}
+
+func (LongestOutputSelector) Select(ctx context.Context, s Selection) (string, error) {
+	best, bestLen := "", -1
+	for _, c := range s.Candidates {
+		if c.Succeeded() && len(c.Output) > bestLen {
+			best, bestLen = c.BranchID, len(c.Output)
+		}
+	}
+	if best == "" {
+		return "", ErrNoWinner
+	}
+	return best, nil
+}
+
+// judgeOutputLimit bounds how much of each candidate's output the judge
+// prompt quotes; the end of an agent log holds its report.
+const judgeOutputLimit = 16 * 1024
+
+// judgeVerdict matches the judge's answer line.
+var judgeVerdict = regexp.MustCompile(`(?im)^\W*WINNER:\s*([A-Za-z0-9._:-]+)`)
+
+// JudgeSelector runs a judge agent on the anchor branch that compares the
+// candidates' reports and names the winner, or NONE.
+type JudgeSelector struct {
+	// Agent runs the judge; "" uses the episode agent.
+	Agent string
+}
+
+func (j JudgeSelector) Select(ctx context.Context, s Selection) (string, error) {
+	if s.RunAgent == nil {
+		return "", fmt.Errorf("judge selector needs an agent runner")
+	}
+	output, err := s.RunAgent(ctx, j.Agent, buildJudgePrompt(s))
+	if err != nil {
+		return "", fmt.Errorf("judge agent: %w", err)
+	}
+	matches := judgeVerdict.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("judge agent gave no WINNER line")
+	}
+	verdict := matches[len(matches)-1][1]
+	if strings.EqualFold(verdict, "none") {
+		return "", fmt.Errorf("judge rejected every branch: %w", ErrNoWinner)
+	}
+	for _, c := range s.Candidates {
+		if c.Succeeded() && c.BranchID == verdict {
+			return verdict, nil
+		}
+	}
+	return "", fmt.Errorf("judge picked %q, which is not a succeeded candidate", verdict)
+}
+
+func buildJudgePrompt(s Selection) string {
+	var b strings.Builder
+	b.WriteString("You are judging several attempts at the same task. Do not change any files.\n\n")
+	b.WriteString("Task given to every attempt:\n")
+	b.WriteString(strings.TrimSpace(s.Prompt))
+	b.WriteString("\n\n")
+	for _, c := range s.Candidates {
+		if !c.Succeeded() {
+			continue
+		}
+		out := c.Output
+		if len(out) > judgeOutputLimit {
+			out = "[...]\n" + out[len(out)-judgeOutputLimit:]
+		}
+		fmt.Fprintf(&b, "=== Attempt on branch %s ===\n%s\n\n", c.BranchID, strings.TrimSpace(out))
+	}
+	b.WriteString("Decide which attempt best completes the task. End your answer with a single line `WINNER: <branch id>`, or `WINNER: NONE` if no attempt is acceptable.")
+	return b.String()
+}
+
+// ScriptSelector runs Command with "sh -c", writing the selection as JSON
+// ({"anchor", "prompt", "candidates": [{"branch_id", "status", "output",
+// "error"}]}) to its stdin. The first line of its stdout names the winner;
+// an empty answer or "none" means no winner.
+type ScriptSelector struct {
+	Command string
+}
+
+func (sc ScriptSelector) Select(ctx context.Context, s Selection) (string, error) {
+	type candidateJSON struct {
+		BranchID string `json:"branch_id"`
+		Status   string `json:"status"`
+		Output   string `json:"output,omitempty"`
+		Error    string `json:"error,omitempty"`
+	}
+	in := struct {
+		Anchor     string          `json:"anchor"`
+		Prompt     string          `json:"prompt"`
+		Candidates []candidateJSON `json:"candidates"`
+	}{Anchor: s.Anchor, Prompt: s.Prompt}
+	for _, c := range s.Candidates {
+		cj := candidateJSON{BranchID: c.BranchID, Status: c.Status, Output: c.Output}
+		if c.Err != nil {
+			cj.Error = c.Err.Error()
+		}
+		in.Candidates = append(in.Candidates, cj)
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", sc.Command)
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("selector script %q: %w: %s", sc.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	first, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	winner := strings.TrimSpace(first)
+	if winner == "" || strings.EqualFold(winner, "none") {
+		return "", fmt.Errorf("selector script %q: %w", sc.Command, ErrNoWinner)
+	}
+	for _, c := range s.Candidates {
+		if c.Succeeded() && c.BranchID == winner {
+			return winner, nil
+		}
+	}
+	return "", fmt.Errorf("selector script %q picked %q, which is not a succeeded candidate", sc.Command, winner)
+}
+
+// ParseSelector parses a selector spec: "first-success" (the default),
+// "longest-output", "judge" or "judge:<agent>", or "script:<command>".
+func ParseSelector(spec string) (Selector, error) {
+	spec = strings.TrimSpace(spec)
+	name, arg, _ := strings.Cut(spec, ":")
+	switch strings.TrimSpace(name) {
+	case "", "first-success":
+		return FirstSuccessSelector{}, nil
+	case "longest-output":
+		return LongestOutputSelector{}, nil
+	case "judge":
+		return JudgeSelector{Agent: strings.TrimSpace(arg)}, nil
+	case "script":
+		if strings.TrimSpace(arg) == "" {
+			return nil, fmt.Errorf("selector %q: script needs a command", spec)
+		}
+		return ScriptSelector{Command: strings.TrimSpace(arg)}, nil
+	}
+	return nil, fmt.Errorf("unknown selector %q (want first-success, longest-output, judge[:agent] or script:<command>)", spec)
+}
@@ -0,0 +1,440 @@
+package tools
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IANTHEREAL/agent0/internal/logx"
+)
+
+// Notification is a JSON-RPC notification sent by the server, either inside
+// the SSE stream answering a request or on the standalone listen stream.
+type Notification struct {
+	Method string
+	Params map[string]any
+}
+
+// NotificationHandler receives server notifications. Handlers run on the
+// goroutine reading the stream and must not block.
+type NotificationHandler func(Notification)
+
+// ProgressEvent is a decoded notifications/progress message.
+type ProgressEvent struct {
+	// Token is the progressToken of the request being reported on.
+	Token    any
+	Progress float64
+	// Total is 0 when the server does not know it.
+	Total   float64
+	Message string
+}
+
+const (
+	methodProgress = "notifications/progress"
+	methodLog      = "notifications/message"
+)
+
+// notificationHandlers holds the handlers registered with OnNotification.
+type notificationHandlers struct {
+	mu       sync.RWMutex
+	byMethod map[string][]NotificationHandler
+}
+
+// OnNotification registers h for server notifications with the given method,
+// or for every notification if method is "".
+func (c *MCPClient) OnNotification(method string, h NotificationHandler) {
+	if h == nil {
+		return
+	}
+	c.handlers.mu.Lock()
+	defer c.handlers.mu.Unlock()
+	if c.handlers.byMethod == nil {
+		c.handlers.byMethod = map[string][]NotificationHandler{}
+	}
+	c.handlers.byMethod[method] = append(c.handlers.byMethod[method], h)
+}
+
+// OnProgress registers h for notifications/progress. Once a progress handler
+// is registered, tool calls ask the server for progress by sending a
+// progressToken equal to the request id.
+func (c *MCPClient) OnProgress(h func(ProgressEvent)) {
+	if h == nil {
+		return
+	}
+	c.OnNotification(methodProgress, func(n Notification) {
+		h(decodeProgress(n.Params))
+	})
+}
+
+func (c *MCPClient) wantsProgress() bool {
+	c.handlers.mu.RLock()
+	defer c.handlers.mu.RUnlock()
+	return len(c.handlers.byMethod[methodProgress]) > 0
+}
+
+func (c *MCPClient) dispatchNotification(n Notification) {
+	c.handlers.mu.RLock()
+	hs := append(append([]NotificationHandler(nil), c.handlers.byMethod[n.Method]...), c.handlers.byMethod[""]...)
+	c.handlers.mu.RUnlock()
+	if len(hs) == 0 {
+		if n.Method == methodLog {
+			logx.Debugf("MCP server log: %v", n.Params)
+		}
+		return
+	}
+	for _, h := range hs {
+		h(n)
+	}
+}
+
+func decodeProgress(params map[string]any) ProgressEvent {
+	ev := ProgressEvent{Token: params["progressToken"]}
+	ev.Progress, _ = params["progress"].(float64)
+	ev.Total, _ = params["total"].(float64)
+	ev.Message, _ = params["message"].(string)
+	return ev
+}
+
+// sseEvent is one dispatched Server-Sent Event.
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// sseReader splits an event stream into events as described by the
+// WHATWG EventSource spec (data lines joined with "\n", comments skipped).
+// Lines may be of any length: a full branch_output can arrive as a single
+// data line of many megabytes.
+type sseReader struct {
+	r *bufio.Reader
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Next returns the next event with a non-empty data field, or io.EOF.
+func (r *sseReader) Next() (sseEvent, error) {
+	var (
+		ev      sseEvent
+		data    strings.Builder
+		hasData bool
+	)
+	for {
+		line, err := r.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return sseEvent{}, err
+		}
+		if err == io.EOF && line == "" {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			if hasData {
+				ev.Data = strings.TrimSuffix(data.String(), "\n")
+				return ev, nil
+			}
+			ev = sseEvent{}
+		case strings.HasPrefix(line, ":"):
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "data":
+				data.WriteString(value)
+				data.WriteByte('\n')
+				hasData = true
+			case "event":
+				ev.Event = value
+			case "id":
+				ev.ID = value
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if hasData {
+		ev.Data = strings.TrimSuffix(data.String(), "\n")
+		return ev, nil
+	}
+	return sseEvent{}, io.EOF
+}
+
+// readSSEResponse consumes the SSE stream answering request id. Server
+// notifications and requests that precede the response are dispatched; the
+// stream is read until the response with a matching id arrives.
+func (c *MCPClient) readSSEResponse(ctx context.Context, body io.Reader, id any, trace *exchangeTrace) (map[string]any, error) {
+	r := newSSEReader(body)
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("SSE stream ended without a response for request %v", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if trace != nil && trace.keepEvents {
+			trace.events = append(trace.events, ev)
+		}
+		msgs := decodeSSEMessages(ev.Data)
+		if msgs == nil && trace != nil && !isSSEDone(ev.Data) {
+			trace.sseFailed = true
+		}
+		for _, msg := range msgs {
+			if resp, done := c.handleStreamMessage(ctx, msg, id); done {
+				return resp, nil
+			}
+		}
+	}
+}
+
+// handleStreamMessage routes one JSON-RPC message read from a stream. It
+// returns the message and true when msg answers request id (a nil id matches
+// nothing).
+func (c *MCPClient) handleStreamMessage(ctx context.Context, msg map[string]any, id any) (map[string]any, bool) {
+	method, _ := msg["method"].(string)
+	msgID, hasID := msg["id"]
+	switch {
+	case method != "" && !hasID:
+		if c.recorder != nil {
+			c.recorder.recordNotification(msg)
+		}
+		params, _ := msg["params"].(map[string]any)
+		c.dispatchNotification(Notification{Method: method, Params: params})
+	case method != "":
+		c.answerServerRequest(ctx, msgID, method)
+	case id == nil:
+		logx.Debugf("MCP stream: ignoring response %v outside a request", msgID)
+	case !hasID || sameRPCID(msgID, id):
+		// Servers that predate streamable HTTP omit the id.
+		return msg, true
+	default:
+		logx.Debugf("MCP stream: ignoring response for request %v while waiting for %v", msgID, id)
+	}
+	return nil, false
+}
+
+// answerServerRequest replies to a request the server sent over a stream.
+// Only ping is supported; other methods get "method not found".
+func (c *MCPClient) answerServerRequest(ctx context.Context, id any, method string) {
+	reply := map[string]any{"jsonrpc": "2.0", "id": id}
+	if method == "ping" {
+		reply["result"] = map[string]any{}
+	} else {
+		reply["error"] = map[string]any{"code": -32601, "message": "method not found: " + method}
+	}
+	if c.transport != nil {
+		if _, err := c.transport.RoundTrip(ctx, reply); err != nil {
+			logx.Debugf("MCP reply to server %s failed: %v", method, err)
+		}
+		return
+	}
+	resp, cancel, err := c.rpcPost(ctx, c.rpcURL, reply, c.timeout)
+	if err != nil {
+		logx.Debugf("MCP reply to server %s failed: %v", method, err)
+		return
+	}
+	defer cancel()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// decodeSSEMessages decodes an event's data as a JSON-RPC message or batch,
+// tolerating text around the JSON the way older Pantheon builds send it.
+func decodeSSEMessages(data string) []map[string]any {
+	text := strings.TrimSpace(data)
+	if isSSEDone(text) {
+		return nil
+	}
+	raw := []byte(text)
+	if !json.Valid(raw) {
+		extracted, err := extractJSONFromText(text)
+		if err != nil {
+			logx.Debugf("MCP SSE event is not JSON: %.200s", text)
+			return nil
+		}
+		raw = extracted
+	}
+	var single map[string]any
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return []map[string]any{single}
+	}
+	var batch []map[string]any
+	if err := json.Unmarshal(raw, &batch); err == nil {
+		return batch
+	}
+	return nil
+}
+
+// isSSEDone reports whether data is an end-of-stream marker rather than a
+// message.
+func isSSEDone(data string) bool {
+	text := strings.TrimSpace(data)
+	return text == "" || text == "[DONE]" || text == "DONE"
+}
+
+func sameRPCID(a, b any) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// ErrListenUnsupported is returned by Listen when the server does not offer
+// a standalone notification stream.
+var ErrListenUnsupported = errors.New("MCP server does not support a listen stream")
+
+// Listen keeps a GET event stream open and dispatches the notifications the
+// server sends outside any request, reconnecting (with Last-Event-ID) when
+// the stream drops. It returns when ctx is done, or ErrListenUnsupported if
+// the server answers 405. On stdio and WebSocket transports notifications
+// need no separate stream; Listen just waits for ctx.
+func (c *MCPClient) Listen(ctx context.Context) error {
+	if c.transport != nil {
+		// Stream transports deliver notifications on the connection itself.
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	var (
+		lastEventID string
+		failures    int
+	)
+	for {
+		if err := c.ensureSession(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failures++
+		} else {
+			received, err := c.listenOnce(ctx, &lastEventID)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, ErrListenUnsupported) {
+				return err
+			}
+			if errors.Is(err, errSessionExpired) {
+				c.dropSession(c.sessionID())
+			}
+			if received {
+				failures = 0
+			}
+			failures++
+			if err != nil {
+				logx.Debugf("MCP listen stream closed: %v", err)
+			}
+		}
+		if err := sleepContext(ctx, c.retry.Backoff(failures)); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *MCPClient) listenOnce(ctx context.Context, lastEventID *string) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.rpcURL, nil)
+	if err != nil {
+		return false, err
+	}
+	if err := c.setAuthHeaders(ctx, req.Header); err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	c.setSessionHeaders(req.Header)
+	if *lastEventID != "" {
+		req.Header.Set("Last-Event-ID", *lastEventID)
+	}
+
+	// The stream is long-lived: no per-request timeout, only ctx.
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusMethodNotAllowed:
+		return false, ErrListenUnsupported
+	case resp.StatusCode == http.StatusNotFound && req.Header.Get(headerSessionID) != "":
+		return false, errSessionExpired
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return false, newHTTPStatusError(resp, body)
+	}
+
+	received := false
+	r := newSSEReader(resp.Body)
+	for {
+		ev, err := r.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return received, err
+		}
+		received = true
+		if ev.ID != "" {
+			*lastEventID = ev.ID
+		}
+		for _, msg := range decodeSSEMessages(ev.Data) {
+			c.handleStreamMessage(ctx, msg, nil)
+		}
+	}
+}
+
+// progressLogger logs progress notifications at most once per interval per
+// token, so a chatty server does not flood the controller log. A token is
+// forgotten once its progress reaches the total, or once it has been quiet
+// for an interval (its request has ended or will be logged afresh anyway),
+// so the map only holds requests still reporting.
+type progressLogger struct {
+	interval time.Duration
+	mu       sync.Mutex
+	last     map[string]time.Time
+	now      func() time.Time
+}
+
+func (p *progressLogger) log(ev ProgressEvent) {
+	key := fmt.Sprint(ev.Token)
+	done := ev.Total > 0 && ev.Progress >= ev.Total
+	p.mu.Lock()
+	now := time.Now()
+	if p.now != nil {
+		now = p.now()
+	}
+	if p.last == nil {
+		p.last = map[string]time.Time{}
+	}
+	for k, t := range p.last {
+		if now.Sub(t) >= p.interval {
+			delete(p.last, k)
+		}
+	}
+	if _, ok := p.last[key]; ok && !done {
+		p.mu.Unlock()
+		return
+	}
+	if done {
+		delete(p.last, key)
+	} else {
+		p.last[key] = now
+	}
+	p.mu.Unlock()
+
+	progress := fmt.Sprintf("%g", ev.Progress)
+	if ev.Total > 0 {
+		progress = fmt.Sprintf("%g/%g", ev.Progress, ev.Total)
+	}
+	if ev.Message != "" {
+		logx.Infof("Pantheon progress [%v] %s: %s", ev.Token, progress, ev.Message)
+	} else {
+		logx.Infof("Pantheon progress [%v] %s", ev.Token, progress)
+	}
+}
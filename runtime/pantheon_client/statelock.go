@@ -0,0 +1,59 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrStateLocked is returned when another process holds the lock of a
+// controller state file.
+var ErrStateLocked = errors.New("state file is locked by a running controller")
+
+// errLockHeld is what lockFile returns when the lock is taken.
+var errLockHeld = errors.New("lock held")
+
+// stateLock is the lock a running controller holds on <state>.lock. The
+// controller keeps its state in memory between saves, so commands that
+// rewrite the state file (rollback) must not run beside it.
+type stateLock struct {
+	f *os.File
+}
+
+// lockState takes the lock of the state file at statePath, or returns
+// ErrStateLocked naming the pid that holds it.
+func lockState(statePath string) (*stateLock, error) {
+	path := statePath + ".lock"
+	dir := filepath.Dir(path)
+	if dir != "." && dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, errLockHeld) {
+			pid, _ := os.ReadFile(path)
+			return nil, fmt.Errorf("%w: %s (pid %s)", ErrStateLocked, statePath, strings.TrimSpace(string(pid)))
+		}
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	// The pid is only informational; the lock itself is what counts.
+	if err := f.Truncate(0); err == nil {
+		_, _ = fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return &stateLock{f: f}, nil
+}
+
+// Unlock releases the lock. The lock file is left in place; removing it
+// would race with a process that has just opened it.
+func (l *stateLock) Unlock() {
+	_ = unlockFile(l.f)
+	l.f.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package tools
+
+import "os"
+
+// Without flock the lock file only records the pid; rollback cannot tell
+// that a controller is running.
+func lockFile(f *os.File) error { return nil }
+
+func unlockFile(f *os.File) error { return nil }
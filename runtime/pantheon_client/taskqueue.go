@@ -0,0 +1,417 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/IANTHEREAL/agent0/internal/logx"
+)
+
+// QueuedTask is one entry of a task queue.
+type QueuedTask struct {
+	// ID identifies the task in the state file; it defaults to the file
+	// name (directory queues) or a hash of the prompt (JSONL queues).
+	ID     string `json:"id,omitempty"`
+	Prompt string `json:"prompt"`
+	// MaxEpisodes bounds the episodes spent on the task. 0 means one
+	// episode without DoneWhen, and no limit with it.
+	MaxEpisodes int `json:"max_episodes,omitempty"`
+	// DoneWhen are ParseGate specs checked on the new anchor after every
+	// episode; the task is complete once all of them pass.
+	DoneWhen []string `json:"done_when,omitempty"`
+}
+
+// Task progress statuses, as saved in the state file.
+const (
+	TaskRunning    = "running"
+	TaskDone       = "done"
+	TaskIncomplete = "incomplete" // max_episodes reached before done_when passed
+	TaskRemoved    = "removed"    // dequeued while it was running
+)
+
+// TaskProgress is the controller's record of one queued task.
+type TaskProgress struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Episodes int    `json:"episodes,omitempty"`
+	// StartAnchor is the anchor the task started from and LastAnchor the
+	// anchor its latest episode promoted.
+	StartAnchor string `json:"start_anchor,omitempty"`
+	LastAnchor  string `json:"last_anchor,omitempty"`
+	StartedAt   string `json:"started_at,omitempty"`
+	FinishedAt  string `json:"finished_at,omitempty"`
+}
+
+func (p TaskProgress) finished() bool { return p.Status != "" && p.Status != TaskRunning }
+
+// LoadTaskQueue reads a task queue: a JSONL file with one QueuedTask per
+// line, or a directory whose *.json files hold one QueuedTask each and whose
+// *.md and *.txt files are prompts, taken in file name order. YAML is not
+// supported.
+func LoadTaskQueue(path string) ([]QueuedTask, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("task queue: %w", err)
+	}
+	var tasks []QueuedTask
+	if info.IsDir() {
+		tasks, err = loadTaskDir(path)
+	} else {
+		tasks, err = loadTaskJSONL(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(tasks))
+	for _, t := range tasks {
+		if seen[t.ID] {
+			return nil, fmt.Errorf("task queue %s: duplicate task id %q", path, t.ID)
+		}
+		seen[t.ID] = true
+	}
+	return tasks, nil
+}
+
+func loadTaskJSONL(path string) ([]QueuedTask, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("task queue: %w", err)
+	}
+	var tasks []QueuedTask
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64*1024), len(data)+1)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var t QueuedTask
+		if err := json.Unmarshal([]byte(line), &t); err != nil {
+			return nil, fmt.Errorf("task queue %s:%d: %w", path, n, err)
+		}
+		if err := t.normalize(""); err != nil {
+			return nil, fmt.Errorf("task queue %s:%d: %w", path, n, err)
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, sc.Err()
+}
+
+func loadTaskDir(dir string) ([]QueuedTask, error) {
+	files, err := taskFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]QueuedTask, 0, len(files))
+	for _, f := range files {
+		tasks = append(tasks, f.task)
+	}
+	return tasks, nil
+}
+
+type taskFile struct {
+	path string
+	task QueuedTask
+}
+
+// taskFiles reads the tasks of a directory queue. os.ReadDir returns the
+// files sorted by name, which is the queue order.
+func taskFiles(dir string) ([]taskFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("task queue: %w", err)
+	}
+	var files []taskFile
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if e.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		switch ext {
+		case ".json", ".md", ".txt":
+		default:
+			continue
+		}
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("task queue: %w", err)
+		}
+		var t QueuedTask
+		if ext == ".json" {
+			if err := json.Unmarshal(data, &t); err != nil {
+				return nil, fmt.Errorf("task queue %s: %w", path, err)
+			}
+		} else {
+			t.Prompt = string(data)
+		}
+		if err := t.normalize(strings.TrimSuffix(name, ext)); err != nil {
+			return nil, fmt.Errorf("task queue %s: %w", path, err)
+		}
+		files = append(files, taskFile{path: path, task: t})
+	}
+	return files, nil
+}
+
+func (t *QueuedTask) normalize(defaultID string) error {
+	t.ID = strings.TrimSpace(t.ID)
+	t.Prompt = strings.TrimSpace(t.Prompt)
+	if t.Prompt == "" {
+		return fmt.Errorf("task %q has no prompt", t.ID)
+	}
+	if t.ID == "" {
+		t.ID = defaultID
+	}
+	if t.ID == "" {
+		t.ID = promptHash(t.Prompt)
+	}
+	if t.MaxEpisodes < 0 {
+		return fmt.Errorf("task %q: max_episodes must not be negative", t.ID)
+	}
+	for _, spec := range t.DoneWhen {
+		if _, err := ParseGate(spec); err != nil {
+			return fmt.Errorf("task %q: done_when: %w", t.ID, err)
+		}
+	}
+	return nil
+}
+
+// EnqueueTask adds t to the end of the queue at path: a new line of a JSONL
+// queue (the file is created if missing), or a file in a directory queue
+// named to sort after every task file there (see queueFileName). A running
+// controller picks it up before its next task.
+func EnqueueTask(path string, t QueuedTask) (QueuedTask, error) {
+	info, err := os.Stat(path)
+	isDir := err == nil && info.IsDir()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return QueuedTask{}, err
+	}
+	if err := t.normalize(""); err != nil {
+		return QueuedTask{}, err
+	}
+	if err := checkTaskID(t.ID); err != nil {
+		return QueuedTask{}, err
+	}
+	if existing, err := LoadTaskQueue(path); err == nil {
+		for _, e := range existing {
+			if e.ID == t.ID {
+				return QueuedTask{}, fmt.Errorf("task %q is already queued", t.ID)
+			}
+		}
+	}
+	if isDir {
+		data, err := json.MarshalIndent(t, "", "  ")
+		if err != nil {
+			return QueuedTask{}, err
+		}
+		name, err := queueFileName(path, t.ID)
+		if err != nil {
+			return QueuedTask{}, err
+		}
+		file := filepath.Join(path, name)
+		tmp := file + ".tmp"
+		if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+			return QueuedTask{}, err
+		}
+		return t, os.Rename(tmp, file)
+	}
+	line, err := json.Marshal(t)
+	if err != nil {
+		return QueuedTask{}, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return QueuedTask{}, err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return QueuedTask{}, err
+	}
+	return t, f.Close()
+}
+
+// queueFileName names the file of a task enqueued in directory queue dir.
+// Files are taken in name order, so <id>.json is used only if it sorts
+// after the last task file; otherwise the id is prefixed with as many "~"
+// (which sorts after letters and digits) as it takes.
+func queueFileName(dir, id string) (string, error) {
+	files, err := taskFiles(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return id + ".json", nil
+	}
+	last := filepath.Base(files[len(files)-1].path)
+	prefix := ""
+	for prefix+id+".json" <= last {
+		prefix += "~"
+	}
+	return prefix + id + ".json", nil
+}
+
+// checkTaskID rejects an id that could not serve as the <id>.json name of
+// a directory queue entry without escaping the directory.
+func checkTaskID(id string) error {
+	if id == "." || strings.Contains(id, "..") || strings.ContainsAny(id, `/\`+"\x00") {
+		return fmt.Errorf("task id %q must not contain path separators or \"..\"", id)
+	}
+	return nil
+}
+
+// DequeueTask removes the task with id from the queue at path. A running
+// controller working on it stops after the current episode.
+func DequeueTask(path, id string) error {
+	id = strings.TrimSpace(id)
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("task queue: %w", err)
+	}
+	if info.IsDir() {
+		return dequeueTaskFile(path, id)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	found := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		var t QueuedTask
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") && json.Unmarshal([]byte(trimmed), &t) == nil && t.normalize("") == nil && t.ID == id {
+			found = true
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if !found {
+		return fmt.Errorf("task %q is not queued in %s", id, path)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(kept, "")), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func dequeueTaskFile(dir, id string) error {
+	files, err := taskFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.task.ID == id {
+			return os.Remove(f.path)
+		}
+	}
+	return fmt.Errorf("task %q is not queued in %s", id, dir)
+}
+
+// taskProgress returns the progress record for id, or nil.
+func (s *ControllerState) taskProgress(id string) *TaskProgress {
+	for i := range s.Tasks {
+		if s.Tasks[i].ID == id {
+			return &s.Tasks[i]
+		}
+	}
+	return nil
+}
+
+// nextTask re-reads the queue and returns the task to work on: the current
+// one if it is still queued, else the first queued task not yet finished.
+// The current task is marked removed when it was dequeued. ok is false when
+// the queue is drained.
+func nextTask(state *ControllerState, queue []QueuedTask) (task QueuedTask, ok bool) {
+	if id := state.CurrentTask; id != "" {
+		for _, t := range queue {
+			if t.ID == id {
+				return t, true
+			}
+		}
+		if p := state.taskProgress(id); p != nil && !p.finished() {
+			p.Status = TaskRemoved
+			p.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+		}
+		state.CurrentTask = ""
+	}
+	for _, t := range queue {
+		if p := state.taskProgress(t.ID); p != nil && p.finished() {
+			continue
+		}
+		return t, true
+	}
+	return QueuedTask{}, false
+}
+
+func findTask(queue []QueuedTask, id string) QueuedTask {
+	for _, t := range queue {
+		if t.ID == id {
+			return t
+		}
+	}
+	return QueuedTask{}
+}
+
+// taskStatusAfterEpisode decides whether a task is finished once an episode
+// promoted in's branch: done when its done_when gates pass (or, without
+// them, after max_episodes), incomplete when max_episodes is used up.
+func taskStatusAfterEpisode(ctx context.Context, task QueuedTask, progress TaskProgress, in GateInput) string {
+	if len(task.DoneWhen) == 0 {
+		if progress.Episodes >= max(task.MaxEpisodes, 1) {
+			return TaskDone
+		}
+		return TaskRunning
+	}
+	var gates []Gate
+	for _, spec := range task.DoneWhen {
+		// Specs were validated when the queue was loaded.
+		if g, err := ParseGate(spec); err == nil {
+			gates = append(gates, g)
+		}
+	}
+	err := checkGates(ctx, gates, in)
+	if err == nil {
+		return TaskDone
+	}
+	var notDone *GateError
+	if !errors.As(err, &notDone) {
+		logx.Warningf("Could not check done_when of task %s: %v", task.ID, err)
+	}
+	if task.MaxEpisodes > 0 && progress.Episodes >= task.MaxEpisodes {
+		return TaskIncomplete
+	}
+	return TaskRunning
+}
+
+// startTask makes task the current one, creating its progress record.
+func (s *ControllerState) startTask(task QueuedTask) {
+	s.CurrentTask = task.ID
+	if p := s.taskProgress(task.ID); p != nil {
+		return
+	}
+	s.Tasks = append(s.Tasks, TaskProgress{
+		ID:          task.ID,
+		Status:      TaskRunning,
+		StartAnchor: s.AnchorBranch,
+		StartedAt:   time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// finishTask records the outcome of the current task.
+func (s *ControllerState) finishTask(status string) {
+	if p := s.taskProgress(s.CurrentTask); p != nil {
+		p.Status = status
+		p.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	s.CurrentTask = ""
+}
@@ -0,0 +1,163 @@
+package tools
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// TransportConfig tunes the HTTP transport used to reach Pantheon. The zero
+// value behaves like http.DefaultTransport (system roots, proxy from the
+// environment). It holds file paths only, so it is safe to persist.
+type TransportConfig struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots.
+	CAFile string `json:"ca_file,omitempty"`
+	// CertFile/KeyFile are the PEM client certificate and key for mTLS.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// ServerName overrides the name verified against the server certificate.
+	ServerName string `json:"server_name,omitempty"`
+	// InsecureSkipVerify disables server certificate verification. Test only.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// ProxyURL routes all requests through this HTTP(S) proxy. When empty,
+	// HTTP_PROXY/HTTPS_PROXY/NO_PROXY apply. "direct" disables proxying.
+	ProxyURL string `json:"proxy_url,omitempty"`
+
+	MaxIdleConns        int           `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost int           `json:"max_idle_conns_per_host,omitempty"`
+	MaxConnsPerHost     int           `json:"max_conns_per_host,omitempty"`
+	IdleConnTimeout     time.Duration `json:"idle_conn_timeout,omitempty"`
+}
+
+// IsZero reports whether c leaves every setting at its default.
+func (c TransportConfig) IsZero() bool { return c == TransportConfig{} }
+
+// Merge returns c with every non-zero field of override applied on top.
+func (c TransportConfig) Merge(override TransportConfig) TransportConfig {
+	if override.CAFile != "" {
+		c.CAFile = override.CAFile
+	}
+	if override.CertFile != "" {
+		c.CertFile = override.CertFile
+	}
+	if override.KeyFile != "" {
+		c.KeyFile = override.KeyFile
+	}
+	if override.ServerName != "" {
+		c.ServerName = override.ServerName
+	}
+	if override.InsecureSkipVerify {
+		c.InsecureSkipVerify = true
+	}
+	if override.ProxyURL != "" {
+		c.ProxyURL = override.ProxyURL
+	}
+	if override.MaxIdleConns > 0 {
+		c.MaxIdleConns = override.MaxIdleConns
+	}
+	if override.MaxIdleConnsPerHost > 0 {
+		c.MaxIdleConnsPerHost = override.MaxIdleConnsPerHost
+	}
+	if override.MaxConnsPerHost > 0 {
+		c.MaxConnsPerHost = override.MaxConnsPerHost
+	}
+	if override.IdleConnTimeout > 0 {
+		c.IdleConnTimeout = override.IdleConnTimeout
+	}
+	return c
+}
+
+// NewHTTPClient builds an http.Client from cfg. Certificate files are read
+// once, so a bad path fails here rather than on the first request.
+func NewHTTPClient(cfg TransportConfig) (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		tr.TLSClientConfig = tlsCfg
+	}
+
+	if tr.Proxy, err = cfg.proxyFunc(); err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxIdleConns > 0 {
+		tr.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.MaxConnsPerHost > 0 {
+		tr.MaxConnsPerHost = cfg.MaxConnsPerHost
+	}
+	if cfg.IdleConnTimeout > 0 {
+		tr.IdleConnTimeout = cfg.IdleConnTimeout
+	}
+	return &http.Client{Transport: tr}, nil
+}
+
+// proxyFunc returns the proxy selection for ProxyURL in the form
+// http.Transport.Proxy takes; nil means always connect directly.
+func (c TransportConfig) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	switch proxy := strings.TrimSpace(c.ProxyURL); {
+	case proxy == "":
+		return http.ProxyFromEnvironment, nil
+	case strings.EqualFold(proxy, "direct"):
+		return nil, nil
+	default:
+		u, err := url.Parse(proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid MCP proxy URL %q", proxy)
+		}
+		return http.ProxyURL(u), nil
+	}
+}
+
+func (c TransportConfig) tlsConfig() (*tls.Config, error) {
+	caFile := strings.TrimSpace(c.CAFile)
+	certFile := strings.TrimSpace(c.CertFile)
+	keyFile := strings.TrimSpace(c.KeyFile)
+	if caFile == "" && certFile == "" && keyFile == "" && c.ServerName == "" && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         strings.TrimSpace(c.ServerName),
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read MCP CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("MCP CA bundle %s contains no PEM certificates", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("MCP client certificate and key must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load MCP client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
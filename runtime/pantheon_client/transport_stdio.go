@@ -0,0 +1,162 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/IANTHEREAL/agent0/internal/logx"
+)
+
+// stdioStopTimeout is how long Close waits for the server to exit after its
+// stdin is closed before killing it.
+const stdioStopTimeout = 5 * time.Second
+
+// NewStdioTransport returns a transport that spawns command as a local MCP
+// server and exchanges newline-delimited JSON-RPC messages over its
+// stdin/stdout. The server's stderr is forwarded to the debug log. The
+// process is started on first use and restarted if it exits.
+func NewStdioTransport(command string, args ...string) Transport {
+	return &streamTransport{
+		name: "stdio",
+		dial: func(ctx context.Context) (messageConn, error) {
+			return startStdioProcess(command, args)
+		},
+	}
+}
+
+type stdioConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	// pipes are the read ends of stdout and stderr, closed by Close if a
+	// killed server's descendants keep them open.
+	pipes []io.Closer
+	done  chan struct{}
+}
+
+func startStdioProcess(command string, args []string) (*stdioConn, error) {
+	// Not exec.CommandContext: the server outlives the call that started it.
+	cmd := exec.Command(command, args...)
+	cmd.Env = os.Environ()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	logx.Infof("Started stdio MCP server %s (pid %d).", command, cmd.Process.Pid)
+
+	// Wait closes the pipes, so it must only run once both readers have
+	// seen EOF; stdout is read by the transport through ReadMessage.
+	stdoutEOF := &eofSignal{r: stdout, done: make(chan struct{})}
+	stderrEOF := make(chan struct{})
+	c := &stdioConn{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdoutEOF),
+		pipes:  []io.Closer{stdout, stderr},
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(stderrEOF)
+		logStderr(stderr)
+	}()
+	go func() {
+		<-stdoutEOF.done
+		<-stderrEOF
+		err := cmd.Wait()
+		logx.Debugf("stdio MCP server %s exited: %v", command, err)
+		close(c.done)
+	}()
+	return c, nil
+}
+
+// logStderr forwards the server's stderr to the debug log line by line
+// until EOF. Lines longer than the buffer are logged in pieces rather than
+// ending the copy, which would leave the server blocked on a full pipe.
+func logStderr(r io.Reader) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := br.ReadSlice('\n')
+		if line = bytes.TrimRight(line, "\r\n"); len(line) > 0 {
+			logx.Debugf("MCP stdio server: %s", line)
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
+// eofSignal closes done once a read from r fails, EOF included.
+type eofSignal struct {
+	r    io.Reader
+	once sync.Once
+	done chan struct{}
+}
+
+func (e *eofSignal) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil {
+		e.once.Do(func() { close(e.done) })
+	}
+	return n, err
+}
+
+// ReadMessage returns the next non-empty line written by the server.
+func (c *stdioConn) ReadMessage() ([]byte, error) {
+	for {
+		line, err := c.stdout.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *stdioConn) WriteMessage(data []byte) error {
+	if bytes.ContainsAny(data, "\r\n") {
+		return fmt.Errorf("stdio MCP message contains a newline")
+	}
+	_, err := c.stdin.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes stdin, giving the server a chance to exit, then kills it.
+// If the output pipes stay open after the kill (a child process inherited
+// them), Close gives up on them so it cannot hang.
+func (c *stdioConn) Close() error {
+	_ = c.stdin.Close()
+	select {
+	case <-c.done:
+		return nil
+	case <-time.After(stdioStopTimeout):
+	}
+	_ = c.cmd.Process.Kill()
+	select {
+	case <-c.done:
+	case <-time.After(stdioStopTimeout):
+		for _, p := range c.pipes {
+			_ = p.Close()
+		}
+		<-c.done
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+package tools
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is the fixed key suffix from RFC 6455 section 1.3.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// defaultWebSocketMaxMessage bounds one reassembled message when
+// WebSocketOptions.MaxMessageSize is unset. It leaves room for a full
+// branch_output while keeping a bad length field from allocating gigabytes.
+const defaultWebSocketMaxMessage = 64 << 20
+
+// WebSocketOptions configures NewWebSocketTransport.
+type WebSocketOptions struct {
+	// Header is sent with the opening handshake (auth, tenant headers, ...).
+	Header http.Header
+	// HeaderFunc, if set, adds headers per connection attempt, e.g. a
+	// freshly read bearer token.
+	HeaderFunc func(ctx context.Context, h http.Header) error
+	// TLSConfig is used for wss:// URLs.
+	TLSConfig *tls.Config
+	// Proxy picks an HTTP(S) proxy to tunnel through with CONNECT, like
+	// http.Transport.Proxy. It sees the URL with an http or https scheme.
+	// nil connects directly.
+	Proxy func(*http.Request) (*url.URL, error)
+	// MaxMessageSize caps a message in bytes across all of its frames.
+	// Zero means 64 MiB.
+	MaxMessageSize int
+}
+
+// NewWebSocketTransport returns a transport that sends one JSON-RPC message
+// per WebSocket text frame (subprotocol "mcp"). It connects on first use and
+// reconnects after the connection drops.
+func NewWebSocketTransport(rawURL string, opts WebSocketOptions) Transport {
+	return &streamTransport{
+		name: "websocket",
+		dial: func(ctx context.Context) (messageConn, error) {
+			return dialWebSocket(ctx, rawURL, opts)
+		},
+	}
+}
+
+// wsConn is a minimal RFC 6455 client connection: text frames only, no
+// extensions. Control frames are answered inside ReadMessage.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	max  int // message size limit; 0 means defaultWebSocketMaxMessage
+	wmu  sync.Mutex
+}
+
+func dialWebSocket(ctx context.Context, rawURL string, opts WebSocketOptions) (*wsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	conn, err := dialWebSocketTCP(ctx, u, host, opts.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		cfg := &tls.Config{}
+		if opts.TLSConfig != nil {
+			cfg = opts.TLSConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	ws, err := websocketHandshake(ctx, conn, u, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws.max = opts.MaxMessageSize
+	return ws, nil
+}
+
+// dialWebSocketTCP connects to addr, through a CONNECT tunnel when proxy
+// picks a proxy for u.
+func dialWebSocketTCP(ctx context.Context, u *url.URL, addr string, proxy func(*http.Request) (*url.URL, error)) (net.Conn, error) {
+	var d net.Dialer
+	if proxy == nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	// Proxy functions choose by http/https scheme, as HTTP_PROXY and
+	// HTTPS_PROXY do.
+	target := *u
+	target.Scheme = "http"
+	if u.Scheme == "wss" {
+		target.Scheme = "https"
+	}
+	proxyURL, err := proxy(&http.Request{Method: http.MethodGet, URL: &target, Host: u.Host, Header: http.Header{}})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		if proxyURL.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+	conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if err := proxyConnect(ctx, conn, proxyURL, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket proxy %s: %w", proxyURL.Redacted(), err)
+	}
+	return conn, nil
+}
+
+// proxyConnect asks the proxy on conn for a tunnel to addr.
+func proxyConnect(ctx context.Context, conn net.Conn, proxyURL *url.URL, addr string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	if r.Buffered() > 0 {
+		return fmt.Errorf("CONNECT %s: unexpected data after the proxy response", addr)
+	}
+	return nil
+}
+
+func websocketHandshake(ctx context.Context, conn net.Conn, u *url.URL, opts WebSocketOptions) (*wsConn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.EscapedPath(), RawQuery: u.RawQuery},
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	for name, values := range opts.Header {
+		req.Header[name] = values
+	}
+	if opts.HeaderFunc != nil {
+		if err := opts.HeaderFunc(ctx, req.Header); err != nil {
+			return nil, err
+		}
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", "mcp")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, newHTTPStatusError(resp, body)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, fmt.Errorf("websocket handshake: server did not upgrade")
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("websocket handshake: bad Sec-WebSocket-Accept")
+	}
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "mcp" {
+		return nil, fmt.Errorf("websocket handshake: server selected subprotocol %q, want \"mcp\"", p)
+	}
+	return &wsConn{conn: conn, r: r}, nil
+}
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// ReadMessage returns the next complete text or binary message. A message
+// larger than the size limit, in one frame or reassembled, is an error.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	limit := c.max
+	if limit <= 0 {
+		limit = defaultWebSocketMaxMessage
+	}
+	var msg []byte
+	inMessage := false
+	for {
+		fin, op, payload, err := c.readFrame(limit - len(msg))
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			_ = c.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if inMessage {
+				return nil, errors.New("websocket: new message inside fragmented message")
+			}
+			inMessage = true
+			msg = payload
+		case wsOpContinuation:
+			if !inMessage {
+				return nil, errors.New("websocket: unexpected continuation frame")
+			}
+			msg = append(msg, payload...)
+		default:
+			return nil, fmt.Errorf("websocket: unknown opcode %d", op)
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (c *wsConn) WriteMessage(data []byte) error {
+	return c.writeFrame(wsOpText, data)
+}
+
+func (c *wsConn) Close() error {
+	_ = c.writeFrame(wsOpClose, []byte{0x03, 0xe8}) // 1000 normal closure
+	return c.conn.Close()
+}
+
+// readFrame reads one frame whose payload may be at most limit bytes;
+// control frames are held to the 125 bytes RFC 6455 allows them.
+func (c *wsConn) readFrame(limit int) (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if op&0x8 != 0 {
+		limit = 125
+	}
+	if n > uint64(limit) {
+		err = fmt.Errorf("websocket: %d byte frame exceeds the message size limit", n)
+		return
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// writeFrame writes a single masked frame, as RFC 6455 requires of clients.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	header := []byte{0x80 | op, 0x80}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] |= byte(n)
+	case n <= 0xffff:
+		header[1] |= 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] |= 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	header = append(header, mask[:]...)
+	masked := make([]byte, len(payload))
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(masked)
+	return err
+}